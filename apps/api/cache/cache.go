@@ -64,6 +64,89 @@ func (c *Cache) DeletePattern(ctx context.Context, pattern string) error {
 	return nil
 }
 
+func (c *Cache) SetNX(ctx context.Context, key string, value interface{}, expiration time.Duration) (bool, error) {
+	return c.client.SetNX(ctx, key, value, expiration).Result()
+}
+
+// incrScript increments a counter and gives it an expiry if it has none, in
+// one step, so a counter can never be left behind without one.
+var incrScript = redis.NewScript(`
+local count = redis.call("INCR", KEYS[1])
+if redis.call("PTTL", KEYS[1]) == -1 then
+	redis.call("PEXPIRE", KEYS[1], ARGV[1])
+end
+return count
+`)
+
+// Incr increments a counter, setting the expiry when the key is created.
+func (c *Cache) Incr(ctx context.Context, key string, expiration time.Duration) (int64, error) {
+	return incrScript.Run(ctx, c.client, []string{key}, expiration.Milliseconds()).Int64()
+}
+
+func (c *Cache) Expire(ctx context.Context, key string, expiration time.Duration) error {
+	return c.client.Expire(ctx, key, expiration).Err()
+}
+
+// deleteIfEqualsScript removes a key only while it still holds the expected
+// value, so a holder can never release a lock that has since changed hands.
+var deleteIfEqualsScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+func (c *Cache) DeleteIfEquals(ctx context.Context, key string, value string) (bool, error) {
+	n, err := deleteIfEqualsScript.Run(ctx, c.client, []string{key}, value).Int()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// MGet returns the values of keys in order, with nil for missing keys.
+func (c *Cache) MGet(ctx context.Context, keys ...string) ([]interface{}, error) {
+	return c.client.MGet(ctx, keys...).Result()
+}
+
+func (c *Cache) HDel(ctx context.Context, key string, fields ...string) error {
+	return c.client.HDel(ctx, key, fields...).Err()
+}
+
+// HMGet returns the values of a hash's fields in order, with nil for
+// missing fields.
+func (c *Cache) HMGet(ctx context.Context, key string, fields ...string) ([]interface{}, error) {
+	return c.client.HMGet(ctx, key, fields...).Result()
+}
+
+func (c *Cache) ZRem(ctx context.Context, key string, members ...interface{}) error {
+	return c.client.ZRem(ctx, key, members...).Err()
+}
+
+// ZRangeByScore returns the members of a sorted set scored between min and
+// max, which may be "-inf", "+inf" or exclusive like "(100".
+func (c *Cache) ZRangeByScore(ctx context.Context, key string, min string, max string) ([]string, error) {
+	return c.client.ZRangeByScore(ctx, key, &redis.ZRangeBy{Min: min, Max: max}).Result()
+}
+
+func (c *Cache) ZRemRangeByScore(ctx context.Context, key string, min string, max string) error {
+	return c.client.ZRemRangeByScore(ctx, key, min, max).Err()
+}
+
+// TxPipelined runs the commands queued by fn in one MULTI/EXEC round-trip.
+func (c *Cache) TxPipelined(ctx context.Context, fn func(redis.Pipeliner) error) error {
+	_, err := c.client.TxPipelined(ctx, fn)
+	return err
+}
+
+func (c *Cache) Publish(ctx context.Context, channel string, message interface{}) error {
+	return c.client.Publish(ctx, channel, message).Err()
+}
+
+func (c *Cache) PSubscribe(ctx context.Context, patterns ...string) *redis.PubSub {
+	return c.client.PSubscribe(ctx, patterns...)
+}
+
 func (c *Cache) Close() error {
 	return c.client.Close()
 }
@@ -0,0 +1,249 @@
+package cache
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// limiterRetryInterval is how long the Limiter stays on its in-memory
+// fallback after a Redis error before trying Redis again, so an outage does
+// not add a failed round-trip to every request
+const limiterRetryInterval = 5 * time.Second
+
+const (
+	windowModeAllow  = "allow"
+	windowModeRecord = "record"
+	windowModePeek   = "peek"
+)
+
+// Window describes the hits in a sliding window after a call to the Limiter.
+type Window struct {
+	// Allowed is false when Allow found the window already full
+	Allowed bool
+	Count   int64
+	// Oldest and Newest are the times of the first and last hit still in the
+	// window; they are zero when it is empty
+	Oldest time.Time
+	Newest time.Time
+}
+
+// ResetAfter is how long until the oldest hit leaves the window, freeing up
+// room for another.
+func (w Window) ResetAfter(window time.Duration, now time.Time) time.Duration {
+	if w.Oldest.IsZero() {
+		return 0
+	}
+	if d := w.Oldest.Add(window).Sub(now); d > 0 {
+		return d
+	}
+	return 0
+}
+
+// Limiter counts hits in sliding windows. Windows are kept in Redis so every
+// instance shares them; while Redis is unavailable each process falls back to
+// counting in its own memory, which is less strict but keeps limits in place.
+type Limiter struct {
+	cache *Cache
+	local *localWindows
+	// redisDownUntil holds a UnixNano time while Redis is being skipped
+	redisDownUntil atomic.Int64
+}
+
+func NewLimiter(cache *Cache, maxLocalKeys int) *Limiter {
+	return &Limiter{
+		cache: cache,
+		local: newLocalWindows(maxLocalKeys),
+	}
+}
+
+// Allow records a hit unless the window already holds limit hits.
+func (l *Limiter) Allow(ctx context.Context, key string, limit int64, window time.Duration) Window {
+	return l.hit(ctx, key, windowModeAllow, limit, window)
+}
+
+// Record records a hit regardless of how many the window holds.
+func (l *Limiter) Record(ctx context.Context, key string, window time.Duration) Window {
+	return l.hit(ctx, key, windowModeRecord, 0, window)
+}
+
+// Peek reports on the window without recording a hit.
+func (l *Limiter) Peek(ctx context.Context, key string, window time.Duration) Window {
+	return l.hit(ctx, key, windowModePeek, 0, window)
+}
+
+// Reset forgets every hit in the window.
+func (l *Limiter) Reset(ctx context.Context, key string) {
+	l.local.reset(key)
+	if l.redisDown(time.Now()) {
+		return
+	}
+	if err := l.cache.Delete(ctx, key); err != nil {
+		l.markRedisDown(err)
+	}
+}
+
+func (l *Limiter) hit(ctx context.Context, key string, mode string, limit int64, window time.Duration) Window {
+	now := time.Now()
+	if !l.redisDown(now) {
+		result, err := l.cache.slidingWindow(ctx, key, mode, limit, window, now)
+		if err == nil {
+			return result
+		}
+		l.markRedisDown(err)
+	}
+	return l.local.hit(key, mode, limit, window, now)
+}
+
+func (l *Limiter) redisDown(now time.Time) bool {
+	return now.UnixNano() < l.redisDownUntil.Load()
+}
+
+func (l *Limiter) markRedisDown(err error) {
+	// A request that was cancelled says nothing about Redis
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+	log.Printf("Rate limiter falling back to memory for %s: %v", limiterRetryInterval, err)
+	l.redisDownUntil.Store(time.Now().Add(limiterRetryInterval).UnixNano())
+}
+
+// slidingWindowScript keeps one sorted set member per hit, scored by its time
+// in milliseconds, and drops those older than the window before counting.
+var slidingWindowScript = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local mode = ARGV[3]
+local limit = tonumber(ARGV[4])
+
+redis.call("ZREMRANGEBYSCORE", KEYS[1], "-inf", now - window)
+local count = redis.call("ZCARD", KEYS[1])
+
+local allowed = 1
+if mode == "allow" and count >= limit then
+	allowed = 0
+elseif mode ~= "peek" then
+	redis.call("ZADD", KEYS[1], now, ARGV[5])
+	redis.call("PEXPIRE", KEYS[1], window)
+	count = count + 1
+end
+
+local oldest = redis.call("ZRANGE", KEYS[1], 0, 0, "WITHSCORES")
+local newest = redis.call("ZRANGE", KEYS[1], -1, -1, "WITHSCORES")
+return {allowed, count, tonumber(oldest[2]) or 0, tonumber(newest[2]) or 0}
+`)
+
+func (c *Cache) slidingWindow(ctx context.Context, key string, mode string, limit int64, window time.Duration, now time.Time) (Window, error) {
+	member, err := windowMember(now)
+	if err != nil {
+		return Window{}, err
+	}
+
+	values, err := slidingWindowScript.Run(ctx, c.client, []string{key},
+		now.UnixMilli(), window.Milliseconds(), mode, limit, member).Int64Slice()
+	if err != nil {
+		return Window{}, err
+	}
+
+	return Window{
+		Allowed: values[0] == 1,
+		Count:   values[1],
+		Oldest:  windowTime(values[2]),
+		Newest:  windowTime(values[3]),
+	}, nil
+}
+
+// windowMember makes each hit a distinct member, even when two land in the
+// same millisecond.
+func windowMember(now time.Time) (string, error) {
+	suffix := make([]byte, 6)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", err
+	}
+	return strconv.FormatInt(now.UnixNano(), 10) + "-" + hex.EncodeToString(suffix), nil
+}
+
+func windowTime(ms int64) time.Time {
+	if ms == 0 {
+		return time.Time{}
+	}
+	return time.UnixMilli(ms)
+}
+
+// localWindows is the in-memory fallback for the Limiter.
+type localWindows struct {
+	mu      sync.Mutex
+	hits    map[string][]time.Time
+	maxKeys int
+}
+
+func newLocalWindows(maxKeys int) *localWindows {
+	return &localWindows{
+		hits:    make(map[string][]time.Time),
+		maxKeys: maxKeys,
+	}
+}
+
+func (l *localWindows) hit(key string, mode string, limit int64, window time.Duration, now time.Time) Window {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	hits := l.hits[key]
+	cutoff := now.Add(-window)
+	for len(hits) > 0 && !hits[0].After(cutoff) {
+		hits = hits[1:]
+	}
+
+	allowed := true
+	if mode == windowModeAllow && int64(len(hits)) >= limit {
+		allowed = false
+	} else if mode != windowModePeek {
+		if _, ok := l.hits[key]; !ok && len(l.hits) >= l.maxKeys {
+			l.evict(cutoff)
+		}
+		hits = append(hits, now)
+	}
+
+	if len(hits) == 0 {
+		delete(l.hits, key)
+		return Window{Allowed: allowed}
+	}
+	l.hits[key] = hits
+
+	return Window{
+		Allowed: allowed,
+		Count:   int64(len(hits)),
+		Oldest:  hits[0],
+		Newest:  hits[len(hits)-1],
+	}
+}
+
+func (l *localWindows) reset(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.hits, key)
+}
+
+// evict drops windows whose hits are all older than cutoff, and everything if
+// that does not free up space. This only runs while Redis is down, so
+// briefly forgetting some counts is acceptable.
+func (l *localWindows) evict(cutoff time.Time) {
+	for key, hits := range l.hits {
+		if !hits[len(hits)-1].After(cutoff) {
+			delete(l.hits, key)
+		}
+	}
+
+	if len(l.hits) >= l.maxKeys {
+		l.hits = make(map[string][]time.Time)
+	}
+}
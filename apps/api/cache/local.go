@@ -0,0 +1,80 @@
+package cache
+
+import (
+	"sync"
+	"time"
+)
+
+// Local is a small in-process cache with per-entry expiry. It is meant for
+// hot, short-lived lookups that would otherwise cost a Redis round-trip on
+// every request, and it only sees writes made by this process.
+type Local struct {
+	mu         sync.Mutex
+	entries    map[string]localEntry
+	maxEntries int
+}
+
+type localEntry struct {
+	value     interface{}
+	expiresAt time.Time
+}
+
+func NewLocal(maxEntries int) *Local {
+	return &Local{
+		entries:    make(map[string]localEntry),
+		maxEntries: maxEntries,
+	}
+}
+
+func (l *Local) Get(key string) (interface{}, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	entry, ok := l.entries[key]
+	if !ok {
+		return nil, false
+	}
+
+	if time.Now().After(entry.expiresAt) {
+		delete(l.entries, key)
+		return nil, false
+	}
+
+	return entry.value, true
+}
+
+func (l *Local) Set(key string, value interface{}, expiration time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if len(l.entries) >= l.maxEntries {
+		l.evict()
+	}
+
+	l.entries[key] = localEntry{
+		value:     value,
+		expiresAt: time.Now().Add(expiration),
+	}
+}
+
+func (l *Local) Delete(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.entries, key)
+}
+
+// evict drops expired entries, and everything if that does not free up
+// space. Entries are cheap to refill, so a full reset is acceptable.
+func (l *Local) evict() {
+	now := time.Now()
+	for key, entry := range l.entries {
+		if now.After(entry.expiresAt) {
+			delete(l.entries, key)
+		}
+	}
+
+	if len(l.entries) >= l.maxEntries {
+		l.entries = make(map[string]localEntry)
+	}
+}
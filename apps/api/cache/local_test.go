@@ -0,0 +1,93 @@
+package cache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLocalTTL(t *testing.T) {
+	const short = 20 * time.Millisecond
+
+	tests := []struct {
+		name   string
+		ttl    time.Duration
+		wait   time.Duration
+		wantOK bool
+	}{
+		{"fresh", time.Hour, 0, true},
+		{"not yet expired", time.Hour, 2 * short, true},
+		{"expired", short, 2 * short, false},
+		{"zero ttl", 0, time.Millisecond, false},
+		{"negative ttl", -time.Second, 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			l := NewLocal(10)
+			l.Set("key", "value", tt.ttl)
+			time.Sleep(tt.wait)
+
+			value, ok := l.Get("key")
+			if ok != tt.wantOK {
+				t.Fatalf("Get() ok = %v, want %v", ok, tt.wantOK)
+			}
+			if ok && value != "value" {
+				t.Errorf("Get() = %v, want %q", value, "value")
+			}
+		})
+	}
+}
+
+func TestLocalSetRenewsTTL(t *testing.T) {
+	l := NewLocal(10)
+	l.Set("key", 1, 20*time.Millisecond)
+	l.Set("key", 2, time.Hour)
+	time.Sleep(40 * time.Millisecond)
+
+	if value, ok := l.Get("key"); !ok || value != 2 {
+		t.Errorf("Get() = (%v, %v), want (2, true)", value, ok)
+	}
+}
+
+func TestLocalDelete(t *testing.T) {
+	l := NewLocal(10)
+	l.Set("key", "value", time.Hour)
+	l.Delete("key")
+
+	if _, ok := l.Get("key"); ok {
+		t.Error("Get() after Delete ok = true, want false")
+	}
+}
+
+func TestLocalEviction(t *testing.T) {
+	t.Run("drops expired entries first", func(t *testing.T) {
+		l := NewLocal(2)
+		l.Set("expired", 1, time.Millisecond)
+		l.Set("live", 2, time.Hour)
+		time.Sleep(5 * time.Millisecond)
+		l.Set("new", 3, time.Hour)
+
+		if _, ok := l.Get("live"); !ok {
+			t.Error("live entry was evicted")
+		}
+		if _, ok := l.Get("new"); !ok {
+			t.Error("new entry was not stored")
+		}
+	})
+
+	t.Run("resets when nothing has expired", func(t *testing.T) {
+		l := NewLocal(2)
+		l.Set("a", 1, time.Hour)
+		l.Set("b", 2, time.Hour)
+		l.Set("c", 3, time.Hour)
+
+		if _, ok := l.Get("a"); ok {
+			t.Error("old entry survived a full cache")
+		}
+		if _, ok := l.Get("c"); !ok {
+			t.Error("new entry was not stored")
+		}
+	})
+}
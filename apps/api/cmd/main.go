@@ -1,16 +1,27 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/enkyuan/ato/api/cache"
 	"github.com/enkyuan/ato/api/database"
 	"github.com/enkyuan/ato/api/internal/handlers"
+	"github.com/enkyuan/ato/api/pkg/auth"
+	"github.com/enkyuan/ato/api/pkg/mailer"
 	"github.com/joho/godotenv"
 )
 
+// shutdownTimeout bounds how long in-flight requests may take to finish
+// once the server is asked to stop
+const shutdownTimeout = 15 * time.Second
+
 func main() {
 	// Load environment variables
 	if err := godotenv.Load(); err != nil {
@@ -47,12 +58,47 @@ func main() {
 	}
 	defer cache.Close()
 
+	// Load token signing keys
+	keys, err := auth.LoadKeySet()
+	if err != nil {
+		log.Fatal("Failed to load signing keys:", err)
+	}
+	auth.SetKeySet(keys)
+
+	// Configure password hashing
+	auth.SetPasswordHasher(auth.LoadPasswordHasher())
+
+	// Initialize mailer
+	mail, err := mailer.FromEnv()
+	if err != nil {
+		log.Fatal("Failed to configure mailer:", err)
+	}
+
+	// Stop background work and drain requests on SIGINT or SIGTERM
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
 	// Create router
-	router := handlers.NewRouter(db, cache)
+	router := handlers.NewRouter(ctx, db, cache, mail)
+
+	// Start background jobs
+	go router.RunAccountCleanup(ctx)
 
 	// Start server
-	log.Printf("Server starting on port %s", port)
-	if err := http.ListenAndServe(":"+port, router); err != nil {
-		log.Fatal(err)
+	server := &http.Server{Addr: ":" + port, Handler: router}
+	go func() {
+		log.Printf("Server starting on port %s", port)
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	}()
+
+	<-ctx.Done()
+	log.Println("Shutting down server")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Server shutdown failed: %v", err)
 	}
 }
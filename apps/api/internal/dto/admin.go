@@ -0,0 +1,24 @@
+package dto
+
+import "github.com/enkyuan/ato/api/internal/models"
+
+// AdminListUsersRequest is read from the query string.
+type AdminListUsersRequest struct {
+	Query    string
+	Role     string
+	Disabled *bool
+	Before   int
+	Limit    int
+}
+
+type AdminUsersResponse struct {
+	Users []*models.User `json:"users"`
+	// NextBefore is passed as before to get the next, older page; it is left
+	// out on the last page
+	NextBefore int `json:"next_before,omitempty"`
+}
+
+type AdminUserResponse struct {
+	User  *models.User      `json:"user"`
+	Usage *models.UserUsage `json:"usage"`
+}
@@ -0,0 +1,20 @@
+package dto
+
+import (
+	"time"
+
+	"github.com/enkyuan/ato/api/internal/models"
+)
+
+type CreateAPITokenRequest struct {
+	Name      string     `json:"name" validate:"required,max=100"`
+	Scopes    []string   `json:"scopes" validate:"required"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// CreateAPITokenResponse is the only place the token is ever returned; the
+// server keeps just its hash.
+type CreateAPITokenResponse struct {
+	*models.APIToken
+	Token string `json:"token"`
+}
@@ -2,23 +2,70 @@ package dto
 
 import "github.com/enkyuan/ato/api/internal/models"
 
+// ClientInfo describes where a request came from. Handlers fill it in; it is
+// never read from the request body.
+type ClientInfo struct {
+	IPAddress string
+	UserAgent string
+}
+
 type RegisterRequest struct {
-	Name     string `json:"name" validate:"required"`
-	Email    string `json:"email" validate:"required,email"`
-	Password string `json:"password" validate:"required,min=8"`
+	Name     string     `json:"name" validate:"required"`
+	Email    string     `json:"email" validate:"required,email"`
+	Password string     `json:"password" validate:"required"`
+	Client   ClientInfo `json:"-"`
 }
 
 type LoginRequest struct {
-	Email    string `json:"email" validate:"required,email"`
-	Password string `json:"password" validate:"required"`
+	Email    string     `json:"email" validate:"required,email"`
+	Password string     `json:"password" validate:"required"`
+	Client   ClientInfo `json:"-"`
 }
 
 type RefreshRequest struct {
-	RefreshToken string `json:"refresh_token" validate:"required"`
+	RefreshToken string     `json:"refresh_token" validate:"required"`
+	Client       ClientInfo `json:"-"`
 }
 
+// AuthResponse carries a token pair, or, when the user has 2FA on, only an
+// MFA challenge token to exchange at /auth/mfa/verify.
 type AuthResponse struct {
-	AccessToken  string       `json:"access_token"`
-	RefreshToken string       `json:"refresh_token"`
-	User         *models.User `json:"user"`
+	AccessToken  string       `json:"access_token,omitempty"`
+	RefreshToken string       `json:"refresh_token,omitempty"`
+	User         *models.User `json:"user,omitempty"`
+	MFARequired  bool         `json:"mfa_required,omitempty"`
+	MFAToken     string       `json:"mfa_token,omitempty"`
+}
+
+type PasskeyNameRequest struct {
+	Name string `json:"name" validate:"required,max=100"`
+}
+
+type ForgotPasswordRequest struct {
+	Email string `json:"email" validate:"required,email"`
+}
+
+type ResetPasswordRequest struct {
+	Token    string     `json:"token" validate:"required"`
+	Password string     `json:"password" validate:"required"`
+	Client   ClientInfo `json:"-"`
+}
+
+type VerifyEmailRequest struct {
+	Token  string     `json:"token" validate:"required"`
+	Client ClientInfo `json:"-"`
+}
+
+type MagicLinkRequest struct {
+	Email string `json:"email" validate:"required,email"`
+}
+
+type MagicLinkVerifyRequest struct {
+	Token  string     `json:"token" validate:"required"`
+	Client ClientInfo `json:"-"`
+}
+
+type OIDCExchangeRequest struct {
+	Code   string     `json:"code" validate:"required"`
+	Client ClientInfo `json:"-"`
 }
@@ -0,0 +1,33 @@
+package dto
+
+type TOTPEnrollmentResponse struct {
+	Secret string `json:"secret"`
+	URI    string `json:"otpauth_uri"`
+}
+
+type TOTPConfirmRequest struct {
+	Code   string     `json:"code" validate:"required"`
+	Client ClientInfo `json:"-"`
+}
+
+type RecoveryCodesResponse struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+// DisableTOTPRequest re-authenticates with the password, or for accounts
+// without one, a current TOTP code or a recovery code.
+type DisableTOTPRequest struct {
+	Password     string     `json:"password,omitempty"`
+	Code         string     `json:"code,omitempty"`
+	RecoveryCode string     `json:"recovery_code,omitempty"`
+	Client       ClientInfo `json:"-"`
+}
+
+// MFAVerifyRequest completes a login with either a TOTP code or a recovery
+// code.
+type MFAVerifyRequest struct {
+	MFAToken     string     `json:"mfa_token" validate:"required"`
+	Code         string     `json:"code,omitempty"`
+	RecoveryCode string     `json:"recovery_code,omitempty"`
+	Client       ClientInfo `json:"-"`
+}
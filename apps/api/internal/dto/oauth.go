@@ -0,0 +1,106 @@
+package dto
+
+import "github.com/enkyuan/ato/api/internal/models"
+
+type CreateOAuthClientRequest struct {
+	Name         string   `json:"name" validate:"required,max=100"`
+	RedirectURIs []string `json:"redirect_uris" validate:"required"`
+	// Public registers an app that cannot keep a secret, such as a mobile
+	// app; it gets no client secret and must use PKCE
+	Public bool `json:"public"`
+}
+
+// CreateOAuthClientResponse is the only place a client secret is ever
+// returned; the server keeps just its hash.
+type CreateOAuthClientResponse struct {
+	*models.OAuthClient
+	ClientSecret string `json:"client_secret,omitempty"`
+}
+
+// OAuthAuthorizeRequest is an app's authorization request (RFC 6749 section
+// 4.1.1), which the web app's consent screen passes on. PKCE with S256 is
+// required.
+type OAuthAuthorizeRequest struct {
+	ResponseType        string `json:"response_type"`
+	ClientID            string `json:"client_id"`
+	RedirectURI         string `json:"redirect_uri"`
+	Scope               string `json:"scope"`
+	State               string `json:"state"`
+	CodeChallenge       string `json:"code_challenge"`
+	CodeChallengeMethod string `json:"code_challenge_method"`
+}
+
+// OAuthConsentRequest is the user's answer to an authorization request.
+type OAuthConsentRequest struct {
+	OAuthAuthorizeRequest
+	Approve bool       `json:"approve"`
+	Client  ClientInfo `json:"-"`
+}
+
+type OAuthScope struct {
+	Scope       string `json:"scope"`
+	Description string `json:"description"`
+}
+
+// OAuthConsentResponse is what the consent screen shows the user.
+type OAuthConsentResponse struct {
+	ClientID    string       `json:"client_id"`
+	ClientName  string       `json:"client_name"`
+	RedirectURI string       `json:"redirect_uri"`
+	Scopes      []OAuthScope `json:"scopes"`
+}
+
+// OAuthRedirectResponse tells the web app where to send the browser back to
+// the app, with either a code or an error.
+type OAuthRedirectResponse struct {
+	RedirectTo string `json:"redirect_to"`
+}
+
+// OAuthClientCredentials identify the app calling the token, revocation or
+// introspection endpoint. ClientSecret is empty for public clients.
+type OAuthClientCredentials struct {
+	ClientID     string
+	ClientSecret string
+}
+
+type OAuthTokenRequest struct {
+	Credentials  OAuthClientCredentials
+	GrantType    string
+	Code         string
+	RedirectURI  string
+	CodeVerifier string
+	RefreshToken string
+	Scope        string
+	Client       ClientInfo
+}
+
+// OAuthTokenResponse is the token endpoint's reply (RFC 6749 section 5.1).
+type OAuthTokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
+	Scope        string `json:"scope"`
+}
+
+// OAuthIntrospectionResponse describes a token (RFC 7662 section 2.2).
+// Everything but Active is left out for inactive tokens.
+type OAuthIntrospectionResponse struct {
+	Active    bool   `json:"active"`
+	Scope     string `json:"scope,omitempty"`
+	ClientID  string `json:"client_id,omitempty"`
+	Username  string `json:"username,omitempty"`
+	TokenType string `json:"token_type,omitempty"`
+	Exp       int64  `json:"exp,omitempty"`
+	Iat       int64  `json:"iat,omitempty"`
+	Sub       string `json:"sub,omitempty"`
+}
+
+// OAuthErrorResponse is the error format OAuth clients expect (RFC 6749
+// section 5.2). The consent screen also gets RedirectTo when the error
+// should be reported back to the app.
+type OAuthErrorResponse struct {
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description,omitempty"`
+	RedirectTo       string `json:"redirect_to,omitempty"`
+}
@@ -0,0 +1,37 @@
+package dto
+
+// UpdateProfileRequest changes only the fields it includes.
+type UpdateProfileRequest struct {
+	Name        *string                   `json:"name,omitempty" validate:"omitempty,min=1,max=100"`
+	Preferences *UpdatePreferencesRequest `json:"preferences,omitempty"`
+}
+
+// UpdatePreferencesRequest changes only the preferences it includes. An
+// empty string puts one back to the app's default.
+type UpdatePreferencesRequest struct {
+	Theme    *string `json:"theme,omitempty"`
+	Locale   *string `json:"locale,omitempty"`
+	Timezone *string `json:"timezone,omitempty"`
+}
+
+type ChangeEmailRequest struct {
+	Email    string     `json:"email" validate:"required,email"`
+	Password string     `json:"password" validate:"required"`
+	Client   ClientInfo `json:"-"`
+}
+
+type ConfirmEmailChangeRequest struct {
+	Token  string     `json:"token" validate:"required"`
+	Client ClientInfo `json:"-"`
+}
+
+type ChangePasswordRequest struct {
+	CurrentPassword string     `json:"current_password" validate:"required"`
+	NewPassword     string     `json:"new_password" validate:"required"`
+	Client          ClientInfo `json:"-"`
+}
+
+type DeleteAccountRequest struct {
+	Password string     `json:"password" validate:"required"`
+	Client   ClientInfo `json:"-"`
+}
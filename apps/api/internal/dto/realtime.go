@@ -0,0 +1,51 @@
+package dto
+
+// Message types a WebSocket client may send.
+const (
+	RealtimeSubscribe   = "subscribe"
+	RealtimeUnsubscribe = "unsubscribe"
+	RealtimeHeartbeat   = "heartbeat"
+	RealtimeEditStart   = "edit_start"
+	RealtimeEditStop    = "edit_stop"
+	RealtimeAuth        = "auth"
+)
+
+// Message types the server sends to WebSocket clients.
+const (
+	RealtimePresence     = "presence"
+	RealtimeJoined       = "joined"
+	RealtimeLeft         = "left"
+	RealtimeEditing      = "editing"
+	RealtimeEditStopped  = "edit_stopped"
+	RealtimeAck          = "ack"
+	RealtimeError        = "error"
+	RealtimeTokenExpired = "token_expired"
+)
+
+type RealtimeRequest struct {
+	Type    string `json:"type"`
+	GroupID int    `json:"group_id,omitempty"`
+	TodoID  int    `json:"todo_id,omitempty"`
+	Token   string `json:"token,omitempty"`
+}
+
+type PresenceMember struct {
+	UserID int    `json:"user_id"`
+	Name   string `json:"name"`
+}
+
+type EditLock struct {
+	TodoID int `json:"todo_id"`
+	UserID int `json:"user_id"`
+}
+
+type RealtimeEvent struct {
+	Type    string           `json:"type"`
+	GroupID int              `json:"group_id,omitempty"`
+	UserID  int              `json:"user_id,omitempty"`
+	Name    string           `json:"name,omitempty"`
+	TodoID  int              `json:"todo_id,omitempty"`
+	Members []PresenceMember `json:"members,omitempty"`
+	Editing []EditLock       `json:"editing,omitempty"`
+	Error   string           `json:"error,omitempty"`
+}
@@ -0,0 +1,17 @@
+package dto
+
+import "github.com/enkyuan/ato/api/internal/models"
+
+// ListSecurityEventsRequest is read from the query string.
+type ListSecurityEventsRequest struct {
+	Types  []string
+	Before int
+	Limit  int
+}
+
+type SecurityEventsResponse struct {
+	Events []*models.SecurityEvent `json:"events"`
+	// NextBefore is passed as before to get the next, older page; it is left
+	// out on the last page
+	NextBefore int `json:"next_before,omitempty"`
+}
@@ -0,0 +1,38 @@
+package dto
+
+import (
+	"time"
+
+	"github.com/enkyuan/ato/api/internal/models"
+)
+
+type CreateShareRequest struct {
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	Password  string     `json:"password,omitempty"`
+}
+
+// CreateShareResponse is the only place the share token is ever returned;
+// the server keeps just its hash.
+type CreateShareResponse struct {
+	*models.GroupShare
+	Token string `json:"token"`
+}
+
+type SharedGroup struct {
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type SharedTodo struct {
+	Title       string    `json:"title"`
+	Description string    `json:"description,omitempty"`
+	Completed   bool      `json:"completed"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+type SharedGroupResponse struct {
+	Group SharedGroup  `json:"group"`
+	Todos []SharedTodo `json:"todos"`
+}
@@ -0,0 +1,43 @@
+package dto
+
+import (
+	"encoding/json"
+
+	"github.com/enkyuan/ato/api/internal/models"
+)
+
+// Mutation operations accepted by /sync
+const (
+	SyncOpUpsert = "upsert"
+	SyncOpDelete = "delete"
+)
+
+type SyncRequest struct {
+	// Cursor is the value returned by the previous sync, or 0 for a full sync
+	Cursor    int64          `json:"cursor"`
+	DeviceID  string         `json:"device_id"`
+	Limit     int            `json:"limit,omitempty"`
+	Mutations []SyncMutation `json:"mutations"`
+}
+
+type SyncMutation struct {
+	// ID is generated by the client and makes replays of the same mutation
+	// a no-op
+	ID       string `json:"id"`
+	Entity   string `json:"entity"`
+	Op       string `json:"op"`
+	ClientID string `json:"client_id"`
+	// Timestamp is when the change was made on the client, in unix
+	// milliseconds
+	Timestamp int64                      `json:"timestamp"`
+	Fields    map[string]json.RawMessage `json:"fields,omitempty"`
+}
+
+type SyncResponse struct {
+	Cursor     int64                   `json:"cursor"`
+	HasMore    bool                    `json:"has_more"`
+	Results    []*models.SyncResult    `json:"results"`
+	Groups     []*models.Group         `json:"groups"`
+	Todos      []*models.Todo          `json:"todos"`
+	Tombstones []*models.SyncTombstone `json:"tombstones"`
+}
@@ -0,0 +1,130 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/enkyuan/ato/api/internal/dto"
+	"github.com/enkyuan/ato/api/internal/middleware"
+	"github.com/enkyuan/ato/api/internal/service"
+	"github.com/enkyuan/ato/api/pkg/response"
+	"github.com/go-chi/chi/v5"
+)
+
+// AccountHandler lets users delete their account and download their data.
+type AccountHandler struct {
+	accountService service.AccountLifecycleService
+}
+
+func NewAccountHandler(accountService service.AccountLifecycleService) *AccountHandler {
+	return &AccountHandler{
+		accountService: accountService,
+	}
+}
+
+// DeleteAccount schedules the account for deletion after a grace period and
+// returns the user with the date it will happen.
+func (h *AccountHandler) DeleteAccount(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(middleware.UserContextKey).(int)
+	sessionID, _ := r.Context().Value(middleware.SessionContextKey).(string)
+
+	var req dto.DeleteAccountRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		response.Error(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	req.Client = clientInfo(r)
+
+	if req.Password == "" {
+		response.Error(w, http.StatusBadRequest, "Password is required")
+		return
+	}
+
+	user, err := h.accountService.ScheduleAccountDeletion(r.Context(), userID, sessionID, req)
+	if err != nil {
+		writeReauthError(w, err, "Failed to delete account")
+		return
+	}
+
+	response.JSON(w, http.StatusAccepted, user)
+}
+
+func (h *AccountHandler) RestoreAccount(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(middleware.UserContextKey).(int)
+
+	if err := h.accountService.CancelAccountDeletion(r.Context(), userID, clientInfo(r)); err != nil {
+		if errors.Is(err, service.ErrDeletionNotScheduled) {
+			response.Error(w, http.StatusConflict, "Account is not scheduled for deletion")
+			return
+		}
+		response.Error(w, http.StatusInternalServerError, "Failed to cancel account deletion")
+		return
+	}
+
+	response.Success(w, http.StatusOK, "Account deletion cancelled")
+}
+
+// RequestDataExport starts building the archive; the user is emailed once it
+// can be downloaded.
+func (h *AccountHandler) RequestDataExport(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(middleware.UserContextKey).(int)
+
+	export, err := h.accountService.RequestDataExport(r.Context(), userID, clientInfo(r))
+	if err != nil {
+		switch {
+		case errors.Is(err, service.ErrDataExportInProgress):
+			response.Error(w, http.StatusConflict, "A data export is already being prepared")
+		case errors.Is(err, service.ErrUserNotFound):
+			response.Error(w, http.StatusNotFound, "User not found")
+		default:
+			response.Error(w, http.StatusInternalServerError, "Failed to start data export")
+		}
+		return
+	}
+
+	response.JSON(w, http.StatusAccepted, export)
+}
+
+func (h *AccountHandler) ListDataExports(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(middleware.UserContextKey).(int)
+
+	exports, err := h.accountService.ListDataExports(r.Context(), userID)
+	if err != nil {
+		response.Error(w, http.StatusInternalServerError, "Failed to list data exports")
+		return
+	}
+
+	response.JSON(w, http.StatusOK, exports)
+}
+
+// DownloadDataExport serves a finished export as a zip file.
+func (h *AccountHandler) DownloadDataExport(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(middleware.UserContextKey).(int)
+
+	exportID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		response.Error(w, http.StatusBadRequest, "Invalid export ID")
+		return
+	}
+
+	export, err := h.accountService.GetDataExport(r.Context(), userID, exportID)
+	if err != nil {
+		if errors.Is(err, service.ErrDataExportNotFound) {
+			response.Error(w, http.StatusNotFound, "Data export not found or not ready")
+			return
+		}
+		response.Error(w, http.StatusInternalServerError, "Failed to get data export")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="ato-export-%s.zip"`, export.CreatedAt.UTC().Format("2006-01-02")))
+	w.Header().Set("Content-Length", strconv.Itoa(len(export.Archive)))
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	w.Write(export.Archive)
+}
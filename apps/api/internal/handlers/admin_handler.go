@@ -0,0 +1,162 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/enkyuan/ato/api/internal/dto"
+	"github.com/enkyuan/ato/api/internal/middleware"
+	"github.com/enkyuan/ato/api/internal/models"
+	"github.com/enkyuan/ato/api/internal/service"
+	"github.com/enkyuan/ato/api/pkg/response"
+	"github.com/go-chi/chi/v5"
+)
+
+// AdminHandler serves the admin API. Its routes must sit behind
+// RequireAdmin.
+type AdminHandler struct {
+	adminService service.AdminService
+}
+
+func NewAdminHandler(adminService service.AdminService) *AdminHandler {
+	return &AdminHandler{
+		adminService: adminService,
+	}
+}
+
+// ListUsers pages through users, newest first. q searches email and name,
+// and role and disabled filter.
+func (h *AdminHandler) ListUsers(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	req := dto.AdminListUsersRequest{
+		Query: strings.TrimSpace(query.Get("q")),
+		Role:  query.Get("role"),
+	}
+
+	if req.Role != "" && req.Role != models.RoleUser && req.Role != models.RoleAdmin {
+		response.Error(w, http.StatusBadRequest, "Role must be user or admin")
+		return
+	}
+
+	if value := query.Get("disabled"); value != "" {
+		disabled, err := strconv.ParseBool(value)
+		if err != nil {
+			response.Error(w, http.StatusBadRequest, "Disabled must be true or false")
+			return
+		}
+		req.Disabled = &disabled
+	}
+
+	var ok bool
+	if req.Before, req.Limit, ok = readPageParams(w, query, service.MaxAdminUsersLimit); !ok {
+		return
+	}
+
+	users, err := h.adminService.ListUsers(r.Context(), req)
+	if err != nil {
+		response.Error(w, http.StatusInternalServerError, "Failed to list users")
+		return
+	}
+
+	response.JSON(w, http.StatusOK, users)
+}
+
+// GetUser returns a user with a summary of their usage.
+func (h *AdminHandler) GetUser(w http.ResponseWriter, r *http.Request) {
+	userID, ok := adminTargetID(w, r)
+	if !ok {
+		return
+	}
+
+	user, err := h.adminService.GetUser(r.Context(), userID)
+	if err != nil {
+		writeAdminError(w, err, "Failed to get user")
+		return
+	}
+
+	response.JSON(w, http.StatusOK, user)
+}
+
+// DisableUser logs the user out everywhere and blocks the account until it
+// is enabled again.
+func (h *AdminHandler) DisableUser(w http.ResponseWriter, r *http.Request) {
+	h.setDisabled(w, r, true)
+}
+
+func (h *AdminHandler) EnableUser(w http.ResponseWriter, r *http.Request) {
+	h.setDisabled(w, r, false)
+}
+
+func (h *AdminHandler) setDisabled(w http.ResponseWriter, r *http.Request, disabled bool) {
+	adminID := r.Context().Value(middleware.UserContextKey).(int)
+
+	userID, ok := adminTargetID(w, r)
+	if !ok {
+		return
+	}
+
+	user, err := h.adminService.SetAccountDisabled(r.Context(), adminID, userID, disabled, clientInfo(r))
+	if err != nil {
+		writeAdminError(w, err, "Failed to update account")
+		return
+	}
+
+	response.JSON(w, http.StatusOK, user)
+}
+
+// LogoutUser revokes every session, app grant and API token the user has.
+func (h *AdminHandler) LogoutUser(w http.ResponseWriter, r *http.Request) {
+	adminID := r.Context().Value(middleware.UserContextKey).(int)
+
+	userID, ok := adminTargetID(w, r)
+	if !ok {
+		return
+	}
+
+	if err := h.adminService.LogoutUser(r.Context(), adminID, userID, clientInfo(r)); err != nil {
+		writeAdminError(w, err, "Failed to log user out")
+		return
+	}
+
+	response.Success(w, http.StatusOK, "User logged out of all sessions")
+}
+
+// SendPasswordReset emails the user a password reset link.
+func (h *AdminHandler) SendPasswordReset(w http.ResponseWriter, r *http.Request) {
+	adminID := r.Context().Value(middleware.UserContextKey).(int)
+
+	userID, ok := adminTargetID(w, r)
+	if !ok {
+		return
+	}
+
+	if err := h.adminService.SendPasswordReset(r.Context(), adminID, userID, clientInfo(r)); err != nil {
+		writeAdminError(w, err, "Failed to send password reset")
+		return
+	}
+
+	response.Success(w, http.StatusAccepted, "A password reset link has been sent to the user")
+}
+
+func adminTargetID(w http.ResponseWriter, r *http.Request) (int, bool) {
+	userID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		response.Error(w, http.StatusBadRequest, "Invalid user ID")
+		return 0, false
+	}
+	return userID, true
+}
+
+func writeAdminError(w http.ResponseWriter, err error, fallback string) {
+	switch {
+	case errors.Is(err, service.ErrUserNotFound):
+		response.Error(w, http.StatusNotFound, "User not found")
+	case errors.Is(err, service.ErrCannotDisableSelf):
+		response.Error(w, http.StatusBadRequest, "You cannot disable your own account")
+	default:
+		response.Error(w, http.StatusInternalServerError, fallback)
+	}
+}
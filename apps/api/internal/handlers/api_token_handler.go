@@ -0,0 +1,88 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/enkyuan/ato/api/internal/dto"
+	"github.com/enkyuan/ato/api/internal/middleware"
+	"github.com/enkyuan/ato/api/internal/service"
+	"github.com/enkyuan/ato/api/pkg/response"
+	"github.com/go-chi/chi/v5"
+)
+
+// APITokenHandler lets users manage their personal access tokens.
+type APITokenHandler struct {
+	apiTokenService service.APITokenService
+}
+
+func NewAPITokenHandler(apiTokenService service.APITokenService) *APITokenHandler {
+	return &APITokenHandler{
+		apiTokenService: apiTokenService,
+	}
+}
+
+func (h *APITokenHandler) CreateAPIToken(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(middleware.UserContextKey).(int)
+
+	var req dto.CreateAPITokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		response.Error(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	if req.Name == "" || len(req.Name) > 100 {
+		response.Error(w, http.StatusBadRequest, "Name must be between 1 and 100 characters")
+		return
+	}
+
+	token, err := h.apiTokenService.CreateAPIToken(r.Context(), userID, req)
+	if err != nil {
+		switch {
+		case errors.Is(err, service.ErrAPITokenInvalidScopes):
+			response.Error(w, http.StatusBadRequest, "Scopes must be a non-empty list of known scopes")
+		case errors.Is(err, service.ErrAPITokenInvalidExpiry):
+			response.Error(w, http.StatusBadRequest, "Expiry must be in the future")
+		default:
+			response.Error(w, http.StatusInternalServerError, "Failed to create API token")
+		}
+		return
+	}
+
+	response.JSON(w, http.StatusCreated, token)
+}
+
+func (h *APITokenHandler) ListAPITokens(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(middleware.UserContextKey).(int)
+
+	tokens, err := h.apiTokenService.ListAPITokens(r.Context(), userID)
+	if err != nil {
+		response.Error(w, http.StatusInternalServerError, "Failed to list API tokens")
+		return
+	}
+
+	response.JSON(w, http.StatusOK, tokens)
+}
+
+func (h *APITokenHandler) DeleteAPIToken(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(middleware.UserContextKey).(int)
+
+	tokenID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		response.Error(w, http.StatusBadRequest, "Invalid token ID")
+		return
+	}
+
+	if err := h.apiTokenService.DeleteAPIToken(r.Context(), userID, tokenID); err != nil {
+		if errors.Is(err, service.ErrAPITokenNotFound) {
+			response.Error(w, http.StatusNotFound, "API token not found")
+			return
+		}
+		response.Error(w, http.StatusInternalServerError, "Failed to delete API token")
+		return
+	}
+
+	response.Success(w, http.StatusOK, "API token deleted")
+}
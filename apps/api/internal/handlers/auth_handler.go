@@ -3,13 +3,19 @@ package handlers
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
+	"net"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
 
 	"github.com/enkyuan/ato/api/internal/dto"
 	"github.com/enkyuan/ato/api/internal/middleware"
 	"github.com/enkyuan/ato/api/internal/service"
+	"github.com/enkyuan/ato/api/pkg/auth"
 	"github.com/enkyuan/ato/api/pkg/response"
+	"github.com/go-chi/chi/v5"
 )
 
 type AuthHandler struct {
@@ -29,19 +35,19 @@ func (h *AuthHandler) Register(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	req.Client = clientInfo(r)
+
 	// Validate input
 	if req.Name == "" || req.Email == "" || req.Password == "" {
 		response.Error(w, http.StatusBadRequest, "Name, email, and password are required")
 		return
 	}
 
-	if len(req.Password) < 8 {
-		response.Error(w, http.StatusBadRequest, "Password must be at least 8 characters")
-		return
-	}
-
 	authResp, err := h.authService.Register(r.Context(), req)
 	if err != nil {
+		if writePasswordPolicyError(w, err) {
+			return
+		}
 		if errors.Is(err, service.ErrEmailExists) {
 			response.Error(w, http.StatusConflict, "Email already exists")
 			return
@@ -60,6 +66,8 @@ func (h *AuthHandler) Login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	req.Client = clientInfo(r)
+
 	// Validate input
 	if req.Email == "" || req.Password == "" {
 		response.Error(w, http.StatusBadRequest, "Email and password are required")
@@ -72,6 +80,12 @@ func (h *AuthHandler) Login(w http.ResponseWriter, r *http.Request) {
 			response.Error(w, http.StatusUnauthorized, "Invalid credentials")
 			return
 		}
+		if writeAccountDisabledError(w, err) {
+			return
+		}
+		if writeRateLimitError(w, err, "Too many failed login attempts, try again later") {
+			return
+		}
 		response.Error(w, http.StatusInternalServerError, "Failed to authenticate")
 		return
 	}
@@ -86,6 +100,8 @@ func (h *AuthHandler) Refresh(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	req.Client = clientInfo(r)
+
 	if req.RefreshToken == "" {
 		response.Error(w, http.StatusBadRequest, "Refresh token is required")
 		return
@@ -97,10 +113,17 @@ func (h *AuthHandler) Refresh(w http.ResponseWriter, r *http.Request) {
 			response.Error(w, http.StatusUnauthorized, "Token has been revoked")
 			return
 		}
+		if errors.Is(err, service.ErrTokenReuse) {
+			response.Error(w, http.StatusUnauthorized, "Refresh token reuse detected, please log in again")
+			return
+		}
 		if errors.Is(err, service.ErrUserNotFound) {
 			response.Error(w, http.StatusUnauthorized, "User not found")
 			return
 		}
+		if writeAccountDisabledError(w, err) {
+			return
+		}
 		response.Error(w, http.StatusUnauthorized, "Invalid refresh token")
 		return
 	}
@@ -115,7 +138,7 @@ func (h *AuthHandler) Logout(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := h.authService.Logout(r.Context(), tokenString); err != nil {
+	if err := h.authService.Logout(r.Context(), tokenString, clientInfo(r)); err != nil {
 		response.Error(w, http.StatusInternalServerError, "Failed to logout")
 		return
 	}
@@ -139,6 +162,394 @@ func (h *AuthHandler) Me(w http.ResponseWriter, r *http.Request) {
 	response.JSON(w, http.StatusOK, user)
 }
 
+func (h *AuthHandler) ListSessions(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(middleware.UserContextKey).(int)
+	sessionID, _ := r.Context().Value(middleware.SessionContextKey).(string)
+
+	sessions, err := h.authService.ListSessions(r.Context(), userID, sessionID)
+	if err != nil {
+		response.Error(w, http.StatusInternalServerError, "Failed to list sessions")
+		return
+	}
+
+	response.JSON(w, http.StatusOK, sessions)
+}
+
+func (h *AuthHandler) RevokeSession(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(middleware.UserContextKey).(int)
+
+	if err := h.authService.RevokeSession(r.Context(), userID, chi.URLParam(r, "id"), clientInfo(r)); err != nil {
+		if errors.Is(err, service.ErrSessionNotFound) {
+			response.Error(w, http.StatusNotFound, "Session not found")
+			return
+		}
+		response.Error(w, http.StatusInternalServerError, "Failed to revoke session")
+		return
+	}
+
+	response.Success(w, http.StatusOK, "Session revoked")
+}
+
+// RevokeAllSessions logs the user out everywhere, including this session.
+func (h *AuthHandler) RevokeAllSessions(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(middleware.UserContextKey).(int)
+
+	if err := h.authService.RevokeAllSessions(r.Context(), userID, clientInfo(r)); err != nil {
+		response.Error(w, http.StatusInternalServerError, "Failed to revoke sessions")
+		return
+	}
+
+	response.Success(w, http.StatusOK, "Logged out of all sessions")
+}
+
+func (h *AuthHandler) EnrollTOTP(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(middleware.UserContextKey).(int)
+
+	enrollment, err := h.authService.EnrollTOTP(r.Context(), userID)
+	if err != nil {
+		if errors.Is(err, service.ErrMFAAlreadyEnabled) {
+			response.Error(w, http.StatusConflict, "Two-factor authentication is already enabled")
+			return
+		}
+		response.Error(w, http.StatusInternalServerError, "Failed to start two-factor enrolment")
+		return
+	}
+
+	response.JSON(w, http.StatusOK, enrollment)
+}
+
+func (h *AuthHandler) ConfirmTOTP(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(middleware.UserContextKey).(int)
+
+	var req dto.TOTPConfirmRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		response.Error(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	req.Client = clientInfo(r)
+
+	if req.Code == "" {
+		response.Error(w, http.StatusBadRequest, "Code is required")
+		return
+	}
+
+	codes, err := h.authService.ConfirmTOTP(r.Context(), userID, req)
+	if err != nil {
+		switch {
+		case errors.Is(err, service.ErrMFANotEnrolled):
+			response.Error(w, http.StatusBadRequest, "Two-factor enrolment has not been started")
+		case errors.Is(err, service.ErrMFAAlreadyEnabled):
+			response.Error(w, http.StatusConflict, "Two-factor authentication is already enabled")
+		case errors.Is(err, service.ErrInvalidMFACode):
+			response.Error(w, http.StatusUnprocessableEntity, "Invalid code")
+		default:
+			response.Error(w, http.StatusInternalServerError, "Failed to enable two-factor authentication")
+		}
+		return
+	}
+
+	response.JSON(w, http.StatusOK, dto.RecoveryCodesResponse{RecoveryCodes: codes})
+}
+
+func (h *AuthHandler) DisableTOTP(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(middleware.UserContextKey).(int)
+
+	var req dto.DisableTOTPRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		response.Error(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	req.Client = clientInfo(r)
+
+	provided := 0
+	for _, factor := range []string{req.Password, req.Code, req.RecoveryCode} {
+		if factor != "" {
+			provided++
+		}
+	}
+	if provided != 1 {
+		response.Error(w, http.StatusBadRequest, "Exactly one of password, code or recovery code is required")
+		return
+	}
+
+	if err := h.authService.DisableTOTP(r.Context(), userID, req); err != nil {
+		switch {
+		case errors.Is(err, service.ErrInvalidCredentials):
+			response.Error(w, http.StatusUnauthorized, "Invalid password")
+		case errors.Is(err, service.ErrPasswordRequired):
+			response.Error(w, http.StatusBadRequest, "Password is required")
+		case errors.Is(err, service.ErrPasswordNotSet):
+			response.Error(w, http.StatusBadRequest, "Account has no password, confirm with a code instead")
+		case errors.Is(err, service.ErrInvalidMFACode):
+			response.Error(w, http.StatusUnauthorized, "Invalid code")
+		case errors.Is(err, service.ErrMFANotEnabled):
+			response.Error(w, http.StatusBadRequest, "Two-factor authentication is not enabled")
+		default:
+			response.Error(w, http.StatusInternalServerError, "Failed to disable two-factor authentication")
+		}
+		return
+	}
+
+	response.Success(w, http.StatusOK, "Two-factor authentication disabled")
+}
+
+// VerifyMFA is the second step of logging in with 2FA on.
+func (h *AuthHandler) VerifyMFA(w http.ResponseWriter, r *http.Request) {
+	var req dto.MFAVerifyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		response.Error(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	req.Client = clientInfo(r)
+
+	if req.MFAToken == "" || (req.Code == "") == (req.RecoveryCode == "") {
+		response.Error(w, http.StatusBadRequest, "MFA token and either a code or a recovery code are required")
+		return
+	}
+
+	authResp, err := h.authService.VerifyMFA(r.Context(), req)
+	if err != nil {
+		switch {
+		case errors.Is(err, service.ErrMFAChallengeInvalid):
+			response.Error(w, http.StatusUnauthorized, "MFA challenge is invalid or has expired, please log in again")
+		case errors.Is(err, service.ErrInvalidMFACode):
+			response.Error(w, http.StatusUnauthorized, "Invalid code")
+		case errors.Is(err, service.ErrAccountDisabled):
+			writeAccountDisabledError(w, err)
+		default:
+			response.Error(w, http.StatusInternalServerError, "Failed to authenticate")
+		}
+		return
+	}
+
+	response.JSON(w, http.StatusOK, authResp)
+}
+
+// ForgotPassword always answers the same way, whether or not the email has
+// an account.
+func (h *AuthHandler) ForgotPassword(w http.ResponseWriter, r *http.Request) {
+	var req dto.ForgotPasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		response.Error(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	if req.Email == "" {
+		response.Error(w, http.StatusBadRequest, "Email is required")
+		return
+	}
+
+	if err := h.authService.ForgotPassword(r.Context(), req.Email); err != nil {
+		if writeRateLimitError(w, err, "Too many reset links requested, try again later") {
+			return
+		}
+		response.Error(w, http.StatusInternalServerError, "Failed to send reset email")
+		return
+	}
+
+	response.Success(w, http.StatusAccepted, "If an account exists for that email, a reset link has been sent")
+}
+
+func (h *AuthHandler) ResetPassword(w http.ResponseWriter, r *http.Request) {
+	var req dto.ResetPasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		response.Error(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	req.Client = clientInfo(r)
+
+	if req.Token == "" || req.Password == "" {
+		response.Error(w, http.StatusBadRequest, "Token and password are required")
+		return
+	}
+
+	if err := h.authService.ResetPassword(r.Context(), req); err != nil {
+		if writePasswordPolicyError(w, err) {
+			return
+		}
+		if errors.Is(err, service.ErrInvalidAccountToken) || errors.Is(err, service.ErrUserNotFound) {
+			response.Error(w, http.StatusBadRequest, "Reset link is invalid or has expired")
+			return
+		}
+		response.Error(w, http.StatusInternalServerError, "Failed to reset password")
+		return
+	}
+
+	response.Success(w, http.StatusOK, "Password has been reset, please log in")
+}
+
+func (h *AuthHandler) VerifyEmail(w http.ResponseWriter, r *http.Request) {
+	var req dto.VerifyEmailRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		response.Error(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	req.Client = clientInfo(r)
+
+	if req.Token == "" {
+		response.Error(w, http.StatusBadRequest, "Token is required")
+		return
+	}
+
+	if err := h.authService.VerifyEmail(r.Context(), req); err != nil {
+		if errors.Is(err, service.ErrInvalidAccountToken) {
+			response.Error(w, http.StatusBadRequest, "Verification link is invalid or has expired")
+			return
+		}
+		response.Error(w, http.StatusInternalServerError, "Failed to verify email")
+		return
+	}
+
+	response.Success(w, http.StatusOK, "Email verified")
+}
+
+func (h *AuthHandler) ResendEmailVerification(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(middleware.UserContextKey).(int)
+
+	if err := h.authService.SendEmailVerification(r.Context(), userID); err != nil {
+		if errors.Is(err, service.ErrEmailAlreadyVerified) {
+			response.Error(w, http.StatusConflict, "Email is already verified")
+			return
+		}
+		response.Error(w, http.StatusInternalServerError, "Failed to send verification email")
+		return
+	}
+
+	response.Success(w, http.StatusAccepted, "Verification email sent")
+}
+
+func (h *AuthHandler) SendMagicLink(w http.ResponseWriter, r *http.Request) {
+	var req dto.MagicLinkRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		response.Error(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	if req.Email == "" {
+		response.Error(w, http.StatusBadRequest, "Email is required")
+		return
+	}
+
+	if err := h.authService.SendMagicLink(r.Context(), req.Email); err != nil {
+		if writeRateLimitError(w, err, "Too many sign-in links requested, try again later") {
+			return
+		}
+		response.Error(w, http.StatusInternalServerError, "Failed to send sign-in link")
+		return
+	}
+
+	response.Success(w, http.StatusAccepted, "If an account exists for that email, a sign-in link has been sent")
+}
+
+func (h *AuthHandler) VerifyMagicLink(w http.ResponseWriter, r *http.Request) {
+	var req dto.MagicLinkVerifyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		response.Error(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	req.Client = clientInfo(r)
+
+	if req.Token == "" {
+		response.Error(w, http.StatusBadRequest, "Token is required")
+		return
+	}
+
+	authResp, err := h.authService.VerifyMagicLink(r.Context(), req)
+	if err != nil {
+		if errors.Is(err, service.ErrInvalidAccountToken) || errors.Is(err, service.ErrUserNotFound) {
+			response.Error(w, http.StatusUnauthorized, "Sign-in link is invalid or has expired")
+			return
+		}
+		if writeAccountDisabledError(w, err) {
+			return
+		}
+		response.Error(w, http.StatusInternalServerError, "Failed to authenticate")
+		return
+	}
+
+	response.JSON(w, http.StatusOK, authResp)
+}
+
+// readPageParams reads the before and limit query parameters of a newest
+// first list, answering 400 and reporting false if either is invalid. Both
+// are 0 when left out.
+func readPageParams(w http.ResponseWriter, query url.Values, maxLimit int) (int, int, bool) {
+	var before, limit int
+	var err error
+
+	if value := query.Get("before"); value != "" {
+		if before, err = strconv.Atoi(value); err != nil || before < 1 {
+			response.Error(w, http.StatusBadRequest, "Invalid before")
+			return 0, 0, false
+		}
+	}
+
+	if value := query.Get("limit"); value != "" {
+		if limit, err = strconv.Atoi(value); err != nil || limit < 1 || limit > maxLimit {
+			response.Error(w, http.StatusBadRequest, fmt.Sprintf("Limit must be between 1 and %d", maxLimit))
+			return 0, 0, false
+		}
+	}
+
+	return before, limit, true
+}
+
+// writeAccountDisabledError answers 403 if err is because an admin disabled
+// the account, reporting whether it was.
+func writeAccountDisabledError(w http.ResponseWriter, err error) bool {
+	if !errors.Is(err, service.ErrAccountDisabled) {
+		return false
+	}
+
+	response.Error(w, http.StatusForbidden, "Account is disabled")
+	return true
+}
+
+// writeRateLimitError answers 429 with Retry-After if err is a rate limit,
+// reporting whether it was.
+func writeRateLimitError(w http.ResponseWriter, err error, message string) bool {
+	var rateLimitErr *service.RateLimitError
+	if !errors.As(err, &rateLimitErr) {
+		return false
+	}
+
+	middleware.SetRetryAfter(w, rateLimitErr.RetryAfter)
+	response.Error(w, http.StatusTooManyRequests, message)
+	return true
+}
+
+// clientInfo reads the caller's address and user agent. RealIP has already
+// replaced RemoteAddr with the forwarded client address when there is one.
+func clientInfo(r *http.Request) dto.ClientInfo {
+	ip := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+
+	return dto.ClientInfo{
+		IPAddress: ip,
+		UserAgent: r.UserAgent(),
+	}
+}
+
+// writePasswordPolicyError answers with why a new password was refused, and
+// reports whether err was such a refusal.
+func writePasswordPolicyError(w http.ResponseWriter, err error) bool {
+	var policyErr *auth.PasswordPolicyError
+	if !errors.As(err, &policyErr) {
+		return false
+	}
+
+	response.Error(w, http.StatusBadRequest, policyErr.Message)
+	return true
+}
+
 func extractToken(r *http.Request) string {
 	bearerToken := r.Header.Get("Authorization")
 	parts := strings.Split(bearerToken, " ")
@@ -0,0 +1,76 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/enkyuan/ato/api/internal/models"
+)
+
+// versionETag is the strong ETag for a single versioned resource.
+func versionETag(version int) string {
+	return fmt.Sprintf(`"%d"`, version)
+}
+
+// groupsETag covers a whole list, so it changes whenever a group is added,
+// removed, reordered or edited.
+func groupsETag(groups []*models.Group) string {
+	h := sha256.New()
+	for _, group := range groups {
+		fmt.Fprintf(h, "%d:%d;", group.ID, group.Version)
+	}
+	return `W/"` + hex.EncodeToString(h.Sum(nil))[:32] + `"`
+}
+
+// ifMatchVersions turns an If-Match header into the versions a write must be
+// conditional on. It returns nil when the header is absent or "*", and an
+// empty slice when none of the listed ETags can ever match.
+func ifMatchVersions(r *http.Request) []int64 {
+	header := r.Header.Get("If-Match")
+	if header == "" {
+		return nil
+	}
+
+	versions := []int64{}
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" {
+			return nil
+		}
+
+		// If-Match uses strong comparison, so weak ETags never match
+		if !strings.HasPrefix(tag, `"`) || !strings.HasSuffix(tag, `"`) || len(tag) < 2 {
+			continue
+		}
+
+		version, err := strconv.ParseInt(strings.Trim(tag, `"`), 10, 64)
+		if err != nil {
+			continue
+		}
+		versions = append(versions, version)
+	}
+
+	return versions
+}
+
+// notModified reports whether If-None-Match already matches etag, using the
+// weak comparison RFC 9110 requires for that header.
+func notModified(r *http.Request, etag string) bool {
+	header := r.Header.Get("If-None-Match")
+	if header == "" {
+		return false
+	}
+
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+
+	return false
+}
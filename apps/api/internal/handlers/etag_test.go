@@ -0,0 +1,71 @@
+package handlers
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestIfMatchVersions(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		want   []int64
+	}{
+		{"absent", "", nil},
+		{"any", "*", nil},
+		{"any among others", `"3", *`, nil},
+		{"single", `"3"`, []int64{3}},
+		{"several", `"3", "4","5"`, []int64{3, 4, 5}},
+		{"weak never matches", `W/"3"`, []int64{}},
+		{"weak skipped", `W/"3", "4"`, []int64{4}},
+		{"unquoted", `3`, []int64{}},
+		{"lone quote", `"`, []int64{}},
+		{"not a version", `"abc"`, []int64{}},
+		{"list etag", `W/"0123456789abcdef0123456789abcdef"`, []int64{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("PUT", "/groups/1", nil)
+			if tt.header != "" {
+				r.Header.Set("If-Match", tt.header)
+			}
+
+			got := ifMatchVersions(r)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ifMatchVersions(%q) = %#v, want %#v", tt.header, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNotModified(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		etag   string
+		want   bool
+	}{
+		{"absent", "", `"3"`, false},
+		{"any", "*", `"3"`, true},
+		{"same", `"3"`, `"3"`, true},
+		{"different", `"4"`, `"3"`, false},
+		{"weak header matches strong etag", `W/"3"`, `"3"`, true},
+		{"strong header matches weak etag", `"abc"`, `W/"abc"`, true},
+		{"one of several", `"1", "2", W/"abc"`, `W/"abc"`, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/groups", nil)
+			if tt.header != "" {
+				r.Header.Set("If-None-Match", tt.header)
+			}
+
+			if got := notModified(r, tt.etag); got != tt.want {
+				t.Errorf("notModified(%q, %q) = %v, want %v", tt.header, tt.etag, got, tt.want)
+			}
+		})
+	}
+}
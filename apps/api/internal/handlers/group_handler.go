@@ -2,6 +2,7 @@ package handlers
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
 	"strconv"
 
@@ -61,9 +62,44 @@ func (h *GroupHandler) GetUserGroups(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	etag := groupsETag(groups)
+	w.Header().Set("ETag", etag)
+	if notModified(r, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
 	response.JSON(w, http.StatusOK, groups)
 }
 
+func (h *GroupHandler) GetGroup(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(middleware.UserContextKey).(int)
+	groupID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		response.Error(w, http.StatusBadRequest, "Invalid group ID")
+		return
+	}
+
+	group, err := h.groupService.GetGroup(r.Context(), groupID, userID)
+	if err != nil {
+		if errors.Is(err, service.ErrGroupNotFound) {
+			response.Error(w, http.StatusNotFound, "Group not found")
+			return
+		}
+		response.Error(w, http.StatusInternalServerError, "Failed to fetch group")
+		return
+	}
+
+	etag := versionETag(group.Version)
+	w.Header().Set("ETag", etag)
+	if notModified(r, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	response.JSON(w, http.StatusOK, group)
+}
+
 func (h *GroupHandler) UpdateGroupName(w http.ResponseWriter, r *http.Request) {
 	userID := r.Context().Value(middleware.UserContextKey).(int)
 	groupID, err := strconv.Atoi(chi.URLParam(r, "id"))
@@ -83,28 +119,18 @@ func (h *GroupHandler) UpdateGroupName(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := h.groupService.UpdateGroupName(r.Context(), groupID, userID, req.Name); err != nil {
-		response.Error(w, http.StatusInternalServerError, "Failed to update group name")
-		return
-	}
-
-	groups, err := h.groupService.GetUserGroups(r.Context(), userID)
+	group, err := h.groupService.UpdateGroupName(r.Context(), groupID, userID, req.Name, ifMatchVersions(r))
 	if err != nil {
-		response.Error(w, http.StatusInternalServerError, "Failed to fetch updated group")
+		writeGroupError(w, err, "Failed to update group name")
 		return
 	}
 
-	for _, group := range groups {
-		if group.ID == groupID {
-			response.JSON(w, http.StatusOK, group)
-			return
-		}
-	}
-
-	response.Error(w, http.StatusNotFound, "Group not found")
+	w.Header().Set("ETag", versionETag(group.Version))
+	response.JSON(w, http.StatusOK, group)
 }
 
 func (h *GroupHandler) UpdateGroupPosition(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(middleware.UserContextKey).(int)
 	groupID, err := strconv.Atoi(chi.URLParam(r, "id"))
 	if err != nil {
 		response.Error(w, http.StatusBadRequest, "Invalid group ID")
@@ -117,11 +143,13 @@ func (h *GroupHandler) UpdateGroupPosition(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	if err := h.groupService.UpdateGroupPosition(r.Context(), groupID, req.Position); err != nil {
-		response.Error(w, http.StatusInternalServerError, "Failed to update group position")
+	group, err := h.groupService.UpdateGroupPosition(r.Context(), groupID, userID, req.Position, ifMatchVersions(r))
+	if err != nil {
+		writeGroupError(w, err, "Failed to update group position")
 		return
 	}
 
+	w.Header().Set("ETag", versionETag(group.Version))
 	response.JSON(w, http.StatusOK, map[string]string{"message": "Position updated"})
 }
 
@@ -133,10 +161,21 @@ func (h *GroupHandler) DeleteGroup(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := h.groupService.DeleteGroup(r.Context(), groupID, userID); err != nil {
-		response.Error(w, http.StatusInternalServerError, "Failed to delete group")
+	if err := h.groupService.DeleteGroup(r.Context(), groupID, userID, ifMatchVersions(r)); err != nil {
+		writeGroupError(w, err, "Failed to delete group")
 		return
 	}
 
 	response.JSON(w, http.StatusOK, map[string]string{"message": "Group deleted"})
 }
+
+func writeGroupError(w http.ResponseWriter, err error, message string) {
+	switch {
+	case errors.Is(err, service.ErrGroupNotFound):
+		response.Error(w, http.StatusNotFound, "Group not found")
+	case errors.Is(err, service.ErrVersionMismatch):
+		response.Error(w, http.StatusPreconditionFailed, "Group has been modified")
+	default:
+		response.Error(w, http.StatusInternalServerError, message)
+	}
+}
@@ -0,0 +1,16 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/enkyuan/ato/api/pkg/auth"
+	"github.com/enkyuan/ato/api/pkg/response"
+)
+
+// JWKS serves the public signing keys so other services can verify our
+// tokens. Keys are published before they start signing, so a short cache is
+// safe.
+func JWKS(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	response.JSON(w, http.StatusOK, auth.JWKS())
+}
@@ -0,0 +1,280 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+
+	"github.com/enkyuan/ato/api/internal/dto"
+	"github.com/enkyuan/ato/api/internal/middleware"
+	"github.com/enkyuan/ato/api/internal/service"
+	"github.com/enkyuan/ato/api/pkg/response"
+	"github.com/go-chi/chi/v5"
+)
+
+type OAuthHandler struct {
+	oauthService service.OAuthService
+}
+
+func NewOAuthHandler(oauthService service.OAuthService) *OAuthHandler {
+	return &OAuthHandler{
+		oauthService: oauthService,
+	}
+}
+
+func (h *OAuthHandler) CreateOAuthClient(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(middleware.UserContextKey).(int)
+
+	var req dto.CreateOAuthClientRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		response.Error(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	if req.Name == "" || len(req.Name) > 100 {
+		response.Error(w, http.StatusBadRequest, "Name must be between 1 and 100 characters")
+		return
+	}
+
+	client, err := h.oauthService.CreateClient(r.Context(), userID, req)
+	if err != nil {
+		if errors.Is(err, service.ErrOAuthInvalidRedirectURIs) {
+			response.Error(w, http.StatusBadRequest, "Redirect URIs must be 1 to 10 https, loopback http or private-use scheme URIs without a fragment")
+			return
+		}
+		response.Error(w, http.StatusInternalServerError, "Failed to create OAuth client")
+		return
+	}
+
+	response.JSON(w, http.StatusCreated, client)
+}
+
+func (h *OAuthHandler) ListOAuthClients(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(middleware.UserContextKey).(int)
+
+	clients, err := h.oauthService.ListClients(r.Context(), userID)
+	if err != nil {
+		response.Error(w, http.StatusInternalServerError, "Failed to list OAuth clients")
+		return
+	}
+
+	response.JSON(w, http.StatusOK, clients)
+}
+
+func (h *OAuthHandler) DeleteOAuthClient(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(middleware.UserContextKey).(int)
+
+	if err := h.oauthService.DeleteClient(r.Context(), userID, chi.URLParam(r, "clientId")); err != nil {
+		if errors.Is(err, service.ErrOAuthClientNotFound) {
+			response.Error(w, http.StatusNotFound, "OAuth client not found")
+			return
+		}
+		response.Error(w, http.StatusInternalServerError, "Failed to delete OAuth client")
+		return
+	}
+
+	response.Success(w, http.StatusOK, "OAuth client deleted")
+}
+
+// GetOAuthConsent is called by the web app's consent screen with the query
+// string the app sent the user there with, and returns what to show them.
+func (h *OAuthHandler) GetOAuthConsent(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	consent, err := h.oauthService.Consent(r.Context(), dto.OAuthAuthorizeRequest{
+		ResponseType:        query.Get("response_type"),
+		ClientID:            query.Get("client_id"),
+		RedirectURI:         query.Get("redirect_uri"),
+		Scope:               query.Get("scope"),
+		State:               query.Get("state"),
+		CodeChallenge:       query.Get("code_challenge"),
+		CodeChallengeMethod: query.Get("code_challenge_method"),
+	})
+	if err != nil {
+		writeAuthorizationError(w, err)
+		return
+	}
+
+	response.JSON(w, http.StatusOK, consent)
+}
+
+// DecideOAuthConsent records whether the user approved the app. Either way
+// the web app should send the browser to the returned redirect_to.
+func (h *OAuthHandler) DecideOAuthConsent(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(middleware.UserContextKey).(int)
+
+	var req dto.OAuthConsentRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		response.Error(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	req.Client = clientInfo(r)
+
+	redirect, err := h.oauthService.Decide(r.Context(), userID, req)
+	if err != nil {
+		writeAuthorizationError(w, err)
+		return
+	}
+
+	response.JSON(w, http.StatusOK, redirect)
+}
+
+// OAuthToken is the token endpoint. Like every endpoint apps call directly,
+// it takes a form-encoded body and answers in RFC 6749's error format.
+func (h *OAuthHandler) OAuthToken(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeOAuthError(w, service.ErrOAuthInvalidRequest)
+		return
+	}
+
+	if r.PostForm.Get("grant_type") == "" {
+		writeOAuthError(w, service.ErrOAuthInvalidRequest)
+		return
+	}
+
+	tokens, err := h.oauthService.Token(r.Context(), dto.OAuthTokenRequest{
+		Credentials:  oauthClientCredentials(r),
+		GrantType:    r.PostForm.Get("grant_type"),
+		Code:         r.PostForm.Get("code"),
+		RedirectURI:  r.PostForm.Get("redirect_uri"),
+		CodeVerifier: r.PostForm.Get("code_verifier"),
+		RefreshToken: r.PostForm.Get("refresh_token"),
+		Client:       clientInfo(r),
+	})
+	if err != nil {
+		writeOAuthError(w, err)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	response.JSON(w, http.StatusOK, tokens)
+}
+
+// RevokeOAuthToken is the revocation endpoint. It answers 200 for unknown
+// tokens too, so apps cannot use it to probe for valid ones.
+func (h *OAuthHandler) RevokeOAuthToken(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil || r.PostForm.Get("token") == "" {
+		writeOAuthError(w, service.ErrOAuthInvalidRequest)
+		return
+	}
+
+	if err := h.oauthService.Revoke(r.Context(), oauthClientCredentials(r), r.PostForm.Get("token")); err != nil {
+		writeOAuthError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (h *OAuthHandler) IntrospectOAuthToken(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil || r.PostForm.Get("token") == "" {
+		writeOAuthError(w, service.ErrOAuthInvalidRequest)
+		return
+	}
+
+	introspection, err := h.oauthService.Introspect(r.Context(), oauthClientCredentials(r), r.PostForm.Get("token"))
+	if err != nil {
+		writeOAuthError(w, err)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	response.JSON(w, http.StatusOK, introspection)
+}
+
+func (h *OAuthHandler) ListAuthorizedApps(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(middleware.UserContextKey).(int)
+
+	apps, err := h.oauthService.ListAuthorizedApps(r.Context(), userID)
+	if err != nil {
+		response.Error(w, http.StatusInternalServerError, "Failed to list authorized apps")
+		return
+	}
+
+	response.JSON(w, http.StatusOK, apps)
+}
+
+func (h *OAuthHandler) RevokeAuthorizedApp(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(middleware.UserContextKey).(int)
+
+	if err := h.oauthService.RevokeAuthorizedApp(r.Context(), userID, chi.URLParam(r, "clientId"), clientInfo(r)); err != nil {
+		if errors.Is(err, service.ErrOAuthAppNotFound) {
+			response.Error(w, http.StatusNotFound, "App is not authorized")
+			return
+		}
+		response.Error(w, http.StatusInternalServerError, "Failed to revoke app")
+		return
+	}
+
+	response.Success(w, http.StatusOK, "App access revoked")
+}
+
+// oauthClientCredentials reads client authentication from HTTP Basic
+// (client_secret_basic) or the form (client_secret_post). Basic credentials
+// are form-encoded before being put in the header, per RFC 6749 section
+// 2.3.1. The form must already be parsed.
+func oauthClientCredentials(r *http.Request) dto.OAuthClientCredentials {
+	if username, password, ok := r.BasicAuth(); ok {
+		clientID, err := url.QueryUnescape(username)
+		if err != nil {
+			return dto.OAuthClientCredentials{}
+		}
+		clientSecret, err := url.QueryUnescape(password)
+		if err != nil {
+			return dto.OAuthClientCredentials{}
+		}
+		return dto.OAuthClientCredentials{ClientID: clientID, ClientSecret: clientSecret}
+	}
+
+	return dto.OAuthClientCredentials{
+		ClientID:     r.PostForm.Get("client_id"),
+		ClientSecret: r.PostForm.Get("client_secret"),
+	}
+}
+
+// writeOAuthError answers an app's request with an RFC 6749 error.
+func writeOAuthError(w http.ResponseWriter, err error) {
+	code := service.OAuthErrorCode(err)
+	status := http.StatusBadRequest
+	description := err.Error()
+
+	switch code {
+	case "invalid_client":
+		status = http.StatusUnauthorized
+		w.Header().Set("WWW-Authenticate", `Basic realm="ato"`)
+	case "server_error":
+		log.Printf("OAuth request failed: %v", err)
+		status = http.StatusInternalServerError
+		description = "The server could not complete the request"
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	response.JSON(w, status, dto.OAuthErrorResponse{
+		Error:            code,
+		ErrorDescription: description,
+	})
+}
+
+// writeAuthorizationError answers the consent screen. When the app can be
+// told about the error, redirect_to is where to send the browser; errors
+// about the client or redirect URI must only be shown to the user.
+func writeAuthorizationError(w http.ResponseWriter, err error) {
+	var redirectErr *service.OAuthRedirectError
+	switch {
+	case errors.As(err, &redirectErr):
+		response.JSON(w, http.StatusBadRequest, dto.OAuthErrorResponse{
+			Error:            service.OAuthErrorCode(redirectErr.Err),
+			ErrorDescription: redirectErr.Error(),
+			RedirectTo:       redirectErr.RedirectTo,
+		})
+	case errors.Is(err, service.ErrOAuthClientNotFound):
+		response.Error(w, http.StatusBadRequest, "Unknown app")
+	case errors.Is(err, service.ErrOAuthInvalidRedirect):
+		response.Error(w, http.StatusBadRequest, "Redirect URI is not registered for this app")
+	default:
+		response.Error(w, http.StatusInternalServerError, "Failed to check authorization request")
+	}
+}
@@ -0,0 +1,148 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/enkyuan/ato/api/internal/dto"
+	"github.com/enkyuan/ato/api/internal/service"
+	"github.com/enkyuan/ato/api/pkg/response"
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	oidcStateCookie     = "oidc_state"
+	oidcStateCookiePath = "/api/v1/auth/oidc"
+	oidcStateCookieTTL  = 10 * time.Minute
+)
+
+func (h *AuthHandler) ListOIDCProviders(w http.ResponseWriter, r *http.Request) {
+	response.JSON(w, http.StatusOK, map[string][]string{
+		"providers": h.authService.OIDCProviders(),
+	})
+}
+
+// AuthorizeOIDC sends the browser to the provider. The state also goes in a
+// cookie so the callback only succeeds in the browser that started it.
+func (h *AuthHandler) AuthorizeOIDC(w http.ResponseWriter, r *http.Request) {
+	authURL, state, err := h.authService.OIDCAuthorizeURL(r.Context(), chi.URLParam(r, "provider"))
+	if err != nil {
+		if errors.Is(err, service.ErrOIDCProviderNotFound) {
+			response.Error(w, http.StatusNotFound, "Sign-in provider not found")
+			return
+		}
+		log.Printf("Failed to start OIDC sign-in: %v", err)
+		response.Error(w, http.StatusBadGateway, "Failed to reach sign-in provider")
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    state,
+		Path:     oidcStateCookiePath,
+		MaxAge:   int(oidcStateCookieTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https",
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// OIDCCallback is where the provider sends the browser back. Either way it
+// ends on the web app's /auth/callback page, with a code to trade for tokens
+// or an error.
+func (h *AuthHandler) OIDCCallback(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Path:     oidcStateCookiePath,
+		MaxAge:   -1,
+		HttpOnly: true,
+	})
+
+	if query.Get("error") != "" {
+		redirectOIDCResult(w, r, "error", "access_denied")
+		return
+	}
+
+	cookie, err := r.Cookie(oidcStateCookie)
+	state := query.Get("state")
+	if err != nil || state == "" || cookie.Value != state || query.Get("code") == "" {
+		redirectOIDCResult(w, r, "error", "invalid_state")
+		return
+	}
+
+	code, err := h.authService.OIDCCallback(r.Context(), chi.URLParam(r, "provider"), query.Get("code"), state, clientInfo(r))
+	if err != nil {
+		redirectOIDCResult(w, r, "error", oidcErrorCode(err))
+		return
+	}
+
+	redirectOIDCResult(w, r, "code", code)
+}
+
+func (h *AuthHandler) ExchangeOIDC(w http.ResponseWriter, r *http.Request) {
+	var req dto.OIDCExchangeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		response.Error(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	req.Client = clientInfo(r)
+
+	if req.Code == "" {
+		response.Error(w, http.StatusBadRequest, "Code is required")
+		return
+	}
+
+	authResp, err := h.authService.OIDCExchange(r.Context(), req)
+	if err != nil {
+		if errors.Is(err, service.ErrOIDCStateInvalid) || errors.Is(err, service.ErrUserNotFound) {
+			response.Error(w, http.StatusUnauthorized, "Sign-in code is invalid or has expired")
+			return
+		}
+		if writeAccountDisabledError(w, err) {
+			return
+		}
+		response.Error(w, http.StatusInternalServerError, "Failed to authenticate")
+		return
+	}
+
+	response.JSON(w, http.StatusOK, authResp)
+}
+
+// oidcErrorCode turns a sign-in failure into a code the web app can show a
+// message for.
+func oidcErrorCode(err error) string {
+	switch {
+	case errors.Is(err, service.ErrOIDCProviderNotFound):
+		return "unknown_provider"
+	case errors.Is(err, service.ErrOIDCStateInvalid):
+		return "invalid_state"
+	case errors.Is(err, service.ErrOIDCEmailRequired):
+		return "email_required"
+	case errors.Is(err, service.ErrOIDCEmailNotVerified):
+		return "email_not_verified"
+	case errors.Is(err, service.ErrOIDCAccountUnverified):
+		return "account_unverified"
+	default:
+		log.Printf("OIDC sign-in failed: %v", err)
+		return "login_failed"
+	}
+}
+
+func redirectOIDCResult(w http.ResponseWriter, r *http.Request, key string, value string) {
+	base := os.Getenv("FRONTEND_URL")
+	if base == "" {
+		base = "http://localhost:3000"
+	}
+
+	http.Redirect(w, r, base+"/auth/callback?"+url.Values{key: {value}}.Encode(), http.StatusFound)
+}
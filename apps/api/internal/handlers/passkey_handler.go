@@ -0,0 +1,167 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/enkyuan/ato/api/internal/dto"
+	"github.com/enkyuan/ato/api/internal/middleware"
+	"github.com/enkyuan/ato/api/internal/service"
+	"github.com/enkyuan/ato/api/pkg/response"
+	"github.com/go-chi/chi/v5"
+)
+
+// maxPasskeyResponseSize bounds the authenticator response we are willing to
+// parse; attestation objects are a few kilobytes at most.
+const maxPasskeyResponseSize = 64 << 10
+
+func (h *AuthHandler) BeginPasskeyRegistration(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(middleware.UserContextKey).(int)
+
+	var req dto.PasskeyNameRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		response.Error(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	if req.Name == "" || len(req.Name) > 100 {
+		response.Error(w, http.StatusBadRequest, "Name must be between 1 and 100 characters")
+		return
+	}
+
+	options, err := h.authService.BeginPasskeyRegistration(r.Context(), userID, req.Name)
+	if err != nil {
+		writePasskeyError(w, err, "Failed to start passkey registration")
+		return
+	}
+
+	response.JSON(w, http.StatusOK, options)
+}
+
+// FinishPasskeyRegistration takes the PublicKeyCredential returned by
+// navigator.credentials.create, serialized as JSON.
+func (h *AuthHandler) FinishPasskeyRegistration(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(middleware.UserContextKey).(int)
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxPasskeyResponseSize))
+	if err != nil {
+		response.Error(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	passkey, err := h.authService.FinishPasskeyRegistration(r.Context(), userID, body, clientInfo(r))
+	if err != nil {
+		writePasskeyError(w, err, "Failed to register passkey")
+		return
+	}
+
+	response.JSON(w, http.StatusCreated, passkey)
+}
+
+func (h *AuthHandler) BeginPasskeyLogin(w http.ResponseWriter, r *http.Request) {
+	options, err := h.authService.BeginPasskeyLogin(r.Context())
+	if err != nil {
+		writePasskeyError(w, err, "Failed to start passkey login")
+		return
+	}
+
+	response.JSON(w, http.StatusOK, options)
+}
+
+// FinishPasskeyLogin takes the PublicKeyCredential returned by
+// navigator.credentials.get, serialized as JSON.
+func (h *AuthHandler) FinishPasskeyLogin(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxPasskeyResponseSize))
+	if err != nil {
+		response.Error(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	authResp, err := h.authService.FinishPasskeyLogin(r.Context(), body, clientInfo(r))
+	if err != nil {
+		writePasskeyError(w, err, "Failed to authenticate")
+		return
+	}
+
+	response.JSON(w, http.StatusOK, authResp)
+}
+
+func (h *AuthHandler) ListPasskeys(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(middleware.UserContextKey).(int)
+
+	passkeys, err := h.authService.ListPasskeys(r.Context(), userID)
+	if err != nil {
+		response.Error(w, http.StatusInternalServerError, "Failed to list passkeys")
+		return
+	}
+
+	response.JSON(w, http.StatusOK, passkeys)
+}
+
+func (h *AuthHandler) RenamePasskey(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(middleware.UserContextKey).(int)
+
+	passkeyID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		response.Error(w, http.StatusBadRequest, "Invalid passkey ID")
+		return
+	}
+
+	var req dto.PasskeyNameRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		response.Error(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	if req.Name == "" || len(req.Name) > 100 {
+		response.Error(w, http.StatusBadRequest, "Name must be between 1 and 100 characters")
+		return
+	}
+
+	passkey, err := h.authService.RenamePasskey(r.Context(), userID, passkeyID, req.Name)
+	if err != nil {
+		writePasskeyError(w, err, "Failed to rename passkey")
+		return
+	}
+
+	response.JSON(w, http.StatusOK, passkey)
+}
+
+func (h *AuthHandler) DeletePasskey(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(middleware.UserContextKey).(int)
+
+	passkeyID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		response.Error(w, http.StatusBadRequest, "Invalid passkey ID")
+		return
+	}
+
+	if err := h.authService.DeletePasskey(r.Context(), userID, passkeyID, clientInfo(r)); err != nil {
+		writePasskeyError(w, err, "Failed to delete passkey")
+		return
+	}
+
+	response.Success(w, http.StatusOK, "Passkey deleted")
+}
+
+func writePasskeyError(w http.ResponseWriter, err error, fallback string) {
+	switch {
+	case errors.Is(err, service.ErrPasskeysDisabled):
+		response.Error(w, http.StatusServiceUnavailable, "Passkeys are not available")
+	case errors.Is(err, service.ErrPasskeyNotFound):
+		response.Error(w, http.StatusNotFound, "Passkey not found")
+	case errors.Is(err, service.ErrPasskeyCeremony):
+		response.Error(w, http.StatusBadRequest, "Passkey request has expired, please try again")
+	case errors.Is(err, service.ErrPasskeyInvalid):
+		response.Error(w, http.StatusUnauthorized, "Passkey verification failed")
+	case errors.Is(err, service.ErrPasskeyCloneWarned):
+		response.Error(w, http.StatusUnauthorized, "Passkey rejected, it may have been copied")
+	case errors.Is(err, service.ErrAccountDisabled):
+		writeAccountDisabledError(w, err)
+	default:
+		response.Error(w, http.StatusInternalServerError, fallback)
+	}
+}
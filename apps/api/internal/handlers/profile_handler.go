@@ -0,0 +1,159 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/enkyuan/ato/api/internal/dto"
+	"github.com/enkyuan/ato/api/internal/middleware"
+	"github.com/enkyuan/ato/api/internal/service"
+	"github.com/enkyuan/ato/api/pkg/response"
+)
+
+// ProfileHandler lets users change their own account details.
+type ProfileHandler struct {
+	profileService service.ProfileService
+}
+
+func NewProfileHandler(profileService service.ProfileService) *ProfileHandler {
+	return &ProfileHandler{
+		profileService: profileService,
+	}
+}
+
+func (h *ProfileHandler) UpdateProfile(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(middleware.UserContextKey).(int)
+
+	var req dto.UpdateProfileRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		response.Error(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	if req.Name != nil {
+		if name := strings.TrimSpace(*req.Name); name == "" || len(name) > 100 {
+			response.Error(w, http.StatusBadRequest, "Name must be between 1 and 100 characters")
+			return
+		}
+	}
+
+	user, err := h.profileService.UpdateProfile(r.Context(), userID, req)
+	if err != nil {
+		switch {
+		case errors.Is(err, service.ErrInvalidPreferences):
+			response.Error(w, http.StatusBadRequest, err.Error())
+		case errors.Is(err, service.ErrUserNotFound):
+			response.Error(w, http.StatusNotFound, "User not found")
+		default:
+			response.Error(w, http.StatusInternalServerError, "Failed to update profile")
+		}
+		return
+	}
+
+	response.JSON(w, http.StatusOK, user)
+}
+
+// ChangeEmail sends a confirmation link to the new address; the account's
+// email only changes once it is followed.
+func (h *ProfileHandler) ChangeEmail(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(middleware.UserContextKey).(int)
+
+	var req dto.ChangeEmailRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		response.Error(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	req.Client = clientInfo(r)
+
+	if req.Email == "" || req.Password == "" {
+		response.Error(w, http.StatusBadRequest, "Email and password are required")
+		return
+	}
+
+	if err := h.profileService.RequestEmailChange(r.Context(), userID, req); err != nil {
+		writeReauthError(w, err, "Failed to change email")
+		return
+	}
+
+	response.Success(w, http.StatusAccepted, "A confirmation link has been sent to the new email")
+}
+
+func (h *ProfileHandler) ConfirmEmailChange(w http.ResponseWriter, r *http.Request) {
+	var req dto.ConfirmEmailChangeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		response.Error(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	req.Client = clientInfo(r)
+
+	if req.Token == "" {
+		response.Error(w, http.StatusBadRequest, "Token is required")
+		return
+	}
+
+	if err := h.profileService.ConfirmEmailChange(r.Context(), req); err != nil {
+		switch {
+		case errors.Is(err, service.ErrInvalidAccountToken), errors.Is(err, service.ErrUserNotFound):
+			response.Error(w, http.StatusBadRequest, "Confirmation link is invalid or has expired")
+		case errors.Is(err, service.ErrEmailExists):
+			response.Error(w, http.StatusConflict, "Email already exists")
+		default:
+			response.Error(w, http.StatusInternalServerError, "Failed to change email")
+		}
+		return
+	}
+
+	response.Success(w, http.StatusOK, "Email changed")
+}
+
+// ChangePassword logs out every other session and app; the caller's own
+// session stays signed in.
+func (h *ProfileHandler) ChangePassword(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(middleware.UserContextKey).(int)
+	sessionID, _ := r.Context().Value(middleware.SessionContextKey).(string)
+
+	var req dto.ChangePasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		response.Error(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	req.Client = clientInfo(r)
+
+	if req.CurrentPassword == "" || req.NewPassword == "" {
+		response.Error(w, http.StatusBadRequest, "Current and new password are required")
+		return
+	}
+
+	if err := h.profileService.ChangePassword(r.Context(), userID, sessionID, req); err != nil {
+		if writePasswordPolicyError(w, err) {
+			return
+		}
+		writeReauthError(w, err, "Failed to change password")
+		return
+	}
+
+	response.Success(w, http.StatusOK, "Password changed, other sessions have been logged out")
+}
+
+// writeReauthError answers requests that must confirm the current password.
+func writeReauthError(w http.ResponseWriter, err error, fallback string) {
+	switch {
+	case errors.Is(err, service.ErrInvalidCredentials):
+		response.Error(w, http.StatusUnauthorized, "Invalid password")
+	case errors.Is(err, service.ErrPasswordNotSet):
+		response.Error(w, http.StatusBadRequest, "Account has no password, set one with a password reset first")
+	case errors.Is(err, service.ErrEmailUnchanged):
+		response.Error(w, http.StatusBadRequest, "That is already your email")
+	case errors.Is(err, service.ErrEmailExists):
+		response.Error(w, http.StatusConflict, "Email already exists")
+	case errors.Is(err, service.ErrUserNotFound):
+		response.Error(w, http.StatusNotFound, "User not found")
+	default:
+		response.Error(w, http.StatusInternalServerError, fallback)
+	}
+}
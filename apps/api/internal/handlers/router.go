@@ -1,6 +1,7 @@
 package handlers
 
 import (
+	"context"
 	"net/http"
 	"os"
 	"time"
@@ -10,16 +11,25 @@ import (
 	"github.com/enkyuan/ato/api/internal/middleware"
 	"github.com/enkyuan/ato/api/internal/repository"
 	"github.com/enkyuan/ato/api/internal/service"
+	"github.com/enkyuan/ato/api/pkg/auth"
+	"github.com/enkyuan/ato/api/pkg/mailer"
 	"github.com/go-chi/chi/v5"
 	chimiddleware "github.com/go-chi/chi/v5/middleware"
 	"github.com/go-chi/cors"
 )
 
+// rateLimitLocalMaxKeys bounds the in-memory rate limit windows kept while
+// Redis is unavailable
+const rateLimitLocalMaxKeys = 100000
+
 type Router struct {
 	*chi.Mux
+	accountService service.AccountLifecycleService
 }
 
-func NewRouter(db *database.DB, cache *cache.Cache) *Router {
+// NewRouter wires up the API. Background work it starts, such as the
+// realtime hub, stops when ctx is done.
+func NewRouter(ctx context.Context, db *database.DB, cache *cache.Cache, mailer mailer.Mailer) *Router {
 	r := chi.NewRouter()
 
 	// Setup middleware
@@ -27,43 +37,188 @@ func NewRouter(db *database.DB, cache *cache.Cache) *Router {
 
 	// Initialize dependencies
 	userRepo := repository.NewUserRepository(db.DB)
-	authService := service.NewAuthService(userRepo, cache)
-	authMiddleware := middleware.NewAuthMiddleware(authService)
+	tokenRepo := repository.NewTokenRepository(db.DB)
+	securityEventRepo := repository.NewSecurityEventRepository(db.DB)
+	mfaRepo := repository.NewMFARepository(db.DB)
+	passkeyRepo := repository.NewPasskeyRepository(db.DB)
+	accountTokenRepo := repository.NewAccountTokenRepository(db.DB)
+	identityRepo := repository.NewIdentityRepository(db.DB)
+	limiter := newLimiter(cache)
+	apiTokenRepo := repository.NewAPITokenRepository(db.DB)
+	apiTokenService := service.NewAPITokenService(apiTokenRepo, cache)
+	securityEventService := service.NewSecurityEventService(securityEventRepo, mailer)
+	authService := service.NewAuthService(userRepo, tokenRepo, mfaRepo, passkeyRepo, accountTokenRepo, identityRepo, apiTokenService, securityEventService, cache, limiter, mailer)
+	adminRepo := repository.NewAdminRepository(db.DB)
+	adminService := service.NewAdminService(userRepo, adminRepo, securityEventRepo, authService, mailer)
+	authMiddleware := middleware.NewAuthMiddleware(authService, apiTokenService, adminService)
+	idempotencyMiddleware := middleware.NewIdempotencyMiddleware(cache)
+	rateLimit := middleware.NewRateLimitMiddleware(limiter)
 	authHandler := NewAuthHandler(authService)
+	apiTokenHandler := NewAPITokenHandler(apiTokenService)
+	securityEventHandler := NewSecurityEventHandler(securityEventService)
+	adminHandler := NewAdminHandler(adminService)
+
+	profileService := service.NewProfileService(userRepo, accountTokenRepo, securityEventRepo, authService, apiTokenService, mailer)
+	profileHandler := NewProfileHandler(profileService)
+
+	dataExportRepo := repository.NewDataExportRepository(db.DB)
+	accountService := service.NewAccountLifecycleService(userRepo, dataExportRepo, securityEventRepo, authService, mailer)
+	accountHandler := NewAccountHandler(accountService)
+
+	oauthClientRepo := repository.NewOAuthClientRepository(db.DB)
+	oauthService := service.NewOAuthService(oauthClientRepo, tokenRepo, userRepo, securityEventRepo, cache, authService)
+	oauthHandler := NewOAuthHandler(oauthService)
 
 	groupRepo := repository.NewGroupRepository(db.DB)
 	groupService := service.NewGroupService(groupRepo, cache)
 	groupHandler := NewGroupHandler(groupService)
 
+	shareRepo := repository.NewShareRepository(db.DB)
+	shareService := service.NewShareService(shareRepo, groupRepo)
+	shareHandler := NewShareHandler(shareService)
+
+	syncRepo := repository.NewSyncRepository(db.DB)
+	syncService := service.NewSyncService(syncRepo, cache)
+	syncHandler := NewSyncHandler(syncService)
+
+	presenceService := service.NewPresenceService(cache)
+	wsHandler := NewWSHandler(ctx, authService, adminService, groupService, presenceService, allowedOrigins())
+
 	// Health check endpoint (supports both GET and HEAD)
 	r.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte("OK"))
 	})
 
+	// Public keys for verifying our tokens
+	r.Get("/.well-known/jwks.json", JWKS)
+
 	// Setup routes
 	r.Route("/api/v1", func(r chi.Router) {
+		r.Use(chimiddleware.Timeout(60 * time.Second))
+
 		// Public routes
-		r.Post("/auth/register", authHandler.Register)
-		r.Post("/auth/login", authHandler.Login)
-		r.Post("/auth/refresh", authHandler.Refresh)
+		r.Group(func(r chi.Router) {
+			r.Use(rateLimit.Limit(middleware.RateLimitAuth))
+			r.Post("/auth/login", authHandler.Login)
+			r.Post("/auth/refresh", authHandler.Refresh)
+			r.Post("/auth/mfa/verify", authHandler.VerifyMFA)
+			r.Post("/auth/passkeys/login/begin", authHandler.BeginPasskeyLogin)
+			r.Post("/auth/passkeys/login/finish", authHandler.FinishPasskeyLogin)
+			r.Post("/auth/password/reset", authHandler.ResetPassword)
+			r.Post("/auth/verify-email", authHandler.VerifyEmail)
+			r.Post("/auth/email/confirm", profileHandler.ConfirmEmailChange)
+			r.Post("/auth/magic-link/verify", authHandler.VerifyMagicLink)
+			r.Get("/auth/oidc/{provider}/authorize", authHandler.AuthorizeOIDC)
+			r.Get("/auth/oidc/{provider}/callback", authHandler.OIDCCallback)
+			r.Post("/auth/oidc/exchange", authHandler.ExchangeOIDC)
+		})
+		r.Group(func(r chi.Router) {
+			r.Use(rateLimit.Limit(middleware.RateLimitAccount))
+			r.Post("/auth/register", authHandler.Register)
+			r.Post("/auth/password/forgot", authHandler.ForgotPassword)
+			r.Post("/auth/magic-link", authHandler.SendMagicLink)
+		})
+		r.Group(func(r chi.Router) {
+			r.Use(rateLimit.Limit(middleware.RateLimitAPI))
+			r.Get("/auth/oidc/providers", authHandler.ListOIDCProviders)
+			r.Get("/share/{token}", shareHandler.GetSharedGroup)
+
+			// OAuth endpoints third-party apps call with their client
+			// credentials
+			r.Post("/oauth/token", oauthHandler.OAuthToken)
+			r.Post("/oauth/revoke", oauthHandler.RevokeOAuthToken)
+			r.Post("/oauth/introspect", oauthHandler.IntrospectOAuthToken)
+		})
 
 		// Protected routes
 		r.Group(func(r chi.Router) {
 			r.Use(authMiddleware.Authenticate)
-			r.Post("/auth/logout", authHandler.Logout)
-			r.Get("/auth/me", authHandler.Me)
+			r.Use(rateLimit.Limit(middleware.RateLimitAPI))
+			r.Use(idempotencyMiddleware.Idempotent)
+			r.With(middleware.RequireScope(auth.ScopeProfileRead)).Get("/auth/me", authHandler.Me)
+
+			// Account management is off limits to API tokens
+			r.Group(func(r chi.Router) {
+				r.Use(authMiddleware.RequireSession)
+				r.Post("/auth/logout", authHandler.Logout)
+				r.Patch("/auth/me", profileHandler.UpdateProfile)
+				r.With(rateLimit.Limit(middleware.RateLimitAccount)).Post("/auth/email", profileHandler.ChangeEmail)
+				r.With(rateLimit.Limit(middleware.RateLimitAccount)).Post("/auth/password", profileHandler.ChangePassword)
+				r.With(rateLimit.Limit(middleware.RateLimitAccount)).Delete("/auth/me", accountHandler.DeleteAccount)
+				r.Post("/auth/me/restore", accountHandler.RestoreAccount)
+				r.With(rateLimit.Limit(middleware.RateLimitAccount)).Post("/auth/me/export", accountHandler.RequestDataExport)
+				r.Get("/auth/me/exports", accountHandler.ListDataExports)
+				r.Get("/auth/me/exports/{id}", accountHandler.DownloadDataExport)
+				r.With(rateLimit.Limit(middleware.RateLimitAccount)).Post("/auth/verify-email/resend", authHandler.ResendEmailVerification)
+				r.Get("/auth/sessions", authHandler.ListSessions)
+				r.Delete("/auth/sessions", authHandler.RevokeAllSessions)
+				r.Delete("/auth/sessions/{id}", authHandler.RevokeSession)
+				r.Get("/auth/security-events", securityEventHandler.ListSecurityEvents)
+				r.Post("/auth/mfa/totp", authHandler.EnrollTOTP)
+				r.Post("/auth/mfa/totp/confirm", authHandler.ConfirmTOTP)
+				r.With(rateLimit.Limit(middleware.RateLimitAuth)).Delete("/auth/mfa/totp", authHandler.DisableTOTP)
+				r.Get("/auth/passkeys", authHandler.ListPasskeys)
+				r.Post("/auth/passkeys/register/begin", authHandler.BeginPasskeyRegistration)
+				r.Post("/auth/passkeys/register/finish", authHandler.FinishPasskeyRegistration)
+				r.Put("/auth/passkeys/{id}", authHandler.RenamePasskey)
+				r.Delete("/auth/passkeys/{id}", authHandler.DeletePasskey)
+				r.Get("/auth/tokens", apiTokenHandler.ListAPITokens)
+				r.Post("/auth/tokens", apiTokenHandler.CreateAPIToken)
+				r.Delete("/auth/tokens/{id}", apiTokenHandler.DeleteAPIToken)
+				r.Get("/auth/apps", oauthHandler.ListAuthorizedApps)
+				r.Delete("/auth/apps/{clientId}", oauthHandler.RevokeAuthorizedApp)
+
+				// OAuth app registration and the consent screen
+				r.Get("/oauth/clients", oauthHandler.ListOAuthClients)
+				r.Post("/oauth/clients", oauthHandler.CreateOAuthClient)
+				r.Delete("/oauth/clients/{clientId}", oauthHandler.DeleteOAuthClient)
+				r.Get("/oauth/authorize", oauthHandler.GetOAuthConsent)
+				r.Post("/oauth/authorize", oauthHandler.DecideOAuthConsent)
+			})
+
+			// Admin API, for users with the admin role signed in themselves
+			r.Group(func(r chi.Router) {
+				r.Use(authMiddleware.RequireSession)
+				r.Use(authMiddleware.RequireAdmin)
+				r.Get("/admin/users", adminHandler.ListUsers)
+				r.Get("/admin/users/{id}", adminHandler.GetUser)
+				r.Post("/admin/users/{id}/disable", adminHandler.DisableUser)
+				r.Post("/admin/users/{id}/enable", adminHandler.EnableUser)
+				r.Post("/admin/users/{id}/logout", adminHandler.LogoutUser)
+				r.Post("/admin/users/{id}/password-reset", adminHandler.SendPasswordReset)
+			})
 
 			// Group routes
-			r.Post("/groups", groupHandler.CreateGroup)
-			r.Get("/groups", groupHandler.GetUserGroups)
-			r.Put("/groups/{id}", groupHandler.UpdateGroupName)
-			r.Put("/groups/{id}/position", groupHandler.UpdateGroupPosition)
-			r.Delete("/groups/{id}", groupHandler.DeleteGroup)
+			r.With(middleware.RequireScope(auth.ScopeGroupsWrite)).Post("/groups", groupHandler.CreateGroup)
+			r.With(middleware.RequireScope(auth.ScopeGroupsRead)).Get("/groups", groupHandler.GetUserGroups)
+			r.With(middleware.RequireScope(auth.ScopeGroupsRead)).Get("/groups/{id}", groupHandler.GetGroup)
+			r.With(middleware.RequireScope(auth.ScopeGroupsWrite)).Put("/groups/{id}", groupHandler.UpdateGroupName)
+			r.With(middleware.RequireScope(auth.ScopeGroupsWrite)).Put("/groups/{id}/position", groupHandler.UpdateGroupPosition)
+			r.With(middleware.RequireScope(auth.ScopeGroupsWrite)).Delete("/groups/{id}", groupHandler.DeleteGroup)
+
+			// Share link routes
+			r.With(middleware.RequireScope(auth.ScopeSharesWrite), authMiddleware.RequireVerifiedEmail).Post("/groups/{id}/shares", shareHandler.CreateShare)
+			r.With(middleware.RequireScope(auth.ScopeSharesRead)).Get("/groups/{id}/shares", shareHandler.ListShares)
+			r.With(middleware.RequireScope(auth.ScopeSharesWrite)).Delete("/groups/{id}/shares/{shareId}", shareHandler.RevokeShare)
+
+			// Offline sync. Pulling returns groups and todos; the handler
+			// checks write scopes per mutation
+			r.With(middleware.RequireScope(auth.ScopeGroupsRead, auth.ScopeTodosRead)).Post("/sync", syncHandler.Sync)
 		})
 	})
 
-	return &Router{Mux: r}
+	// WebSocket connections are long-lived, so they sit outside the request
+	// timeout and authenticate themselves during the handshake
+	r.Get("/ws", wsHandler.Serve)
+
+	return &Router{Mux: r, accountService: accountService}
+}
+
+// RunAccountCleanup erases accounts past their deletion grace period, and
+// expired data exports, until ctx is done.
+func (r *Router) RunAccountCleanup(ctx context.Context) {
+	r.accountService.RunAccountCleanup(ctx)
 }
 
 func setupMiddleware(r *chi.Mux) {
@@ -72,20 +227,28 @@ func setupMiddleware(r *chi.Mux) {
 	r.Use(chimiddleware.Recoverer)
 	r.Use(chimiddleware.RequestID)
 	r.Use(chimiddleware.RealIP)
-	r.Use(chimiddleware.Timeout(60 * time.Second))
 
 	// CORS middleware
-	allowedOrigins := []string{"http://localhost:3000", "http://127.0.0.1:3000"}
-	if frontendURL := os.Getenv("FRONTEND_URL"); frontendURL != "" {
-		allowedOrigins = append(allowedOrigins, frontendURL)
-	}
-
 	r.Use(cors.Handler(cors.Options{
-		AllowedOrigins:   allowedOrigins,
-		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type"},
-		ExposedHeaders:   []string{"Link"},
+		AllowedOrigins:   allowedOrigins(),
+		AllowedMethods:   []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
+		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "If-Match", "If-None-Match", "Idempotency-Key", "X-Share-Password"},
+		ExposedHeaders:   []string{"Link", "ETag", "Idempotent-Replayed", "WWW-Authenticate", "Retry-After", "RateLimit-Limit", "RateLimit-Remaining", "RateLimit-Reset", "RateLimit-Policy"},
 		AllowCredentials: true,
 		MaxAge:           300,
 	}))
 }
+
+// newLimiter is split out because NewRouter's cache parameter shadows the
+// package
+func newLimiter(c *cache.Cache) *cache.Limiter {
+	return cache.NewLimiter(c, rateLimitLocalMaxKeys)
+}
+
+func allowedOrigins() []string {
+	origins := []string{"http://localhost:3000", "http://127.0.0.1:3000"}
+	if frontendURL := os.Getenv("FRONTEND_URL"); frontendURL != "" {
+		origins = append(origins, frontendURL)
+	}
+	return origins
+}
@@ -0,0 +1,52 @@
+package handlers
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/enkyuan/ato/api/internal/dto"
+	"github.com/enkyuan/ato/api/internal/middleware"
+	"github.com/enkyuan/ato/api/internal/service"
+	"github.com/enkyuan/ato/api/pkg/response"
+)
+
+// SecurityEventHandler serves users their own security log.
+type SecurityEventHandler struct {
+	securityEventService service.SecurityEventService
+}
+
+func NewSecurityEventHandler(securityEventService service.SecurityEventService) *SecurityEventHandler {
+	return &SecurityEventHandler{
+		securityEventService: securityEventService,
+	}
+}
+
+// ListSecurityEvents pages through the user's security events, newest first.
+// type may be repeated or comma separated to filter; before is the
+// next_before of the previous page.
+func (h *SecurityEventHandler) ListSecurityEvents(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(middleware.UserContextKey).(int)
+	query := r.URL.Query()
+
+	var req dto.ListSecurityEventsRequest
+	for _, value := range query["type"] {
+		for _, eventType := range strings.Split(value, ",") {
+			if eventType = strings.TrimSpace(eventType); eventType != "" {
+				req.Types = append(req.Types, eventType)
+			}
+		}
+	}
+
+	var ok bool
+	if req.Before, req.Limit, ok = readPageParams(w, query, service.MaxSecurityEventsLimit); !ok {
+		return
+	}
+
+	events, err := h.securityEventService.ListSecurityEvents(r.Context(), userID, req)
+	if err != nil {
+		response.Error(w, http.StatusInternalServerError, "Failed to list security events")
+		return
+	}
+
+	response.JSON(w, http.StatusOK, events)
+}
@@ -0,0 +1,130 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/enkyuan/ato/api/internal/dto"
+	"github.com/enkyuan/ato/api/internal/middleware"
+	"github.com/enkyuan/ato/api/internal/service"
+	"github.com/enkyuan/ato/api/pkg/response"
+	"github.com/go-chi/chi/v5"
+)
+
+// SharePasswordHeader carries the password for password-protected links, so
+// it does not end up in access logs the way a query parameter would.
+const SharePasswordHeader = "X-Share-Password"
+
+type ShareHandler struct {
+	shareService service.ShareService
+}
+
+func NewShareHandler(shareService service.ShareService) *ShareHandler {
+	return &ShareHandler{
+		shareService: shareService,
+	}
+}
+
+func (h *ShareHandler) CreateShare(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(middleware.UserContextKey).(int)
+	groupID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		response.Error(w, http.StatusBadRequest, "Invalid group ID")
+		return
+	}
+
+	var req dto.CreateShareRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		response.Error(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		response.Error(w, http.StatusBadRequest, "Expiry must be in the future")
+		return
+	}
+
+	shareResp, err := h.shareService.CreateShare(r.Context(), groupID, userID, req)
+	if err != nil {
+		if errors.Is(err, service.ErrGroupNotFound) {
+			response.Error(w, http.StatusNotFound, "Group not found")
+			return
+		}
+		response.Error(w, http.StatusInternalServerError, "Failed to create share link")
+		return
+	}
+
+	response.JSON(w, http.StatusCreated, shareResp)
+}
+
+func (h *ShareHandler) ListShares(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(middleware.UserContextKey).(int)
+	groupID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		response.Error(w, http.StatusBadRequest, "Invalid group ID")
+		return
+	}
+
+	shares, err := h.shareService.ListShares(r.Context(), groupID, userID)
+	if err != nil {
+		if errors.Is(err, service.ErrGroupNotFound) {
+			response.Error(w, http.StatusNotFound, "Group not found")
+			return
+		}
+		response.Error(w, http.StatusInternalServerError, "Failed to fetch share links")
+		return
+	}
+
+	response.JSON(w, http.StatusOK, shares)
+}
+
+func (h *ShareHandler) RevokeShare(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(middleware.UserContextKey).(int)
+	groupID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		response.Error(w, http.StatusBadRequest, "Invalid group ID")
+		return
+	}
+
+	shareID, err := strconv.Atoi(chi.URLParam(r, "shareId"))
+	if err != nil {
+		response.Error(w, http.StatusBadRequest, "Invalid share ID")
+		return
+	}
+
+	if err := h.shareService.RevokeShare(r.Context(), shareID, groupID, userID); err != nil {
+		if errors.Is(err, service.ErrShareNotFound) {
+			response.Error(w, http.StatusNotFound, "Share link not found")
+			return
+		}
+		response.Error(w, http.StatusInternalServerError, "Failed to revoke share link")
+		return
+	}
+
+	response.Success(w, http.StatusOK, "Share link revoked")
+}
+
+func (h *ShareHandler) GetSharedGroup(w http.ResponseWriter, r *http.Request) {
+	token := chi.URLParam(r, "token")
+
+	shared, err := h.shareService.GetSharedGroup(r.Context(), token, r.Header.Get(SharePasswordHeader))
+	if err != nil {
+		switch {
+		case errors.Is(err, service.ErrShareNotFound):
+			response.Error(w, http.StatusNotFound, "Share link not found")
+		case errors.Is(err, service.ErrSharePasswordRequired):
+			response.Error(w, http.StatusUnauthorized, "Password required")
+		case errors.Is(err, service.ErrSharePasswordInvalid):
+			response.Error(w, http.StatusUnauthorized, "Invalid password")
+		default:
+			response.Error(w, http.StatusInternalServerError, "Failed to fetch shared group")
+		}
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	response.JSON(w, http.StatusOK, shared)
+}
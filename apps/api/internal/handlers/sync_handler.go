@@ -0,0 +1,69 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/enkyuan/ato/api/internal/dto"
+	"github.com/enkyuan/ato/api/internal/middleware"
+	"github.com/enkyuan/ato/api/internal/models"
+	"github.com/enkyuan/ato/api/internal/service"
+	"github.com/enkyuan/ato/api/pkg/auth"
+	"github.com/enkyuan/ato/api/pkg/response"
+)
+
+type SyncHandler struct {
+	syncService service.SyncService
+}
+
+func NewSyncHandler(syncService service.SyncService) *SyncHandler {
+	return &SyncHandler{
+		syncService: syncService,
+	}
+}
+
+func (h *SyncHandler) Sync(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(middleware.UserContextKey).(int)
+
+	var req dto.SyncRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		response.Error(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	// Validate input
+	if req.DeviceID == "" || len(req.DeviceID) > 64 {
+		response.Error(w, http.StatusBadRequest, "Device ID must be between 1 and 64 characters")
+		return
+	}
+
+	if req.Cursor < 0 {
+		response.Error(w, http.StatusBadRequest, "Cursor must not be negative")
+		return
+	}
+
+	if len(req.Mutations) > service.MaxSyncMutations {
+		response.Error(w, http.StatusBadRequest, fmt.Sprintf("At most %d mutations per request", service.MaxSyncMutations))
+		return
+	}
+
+	for _, mutation := range req.Mutations {
+		scope := auth.ScopeTodosWrite
+		if mutation.Entity == models.SyncEntityGroup {
+			scope = auth.ScopeGroupsWrite
+		}
+		if !middleware.HasScope(r.Context(), scope) {
+			middleware.WriteInsufficientScope(w, scope)
+			return
+		}
+	}
+
+	syncResp, err := h.syncService.Sync(r.Context(), userID, req)
+	if err != nil {
+		response.Error(w, http.StatusInternalServerError, "Failed to sync")
+		return
+	}
+
+	response.JSON(w, http.StatusOK, syncResp)
+}
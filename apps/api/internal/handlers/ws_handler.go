@@ -0,0 +1,617 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/enkyuan/ato/api/internal/dto"
+	"github.com/enkyuan/ato/api/internal/middleware"
+	"github.com/enkyuan/ato/api/internal/service"
+	"github.com/enkyuan/ato/api/pkg/auth"
+	"github.com/enkyuan/ato/api/pkg/response"
+	"github.com/gorilla/websocket"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	wsWriteWait      = 10 * time.Second
+	wsPongWait       = 60 * time.Second
+	wsPingPeriod     = (wsPongWait * 9) / 10
+	wsMaxMessageSize = 4096
+	wsSendBuffer     = 32
+
+	// wsRevalidatePeriod is how often a live connection re-checks that its
+	// token and account are still valid, so a logout, revoked session or
+	// disabled account closes it without waiting for the token to expire.
+	wsRevalidatePeriod = 30 * time.Second
+
+	// wsCloseTokenExpired is sent when the access token used to open the
+	// connection expires or is revoked and the client has not
+	// re-authenticated.
+	wsCloseTokenExpired = 4001
+)
+
+type WSHandler struct {
+	authService     service.AuthService
+	adminService    service.AdminService
+	groupService    service.GroupService
+	presenceService service.PresenceService
+	upgrader        websocket.Upgrader
+	hub             *wsHub
+}
+
+// NewWSHandler starts the hub that relays realtime events to this
+// instance's connections. The hub stops when ctx is done.
+func NewWSHandler(ctx context.Context, authService service.AuthService, adminService service.AdminService, groupService service.GroupService, presenceService service.PresenceService, allowedOrigins []string) *WSHandler {
+	origins := make(map[string]bool, len(allowedOrigins))
+	for _, origin := range allowedOrigins {
+		origins[origin] = true
+	}
+
+	h := &WSHandler{
+		authService:     authService,
+		adminService:    adminService,
+		groupService:    groupService,
+		presenceService: presenceService,
+		upgrader: websocket.Upgrader{
+			ReadBufferSize:  1024,
+			WriteBufferSize: 1024,
+			CheckOrigin: func(r *http.Request) bool {
+				origin := r.Header.Get("Origin")
+				// Non-browser clients do not send an Origin header
+				return origin == "" || origins[origin]
+			},
+		},
+		hub: newWSHub(),
+	}
+
+	go h.hub.run(ctx, presenceService)
+
+	return h
+}
+
+// Serve upgrades the request to a WebSocket. Browsers cannot set headers on
+// the handshake, so the access token may also be passed as ?token=.
+func (h *WSHandler) Serve(w http.ResponseWriter, r *http.Request) {
+	tokenString := extractToken(r)
+	if tokenString == "" {
+		tokenString = r.URL.Query().Get("token")
+	}
+	if tokenString == "" {
+		response.Error(w, http.StatusUnauthorized, "No token provided")
+		return
+	}
+
+	claims, err := h.authService.ValidateToken(r.Context(), tokenString)
+	if err != nil {
+		response.Error(w, http.StatusUnauthorized, "Invalid or revoked token")
+		return
+	}
+
+	if !wsScopesGranted(claims) {
+		middleware.WriteInsufficientScope(w, wsScopes...)
+		return
+	}
+
+	user, err := h.authService.GetCurrentUser(r.Context(), claims.UserID)
+	if err != nil {
+		response.Error(w, http.StatusUnauthorized, "User not found")
+		return
+	}
+	if user.DisabledAt != nil {
+		response.Error(w, http.StatusForbidden, "Account is disabled")
+		return
+	}
+
+	conn, err := h.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// The upgrader has already written an error response
+		return
+	}
+
+	// The connection outlives the request, so it gets its own context
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	client := &wsClient{
+		id:      newConnID(),
+		userID:  user.ID,
+		member:  dto.PresenceMember{UserID: user.ID, Name: user.Name},
+		conn:    conn,
+		send:    make(chan dto.RealtimeEvent, wsSendBuffer),
+		token:   tokenString,
+		expired: make(chan struct{}),
+		groups:  make(map[int]bool),
+		editing: make(map[editTarget]bool),
+	}
+	client.expiry = time.AfterFunc(time.Until(claims.ExpiresAt.Time), client.expire)
+
+	go client.writePump()
+	go h.revalidate(ctx, client)
+	h.readPump(ctx, client)
+	h.disconnect(client)
+}
+
+func (h *WSHandler) readPump(ctx context.Context, c *wsClient) {
+	c.conn.SetReadLimit(wsMaxMessageSize)
+	c.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+
+	for {
+		_, data, err := c.conn.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway, wsCloseTokenExpired) {
+				log.Printf("websocket read error: %v", err)
+			}
+			return
+		}
+
+		var req dto.RealtimeRequest
+		if err := json.Unmarshal(data, &req); err != nil {
+			c.push(dto.RealtimeEvent{Type: dto.RealtimeError, Error: "Invalid message"})
+			continue
+		}
+
+		h.handleMessage(ctx, c, req)
+	}
+}
+
+func (h *WSHandler) handleMessage(ctx context.Context, c *wsClient, req dto.RealtimeRequest) {
+	switch req.Type {
+	case dto.RealtimeSubscribe:
+		h.subscribe(ctx, c, req.GroupID)
+	case dto.RealtimeUnsubscribe:
+		h.unsubscribe(ctx, c, req.GroupID)
+	case dto.RealtimeHeartbeat:
+		h.heartbeat(ctx, c)
+	case dto.RealtimeEditStart:
+		h.startEditing(ctx, c, req.GroupID, req.TodoID)
+	case dto.RealtimeEditStop:
+		h.stopEditing(ctx, c, req.GroupID, req.TodoID)
+	case dto.RealtimeAuth:
+		h.reauthenticate(ctx, c, req.Token)
+	default:
+		c.push(dto.RealtimeEvent{Type: dto.RealtimeError, Error: "Unknown message type"})
+	}
+}
+
+func (h *WSHandler) subscribe(ctx context.Context, c *wsClient, groupID int) {
+	if _, err := h.groupService.GetGroup(ctx, groupID, c.userID); err != nil {
+		if errors.Is(err, service.ErrGroupNotFound) {
+			c.push(dto.RealtimeEvent{Type: dto.RealtimeError, GroupID: groupID, Error: "Group not found"})
+			return
+		}
+		c.push(dto.RealtimeEvent{Type: dto.RealtimeError, GroupID: groupID, Error: "Failed to subscribe"})
+		return
+	}
+
+	joined, err := h.presenceService.Join(ctx, groupID, c.member, c.id)
+	if err != nil {
+		c.push(dto.RealtimeEvent{Type: dto.RealtimeError, GroupID: groupID, Error: "Failed to subscribe"})
+		return
+	}
+
+	c.mu.Lock()
+	c.groups[groupID] = true
+	c.mu.Unlock()
+	h.hub.add(groupID, c)
+
+	if joined {
+		h.publish(ctx, dto.RealtimeEvent{Type: dto.RealtimeJoined, GroupID: groupID, UserID: c.member.UserID, Name: c.member.Name})
+	}
+
+	// Send the current snapshot so the client does not wait for the next change
+	members, err := h.presenceService.Members(ctx, groupID)
+	if err != nil {
+		members = []dto.PresenceMember{c.member}
+	}
+	editing, err := h.presenceService.Editing(ctx, groupID)
+	if err != nil {
+		editing = nil
+	}
+	c.push(dto.RealtimeEvent{Type: dto.RealtimePresence, GroupID: groupID, Members: members, Editing: editing})
+}
+
+func (h *WSHandler) unsubscribe(ctx context.Context, c *wsClient, groupID int) {
+	c.mu.Lock()
+	subscribed := c.groups[groupID]
+	delete(c.groups, groupID)
+	var todos []int
+	for target := range c.editing {
+		if target.groupID == groupID {
+			todos = append(todos, target.todoID)
+			delete(c.editing, target)
+		}
+	}
+	c.mu.Unlock()
+
+	if !subscribed {
+		c.push(dto.RealtimeEvent{Type: dto.RealtimeAck, GroupID: groupID})
+		return
+	}
+
+	h.hub.remove(groupID, c)
+	h.leaveGroup(ctx, c, groupID, todos)
+	c.push(dto.RealtimeEvent{Type: dto.RealtimeAck, GroupID: groupID})
+}
+
+func (h *WSHandler) heartbeat(ctx context.Context, c *wsClient) {
+	c.mu.Lock()
+	groups := make([]int, 0, len(c.groups))
+	for groupID := range c.groups {
+		groups = append(groups, groupID)
+	}
+	targets := make([]editTarget, 0, len(c.editing))
+	for target := range c.editing {
+		targets = append(targets, target)
+	}
+	c.mu.Unlock()
+
+	for _, groupID := range groups {
+		if err := h.presenceService.Heartbeat(ctx, groupID, c.member, c.id); err != nil {
+			log.Printf("Failed to refresh presence: %v", err)
+		}
+	}
+
+	for _, target := range targets {
+		if err := h.presenceService.StartEditing(ctx, target.groupID, target.todoID, c.userID, c.id); err != nil {
+			// Our lock expired and someone else took it over
+			c.mu.Lock()
+			delete(c.editing, target)
+			c.mu.Unlock()
+			c.push(dto.RealtimeEvent{Type: dto.RealtimeError, GroupID: target.groupID, TodoID: target.todoID, Error: "Edit lock lost"})
+		}
+	}
+
+	c.push(dto.RealtimeEvent{Type: dto.RealtimeAck})
+}
+
+func (h *WSHandler) startEditing(ctx context.Context, c *wsClient, groupID int, todoID int) {
+	c.mu.Lock()
+	subscribed := c.groups[groupID]
+	c.mu.Unlock()
+
+	if !subscribed {
+		c.push(dto.RealtimeEvent{Type: dto.RealtimeError, GroupID: groupID, Error: "Not subscribed to group"})
+		return
+	}
+
+	if err := h.presenceService.StartEditing(ctx, groupID, todoID, c.userID, c.id); err != nil {
+		if errors.Is(err, service.ErrEditLocked) {
+			c.push(dto.RealtimeEvent{Type: dto.RealtimeError, GroupID: groupID, TodoID: todoID, Error: "Todo is being edited by another user"})
+			return
+		}
+		c.push(dto.RealtimeEvent{Type: dto.RealtimeError, GroupID: groupID, TodoID: todoID, Error: "Failed to lock todo"})
+		return
+	}
+
+	target := editTarget{groupID: groupID, todoID: todoID}
+	c.mu.Lock()
+	alreadyEditing := c.editing[target]
+	c.editing[target] = true
+	c.mu.Unlock()
+
+	if !alreadyEditing {
+		h.publish(ctx, dto.RealtimeEvent{Type: dto.RealtimeEditing, GroupID: groupID, TodoID: todoID, UserID: c.member.UserID, Name: c.member.Name})
+	}
+}
+
+func (h *WSHandler) stopEditing(ctx context.Context, c *wsClient, groupID int, todoID int) {
+	target := editTarget{groupID: groupID, todoID: todoID}
+	c.mu.Lock()
+	editing := c.editing[target]
+	delete(c.editing, target)
+	c.mu.Unlock()
+
+	if !editing {
+		c.push(dto.RealtimeEvent{Type: dto.RealtimeAck, GroupID: groupID, TodoID: todoID})
+		return
+	}
+
+	h.releaseLock(ctx, c, groupID, todoID)
+}
+
+func (h *WSHandler) reauthenticate(ctx context.Context, c *wsClient, tokenString string) {
+	claims, err := h.authService.ValidateToken(ctx, tokenString)
+	if err != nil || claims.UserID != c.userID || !wsScopesGranted(claims) {
+		c.push(dto.RealtimeEvent{Type: dto.RealtimeError, Error: "Invalid or revoked token"})
+		return
+	}
+
+	// Only extend the deadline if the timer has not already fired
+	if c.expiry.Stop() {
+		c.expiry.Reset(time.Until(claims.ExpiresAt.Time))
+	}
+	c.mu.Lock()
+	c.token = tokenString
+	c.mu.Unlock()
+	c.push(dto.RealtimeEvent{Type: dto.RealtimeAck})
+}
+
+// revalidate periodically re-checks the connection's token and account
+// until ctx is done, and closes the connection once either is no longer
+// valid. Lookup failures leave the connection open.
+func (h *WSHandler) revalidate(ctx context.Context, c *wsClient) {
+	ticker := time.NewTicker(wsRevalidatePeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-c.expired:
+			return
+		case <-ticker.C:
+		}
+
+		c.mu.Lock()
+		token := c.token
+		c.mu.Unlock()
+
+		if _, err := h.authService.ValidateToken(ctx, token); err != nil {
+			if errors.Is(err, service.ErrTokenRevoked) {
+				c.expire()
+				return
+			}
+			log.Printf("Failed to revalidate websocket token: %v", err)
+		}
+
+		disabled, err := h.adminService.AccountDisabled(ctx, c.userID)
+		if err != nil {
+			log.Printf("Failed to check account status: %v", err)
+			continue
+		}
+		if disabled {
+			c.expire()
+			return
+		}
+	}
+}
+
+// wsScopes are needed to see who is in a group and what they are editing
+var wsScopes = []string{auth.ScopeGroupsRead, auth.ScopeTodosRead}
+
+func wsScopesGranted(claims *auth.Claims) bool {
+	scopes := claims.Scopes()
+	for _, scope := range wsScopes {
+		if !auth.HasScope(scopes, scope) {
+			return false
+		}
+	}
+	return true
+}
+
+// disconnect releases everything the connection held. It runs on a fresh
+// context so cleanup still happens when the read loop exits on an error.
+func (h *WSHandler) disconnect(c *wsClient) {
+	c.expiry.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	c.mu.Lock()
+	c.closed = true
+	close(c.send)
+	groups := c.groups
+	editing := c.editing
+	c.groups = make(map[int]bool)
+	c.editing = make(map[editTarget]bool)
+	c.mu.Unlock()
+
+	for groupID := range groups {
+		h.hub.remove(groupID, c)
+
+		var todos []int
+		for target := range editing {
+			if target.groupID == groupID {
+				todos = append(todos, target.todoID)
+			}
+		}
+		h.leaveGroup(ctx, c, groupID, todos)
+	}
+}
+
+func (h *WSHandler) leaveGroup(ctx context.Context, c *wsClient, groupID int, todos []int) {
+	for _, todoID := range todos {
+		h.releaseLock(ctx, c, groupID, todoID)
+	}
+
+	left, err := h.presenceService.Leave(ctx, groupID, c.userID, c.id)
+	if err != nil {
+		log.Printf("Failed to remove presence: %v", err)
+		return
+	}
+
+	// Other tabs of the same user keep them present
+	if left {
+		h.publish(ctx, dto.RealtimeEvent{Type: dto.RealtimeLeft, GroupID: groupID, UserID: c.member.UserID, Name: c.member.Name})
+	}
+}
+
+func (h *WSHandler) releaseLock(ctx context.Context, c *wsClient, groupID int, todoID int) {
+	released, err := h.presenceService.StopEditing(ctx, groupID, todoID, c.userID, c.id)
+	if err != nil {
+		log.Printf("Failed to release edit lock: %v", err)
+		return
+	}
+
+	if released {
+		h.publish(ctx, dto.RealtimeEvent{Type: dto.RealtimeEditStopped, GroupID: groupID, TodoID: todoID, UserID: c.member.UserID})
+	}
+}
+
+func (h *WSHandler) publish(ctx context.Context, event dto.RealtimeEvent) {
+	if err := h.presenceService.Publish(ctx, event); err != nil {
+		log.Printf("Failed to publish realtime event: %v", err)
+	}
+}
+
+type editTarget struct {
+	groupID int
+	todoID  int
+}
+
+type wsClient struct {
+	id         string
+	userID     int
+	member     dto.PresenceMember
+	conn       *websocket.Conn
+	send       chan dto.RealtimeEvent
+	expired    chan struct{}
+	expireOnce sync.Once
+	expiry     *time.Timer
+
+	mu      sync.Mutex
+	closed  bool
+	token   string
+	groups  map[int]bool
+	editing map[editTarget]bool
+}
+
+// push queues an event without blocking. A client that cannot keep up is
+// disconnected rather than allowed to stall the hub.
+func (c *wsClient) push(event dto.RealtimeEvent) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return
+	}
+
+	select {
+	case c.send <- event:
+	default:
+		c.closed = true
+		c.conn.Close()
+	}
+}
+
+// expire ends the connection's session. It may be called by both the
+// expiry timer and revalidation.
+func (c *wsClient) expire() {
+	c.expireOnce.Do(func() {
+		close(c.expired)
+	})
+}
+
+func (c *wsClient) writePump() {
+	ticker := time.NewTicker(wsPingPeriod)
+	defer func() {
+		ticker.Stop()
+		c.conn.Close()
+	}()
+
+	for {
+		select {
+		case event, ok := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if !ok {
+				c.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+				return
+			}
+			if err := c.conn.WriteJSON(event); err != nil {
+				return
+			}
+		case <-ticker.C:
+			c.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		case <-c.expired:
+			// The client should reconnect with a fresh access token
+			c.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			c.conn.WriteJSON(dto.RealtimeEvent{Type: dto.RealtimeTokenExpired})
+			c.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(wsCloseTokenExpired, "token expired"))
+			return
+		}
+	}
+}
+
+// wsHub fans out events received over Redis pub/sub to the connections on
+// this instance that are subscribed to the event's group.
+type wsHub struct {
+	mu     sync.RWMutex
+	groups map[int]map[*wsClient]bool
+}
+
+func newWSHub() *wsHub {
+	return &wsHub{
+		groups: make(map[int]map[*wsClient]bool),
+	}
+}
+
+func (hub *wsHub) add(groupID int, c *wsClient) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	if hub.groups[groupID] == nil {
+		hub.groups[groupID] = make(map[*wsClient]bool)
+	}
+	hub.groups[groupID][c] = true
+}
+
+func (hub *wsHub) remove(groupID int, c *wsClient) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	delete(hub.groups[groupID], c)
+	if len(hub.groups[groupID]) == 0 {
+		delete(hub.groups, groupID)
+	}
+}
+
+func (hub *wsHub) broadcast(event dto.RealtimeEvent) {
+	hub.mu.RLock()
+	defer hub.mu.RUnlock()
+
+	for c := range hub.groups[event.GroupID] {
+		c.push(event)
+	}
+}
+
+func (hub *wsHub) run(ctx context.Context, presenceService service.PresenceService) {
+	pubsub := presenceService.Subscribe(ctx)
+	defer pubsub.Close()
+
+	messages := pubsub.Channel()
+	for {
+		var msg *redis.Message
+		select {
+		case <-ctx.Done():
+			return
+		case m, ok := <-messages:
+			if !ok {
+				return
+			}
+			msg = m
+		}
+
+		groupID, ok := service.RealtimeChannelGroupID(msg.Channel)
+		if !ok {
+			continue
+		}
+
+		var event dto.RealtimeEvent
+		if err := json.Unmarshal([]byte(msg.Payload), &event); err != nil {
+			continue
+		}
+		event.GroupID = groupID
+
+		hub.broadcast(event)
+	}
+}
+
+func newConnID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
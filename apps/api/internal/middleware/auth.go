@@ -2,27 +2,45 @@ package middleware
 
 import (
 	"context"
+	"errors"
+	"net"
 	"net/http"
+	"os"
 	"strings"
 
+	"github.com/enkyuan/ato/api/internal/dto"
 	"github.com/enkyuan/ato/api/internal/service"
 	"github.com/enkyuan/ato/api/pkg/response"
 )
 
 type contextKey string
 
-const UserContextKey contextKey = "user"
+const (
+	UserContextKey    contextKey = "user"
+	SessionContextKey contextKey = "session"
+	// ScopesContextKey holds the scopes the request's token grants
+	ScopesContextKey contextKey = "scopes"
+	// ClientContextKey holds the client ID of the third-party app the
+	// request's token was issued to, if any
+	ClientContextKey contextKey = "client"
+)
 
 type AuthMiddleware struct {
-	authService service.AuthService
+	authService     service.AuthService
+	apiTokenService service.APITokenService
+	adminService    service.AdminService
 }
 
-func NewAuthMiddleware(authService service.AuthService) *AuthMiddleware {
+func NewAuthMiddleware(authService service.AuthService, apiTokenService service.APITokenService, adminService service.AdminService) *AuthMiddleware {
 	return &AuthMiddleware{
-		authService: authService,
+		authService:     authService,
+		apiTokenService: apiTokenService,
+		adminService:    adminService,
 	}
 }
 
+// Authenticate accepts access tokens from a login or issued to an OAuth app,
+// and personal access tokens, all as bearer tokens.
 func (m *AuthMiddleware) Authenticate(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		tokenString := extractToken(r)
@@ -31,6 +49,26 @@ func (m *AuthMiddleware) Authenticate(next http.Handler) http.Handler {
 			return
 		}
 
+		if strings.HasPrefix(tokenString, service.APITokenPrefix) {
+			apiToken, err := m.apiTokenService.ValidateAPIToken(r.Context(), tokenString, dto.ClientInfo{
+				IPAddress: clientIP(r),
+				UserAgent: r.UserAgent(),
+			})
+			if err != nil {
+				response.Error(w, http.StatusUnauthorized, "Invalid or revoked token")
+				return
+			}
+
+			if !m.checkAccountEnabled(w, r, apiToken.UserID) {
+				return
+			}
+
+			ctx := context.WithValue(r.Context(), UserContextKey, apiToken.UserID)
+			ctx = context.WithValue(ctx, ScopesContextKey, apiToken.Scopes)
+			next.ServeHTTP(w, r.WithContext(ctx))
+			return
+		}
+
 		// Validate token
 		claims, err := m.authService.ValidateToken(r.Context(), tokenString)
 		if err != nil {
@@ -38,12 +76,109 @@ func (m *AuthMiddleware) Authenticate(next http.Handler) http.Handler {
 			return
 		}
 
-		// Add user ID to context
+		if !m.checkAccountEnabled(w, r, claims.UserID) {
+			return
+		}
+
+		// Add user ID, session, scopes and app to context
 		ctx := context.WithValue(r.Context(), UserContextKey, claims.UserID)
+		ctx = context.WithValue(ctx, SessionContextKey, claims.FamilyID)
+		ctx = context.WithValue(ctx, ScopesContextKey, claims.Scopes())
+		ctx = context.WithValue(ctx, ClientContextKey, claims.ClientID)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
 
+// checkAccountEnabled turns away users whose account an admin has disabled,
+// reporting whether the request may go on.
+func (m *AuthMiddleware) checkAccountEnabled(w http.ResponseWriter, r *http.Request, userID int) bool {
+	disabled, err := m.adminService.AccountDisabled(r.Context(), userID)
+	if err != nil {
+		if errors.Is(err, service.ErrUserNotFound) {
+			response.Error(w, http.StatusUnauthorized, "Invalid or revoked token")
+			return false
+		}
+		response.Error(w, http.StatusInternalServerError, "Failed to check account")
+		return false
+	}
+	if disabled {
+		response.Error(w, http.StatusForbidden, "Account is disabled")
+		return false
+	}
+
+	return true
+}
+
+// RequireAdmin only lets through users with the admin role. It must run
+// after Authenticate.
+func (m *AuthMiddleware) RequireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userID := r.Context().Value(UserContextKey).(int)
+
+		admin, err := m.adminService.IsAdmin(r.Context(), userID)
+		if err != nil {
+			response.Error(w, http.StatusInternalServerError, "Failed to check role")
+			return
+		}
+		if !admin {
+			response.Error(w, http.StatusForbidden, "Admin access required")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RequireSession only lets through tokens from the user's own logins, for
+// account management routes that API tokens and OAuth apps must not reach
+// whatever their scopes. It must run after Authenticate.
+func (m *AuthMiddleware) RequireSession(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sessionID, _ := r.Context().Value(SessionContextKey).(string)
+		clientID, _ := r.Context().Value(ClientContextKey).(string)
+		if sessionID == "" || clientID != "" {
+			response.Error(w, http.StatusForbidden, "This token cannot manage the account")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RequireVerifiedEmail blocks users who have not verified their email, when
+// REQUIRE_EMAIL_VERIFICATION is "true". It must run after Authenticate.
+func (m *AuthMiddleware) RequireVerifiedEmail(next http.Handler) http.Handler {
+	if os.Getenv("REQUIRE_EMAIL_VERIFICATION") != "true" {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userID := r.Context().Value(UserContextKey).(int)
+
+		verified, err := m.authService.EmailVerified(r.Context(), userID)
+		if err != nil {
+			response.Error(w, http.StatusInternalServerError, "Failed to check email verification")
+			return
+		}
+		if !verified {
+			response.Error(w, http.StatusForbidden, "Please verify your email first")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// clientIP is the caller's address. RealIP has already replaced RemoteAddr
+// with the forwarded address when there is one.
+func clientIP(r *http.Request) string {
+	ip := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+	return ip
+}
+
 func extractToken(r *http.Request) string {
 	bearerToken := r.Header.Get("Authorization")
 	parts := strings.Split(bearerToken, " ")
@@ -0,0 +1,210 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/enkyuan/ato/api/cache"
+	"github.com/enkyuan/ato/api/pkg/response"
+	chimiddleware "github.com/go-chi/chi/v5/middleware"
+)
+
+const (
+	IdempotencyKeyHeader     = "Idempotency-Key"
+	IdempotentReplayedHeader = "Idempotent-Replayed"
+	idempotencyTTL           = 24 * time.Hour
+	idempotencyProcessingTTL = 2 * time.Minute
+	idempotencyMaxKeyLength  = 255
+	// idempotencyMaxBodyBytes caps the body buffered to fingerprint a request
+	idempotencyMaxBodyBytes  = 1 << 20
+	idempotencyStateDone     = "done"
+	idempotencyStateInFlight = "processing"
+)
+
+// Response headers worth replaying alongside the stored body
+var idempotencyReplayHeaders = []string{"Content-Type", "ETag", "Location"}
+
+type idempotencyRecord struct {
+	State       string            `json:"state"`
+	Fingerprint string            `json:"fingerprint"`
+	Status      int               `json:"status,omitempty"`
+	Headers     map[string]string `json:"headers,omitempty"`
+	Body        []byte            `json:"body,omitempty"`
+}
+
+type IdempotencyMiddleware struct {
+	cache *cache.Cache
+}
+
+func NewIdempotencyMiddleware(cache *cache.Cache) *IdempotencyMiddleware {
+	return &IdempotencyMiddleware{
+		cache: cache,
+	}
+}
+
+// Idempotent makes retries of a mutating request that carry the same
+// Idempotency-Key replay the first response instead of running again. It must
+// run after Authenticate, since keys are scoped to the user.
+func (m *IdempotencyMiddleware) Idempotent(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(IdempotencyKeyHeader)
+		if key == "" || !isMutatingMethod(r.Method) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if len(key) > idempotencyMaxKeyLength {
+			response.Error(w, http.StatusBadRequest, "Idempotency key is too long")
+			return
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, idempotencyMaxBodyBytes))
+		if err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				response.Error(w, http.StatusRequestEntityTooLarge, "Request body is too large")
+				return
+			}
+			response.Error(w, http.StatusBadRequest, "Invalid request body")
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		userID, _ := r.Context().Value(UserContextKey).(int)
+		cacheKey := idempotencyCacheKey(userID, r.Method, r.URL.Path, key)
+		fingerprint := fingerprintBody(body)
+
+		claimed, err := m.claim(r.Context(), cacheKey, fingerprint)
+		if err != nil {
+			// Without Redis we cannot deduplicate; serve the request as usual
+			log.Printf("Idempotency check failed: %v", err)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if !claimed {
+			m.replay(w, r, cacheKey, fingerprint)
+			return
+		}
+
+		var buf bytes.Buffer
+		ww := chimiddleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		ww.Tee(&buf)
+
+		// Release the key if the handler panics so the client can retry
+		completed := false
+		defer func() {
+			if !completed {
+				m.cache.Delete(context.Background(), cacheKey)
+			}
+		}()
+
+		next.ServeHTTP(ww, r)
+
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+
+		// Server errors are not final, so let a retry run the request again
+		if status >= http.StatusInternalServerError {
+			return
+		}
+
+		record := idempotencyRecord{
+			State:       idempotencyStateDone,
+			Fingerprint: fingerprint,
+			Status:      status,
+			Headers:     make(map[string]string),
+			Body:        buf.Bytes(),
+		}
+		for _, header := range idempotencyReplayHeaders {
+			if value := ww.Header().Get(header); value != "" {
+				record.Headers[header] = value
+			}
+		}
+
+		data, err := json.Marshal(record)
+		if err != nil {
+			return
+		}
+
+		// The request context may already be cancelled by the time we get here
+		if err := m.cache.Set(context.Background(), cacheKey, string(data), idempotencyTTL); err != nil {
+			log.Printf("Failed to store idempotent response: %v", err)
+			return
+		}
+		completed = true
+	})
+}
+
+func (m *IdempotencyMiddleware) claim(ctx context.Context, cacheKey string, fingerprint string) (bool, error) {
+	data, err := json.Marshal(idempotencyRecord{
+		State:       idempotencyStateInFlight,
+		Fingerprint: fingerprint,
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return m.cache.SetNX(ctx, cacheKey, string(data), idempotencyProcessingTTL)
+}
+
+func (m *IdempotencyMiddleware) replay(w http.ResponseWriter, r *http.Request, cacheKey string, fingerprint string) {
+	data, err := m.cache.Get(r.Context(), cacheKey)
+	if err != nil {
+		// The first attempt just failed and released the key
+		response.Error(w, http.StatusConflict, "Request with this idempotency key is being retried, try again")
+		return
+	}
+
+	var record idempotencyRecord
+	if err := json.Unmarshal([]byte(data), &record); err != nil {
+		response.Error(w, http.StatusInternalServerError, "Failed to read idempotent response")
+		return
+	}
+
+	if record.Fingerprint != fingerprint {
+		response.Error(w, http.StatusUnprocessableEntity, "Idempotency key was already used with a different request body")
+		return
+	}
+
+	if record.State != idempotencyStateDone {
+		response.Error(w, http.StatusConflict, "Request with this idempotency key is still in progress")
+		return
+	}
+
+	for header, value := range record.Headers {
+		w.Header().Set(header, value)
+	}
+	w.Header().Set(IdempotentReplayedHeader, "true")
+	w.WriteHeader(record.Status)
+	w.Write(record.Body)
+}
+
+func idempotencyCacheKey(userID int, method string, path string, key string) string {
+	sum := sha256.Sum256([]byte(method + " " + path + "\n" + key))
+	return fmt.Sprintf("idempotency:user:%d:%s", userID, hex.EncodeToString(sum[:]))
+}
+
+func fingerprintBody(body []byte) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+func isMutatingMethod(method string) bool {
+	switch method {
+	case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,138 @@
+package middleware
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/enkyuan/ato/api/cache"
+	"github.com/enkyuan/ato/api/pkg/response"
+)
+
+// Route classes. Each client gets its own window per class.
+const (
+	// RateLimitAuth covers sign-in endpoints, each of which can cost a
+	// password hash comparison
+	RateLimitAuth = "auth"
+	// RateLimitAccount covers endpoints that create accounts or send mail
+	RateLimitAccount = "account"
+	// RateLimitAPI is the default for everything else
+	RateLimitAPI = "api"
+)
+
+type rateLimitClass struct {
+	limit  int64
+	window time.Duration
+}
+
+// Default limits. They can be changed with RATE_LIMIT_<CLASS>, e.g.
+// RATE_LIMIT_AUTH=20/1m.
+var defaultRateLimits = map[string]rateLimitClass{
+	RateLimitAuth:    {limit: 20, window: time.Minute},
+	RateLimitAccount: {limit: 10, window: time.Hour},
+	RateLimitAPI:     {limit: 300, window: time.Minute},
+}
+
+type RateLimitMiddleware struct {
+	limiter *cache.Limiter
+	classes map[string]rateLimitClass
+}
+
+func NewRateLimitMiddleware(limiter *cache.Limiter) *RateLimitMiddleware {
+	classes := make(map[string]rateLimitClass, len(defaultRateLimits))
+	for name, class := range defaultRateLimits {
+		classes[name] = rateLimitClassFromEnv(name, class)
+	}
+
+	return &RateLimitMiddleware{
+		limiter: limiter,
+		classes: classes,
+	}
+}
+
+// Limit applies the class's limit per client: per user once Authenticate has
+// run, per IP address otherwise. Responses carry RateLimit-* headers, and a
+// client over the limit gets 429 with Retry-After.
+func (m *RateLimitMiddleware) Limit(name string) func(http.Handler) http.Handler {
+	class, ok := m.classes[name]
+	if !ok {
+		panic("unknown rate limit class " + name)
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := rateLimitKey(name, rateLimitClient(r))
+			window := m.limiter.Allow(r.Context(), key, class.limit, class.window)
+
+			resetAfter := window.ResetAfter(class.window, time.Now())
+			remaining := class.limit - window.Count
+			if remaining < 0 {
+				remaining = 0
+			}
+
+			w.Header().Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d", class.limit, int64(class.window.Seconds())))
+			w.Header().Set("RateLimit-Limit", strconv.FormatInt(class.limit, 10))
+			w.Header().Set("RateLimit-Remaining", strconv.FormatInt(remaining, 10))
+			w.Header().Set("RateLimit-Reset", strconv.FormatInt(ceilSeconds(resetAfter), 10))
+
+			if !window.Allowed {
+				SetRetryAfter(w, resetAfter)
+				response.Error(w, http.StatusTooManyRequests, "Too many requests, try again later")
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// SetRetryAfter sets the Retry-After header in whole seconds, rounding up so
+// a client that waits exactly that long is not turned away again.
+func SetRetryAfter(w http.ResponseWriter, d time.Duration) {
+	w.Header().Set("Retry-After", strconv.FormatInt(max(ceilSeconds(d), 1), 10))
+}
+
+func ceilSeconds(d time.Duration) int64 {
+	return int64(math.Ceil(d.Seconds()))
+}
+
+func rateLimitClient(r *http.Request) string {
+	if userID, ok := r.Context().Value(UserContextKey).(int); ok {
+		return "user:" + strconv.Itoa(userID)
+	}
+
+	return "ip:" + clientIP(r)
+}
+
+func rateLimitKey(class string, client string) string {
+	return fmt.Sprintf("ratelimit:%s:%s", class, client)
+}
+
+// rateLimitClassFromEnv reads a limit written as <count>/<window>, keeping the
+// default if the variable is unset or malformed.
+func rateLimitClassFromEnv(name string, class rateLimitClass) rateLimitClass {
+	env := "RATE_LIMIT_" + strings.ToUpper(name)
+	value := os.Getenv(env)
+	if value == "" {
+		return class
+	}
+
+	count, period, ok := strings.Cut(value, "/")
+	limit, err := strconv.ParseInt(count, 10, 64)
+	if !ok || err != nil || limit <= 0 {
+		log.Printf("Ignoring invalid %s %q", env, value)
+		return class
+	}
+	window, err := time.ParseDuration(period)
+	if err != nil || window <= 0 {
+		log.Printf("Ignoring invalid %s %q", env, value)
+		return class
+	}
+
+	return rateLimitClass{limit: limit, window: window}
+}
@@ -0,0 +1,42 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/enkyuan/ato/api/pkg/auth"
+	"github.com/enkyuan/ato/api/pkg/response"
+)
+
+// RequireScope only lets through tokens that hold every one of the scopes.
+// It must run after Authenticate.
+func RequireScope(scopes ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for _, scope := range scopes {
+				if !HasScope(r.Context(), scope) {
+					WriteInsufficientScope(w, scopes...)
+					return
+				}
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// HasScope reports whether the request's token holds the scope.
+func HasScope(ctx context.Context, scope string) bool {
+	scopes, _ := ctx.Value(ScopesContextKey).([]string)
+	return auth.HasScope(scopes, scope)
+}
+
+// WriteInsufficientScope answers 403 in the form RFC 6750 describes, naming
+// the scopes the request needed.
+func WriteInsufficientScope(w http.ResponseWriter, scopes ...string) {
+	needed := strings.Join(scopes, " ")
+	w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer error="insufficient_scope", scope=%q`, needed))
+	response.Error(w, http.StatusForbidden, fmt.Sprintf("Token is missing the required scope: %s", needed))
+}
@@ -0,0 +1,25 @@
+package models
+
+import "time"
+
+// Account token purposes
+const (
+	AccountTokenPasswordReset     = "password_reset"
+	AccountTokenEmailVerification = "email_verification"
+	AccountTokenMagicLink         = "magic_link"
+	// An email change token's email is the new address it was sent to
+	AccountTokenEmailChange = "email_change"
+)
+
+// AccountToken is a single-use link sent to a user's email. Only a hash of
+// the token is stored.
+type AccountToken struct {
+	ID        int
+	UserID    int
+	Purpose   string
+	TokenHash string
+	Email     string
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+	CreatedAt time.Time
+}
@@ -0,0 +1,25 @@
+package models
+
+import "time"
+
+// Data export statuses
+const (
+	DataExportPending = "pending"
+	DataExportReady   = "ready"
+	DataExportFailed  = "failed"
+)
+
+// DataExport is an archive of everything stored about a user, built in the
+// background when they ask for it.
+type DataExport struct {
+	ID          int        `json:"id"`
+	UserID      int        `json:"-"`
+	Status      string     `json:"status"`
+	Size        int64      `json:"size,omitempty"`
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+
+	// Archive is the zip file, only loaded for downloads
+	Archive []byte `json:"-"`
+}
@@ -3,15 +3,23 @@ package models
 import (
 	"database/sql"
 	"time"
+
+	"github.com/lib/pq"
 )
 
 type Group struct {
 	ID        int       `json:"id"`
 	UserID    int       `json:"user_id"`
+	ClientID  string    `json:"client_id"`
 	Name      string    `json:"name"`
 	Position  int       `json:"position"`
+	Version   int       `json:"version"`
 	CreatedAt time.Time `json:"created_at"`
 	UpdatedAt time.Time `json:"updated_at"`
+
+	// FieldClocks records when each synced field was last written, used for
+	// last-writer-wins merges in /sync
+	FieldClocks map[string]string `json:"-"`
 }
 
 func CreateGroup(db *sql.DB, userID int, name string) (*Group, error) {
@@ -34,12 +42,14 @@ func CreateGroup(db *sql.DB, userID int, name string) (*Group, error) {
 	err = db.QueryRow(`
 		INSERT INTO groups (user_id, name, position)
 		VALUES ($1, $2, $3)
-		RETURNING id, user_id, name, position, created_at, updated_at
+		RETURNING id, user_id, client_id, name, position, version, created_at, updated_at
 	`, userID, name, nextPosition).Scan(
 		&group.ID,
 		&group.UserID,
+		&group.ClientID,
 		&group.Name,
 		&group.Position,
+		&group.Version,
 		&group.CreatedAt,
 		&group.UpdatedAt,
 	)
@@ -53,7 +63,7 @@ func CreateGroup(db *sql.DB, userID int, name string) (*Group, error) {
 
 func GetGroupsByUserID(db *sql.DB, userID int) ([]*Group, error) {
 	rows, err := db.Query(`
-		SELECT id, user_id, name, position, created_at, updated_at
+		SELECT id, user_id, client_id, name, position, version, created_at, updated_at
 		FROM groups
 		WHERE user_id = $1
 		ORDER BY position ASC
@@ -69,8 +79,10 @@ func GetGroupsByUserID(db *sql.DB, userID int) ([]*Group, error) {
 		err := rows.Scan(
 			&group.ID,
 			&group.UserID,
+			&group.ClientID,
 			&group.Name,
 			&group.Position,
+			&group.Version,
 			&group.CreatedAt,
 			&group.UpdatedAt,
 		)
@@ -83,23 +95,86 @@ func GetGroupsByUserID(db *sql.DB, userID int) ([]*Group, error) {
 	return groups, nil
 }
 
-func UpdateGroupName(db *sql.DB, groupID int, userID int, name string) error {
-	_, err := db.Exec(`
-		UPDATE groups SET name = $1 WHERE id = $2 AND user_id = $3
-	`, name, groupID, userID)
-	return err
+func GetGroupByID(db *sql.DB, groupID int, userID int) (*Group, error) {
+	var group Group
+	err := db.QueryRow(`
+		SELECT id, user_id, client_id, name, position, version, created_at, updated_at
+		FROM groups
+		WHERE id = $1 AND user_id = $2
+	`, groupID, userID).Scan(
+		&group.ID,
+		&group.UserID,
+		&group.ClientID,
+		&group.Name,
+		&group.Position,
+		&group.Version,
+		&group.CreatedAt,
+		&group.UpdatedAt,
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &group, nil
+}
+
+// UpdateGroupName renames a group. When ifMatch is non-nil the update only
+// happens if the group's current version is one of the given versions.
+func UpdateGroupName(db *sql.DB, groupID int, userID int, name string, ifMatch []int64) (*Group, error) {
+	return updateGroup(db, `
+		UPDATE groups SET name = $1
+		WHERE id = $2 AND user_id = $3 AND ($4::bigint[] IS NULL OR version = ANY($4))
+		RETURNING id, user_id, client_id, name, position, version, created_at, updated_at
+	`, name, groupID, userID, pq.Int64Array(ifMatch))
 }
 
-func UpdateGroupPosition(db *sql.DB, groupID int, position int) error {
-	_, err := db.Exec(`
-		UPDATE groups SET position = $1 WHERE id = $2
-	`, position, groupID)
-	return err
+func UpdateGroupPosition(db *sql.DB, groupID int, userID int, position int, ifMatch []int64) (*Group, error) {
+	return updateGroup(db, `
+		UPDATE groups SET position = $1
+		WHERE id = $2 AND user_id = $3 AND ($4::bigint[] IS NULL OR version = ANY($4))
+		RETURNING id, user_id, client_id, name, position, version, created_at, updated_at
+	`, position, groupID, userID, pq.Int64Array(ifMatch))
 }
 
-func DeleteGroup(db *sql.DB, groupID int, userID int) error {
-	_, err := db.Exec(`
-		DELETE FROM groups WHERE id = $1 AND user_id = $2
-	`, groupID, userID)
-	return err
+func updateGroup(db *sql.DB, query string, args ...interface{}) (*Group, error) {
+	var group Group
+	err := db.QueryRow(query, args...).Scan(
+		&group.ID,
+		&group.UserID,
+		&group.ClientID,
+		&group.Name,
+		&group.Position,
+		&group.Version,
+		&group.CreatedAt,
+		&group.UpdatedAt,
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &group, nil
+}
+
+// DeleteGroup returns sql.ErrNoRows when nothing was deleted, either because
+// the group does not exist or because its version did not match ifMatch.
+func DeleteGroup(db *sql.DB, groupID int, userID int, ifMatch []int64) error {
+	result, err := db.Exec(`
+		DELETE FROM groups
+		WHERE id = $1 AND user_id = $2 AND ($3::bigint[] IS NULL OR version = ANY($3))
+	`, groupID, userID, pq.Int64Array(ifMatch))
+	if err != nil {
+		return err
+	}
+
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
 }
@@ -0,0 +1,11 @@
+package models
+
+import "time"
+
+type TOTPCredential struct {
+	UserID       int        `json:"-"`
+	Secret       string     `json:"-"`
+	LastUsedStep int64      `json:"-"`
+	ConfirmedAt  *time.Time `json:"confirmed_at"`
+	CreatedAt    time.Time  `json:"created_at"`
+}
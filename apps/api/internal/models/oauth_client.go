@@ -0,0 +1,37 @@
+package models
+
+import "time"
+
+// OAuthClient is a third-party app that users can authorise to act on their
+// behalf. ID is the public client_id. Public clients, such as mobile and
+// desktop apps, cannot keep a secret and have no SecretHash.
+type OAuthClient struct {
+	ID           string    `json:"client_id"`
+	OwnerID      int       `json:"-"`
+	Name         string    `json:"name"`
+	SecretHash   string    `json:"-"`
+	RedirectURIs []string  `json:"redirect_uris"`
+	Public       bool      `json:"public"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// AllowsRedirect reports whether uri is one of the client's registered
+// redirect URIs. Matching is exact, as OAuth 2.0 Security BCP requires.
+func (c *OAuthClient) AllowsRedirect(uri string) bool {
+	for _, registered := range c.RedirectURIs {
+		if registered == uri {
+			return true
+		}
+	}
+	return false
+}
+
+// AuthorizedApp is an app the user has granted access to, across every
+// grant they have given it.
+type AuthorizedApp struct {
+	ClientID     string    `json:"client_id"`
+	Name         string    `json:"name"`
+	Scopes       []string  `json:"scopes"`
+	AuthorizedAt time.Time `json:"authorized_at"`
+	LastUsedAt   time.Time `json:"last_used_at"`
+}
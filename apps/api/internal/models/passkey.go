@@ -0,0 +1,22 @@
+package models
+
+import "time"
+
+// Passkey is a WebAuthn credential registered to a user.
+type Passkey struct {
+	ID              int        `json:"id"`
+	UserID          int        `json:"-"`
+	Name            string     `json:"name"`
+	CredentialID    []byte     `json:"-"`
+	PublicKey       []byte     `json:"-"`
+	AttestationType string     `json:"-"`
+	Transports      []string   `json:"transports"`
+	AAGUID          []byte     `json:"-"`
+	SignCount       uint32     `json:"-"`
+	UserPresent     bool       `json:"-"`
+	UserVerified    bool       `json:"-"`
+	BackupEligible  bool       `json:"backup_eligible"`
+	BackupState     bool       `json:"backed_up"`
+	LastUsedAt      *time.Time `json:"last_used_at"`
+	CreatedAt       time.Time  `json:"created_at"`
+}
@@ -0,0 +1,44 @@
+package models
+
+import "time"
+
+// Security event types
+const (
+	SecurityEventLoginSucceeded      = "login_succeeded"
+	SecurityEventLoginFailed         = "login_failed"
+	SecurityEventTokenRefreshed      = "token_refreshed"
+	SecurityEventLogout              = "logout"
+	SecurityEventSessionRevoked      = "session_revoked"
+	SecurityEventLogoutAll           = "logout_all"
+	SecurityEventRefreshTokenReuse   = "refresh_token_reuse"
+	SecurityEventMFAEnabled          = "mfa_enabled"
+	SecurityEventMFADisabled         = "mfa_disabled"
+	SecurityEventRecoveryCodeUsed    = "recovery_code_used"
+	SecurityEventPasskeyAdded        = "passkey_added"
+	SecurityEventPasskeyRemoved      = "passkey_removed"
+	SecurityEventPasskeyCloned       = "passkey_clone_detected"
+	SecurityEventPasswordReset       = "password_reset"
+	SecurityEventPasswordChanged     = "password_changed"
+	SecurityEventEmailChanged        = "email_changed"
+	SecurityEventEmailVerified       = "email_verified"
+	SecurityEventIdentityLinked      = "identity_linked"
+	SecurityEventAccountLocked       = "account_locked"
+	SecurityEventAppAuthorized       = "app_authorized"
+	SecurityEventAppRevoked          = "app_revoked"
+	SecurityEventDeletionScheduled   = "deletion_scheduled"
+	SecurityEventDeletionCancelled   = "deletion_cancelled"
+	SecurityEventDataExportRequested = "data_export_requested"
+	SecurityEventAccountDisabled     = "account_disabled"
+	SecurityEventAccountEnabled      = "account_enabled"
+	SecurityEventResetRequested      = "password_reset_requested"
+)
+
+type SecurityEvent struct {
+	ID        int               `json:"id"`
+	UserID    int               `json:"user_id"`
+	Type      string            `json:"type"`
+	IPAddress string            `json:"ip_address,omitempty"`
+	UserAgent string            `json:"user_agent,omitempty"`
+	Metadata  map[string]string `json:"metadata,omitempty"`
+	CreatedAt time.Time         `json:"created_at"`
+}
@@ -0,0 +1,17 @@
+package models
+
+import "time"
+
+type GroupShare struct {
+	ID             int        `json:"id"`
+	GroupID        int        `json:"group_id"`
+	UserID         int        `json:"user_id"`
+	TokenHash      string     `json:"-"`
+	PasswordHash   string     `json:"-"`
+	HasPassword    bool       `json:"has_password"`
+	ExpiresAt      *time.Time `json:"expires_at"`
+	AccessCount    int        `json:"access_count"`
+	LastAccessedAt *time.Time `json:"last_accessed_at"`
+	RevokedAt      *time.Time `json:"revoked_at,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+}
@@ -0,0 +1,37 @@
+package models
+
+import "time"
+
+// Entities that take part in delta sync
+const (
+	SyncEntityGroup = "group"
+	SyncEntityTodo  = "todo"
+)
+
+// Outcomes of applying a client mutation
+const (
+	SyncStatusApplied  = "applied"
+	SyncStatusIgnored  = "ignored"
+	SyncStatusRejected = "rejected"
+)
+
+type SyncTombstone struct {
+	Entity    string    `json:"entity"`
+	ClientID  string    `json:"client_id"`
+	Cursor    int64     `json:"cursor"`
+	DeletedAt time.Time `json:"deleted_at"`
+}
+
+type SyncResult struct {
+	MutationID string `json:"id"`
+	Status     string `json:"status"`
+	Error      string `json:"error,omitempty"`
+}
+
+type SyncChanges struct {
+	Cursor     int64            `json:"cursor"`
+	HasMore    bool             `json:"has_more"`
+	Groups     []*Group         `json:"groups"`
+	Todos      []*Todo          `json:"todos"`
+	Tombstones []*SyncTombstone `json:"tombstones"`
+}
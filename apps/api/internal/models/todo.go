@@ -1,15 +1,26 @@
 package models
 
-import "time"
+import (
+	"database/sql"
+	"time"
+)
 
 type Todo struct {
-	ID          int       `json:"id"`
-	UserID      int       `json:"user_id"`
-	Title       string    `json:"title"`
-	Description string    `json:"description,omitempty"`
-	Completed   bool      `json:"completed"`
-	CreatedAt   time.Time `json:"created_at"`
-	UpdatedAt   time.Time `json:"updated_at"`
+	ID            int       `json:"id"`
+	UserID        int       `json:"user_id"`
+	GroupID       *int      `json:"group_id"`
+	ClientID      string    `json:"client_id"`
+	GroupClientID *string   `json:"group_client_id"`
+	Title         string    `json:"title"`
+	Description   string    `json:"description,omitempty"`
+	Completed     bool      `json:"completed"`
+	Version       int       `json:"version"`
+	CreatedAt     time.Time `json:"created_at"`
+	UpdatedAt     time.Time `json:"updated_at"`
+
+	// FieldClocks records when each synced field was last written, used for
+	// last-writer-wins merges in /sync
+	FieldClocks map[string]string `json:"-"`
 }
 
 type CreateTodoRequest struct {
@@ -22,3 +33,40 @@ type UpdateTodoRequest struct {
 	Description *string `json:"description,omitempty" validate:"omitempty,max=1000"`
 	Completed   *bool   `json:"completed,omitempty"`
 }
+
+func GetTodosByGroupID(db *sql.DB, groupID int) ([]*Todo, error) {
+	rows, err := db.Query(`
+		SELECT id, user_id, group_id, client_id, title, COALESCE(description, ''),
+			completed, version, created_at, updated_at
+		FROM todos
+		WHERE group_id = $1
+		ORDER BY created_at ASC, id ASC
+	`, groupID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	todos := []*Todo{}
+	for rows.Next() {
+		var todo Todo
+		err := rows.Scan(
+			&todo.ID,
+			&todo.UserID,
+			&todo.GroupID,
+			&todo.ClientID,
+			&todo.Title,
+			&todo.Description,
+			&todo.Completed,
+			&todo.Version,
+			&todo.CreatedAt,
+			&todo.UpdatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		todos = append(todos, &todo)
+	}
+
+	return todos, rows.Err()
+}
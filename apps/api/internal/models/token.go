@@ -0,0 +1,54 @@
+package models
+
+import "time"
+
+// TokenFamily is one login session. It is exposed to users as a session.
+// Families with a ClientID are grants to third-party apps instead, and are
+// listed as authorised apps rather than sessions.
+type TokenFamily struct {
+	ID            string     `json:"id"`
+	UserID        int        `json:"user_id"`
+	ClientID      string     `json:"-"`
+	Scopes        []string   `json:"-"`
+	UserAgent     string     `json:"user_agent"`
+	IPAddress     string     `json:"ip_address"`
+	LastUsedAt    time.Time  `json:"last_used_at"`
+	RevokedAt     *time.Time `json:"revoked_at,omitempty"`
+	RevokedReason string     `json:"revoked_reason,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+
+	// Current marks the session the listing request was made from
+	Current bool `json:"current"`
+}
+
+type RefreshToken struct {
+	ID        string
+	FamilyID  string
+	UserID    int
+	ParentID  *string
+	ExpiresAt time.Time
+	RotatedAt *time.Time
+	CreatedAt time.Time
+
+	// FamilyRevokedAt is set when the token's whole family has been revoked
+	FamilyRevokedAt *time.Time
+	// FamilyClientID and FamilyScopes describe the app the family was
+	// granted to, if any
+	FamilyClientID string
+	FamilyScopes   []string
+}
+
+// Reasons a token family is revoked
+const (
+	TokenFamilyRevokedLogout    = "logout"
+	TokenFamilyRevokedReuse     = "reuse_detected"
+	TokenFamilyRevokedByUser    = "session_revoked"
+	TokenFamilyRevokedLogoutAll = "logout_all"
+	TokenFamilyRevokedPassword  = "password_changed"
+	TokenFamilyRevokedDeletion  = "account_deleted"
+	// Reasons for OAuth grants: the user removed the app, the app revoked
+	// its own token, or the app's owner deleted it
+	TokenFamilyRevokedAppRemoved    = "app_removed"
+	TokenFamilyRevokedByClient      = "client_revoked"
+	TokenFamilyRevokedClientDeleted = "client_deleted"
+)
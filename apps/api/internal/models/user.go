@@ -3,10 +3,59 @@ package models
 import "time"
 
 type User struct {
-	ID           int       `json:"id"`
-	Email        string    `json:"email"`
-	PasswordHash string    `json:"-"` // Never expose password hash in JSON
-	Name         string    `json:"name"`
-	CreatedAt    time.Time `json:"created_at"`
-	UpdatedAt    time.Time `json:"updated_at"`
+	ID           int    `json:"id"`
+	Email        string `json:"email"`
+	PasswordHash string `json:"-"` // Never expose password hash in JSON
+	Name         string `json:"name"`
+	// EmailVerifiedAt is nil until the user follows a verification link
+	EmailVerifiedAt *time.Time      `json:"email_verified_at"`
+	Preferences     UserPreferences `json:"preferences"`
+	// DeletionScheduledAt is when the account will be erased, if the user
+	// asked for that and has not changed their mind
+	DeletionScheduledAt *time.Time `json:"deletion_scheduled_at,omitempty"`
+	Role                string     `json:"role"`
+	// DisabledAt is set while an admin has the account disabled
+	DisabledAt *time.Time `json:"disabled_at,omitempty"`
+	TokenEpoch int64      `json:"-"`
+	CreatedAt  time.Time  `json:"created_at"`
+	UpdatedAt  time.Time  `json:"updated_at"`
 }
+
+// Roles a user can have
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+)
+
+// UserUsage is a summary of how much an account uses the service, for
+// admins.
+type UserUsage struct {
+	Groups         int        `json:"groups"`
+	Todos          int        `json:"todos"`
+	CompletedTodos int        `json:"completed_todos"`
+	ShareLinks     int        `json:"share_links"`
+	ActiveSessions int        `json:"active_sessions"`
+	Passkeys       int        `json:"passkeys"`
+	APITokens      int        `json:"api_tokens"`
+	OAuthClients   int        `json:"oauth_clients"`
+	LastLoginAt    *time.Time `json:"last_login_at"`
+	LastActiveAt   *time.Time `json:"last_active_at"`
+}
+
+// UserPreferences are settings the apps apply for the user. Empty fields
+// mean the app's default.
+type UserPreferences struct {
+	// Theme is "system", "light" or "dark"
+	Theme string `json:"theme,omitempty"`
+	// Locale is a BCP 47 language tag such as en-US
+	Locale string `json:"locale,omitempty"`
+	// Timezone is an IANA time zone name such as Europe/Paris
+	Timezone string `json:"timezone,omitempty"`
+}
+
+// Themes a user can choose
+const (
+	ThemeSystem = "system"
+	ThemeLight  = "light"
+	ThemeDark   = "dark"
+)
@@ -0,0 +1,109 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/enkyuan/ato/api/internal/models"
+)
+
+type AccountTokenRepository interface {
+	Create(ctx context.Context, token *models.AccountToken) error
+	GetValid(ctx context.Context, purpose string, tokenHash string) (*models.AccountToken, error)
+	Consume(ctx context.Context, purpose string, tokenHash string) (*models.AccountToken, error)
+	InvalidateForUser(ctx context.Context, userID int, purpose string) error
+}
+
+type accountTokenRepository struct {
+	db *sql.DB
+}
+
+func NewAccountTokenRepository(db *sql.DB) AccountTokenRepository {
+	return &accountTokenRepository{db: db}
+}
+
+func (r *accountTokenRepository) Create(ctx context.Context, token *models.AccountToken) error {
+	query := `
+		INSERT INTO account_tokens (user_id, purpose, token_hash, email, expires_at)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, created_at
+	`
+
+	return r.db.QueryRowContext(ctx, query,
+		token.UserID,
+		token.Purpose,
+		token.TokenHash,
+		token.Email,
+		token.ExpiresAt,
+	).Scan(&token.ID, &token.CreatedAt)
+}
+
+// GetValid returns a token that can still be used, without using it. It
+// returns sql.ErrNoRows if the token does not exist, has expired or was
+// already used.
+func (r *accountTokenRepository) GetValid(ctx context.Context, purpose string, tokenHash string) (*models.AccountToken, error) {
+	query := `
+		SELECT id, user_id, purpose, token_hash, email, expires_at, used_at, created_at
+		FROM account_tokens
+		WHERE token_hash = $1 AND purpose = $2 AND used_at IS NULL AND expires_at > CURRENT_TIMESTAMP
+	`
+
+	token := &models.AccountToken{}
+	err := r.db.QueryRowContext(ctx, query, tokenHash, purpose).Scan(
+		&token.ID,
+		&token.UserID,
+		&token.Purpose,
+		&token.TokenHash,
+		&token.Email,
+		&token.ExpiresAt,
+		&token.UsedAt,
+		&token.CreatedAt,
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return token, nil
+}
+
+// Consume marks a token used and returns it. It returns sql.ErrNoRows if the
+// token does not exist, has expired or was already used, so two requests
+// racing with the same token cannot both succeed.
+func (r *accountTokenRepository) Consume(ctx context.Context, purpose string, tokenHash string) (*models.AccountToken, error) {
+	query := `
+		UPDATE account_tokens SET used_at = CURRENT_TIMESTAMP
+		WHERE token_hash = $1 AND purpose = $2 AND used_at IS NULL AND expires_at > CURRENT_TIMESTAMP
+		RETURNING id, user_id, purpose, token_hash, email, expires_at, used_at, created_at
+	`
+
+	token := &models.AccountToken{}
+	err := r.db.QueryRowContext(ctx, query, tokenHash, purpose).Scan(
+		&token.ID,
+		&token.UserID,
+		&token.Purpose,
+		&token.TokenHash,
+		&token.Email,
+		&token.ExpiresAt,
+		&token.UsedAt,
+		&token.CreatedAt,
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return token, nil
+}
+
+// InvalidateForUser spends every outstanding token of one purpose, e.g. all
+// reset links once the password has been reset.
+func (r *accountTokenRepository) InvalidateForUser(ctx context.Context, userID int, purpose string) error {
+	query := `
+		UPDATE account_tokens SET used_at = CURRENT_TIMESTAMP
+		WHERE user_id = $1 AND purpose = $2 AND used_at IS NULL
+	`
+
+	_, err := r.db.ExecContext(ctx, query, userID, purpose)
+	return err
+}
@@ -0,0 +1,114 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+
+	"github.com/enkyuan/ato/api/internal/models"
+)
+
+// AdminRepository answers questions about users in general, for the admin
+// API.
+type AdminRepository interface {
+	ListUsers(ctx context.Context, filter UserFilter) ([]*models.User, error)
+	GetUsage(ctx context.Context, userID int) (*models.UserUsage, error)
+}
+
+// UserFilter narrows the user list. Query matches part of the email or name.
+// Users come newest first; Before pages backwards from a user ID.
+type UserFilter struct {
+	Query    string
+	Role     string
+	Disabled *bool
+	Before   int
+	Limit    int
+}
+
+type adminRepository struct {
+	db *sql.DB
+}
+
+func NewAdminRepository(db *sql.DB) AdminRepository {
+	return &adminRepository{db: db}
+}
+
+func (r *adminRepository) ListUsers(ctx context.Context, filter UserFilter) ([]*models.User, error) {
+	query := `
+		SELECT ` + userColumns + `
+		FROM users
+		WHERE ($1 = '' OR email ILIKE $1 OR name ILIKE $1)
+			AND ($2 = '' OR role = $2)
+			AND ($3::boolean IS NULL OR (disabled_at IS NOT NULL) = $3)
+			AND ($4 = 0 OR id < $4)
+		ORDER BY id DESC
+		LIMIT $5
+	`
+
+	pattern := ""
+	if filter.Query != "" {
+		pattern = "%" + escapeLike(filter.Query) + "%"
+	}
+
+	rows, err := r.db.QueryContext(ctx, query, pattern, filter.Role, filter.Disabled, filter.Before, filter.Limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []*models.User{}
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+
+	return users, rows.Err()
+}
+
+func (r *adminRepository) GetUsage(ctx context.Context, userID int) (*models.UserUsage, error) {
+	query := `
+		SELECT
+			(SELECT COUNT(*) FROM groups WHERE user_id = $1),
+			(SELECT COUNT(*) FROM todos WHERE user_id = $1),
+			(SELECT COUNT(*) FROM todos WHERE user_id = $1 AND completed),
+			(SELECT COUNT(*) FROM group_shares WHERE user_id = $1 AND revoked_at IS NULL
+				AND (expires_at IS NULL OR expires_at > CURRENT_TIMESTAMP)),
+			(SELECT COUNT(*) FROM token_families f WHERE f.user_id = $1 AND f.revoked_at IS NULL AND EXISTS (
+				SELECT 1 FROM refresh_tokens t
+				WHERE t.family_id = f.id AND t.rotated_at IS NULL AND t.expires_at > CURRENT_TIMESTAMP
+			)),
+			(SELECT COUNT(*) FROM passkeys WHERE user_id = $1),
+			(SELECT COUNT(*) FROM api_tokens WHERE user_id = $1
+				AND (expires_at IS NULL OR expires_at > CURRENT_TIMESTAMP)),
+			(SELECT COUNT(*) FROM oauth_clients WHERE owner_id = $1),
+			(SELECT MAX(created_at) FROM security_events WHERE user_id = $1 AND type = $2),
+			(SELECT MAX(last_used_at) FROM token_families WHERE user_id = $1)
+	`
+
+	usage := &models.UserUsage{}
+	err := r.db.QueryRowContext(ctx, query, userID, models.SecurityEventLoginSucceeded).Scan(
+		&usage.Groups,
+		&usage.Todos,
+		&usage.CompletedTodos,
+		&usage.ShareLinks,
+		&usage.ActiveSessions,
+		&usage.Passkeys,
+		&usage.APITokens,
+		&usage.OAuthClients,
+		&usage.LastLoginAt,
+		&usage.LastActiveAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return usage, nil
+}
+
+// escapeLike makes s match literally inside a LIKE pattern.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
@@ -0,0 +1,154 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/enkyuan/ato/api/internal/models"
+	"github.com/lib/pq"
+)
+
+type APITokenRepository interface {
+	Create(ctx context.Context, token *models.APIToken) error
+	GetByHash(ctx context.Context, tokenHash string) (*models.APIToken, error)
+	ListByUser(ctx context.Context, userID int) ([]*models.APIToken, error)
+	RecordUse(ctx context.Context, id int, ip string) error
+	Delete(ctx context.Context, id int, userID int) (string, error)
+	DeleteAllForUser(ctx context.Context, userID int) ([]string, error)
+}
+
+type apiTokenRepository struct {
+	db *sql.DB
+}
+
+func NewAPITokenRepository(db *sql.DB) APITokenRepository {
+	return &apiTokenRepository{db: db}
+}
+
+const apiTokenColumns = `
+	id, user_id, name, token_hash, token_hint, scopes, expires_at, last_used_at, COALESCE(last_used_ip, ''), created_at
+`
+
+func scanAPIToken(row interface{ Scan(...interface{}) error }) (*models.APIToken, error) {
+	token := &models.APIToken{}
+	var scopes pq.StringArray
+	err := row.Scan(
+		&token.ID,
+		&token.UserID,
+		&token.Name,
+		&token.TokenHash,
+		&token.TokenHint,
+		&scopes,
+		&token.ExpiresAt,
+		&token.LastUsedAt,
+		&token.LastUsedIP,
+		&token.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	token.Scopes = []string(scopes)
+	return token, nil
+}
+
+func (r *apiTokenRepository) Create(ctx context.Context, token *models.APIToken) error {
+	query := `
+		INSERT INTO api_tokens (user_id, name, token_hash, token_hint, scopes, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id, created_at
+	`
+
+	return r.db.QueryRowContext(ctx, query,
+		token.UserID,
+		token.Name,
+		token.TokenHash,
+		token.TokenHint,
+		pq.StringArray(token.Scopes),
+		token.ExpiresAt,
+	).Scan(&token.ID, &token.CreatedAt)
+}
+
+func (r *apiTokenRepository) GetByHash(ctx context.Context, tokenHash string) (*models.APIToken, error) {
+	query := `
+		SELECT ` + apiTokenColumns + `
+		FROM api_tokens
+		WHERE token_hash = $1
+	`
+
+	return scanAPIToken(r.db.QueryRowContext(ctx, query, tokenHash))
+}
+
+func (r *apiTokenRepository) ListByUser(ctx context.Context, userID int) ([]*models.APIToken, error) {
+	query := `
+		SELECT ` + apiTokenColumns + `
+		FROM api_tokens
+		WHERE user_id = $1
+		ORDER BY created_at DESC
+	`
+
+	rows, err := r.db.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokens := []*models.APIToken{}
+	for rows.Next() {
+		token, err := scanAPIToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, token)
+	}
+
+	return tokens, rows.Err()
+}
+
+func (r *apiTokenRepository) RecordUse(ctx context.Context, id int, ip string) error {
+	query := `
+		UPDATE api_tokens SET last_used_at = CURRENT_TIMESTAMP, last_used_ip = NULLIF($2, '')
+		WHERE id = $1
+	`
+
+	_, err := r.db.ExecContext(ctx, query, id, ip)
+	return err
+}
+
+// Delete revokes one of the user's tokens and returns its hash. It returns
+// sql.ErrNoRows if the user has no such token.
+func (r *apiTokenRepository) Delete(ctx context.Context, id int, userID int) (string, error) {
+	query := `
+		DELETE FROM api_tokens WHERE id = $1 AND user_id = $2
+		RETURNING token_hash
+	`
+
+	var tokenHash string
+	err := r.db.QueryRowContext(ctx, query, id, userID).Scan(&tokenHash)
+	return tokenHash, err
+}
+
+// DeleteAllForUser revokes every token the user has and returns their hashes.
+func (r *apiTokenRepository) DeleteAllForUser(ctx context.Context, userID int) ([]string, error) {
+	query := `
+		DELETE FROM api_tokens WHERE user_id = $1
+		RETURNING token_hash
+	`
+
+	rows, err := r.db.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	hashes := []string{}
+	for rows.Next() {
+		var tokenHash string
+		if err := rows.Scan(&tokenHash); err != nil {
+			return nil, err
+		}
+		hashes = append(hashes, tokenHash)
+	}
+
+	return hashes, rows.Err()
+}
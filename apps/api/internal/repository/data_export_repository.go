@@ -0,0 +1,254 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"github.com/enkyuan/ato/api/internal/models"
+)
+
+type DataExportRepository interface {
+	Create(ctx context.Context, userID int) (*models.DataExport, error)
+	GetLatest(ctx context.Context, userID int) (*models.DataExport, error)
+	ListByUser(ctx context.Context, userID int) ([]*models.DataExport, error)
+	GetArchive(ctx context.Context, id int, userID int) (*models.DataExport, error)
+	Complete(ctx context.Context, id int, archive []byte, expiresAt time.Time) error
+	Fail(ctx context.Context, id int) error
+	DeleteExpired(ctx context.Context) (int64, error)
+	CollectUserData(ctx context.Context, userID int) (map[string]json.RawMessage, error)
+}
+
+type dataExportRepository struct {
+	db *sql.DB
+}
+
+func NewDataExportRepository(db *sql.DB) DataExportRepository {
+	return &dataExportRepository{db: db}
+}
+
+const dataExportColumns = `
+	id, user_id, status, COALESCE(octet_length(archive), 0), completed_at, expires_at, created_at
+`
+
+func scanDataExport(row interface{ Scan(...interface{}) error }) (*models.DataExport, error) {
+	export := &models.DataExport{}
+	err := row.Scan(
+		&export.ID,
+		&export.UserID,
+		&export.Status,
+		&export.Size,
+		&export.CompletedAt,
+		&export.ExpiresAt,
+		&export.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return export, nil
+}
+
+func (r *dataExportRepository) Create(ctx context.Context, userID int) (*models.DataExport, error) {
+	query := `
+		INSERT INTO data_exports (user_id, status)
+		VALUES ($1, $2)
+		RETURNING ` + dataExportColumns
+
+	return scanDataExport(r.db.QueryRowContext(ctx, query, userID, models.DataExportPending))
+}
+
+func (r *dataExportRepository) GetLatest(ctx context.Context, userID int) (*models.DataExport, error) {
+	query := `
+		SELECT ` + dataExportColumns + `
+		FROM data_exports
+		WHERE user_id = $1
+		ORDER BY created_at DESC
+		LIMIT 1
+	`
+
+	return scanDataExport(r.db.QueryRowContext(ctx, query, userID))
+}
+
+// ListByUser returns the user's exports that can still be downloaded or are
+// being built, newest first.
+func (r *dataExportRepository) ListByUser(ctx context.Context, userID int) ([]*models.DataExport, error) {
+	query := `
+		SELECT ` + dataExportColumns + `
+		FROM data_exports
+		WHERE user_id = $1 AND (expires_at IS NULL OR expires_at > CURRENT_TIMESTAMP)
+		ORDER BY created_at DESC
+	`
+
+	rows, err := r.db.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	exports := []*models.DataExport{}
+	for rows.Next() {
+		export, err := scanDataExport(rows)
+		if err != nil {
+			return nil, err
+		}
+		exports = append(exports, export)
+	}
+
+	return exports, rows.Err()
+}
+
+// GetArchive loads a finished export with its archive. It returns
+// sql.ErrNoRows if the user has no such export ready to download.
+func (r *dataExportRepository) GetArchive(ctx context.Context, id int, userID int) (*models.DataExport, error) {
+	query := `
+		SELECT ` + dataExportColumns + `, archive
+		FROM data_exports
+		WHERE id = $1 AND user_id = $2 AND status = $3 AND expires_at > CURRENT_TIMESTAMP
+	`
+
+	export := &models.DataExport{}
+	err := r.db.QueryRowContext(ctx, query, id, userID, models.DataExportReady).Scan(
+		&export.ID,
+		&export.UserID,
+		&export.Status,
+		&export.Size,
+		&export.CompletedAt,
+		&export.ExpiresAt,
+		&export.CreatedAt,
+		&export.Archive,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return export, nil
+}
+
+func (r *dataExportRepository) Complete(ctx context.Context, id int, archive []byte, expiresAt time.Time) error {
+	query := `
+		UPDATE data_exports SET status = $2, archive = $3, completed_at = CURRENT_TIMESTAMP, expires_at = $4
+		WHERE id = $1
+	`
+
+	_, err := r.db.ExecContext(ctx, query, id, models.DataExportReady, archive, expiresAt)
+	return err
+}
+
+func (r *dataExportRepository) Fail(ctx context.Context, id int) error {
+	query := `
+		UPDATE data_exports SET status = $2, completed_at = CURRENT_TIMESTAMP
+		WHERE id = $1
+	`
+
+	_, err := r.db.ExecContext(ctx, query, id, models.DataExportFailed)
+	return err
+}
+
+// DeleteExpired removes exports past their download window, and failed ones
+// older than a day.
+func (r *dataExportRepository) DeleteExpired(ctx context.Context) (int64, error) {
+	query := `
+		DELETE FROM data_exports
+		WHERE expires_at <= CURRENT_TIMESTAMP
+			OR (status = $1 AND created_at < CURRENT_TIMESTAMP - INTERVAL '1 day')
+	`
+
+	result, err := r.db.ExecContext(ctx, query, models.DataExportFailed)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+// userDataSections are the parts of a data export, each a query for one
+// kind of data by user ID. Columns are listed explicitly so secrets such as
+// password and token hashes never end up in an export.
+var userDataSections = []struct {
+	name  string
+	query string
+}{
+	{"groups", `
+		SELECT id, client_id, name, position, created_at, updated_at
+		FROM groups WHERE user_id = $1 ORDER BY position, id
+	`},
+	{"todos", `
+		SELECT t.id, t.client_id, t.group_id, g.name AS group_name, t.title,
+			t.description, t.completed, t.created_at, t.updated_at
+		FROM todos t LEFT JOIN groups g ON g.id = t.group_id
+		WHERE t.user_id = $1 ORDER BY t.created_at, t.id
+	`},
+	{"share_links", `
+		SELECT id, group_id, password_hash IS NOT NULL AS password_protected,
+			expires_at, access_count, last_accessed_at, revoked_at, created_at
+		FROM group_shares WHERE user_id = $1 ORDER BY created_at, id
+	`},
+	{"sessions", `
+		SELECT f.id, c.name AS app, f.scopes, f.user_agent, f.ip_address,
+			f.last_used_at, f.revoked_at, f.revoked_reason, f.created_at
+		FROM token_families f LEFT JOIN oauth_clients c ON c.id = f.client_id
+		WHERE f.user_id = $1 ORDER BY f.created_at, f.id
+	`},
+	{"security_events", `
+		SELECT id, type, ip_address, user_agent, metadata, created_at
+		FROM security_events WHERE user_id = $1 ORDER BY created_at, id
+	`},
+	{"passkeys", `
+		SELECT id, name, last_used_at, created_at
+		FROM passkeys WHERE user_id = $1 ORDER BY created_at, id
+	`},
+	{"identities", `
+		SELECT provider, email, last_login_at, created_at
+		FROM user_identities WHERE user_id = $1 ORDER BY created_at, id
+	`},
+	{"api_tokens", `
+		SELECT id, name, token_hint, scopes, expires_at, last_used_at, last_used_ip, created_at
+		FROM api_tokens WHERE user_id = $1 ORDER BY created_at, id
+	`},
+	{"oauth_clients", `
+		SELECT id AS client_id, name, redirect_uris, secret_hash IS NULL AS public, created_at
+		FROM oauth_clients WHERE owner_id = $1 ORDER BY created_at, id
+	`},
+}
+
+// CollectUserData returns everything stored about a user as JSON, keyed by
+// section: "account" is an object and every other section an array. It reads
+// from one snapshot so the sections agree with each other.
+func (r *dataExportRepository) CollectUserData(ctx context.Context, userID int) (map[string]json.RawMessage, error) {
+	tx, err := r.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	data := make(map[string]json.RawMessage, len(userDataSections)+1)
+
+	var account []byte
+	err = tx.QueryRowContext(ctx, `
+		SELECT row_to_json(u) FROM (
+			SELECT id, email, name, email_verified_at, password_hash IS NOT NULL AS has_password,
+				EXISTS (
+					SELECT 1 FROM totp_credentials t WHERE t.user_id = users.id AND t.confirmed_at IS NOT NULL
+				) AS two_factor_enabled,
+				preferences, deletion_scheduled_at, role, disabled_at, created_at, updated_at
+			FROM users WHERE id = $1
+		) u
+	`, userID).Scan(&account)
+	if err != nil {
+		return nil, err
+	}
+	data["account"] = account
+
+	for _, section := range userDataSections {
+		var rows []byte
+		err := tx.QueryRowContext(ctx, `SELECT COALESCE(json_agg(s), '[]') FROM (`+section.query+`) s`, userID).Scan(&rows)
+		if err != nil {
+			return nil, err
+		}
+		data[section.name] = rows
+	}
+
+	return data, nil
+}
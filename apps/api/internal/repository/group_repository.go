@@ -10,9 +10,10 @@ import (
 type GroupRepository interface {
 	Create(ctx context.Context, userID int, name string) (*models.Group, error)
 	GetByUserID(ctx context.Context, userID int) ([]*models.Group, error)
-	UpdateName(ctx context.Context, groupID int, userID int, name string) error
-	UpdatePosition(ctx context.Context, groupID int, position int) error
-	Delete(ctx context.Context, groupID int, userID int) error
+	GetByID(ctx context.Context, groupID int, userID int) (*models.Group, error)
+	UpdateName(ctx context.Context, groupID int, userID int, name string, ifMatch []int64) (*models.Group, error)
+	UpdatePosition(ctx context.Context, groupID int, userID int, position int, ifMatch []int64) (*models.Group, error)
+	Delete(ctx context.Context, groupID int, userID int, ifMatch []int64) error
 }
 
 type groupRepository struct {
@@ -31,14 +32,18 @@ func (r *groupRepository) GetByUserID(ctx context.Context, userID int) ([]*model
 	return models.GetGroupsByUserID(r.db, userID)
 }
 
-func (r *groupRepository) UpdateName(ctx context.Context, groupID int, userID int, name string) error {
-	return models.UpdateGroupName(r.db, groupID, userID, name)
+func (r *groupRepository) GetByID(ctx context.Context, groupID int, userID int) (*models.Group, error) {
+	return models.GetGroupByID(r.db, groupID, userID)
 }
 
-func (r *groupRepository) UpdatePosition(ctx context.Context, groupID int, position int) error {
-	return models.UpdateGroupPosition(r.db, groupID, position)
+func (r *groupRepository) UpdateName(ctx context.Context, groupID int, userID int, name string, ifMatch []int64) (*models.Group, error) {
+	return models.UpdateGroupName(r.db, groupID, userID, name, ifMatch)
 }
 
-func (r *groupRepository) Delete(ctx context.Context, groupID int, userID int) error {
-	return models.DeleteGroup(r.db, groupID, userID)
+func (r *groupRepository) UpdatePosition(ctx context.Context, groupID int, userID int, position int, ifMatch []int64) (*models.Group, error) {
+	return models.UpdateGroupPosition(r.db, groupID, userID, position, ifMatch)
+}
+
+func (r *groupRepository) Delete(ctx context.Context, groupID int, userID int, ifMatch []int64) error {
+	return models.DeleteGroup(r.db, groupID, userID, ifMatch)
 }
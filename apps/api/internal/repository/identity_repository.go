@@ -0,0 +1,72 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/enkyuan/ato/api/internal/models"
+)
+
+type IdentityRepository interface {
+	GetByProviderSubject(ctx context.Context, provider string, subject string) (*models.UserIdentity, error)
+	Create(ctx context.Context, identity *models.UserIdentity) error
+	RecordLogin(ctx context.Context, id int, email string) error
+}
+
+type identityRepository struct {
+	db *sql.DB
+}
+
+func NewIdentityRepository(db *sql.DB) IdentityRepository {
+	return &identityRepository{db: db}
+}
+
+func (r *identityRepository) GetByProviderSubject(ctx context.Context, provider string, subject string) (*models.UserIdentity, error) {
+	query := `
+		SELECT id, user_id, provider, subject, COALESCE(email, ''), last_login_at, created_at
+		FROM user_identities
+		WHERE provider = $1 AND subject = $2
+	`
+
+	identity := &models.UserIdentity{}
+	err := r.db.QueryRowContext(ctx, query, provider, subject).Scan(
+		&identity.ID,
+		&identity.UserID,
+		&identity.Provider,
+		&identity.Subject,
+		&identity.Email,
+		&identity.LastLoginAt,
+		&identity.CreatedAt,
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return identity, nil
+}
+
+func (r *identityRepository) Create(ctx context.Context, identity *models.UserIdentity) error {
+	query := `
+		INSERT INTO user_identities (user_id, provider, subject, email)
+		VALUES ($1, $2, $3, NULLIF($4, ''))
+		RETURNING id, last_login_at, created_at
+	`
+
+	return r.db.QueryRowContext(ctx, query,
+		identity.UserID,
+		identity.Provider,
+		identity.Subject,
+		identity.Email,
+	).Scan(&identity.ID, &identity.LastLoginAt, &identity.CreatedAt)
+}
+
+func (r *identityRepository) RecordLogin(ctx context.Context, id int, email string) error {
+	query := `
+		UPDATE user_identities SET last_login_at = CURRENT_TIMESTAMP, email = NULLIF($2, '')
+		WHERE id = $1
+	`
+
+	_, err := r.db.ExecContext(ctx, query, id, email)
+	return err
+}
@@ -0,0 +1,177 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/enkyuan/ato/api/internal/models"
+)
+
+type MFARepository interface {
+	GetTOTP(ctx context.Context, userID int) (*models.TOTPCredential, error)
+	SaveTOTPEnrollment(ctx context.Context, userID int, secret string) error
+	ConfirmTOTP(ctx context.Context, userID int, step int64, recoveryCodeHashes []string) error
+	UseTOTPStep(ctx context.Context, userID int, step int64) (bool, error)
+	UseRecoveryCode(ctx context.Context, userID int, codeHash string) (bool, error)
+	DeleteTOTP(ctx context.Context, userID int) error
+}
+
+type mfaRepository struct {
+	db *sql.DB
+}
+
+func NewMFARepository(db *sql.DB) MFARepository {
+	return &mfaRepository{db: db}
+}
+
+func (r *mfaRepository) GetTOTP(ctx context.Context, userID int) (*models.TOTPCredential, error) {
+	query := `
+		SELECT user_id, secret, last_used_step, confirmed_at, created_at
+		FROM totp_credentials
+		WHERE user_id = $1
+	`
+
+	credential := &models.TOTPCredential{}
+	err := r.db.QueryRowContext(ctx, query, userID).Scan(
+		&credential.UserID,
+		&credential.Secret,
+		&credential.LastUsedStep,
+		&credential.ConfirmedAt,
+		&credential.CreatedAt,
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return credential, nil
+}
+
+// SaveTOTPEnrollment stores a new, unconfirmed secret, replacing any earlier
+// enrolment that was never confirmed. It returns sql.ErrNoRows if 2FA is
+// already enabled.
+func (r *mfaRepository) SaveTOTPEnrollment(ctx context.Context, userID int, secret string) error {
+	query := `
+		INSERT INTO totp_credentials (user_id, secret)
+		VALUES ($1, $2)
+		ON CONFLICT (user_id) DO UPDATE
+		SET secret = EXCLUDED.secret, last_used_step = 0, created_at = CURRENT_TIMESTAMP
+		WHERE totp_credentials.confirmed_at IS NULL
+	`
+
+	result, err := r.db.ExecContext(ctx, query, userID, secret)
+	if err != nil {
+		return err
+	}
+
+	saved, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if saved == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+// ConfirmTOTP enables 2FA and replaces the user's recovery codes in one
+// transaction, so 2FA is never on without codes to fall back on.
+func (r *mfaRepository) ConfirmTOTP(ctx context.Context, userID int, step int64, recoveryCodeHashes []string) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, `
+		UPDATE totp_credentials SET confirmed_at = CURRENT_TIMESTAMP, last_used_step = $2
+		WHERE user_id = $1 AND confirmed_at IS NULL
+	`, userID, step)
+	if err != nil {
+		return err
+	}
+
+	confirmed, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if confirmed == 0 {
+		return sql.ErrNoRows
+	}
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM recovery_codes WHERE user_id = $1`, userID); err != nil {
+		return err
+	}
+
+	for _, hash := range recoveryCodeHashes {
+		_, err := tx.ExecContext(ctx, `
+			INSERT INTO recovery_codes (user_id, code_hash) VALUES ($1, $2)
+		`, userID, hash)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// UseTOTPStep records that a code for the given time step was accepted. It
+// returns false if that step, or a later one, was already used.
+func (r *mfaRepository) UseTOTPStep(ctx context.Context, userID int, step int64) (bool, error) {
+	query := `
+		UPDATE totp_credentials SET last_used_step = $2
+		WHERE user_id = $1 AND confirmed_at IS NOT NULL AND last_used_step < $2
+	`
+
+	result, err := r.db.ExecContext(ctx, query, userID, step)
+	if err != nil {
+		return false, err
+	}
+
+	used, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return used > 0, nil
+}
+
+// UseRecoveryCode spends a recovery code, returning false if it does not
+// exist or was already used.
+func (r *mfaRepository) UseRecoveryCode(ctx context.Context, userID int, codeHash string) (bool, error) {
+	query := `
+		UPDATE recovery_codes SET used_at = CURRENT_TIMESTAMP
+		WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL
+	`
+
+	result, err := r.db.ExecContext(ctx, query, userID, codeHash)
+	if err != nil {
+		return false, err
+	}
+
+	used, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return used > 0, nil
+}
+
+func (r *mfaRepository) DeleteTOTP(ctx context.Context, userID int) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM totp_credentials WHERE user_id = $1`, userID); err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM recovery_codes WHERE user_id = $1`, userID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,123 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/enkyuan/ato/api/internal/models"
+	"github.com/lib/pq"
+)
+
+type OAuthClientRepository interface {
+	Create(ctx context.Context, client *models.OAuthClient) error
+	GetByID(ctx context.Context, id string) (*models.OAuthClient, error)
+	ListByOwner(ctx context.Context, ownerID int) ([]*models.OAuthClient, error)
+	Delete(ctx context.Context, id string, ownerID int) error
+}
+
+type oauthClientRepository struct {
+	db *sql.DB
+}
+
+func NewOAuthClientRepository(db *sql.DB) OAuthClientRepository {
+	return &oauthClientRepository{db: db}
+}
+
+const oauthClientColumns = `
+	id, owner_id, name, COALESCE(secret_hash, ''), redirect_uris, created_at
+`
+
+func scanOAuthClient(row interface{ Scan(...interface{}) error }) (*models.OAuthClient, error) {
+	client := &models.OAuthClient{}
+	var redirectURIs pq.StringArray
+	err := row.Scan(
+		&client.ID,
+		&client.OwnerID,
+		&client.Name,
+		&client.SecretHash,
+		&redirectURIs,
+		&client.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	client.RedirectURIs = []string(redirectURIs)
+	client.Public = client.SecretHash == ""
+	return client, nil
+}
+
+func (r *oauthClientRepository) Create(ctx context.Context, client *models.OAuthClient) error {
+	query := `
+		INSERT INTO oauth_clients (id, owner_id, name, secret_hash, redirect_uris)
+		VALUES ($1, $2, $3, NULLIF($4, ''), $5)
+		RETURNING created_at
+	`
+
+	return r.db.QueryRowContext(ctx, query,
+		client.ID,
+		client.OwnerID,
+		client.Name,
+		client.SecretHash,
+		pq.StringArray(client.RedirectURIs),
+	).Scan(&client.CreatedAt)
+}
+
+func (r *oauthClientRepository) GetByID(ctx context.Context, id string) (*models.OAuthClient, error) {
+	query := `
+		SELECT ` + oauthClientColumns + `
+		FROM oauth_clients
+		WHERE id = $1
+	`
+
+	return scanOAuthClient(r.db.QueryRowContext(ctx, query, id))
+}
+
+func (r *oauthClientRepository) ListByOwner(ctx context.Context, ownerID int) ([]*models.OAuthClient, error) {
+	query := `
+		SELECT ` + oauthClientColumns + `
+		FROM oauth_clients
+		WHERE owner_id = $1
+		ORDER BY created_at DESC
+	`
+
+	rows, err := r.db.QueryContext(ctx, query, ownerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	clients := []*models.OAuthClient{}
+	for rows.Next() {
+		client, err := scanOAuthClient(rows)
+		if err != nil {
+			return nil, err
+		}
+		clients = append(clients, client)
+	}
+
+	return clients, rows.Err()
+}
+
+// Delete removes one of the owner's clients, along with every grant to it.
+// It returns sql.ErrNoRows if the owner has no such client.
+func (r *oauthClientRepository) Delete(ctx context.Context, id string, ownerID int) error {
+	query := `
+		DELETE FROM oauth_clients WHERE id = $1 AND owner_id = $2
+	`
+
+	result, err := r.db.ExecContext(ctx, query, id, ownerID)
+	if err != nil {
+		return err
+	}
+
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
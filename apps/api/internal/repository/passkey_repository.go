@@ -0,0 +1,185 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/enkyuan/ato/api/internal/models"
+	"github.com/lib/pq"
+)
+
+type PasskeyRepository interface {
+	EnsureUserHandle(ctx context.Context, userID int, candidate []byte) ([]byte, error)
+	GetUserIDByHandle(ctx context.Context, handle []byte) (int, error)
+	Create(ctx context.Context, passkey *models.Passkey) error
+	ListByUser(ctx context.Context, userID int) ([]*models.Passkey, error)
+	RecordUse(ctx context.Context, id int, signCount uint32, backupState bool) error
+	Rename(ctx context.Context, id int, userID int, name string) (*models.Passkey, error)
+	Delete(ctx context.Context, id int, userID int) error
+}
+
+type passkeyRepository struct {
+	db *sql.DB
+}
+
+func NewPasskeyRepository(db *sql.DB) PasskeyRepository {
+	return &passkeyRepository{db: db}
+}
+
+const passkeyColumns = `
+	id, user_id, name, credential_id, public_key, attestation_type, transports, aaguid,
+	sign_count, user_present, user_verified, backup_eligible, backup_state, last_used_at, created_at
+`
+
+func scanPasskey(row interface{ Scan(...interface{}) error }) (*models.Passkey, error) {
+	passkey := &models.Passkey{}
+	var transports pq.StringArray
+	var signCount int64
+	err := row.Scan(
+		&passkey.ID,
+		&passkey.UserID,
+		&passkey.Name,
+		&passkey.CredentialID,
+		&passkey.PublicKey,
+		&passkey.AttestationType,
+		&transports,
+		&passkey.AAGUID,
+		&signCount,
+		&passkey.UserPresent,
+		&passkey.UserVerified,
+		&passkey.BackupEligible,
+		&passkey.BackupState,
+		&passkey.LastUsedAt,
+		&passkey.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	passkey.Transports = []string(transports)
+	passkey.SignCount = uint32(signCount)
+	return passkey, nil
+}
+
+// EnsureUserHandle returns the user's WebAuthn handle, storing candidate as
+// the handle if they do not have one yet.
+func (r *passkeyRepository) EnsureUserHandle(ctx context.Context, userID int, candidate []byte) ([]byte, error) {
+	// Only write when the handle is missing, so logins do not touch the row
+	query := `
+		WITH created AS (
+			UPDATE users SET webauthn_handle = $2
+			WHERE id = $1 AND webauthn_handle IS NULL
+			RETURNING webauthn_handle
+		)
+		SELECT webauthn_handle FROM created
+		UNION ALL
+		SELECT webauthn_handle FROM users WHERE id = $1 AND webauthn_handle IS NOT NULL
+	`
+
+	var handle []byte
+	err := r.db.QueryRowContext(ctx, query, userID, candidate).Scan(&handle)
+	return handle, err
+}
+
+func (r *passkeyRepository) GetUserIDByHandle(ctx context.Context, handle []byte) (int, error) {
+	query := `
+		SELECT id FROM users WHERE webauthn_handle = $1
+	`
+
+	var userID int
+	err := r.db.QueryRowContext(ctx, query, handle).Scan(&userID)
+	return userID, err
+}
+
+func (r *passkeyRepository) Create(ctx context.Context, passkey *models.Passkey) error {
+	query := `
+		INSERT INTO passkeys (user_id, name, credential_id, public_key, attestation_type, transports,
+			aaguid, sign_count, user_present, user_verified, backup_eligible, backup_state)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+		RETURNING id, created_at
+	`
+
+	return r.db.QueryRowContext(ctx, query,
+		passkey.UserID,
+		passkey.Name,
+		passkey.CredentialID,
+		passkey.PublicKey,
+		passkey.AttestationType,
+		pq.StringArray(passkey.Transports),
+		passkey.AAGUID,
+		int64(passkey.SignCount),
+		passkey.UserPresent,
+		passkey.UserVerified,
+		passkey.BackupEligible,
+		passkey.BackupState,
+	).Scan(&passkey.ID, &passkey.CreatedAt)
+}
+
+func (r *passkeyRepository) ListByUser(ctx context.Context, userID int) ([]*models.Passkey, error) {
+	query := `
+		SELECT ` + passkeyColumns + `
+		FROM passkeys
+		WHERE user_id = $1
+		ORDER BY created_at ASC
+	`
+
+	rows, err := r.db.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	passkeys := []*models.Passkey{}
+	for rows.Next() {
+		passkey, err := scanPasskey(rows)
+		if err != nil {
+			return nil, err
+		}
+		passkeys = append(passkeys, passkey)
+	}
+
+	return passkeys, rows.Err()
+}
+
+// RecordUse stores the counters from a successful login.
+func (r *passkeyRepository) RecordUse(ctx context.Context, id int, signCount uint32, backupState bool) error {
+	query := `
+		UPDATE passkeys SET sign_count = $2, backup_state = $3, last_used_at = CURRENT_TIMESTAMP
+		WHERE id = $1
+	`
+
+	_, err := r.db.ExecContext(ctx, query, id, int64(signCount), backupState)
+	return err
+}
+
+func (r *passkeyRepository) Rename(ctx context.Context, id int, userID int, name string) (*models.Passkey, error) {
+	query := `
+		UPDATE passkeys SET name = $3
+		WHERE id = $1 AND user_id = $2
+		RETURNING ` + passkeyColumns
+
+	return scanPasskey(r.db.QueryRowContext(ctx, query, id, userID, name))
+}
+
+// Delete removes one of the user's passkeys, returning sql.ErrNoRows if the
+// user has no such passkey.
+func (r *passkeyRepository) Delete(ctx context.Context, id int, userID int) error {
+	query := `
+		DELETE FROM passkeys WHERE id = $1 AND user_id = $2
+	`
+
+	result, err := r.db.ExecContext(ctx, query, id, userID)
+	if err != nil {
+		return err
+	}
+
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
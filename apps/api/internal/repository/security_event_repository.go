@@ -0,0 +1,118 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+
+	"github.com/enkyuan/ato/api/internal/models"
+	"github.com/lib/pq"
+)
+
+type SecurityEventRepository interface {
+	Create(ctx context.Context, event *models.SecurityEvent) error
+	ListByUser(ctx context.Context, userID int, filter SecurityEventFilter) ([]*models.SecurityEvent, error)
+	DeviceSeen(ctx context.Context, userID int, device string) (seen bool, anyLogins bool, err error)
+}
+
+// SecurityEventFilter narrows a user's event log. Events come newest first;
+// Before pages backwards from an event ID.
+type SecurityEventFilter struct {
+	Types  []string
+	Before int
+	Limit  int
+}
+
+type securityEventRepository struct {
+	db *sql.DB
+}
+
+func NewSecurityEventRepository(db *sql.DB) SecurityEventRepository {
+	return &securityEventRepository{db: db}
+}
+
+func (r *securityEventRepository) Create(ctx context.Context, event *models.SecurityEvent) error {
+	metadata, err := json.Marshal(event.Metadata)
+	if err != nil {
+		return err
+	}
+	if event.Metadata == nil {
+		metadata = []byte("{}")
+	}
+
+	query := `
+		INSERT INTO security_events (user_id, type, ip_address, user_agent, metadata)
+		VALUES ($1, $2, NULLIF($3, ''), NULLIF($4, ''), $5)
+		RETURNING id, created_at
+	`
+
+	return r.db.QueryRowContext(ctx, query,
+		event.UserID,
+		event.Type,
+		event.IPAddress,
+		event.UserAgent,
+		metadata,
+	).Scan(&event.ID, &event.CreatedAt)
+}
+
+func (r *securityEventRepository) ListByUser(ctx context.Context, userID int, filter SecurityEventFilter) ([]*models.SecurityEvent, error) {
+	query := `
+		SELECT id, user_id, type, COALESCE(ip_address, ''), COALESCE(user_agent, ''), metadata, created_at
+		FROM security_events
+		WHERE user_id = $1
+			AND (COALESCE(cardinality($2::text[]), 0) = 0 OR type = ANY($2))
+			AND ($3 = 0 OR id < $3)
+		ORDER BY id DESC
+		LIMIT $4
+	`
+
+	rows, err := r.db.QueryContext(ctx, query, userID, pq.Array(filter.Types), filter.Before, filter.Limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []*models.SecurityEvent{}
+	for rows.Next() {
+		event := &models.SecurityEvent{}
+		var metadata []byte
+		err := rows.Scan(
+			&event.ID,
+			&event.UserID,
+			&event.Type,
+			&event.IPAddress,
+			&event.UserAgent,
+			&metadata,
+			&event.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(metadata, &event.Metadata); err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+
+	return events, rows.Err()
+}
+
+// DeviceSeen reports whether the user has logged in before from device, and
+// whether they have logged in before at all.
+func (r *securityEventRepository) DeviceSeen(ctx context.Context, userID int, device string) (bool, bool, error) {
+	query := `
+		SELECT
+			EXISTS (
+				SELECT 1 FROM security_events
+				WHERE user_id = $1 AND type = $2 AND metadata->>'device' = $3
+			),
+			EXISTS (
+				SELECT 1 FROM security_events
+				WHERE user_id = $1 AND type = $2
+			)
+	`
+
+	var seen, anyLogins bool
+	err := r.db.QueryRowContext(ctx, query, userID, models.SecurityEventLoginSucceeded, device).Scan(&seen, &anyLogins)
+	return seen, anyLogins, err
+}
@@ -0,0 +1,145 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/enkyuan/ato/api/internal/models"
+)
+
+type ShareRepository interface {
+	Create(ctx context.Context, share *models.GroupShare) error
+	GetByTokenHash(ctx context.Context, tokenHash string) (*models.GroupShare, error)
+	ListByGroupID(ctx context.Context, groupID int, userID int) ([]*models.GroupShare, error)
+	Revoke(ctx context.Context, shareID int, groupID int, userID int) error
+	RecordAccess(ctx context.Context, shareID int) error
+	GetTodosByGroupID(ctx context.Context, groupID int) ([]*models.Todo, error)
+}
+
+type shareRepository struct {
+	db *sql.DB
+}
+
+func NewShareRepository(db *sql.DB) ShareRepository {
+	return &shareRepository{db: db}
+}
+
+func (r *shareRepository) Create(ctx context.Context, share *models.GroupShare) error {
+	query := `
+		INSERT INTO group_shares (group_id, user_id, token_hash, password_hash, expires_at)
+		VALUES ($1, $2, $3, NULLIF($4, ''), $5)
+		RETURNING id, created_at
+	`
+
+	return r.db.QueryRowContext(ctx, query,
+		share.GroupID,
+		share.UserID,
+		share.TokenHash,
+		share.PasswordHash,
+		share.ExpiresAt,
+	).Scan(&share.ID, &share.CreatedAt)
+}
+
+func (r *shareRepository) GetByTokenHash(ctx context.Context, tokenHash string) (*models.GroupShare, error) {
+	query := `
+		SELECT id, group_id, user_id, token_hash, COALESCE(password_hash, ''), expires_at,
+			access_count, last_accessed_at, revoked_at, created_at
+		FROM group_shares
+		WHERE token_hash = $1
+	`
+
+	share := &models.GroupShare{}
+	err := r.db.QueryRowContext(ctx, query, tokenHash).Scan(
+		&share.ID,
+		&share.GroupID,
+		&share.UserID,
+		&share.TokenHash,
+		&share.PasswordHash,
+		&share.ExpiresAt,
+		&share.AccessCount,
+		&share.LastAccessedAt,
+		&share.RevokedAt,
+		&share.CreatedAt,
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	share.HasPassword = share.PasswordHash != ""
+	return share, nil
+}
+
+func (r *shareRepository) ListByGroupID(ctx context.Context, groupID int, userID int) ([]*models.GroupShare, error) {
+	query := `
+		SELECT id, group_id, user_id, password_hash IS NOT NULL, expires_at,
+			access_count, last_accessed_at, created_at
+		FROM group_shares
+		WHERE group_id = $1 AND user_id = $2 AND revoked_at IS NULL
+		ORDER BY created_at DESC
+	`
+
+	rows, err := r.db.QueryContext(ctx, query, groupID, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	shares := []*models.GroupShare{}
+	for rows.Next() {
+		share := &models.GroupShare{}
+		err := rows.Scan(
+			&share.ID,
+			&share.GroupID,
+			&share.UserID,
+			&share.HasPassword,
+			&share.ExpiresAt,
+			&share.AccessCount,
+			&share.LastAccessedAt,
+			&share.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		shares = append(shares, share)
+	}
+
+	return shares, rows.Err()
+}
+
+func (r *shareRepository) Revoke(ctx context.Context, shareID int, groupID int, userID int) error {
+	query := `
+		UPDATE group_shares SET revoked_at = CURRENT_TIMESTAMP
+		WHERE id = $1 AND group_id = $2 AND user_id = $3 AND revoked_at IS NULL
+	`
+
+	result, err := r.db.ExecContext(ctx, query, shareID, groupID, userID)
+	if err != nil {
+		return err
+	}
+
+	revoked, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if revoked == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+func (r *shareRepository) RecordAccess(ctx context.Context, shareID int) error {
+	query := `
+		UPDATE group_shares
+		SET access_count = access_count + 1, last_accessed_at = CURRENT_TIMESTAMP
+		WHERE id = $1
+	`
+
+	_, err := r.db.ExecContext(ctx, query, shareID)
+	return err
+}
+
+func (r *shareRepository) GetTodosByGroupID(ctx context.Context, groupID int) ([]*models.Todo, error) {
+	return models.GetTodosByGroupID(r.db, groupID)
+}
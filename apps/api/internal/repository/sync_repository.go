@@ -0,0 +1,452 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+
+	"github.com/enkyuan/ato/api/internal/models"
+)
+
+// SyncTx is the set of operations a sync mutation may perform. All of them
+// run inside the transaction opened by SyncRepository.Apply.
+type SyncTx interface {
+	GetGroup(ctx context.Context, userID int, clientID string) (*models.Group, error)
+	GetTodo(ctx context.Context, userID int, clientID string) (*models.Todo, error)
+	IsDeleted(ctx context.Context, userID int, entity string, clientID string) (bool, error)
+	NextGroupPosition(ctx context.Context, userID int) (int, error)
+	InsertGroup(ctx context.Context, group *models.Group) error
+	UpdateGroup(ctx context.Context, group *models.Group) error
+	InsertTodo(ctx context.Context, todo *models.Todo) error
+	UpdateTodo(ctx context.Context, todo *models.Todo) error
+	Delete(ctx context.Context, userID int, entity string, clientID string) error
+}
+
+type SyncRepository interface {
+	// Apply runs fn in a transaction and records its result under
+	// mutationID. If the mutation was applied before, fn is not called and
+	// the recorded result is returned instead.
+	Apply(ctx context.Context, userID int, mutationID string, fn func(tx SyncTx) (*models.SyncResult, error)) (*models.SyncResult, error)
+	Changes(ctx context.Context, userID int, since int64, limit int) (*models.SyncChanges, error)
+}
+
+type syncRepository struct {
+	db *sql.DB
+}
+
+func NewSyncRepository(db *sql.DB) SyncRepository {
+	return &syncRepository{db: db}
+}
+
+var syncTables = map[string]string{
+	models.SyncEntityGroup: "groups",
+	models.SyncEntityTodo:  "todos",
+}
+
+func (r *syncRepository) Apply(ctx context.Context, userID int, mutationID string, fn func(tx SyncTx) (*models.SyncResult, error)) (*models.SyncResult, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// Claiming the mutation ID first makes a concurrent replay wait for us
+	res, err := tx.ExecContext(ctx, `
+		INSERT INTO sync_mutations (user_id, mutation_id, status)
+		VALUES ($1, $2, 'pending')
+		ON CONFLICT (user_id, mutation_id) DO NOTHING
+	`, userID, mutationID)
+	if err != nil {
+		return nil, err
+	}
+
+	claimed, err := res.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+
+	if claimed == 0 {
+		result := &models.SyncResult{MutationID: mutationID}
+		var errMessage sql.NullString
+		err := tx.QueryRowContext(ctx, `
+			SELECT status, error FROM sync_mutations WHERE user_id = $1 AND mutation_id = $2
+		`, userID, mutationID).Scan(&result.Status, &errMessage)
+		if err != nil {
+			return nil, err
+		}
+		result.Error = errMessage.String
+		return result, nil
+	}
+
+	result, err := fn(&syncTx{tx: tx})
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		UPDATE sync_mutations SET status = $1, error = NULLIF($2, '')
+		WHERE user_id = $3 AND mutation_id = $4
+	`, result.Status, result.Error, userID, mutationID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+func (r *syncRepository) Changes(ctx context.Context, userID int, since int64, limit int) (*models.SyncChanges, error) {
+	// One snapshot for the cursor and the rows, so nothing committed in
+	// between can be skipped by the cursor we hand back
+	tx, err := r.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	changes := &models.SyncChanges{
+		Groups:     []*models.Group{},
+		Todos:      []*models.Todo{},
+		Tombstones: []*models.SyncTombstone{},
+	}
+
+	err = tx.QueryRowContext(ctx, `
+		SELECT COALESCE((SELECT cursor FROM sync_cursors WHERE user_id = $1), 0)
+	`, userID).Scan(&changes.Cursor)
+	if err != nil {
+		return nil, err
+	}
+
+	if since >= changes.Cursor {
+		changes.Cursor = since
+		return changes, nil
+	}
+
+	// Cursors are unique per user, so the (limit+1)-th change marks where
+	// this page has to stop
+	var next int64
+	err = tx.QueryRowContext(ctx, `
+		SELECT sync_cursor FROM (
+			SELECT sync_cursor FROM groups WHERE user_id = $1 AND sync_cursor > $2
+			UNION ALL
+			SELECT sync_cursor FROM todos WHERE user_id = $1 AND sync_cursor > $2
+			UNION ALL
+			SELECT sync_cursor FROM sync_tombstones WHERE user_id = $1 AND sync_cursor > $2
+		) changes
+		ORDER BY sync_cursor
+		OFFSET $3 LIMIT 1
+	`, userID, since, limit).Scan(&next)
+	switch {
+	case err == sql.ErrNoRows:
+	case err != nil:
+		return nil, err
+	default:
+		changes.Cursor = next - 1
+		changes.HasMore = true
+	}
+
+	if changes.Groups, err = r.changedGroups(ctx, tx, userID, since, changes.Cursor); err != nil {
+		return nil, err
+	}
+	if changes.Todos, err = r.changedTodos(ctx, tx, userID, since, changes.Cursor); err != nil {
+		return nil, err
+	}
+	if changes.Tombstones, err = r.tombstones(ctx, tx, userID, since, changes.Cursor); err != nil {
+		return nil, err
+	}
+
+	return changes, nil
+}
+
+func (r *syncRepository) changedGroups(ctx context.Context, tx *sql.Tx, userID int, since int64, until int64) ([]*models.Group, error) {
+	rows, err := tx.QueryContext(ctx, `
+		SELECT id, user_id, client_id, name, position, version, created_at, updated_at
+		FROM groups
+		WHERE user_id = $1 AND sync_cursor > $2 AND sync_cursor <= $3
+		ORDER BY sync_cursor ASC
+	`, userID, since, until)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	groups := []*models.Group{}
+	for rows.Next() {
+		var group models.Group
+		err := rows.Scan(
+			&group.ID,
+			&group.UserID,
+			&group.ClientID,
+			&group.Name,
+			&group.Position,
+			&group.Version,
+			&group.CreatedAt,
+			&group.UpdatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		groups = append(groups, &group)
+	}
+
+	return groups, rows.Err()
+}
+
+func (r *syncRepository) changedTodos(ctx context.Context, tx *sql.Tx, userID int, since int64, until int64) ([]*models.Todo, error) {
+	rows, err := tx.QueryContext(ctx, `
+		SELECT t.id, t.user_id, t.group_id, t.client_id, g.client_id, t.title,
+			COALESCE(t.description, ''), t.completed, t.version, t.created_at, t.updated_at
+		FROM todos t
+		LEFT JOIN groups g ON g.id = t.group_id
+		WHERE t.user_id = $1 AND t.sync_cursor > $2 AND t.sync_cursor <= $3
+		ORDER BY t.sync_cursor ASC
+	`, userID, since, until)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	todos := []*models.Todo{}
+	for rows.Next() {
+		var todo models.Todo
+		err := rows.Scan(
+			&todo.ID,
+			&todo.UserID,
+			&todo.GroupID,
+			&todo.ClientID,
+			&todo.GroupClientID,
+			&todo.Title,
+			&todo.Description,
+			&todo.Completed,
+			&todo.Version,
+			&todo.CreatedAt,
+			&todo.UpdatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		todos = append(todos, &todo)
+	}
+
+	return todos, rows.Err()
+}
+
+func (r *syncRepository) tombstones(ctx context.Context, tx *sql.Tx, userID int, since int64, until int64) ([]*models.SyncTombstone, error) {
+	rows, err := tx.QueryContext(ctx, `
+		SELECT entity, client_id, sync_cursor, deleted_at
+		FROM sync_tombstones
+		WHERE user_id = $1 AND sync_cursor > $2 AND sync_cursor <= $3
+		ORDER BY sync_cursor ASC
+	`, userID, since, until)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tombstones := []*models.SyncTombstone{}
+	for rows.Next() {
+		var tombstone models.SyncTombstone
+		err := rows.Scan(
+			&tombstone.Entity,
+			&tombstone.ClientID,
+			&tombstone.Cursor,
+			&tombstone.DeletedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		tombstones = append(tombstones, &tombstone)
+	}
+
+	return tombstones, rows.Err()
+}
+
+type syncTx struct {
+	tx *sql.Tx
+}
+
+func (t *syncTx) GetGroup(ctx context.Context, userID int, clientID string) (*models.Group, error) {
+	var group models.Group
+	var clocks []byte
+	err := t.tx.QueryRowContext(ctx, `
+		SELECT id, user_id, client_id, name, position, version, field_clocks, created_at, updated_at
+		FROM groups
+		WHERE user_id = $1 AND client_id = $2
+		FOR UPDATE
+	`, userID, clientID).Scan(
+		&group.ID,
+		&group.UserID,
+		&group.ClientID,
+		&group.Name,
+		&group.Position,
+		&group.Version,
+		&clocks,
+		&group.CreatedAt,
+		&group.UpdatedAt,
+	)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(clocks, &group.FieldClocks); err != nil {
+		return nil, fmt.Errorf("invalid field clocks: %w", err)
+	}
+
+	return &group, nil
+}
+
+func (t *syncTx) GetTodo(ctx context.Context, userID int, clientID string) (*models.Todo, error) {
+	var todo models.Todo
+	var clocks []byte
+	err := t.tx.QueryRowContext(ctx, `
+		SELECT t.id, t.user_id, t.group_id, t.client_id, g.client_id, t.title,
+			COALESCE(t.description, ''), t.completed, t.version, t.field_clocks, t.created_at, t.updated_at
+		FROM todos t
+		LEFT JOIN groups g ON g.id = t.group_id
+		WHERE t.user_id = $1 AND t.client_id = $2
+		FOR UPDATE OF t
+	`, userID, clientID).Scan(
+		&todo.ID,
+		&todo.UserID,
+		&todo.GroupID,
+		&todo.ClientID,
+		&todo.GroupClientID,
+		&todo.Title,
+		&todo.Description,
+		&todo.Completed,
+		&todo.Version,
+		&clocks,
+		&todo.CreatedAt,
+		&todo.UpdatedAt,
+	)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(clocks, &todo.FieldClocks); err != nil {
+		return nil, fmt.Errorf("invalid field clocks: %w", err)
+	}
+
+	return &todo, nil
+}
+
+func (t *syncTx) IsDeleted(ctx context.Context, userID int, entity string, clientID string) (bool, error) {
+	var deleted bool
+	err := t.tx.QueryRowContext(ctx, `
+		SELECT EXISTS (
+			SELECT 1 FROM sync_tombstones WHERE user_id = $1 AND entity = $2 AND client_id = $3
+		)
+	`, userID, entity, clientID).Scan(&deleted)
+	return deleted, err
+}
+
+func (t *syncTx) NextGroupPosition(ctx context.Context, userID int) (int, error) {
+	var position int
+	err := t.tx.QueryRowContext(ctx, `
+		SELECT COALESCE(MAX(position), -1) + 1 FROM groups WHERE user_id = $1
+	`, userID).Scan(&position)
+	return position, err
+}
+
+func (t *syncTx) InsertGroup(ctx context.Context, group *models.Group) error {
+	clocks, err := json.Marshal(group.FieldClocks)
+	if err != nil {
+		return err
+	}
+
+	return t.tx.QueryRowContext(ctx, `
+		INSERT INTO groups (user_id, client_id, name, position, field_clocks)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, version, created_at, updated_at
+	`, group.UserID, group.ClientID, group.Name, group.Position, clocks).Scan(
+		&group.ID,
+		&group.Version,
+		&group.CreatedAt,
+		&group.UpdatedAt,
+	)
+}
+
+func (t *syncTx) UpdateGroup(ctx context.Context, group *models.Group) error {
+	clocks, err := json.Marshal(group.FieldClocks)
+	if err != nil {
+		return err
+	}
+
+	_, err = t.tx.ExecContext(ctx, `
+		UPDATE groups SET name = $1, position = $2, field_clocks = $3 WHERE id = $4
+	`, group.Name, group.Position, clocks, group.ID)
+	return err
+}
+
+func (t *syncTx) InsertTodo(ctx context.Context, todo *models.Todo) error {
+	clocks, err := json.Marshal(todo.FieldClocks)
+	if err != nil {
+		return err
+	}
+
+	return t.tx.QueryRowContext(ctx, `
+		INSERT INTO todos (user_id, group_id, client_id, title, description, completed, field_clocks)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING id, version, created_at, updated_at
+	`, todo.UserID, todo.GroupID, todo.ClientID, todo.Title, todo.Description, todo.Completed, clocks).Scan(
+		&todo.ID,
+		&todo.Version,
+		&todo.CreatedAt,
+		&todo.UpdatedAt,
+	)
+}
+
+func (t *syncTx) UpdateTodo(ctx context.Context, todo *models.Todo) error {
+	clocks, err := json.Marshal(todo.FieldClocks)
+	if err != nil {
+		return err
+	}
+
+	_, err = t.tx.ExecContext(ctx, `
+		UPDATE todos SET group_id = $1, title = $2, description = $3, completed = $4, field_clocks = $5
+		WHERE id = $6
+	`, todo.GroupID, todo.Title, todo.Description, todo.Completed, clocks, todo.ID)
+	return err
+}
+
+// Delete removes a synced row, leaving a tombstone through the delete
+// trigger. Deleting a row the server never saw still records a tombstone so
+// a late upsert from another device cannot resurrect it.
+func (t *syncTx) Delete(ctx context.Context, userID int, entity string, clientID string) error {
+	table, ok := syncTables[entity]
+	if !ok {
+		return fmt.Errorf("unknown sync entity %q", entity)
+	}
+
+	res, err := t.tx.ExecContext(ctx, fmt.Sprintf(`
+		DELETE FROM %s WHERE user_id = $1 AND client_id = $2
+	`, table), userID, clientID)
+	if err != nil {
+		return err
+	}
+
+	deleted, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if deleted == 0 {
+		_, err = t.tx.ExecContext(ctx, `
+			INSERT INTO sync_tombstones (user_id, entity, client_id, sync_cursor)
+			VALUES ($1, $2, $3, next_sync_cursor($1))
+			ON CONFLICT (user_id, entity, client_id) DO NOTHING
+		`, userID, entity, clientID)
+	}
+
+	return err
+}
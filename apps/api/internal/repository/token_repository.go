@@ -0,0 +1,363 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/enkyuan/ato/api/internal/models"
+	"github.com/lib/pq"
+)
+
+type TokenRepository interface {
+	CreateFamily(ctx context.Context, family *models.TokenFamily) error
+	GetFamily(ctx context.Context, familyID string) (*models.TokenFamily, error)
+	ListActiveFamilies(ctx context.Context, userID int) ([]*models.TokenFamily, error)
+	TouchFamily(ctx context.Context, familyID string) error
+	RevokeFamily(ctx context.Context, familyID string, reason string) error
+	RevokeUserFamily(ctx context.Context, familyID string, userID int, reason string) error
+	RevokeAllFamilies(ctx context.Context, userID int, reason string) ([]string, error)
+	RevokeOtherFamilies(ctx context.Context, userID int, keepFamilyID string, reason string) ([]string, error)
+	ListAuthorizedApps(ctx context.Context, userID int) ([]*models.AuthorizedApp, error)
+	RevokeAppFamilies(ctx context.Context, userID int, clientID string, reason string) ([]string, error)
+	RevokeClientFamilies(ctx context.Context, clientID string, reason string) ([]string, error)
+	CreateRefreshToken(ctx context.Context, token *models.RefreshToken) error
+	GetRefreshToken(ctx context.Context, id string) (*models.RefreshToken, error)
+	RotateRefreshToken(ctx context.Context, id string, next *models.RefreshToken) (bool, error)
+}
+
+type tokenRepository struct {
+	db *sql.DB
+}
+
+func NewTokenRepository(db *sql.DB) TokenRepository {
+	return &tokenRepository{db: db}
+}
+
+func (r *tokenRepository) CreateFamily(ctx context.Context, family *models.TokenFamily) error {
+	query := `
+		INSERT INTO token_families (user_id, user_agent, ip_address, client_id, scopes)
+		VALUES ($1, NULLIF($2, ''), NULLIF($3, ''), NULLIF($4, ''), $5)
+		RETURNING id, last_used_at, created_at
+	`
+
+	return r.db.QueryRowContext(ctx, query,
+		family.UserID,
+		family.UserAgent,
+		family.IPAddress,
+		family.ClientID,
+		pq.StringArray(family.Scopes),
+	).Scan(
+		&family.ID,
+		&family.LastUsedAt,
+		&family.CreatedAt,
+	)
+}
+
+func (r *tokenRepository) GetFamily(ctx context.Context, familyID string) (*models.TokenFamily, error) {
+	query := `
+		SELECT id, user_id, COALESCE(client_id, ''), scopes, COALESCE(user_agent, ''),
+			COALESCE(ip_address, ''), last_used_at, revoked_at, COALESCE(revoked_reason, ''), created_at
+		FROM token_families
+		WHERE id = $1
+	`
+
+	family := &models.TokenFamily{}
+	var scopes pq.StringArray
+	err := r.db.QueryRowContext(ctx, query, familyID).Scan(
+		&family.ID,
+		&family.UserID,
+		&family.ClientID,
+		&scopes,
+		&family.UserAgent,
+		&family.IPAddress,
+		&family.LastUsedAt,
+		&family.RevokedAt,
+		&family.RevokedReason,
+		&family.CreatedAt,
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	family.Scopes = []string(scopes)
+	return family, nil
+}
+
+// ListActiveFamilies returns the user's sessions that are not revoked and
+// still hold an unused, unexpired refresh token. Grants to apps are left out.
+func (r *tokenRepository) ListActiveFamilies(ctx context.Context, userID int) ([]*models.TokenFamily, error) {
+	query := `
+		SELECT f.id, f.user_id, COALESCE(f.user_agent, ''), COALESCE(f.ip_address, ''),
+			f.last_used_at, f.created_at
+		FROM token_families f
+		WHERE f.user_id = $1 AND f.client_id IS NULL AND f.revoked_at IS NULL AND EXISTS (
+			SELECT 1 FROM refresh_tokens t
+			WHERE t.family_id = f.id AND t.rotated_at IS NULL AND t.expires_at > CURRENT_TIMESTAMP
+		)
+		ORDER BY f.last_used_at DESC
+	`
+
+	rows, err := r.db.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	families := []*models.TokenFamily{}
+	for rows.Next() {
+		family := &models.TokenFamily{}
+		err := rows.Scan(
+			&family.ID,
+			&family.UserID,
+			&family.UserAgent,
+			&family.IPAddress,
+			&family.LastUsedAt,
+			&family.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		families = append(families, family)
+	}
+
+	return families, rows.Err()
+}
+
+func (r *tokenRepository) TouchFamily(ctx context.Context, familyID string) error {
+	query := `
+		UPDATE token_families SET last_used_at = CURRENT_TIMESTAMP WHERE id = $1
+	`
+
+	_, err := r.db.ExecContext(ctx, query, familyID)
+	return err
+}
+
+func (r *tokenRepository) RevokeFamily(ctx context.Context, familyID string, reason string) error {
+	query := `
+		UPDATE token_families SET revoked_at = CURRENT_TIMESTAMP, revoked_reason = $2
+		WHERE id = $1 AND revoked_at IS NULL
+	`
+
+	_, err := r.db.ExecContext(ctx, query, familyID, reason)
+	return err
+}
+
+// RevokeUserFamily revokes one of the user's sessions, returning
+// sql.ErrNoRows if the user has no such active session.
+func (r *tokenRepository) RevokeUserFamily(ctx context.Context, familyID string, userID int, reason string) error {
+	query := `
+		UPDATE token_families SET revoked_at = CURRENT_TIMESTAMP, revoked_reason = $3
+		WHERE id = $1 AND user_id = $2 AND client_id IS NULL AND revoked_at IS NULL
+	`
+
+	result, err := r.db.ExecContext(ctx, query, familyID, userID, reason)
+	if err != nil {
+		return err
+	}
+
+	revoked, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if revoked == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+func (r *tokenRepository) RevokeAllFamilies(ctx context.Context, userID int, reason string) ([]string, error) {
+	query := `
+		UPDATE token_families SET revoked_at = CURRENT_TIMESTAMP, revoked_reason = $2
+		WHERE user_id = $1 AND revoked_at IS NULL
+		RETURNING id
+	`
+
+	return r.revokeFamilies(ctx, query, userID, reason)
+}
+
+// RevokeOtherFamilies revokes every session and app grant of the user's but
+// one.
+func (r *tokenRepository) RevokeOtherFamilies(ctx context.Context, userID int, keepFamilyID string, reason string) ([]string, error) {
+	query := `
+		UPDATE token_families SET revoked_at = CURRENT_TIMESTAMP, revoked_reason = $3
+		WHERE user_id = $1 AND id <> $2 AND revoked_at IS NULL
+		RETURNING id
+	`
+
+	return r.revokeFamilies(ctx, query, userID, keepFamilyID, reason)
+}
+
+// ListAuthorizedApps returns the apps holding a live grant from the user,
+// merging the scopes of every grant to the same app.
+func (r *tokenRepository) ListAuthorizedApps(ctx context.Context, userID int) ([]*models.AuthorizedApp, error) {
+	query := `
+		SELECT c.id, c.name, array_agg(DISTINCT s.scope ORDER BY s.scope),
+			MIN(f.created_at), MAX(f.last_used_at)
+		FROM token_families f
+		JOIN oauth_clients c ON c.id = f.client_id
+		CROSS JOIN LATERAL unnest(f.scopes) AS s(scope)
+		WHERE f.user_id = $1 AND f.revoked_at IS NULL AND EXISTS (
+			SELECT 1 FROM refresh_tokens t
+			WHERE t.family_id = f.id AND t.rotated_at IS NULL AND t.expires_at > CURRENT_TIMESTAMP
+		)
+		GROUP BY c.id, c.name
+		ORDER BY MAX(f.last_used_at) DESC
+	`
+
+	rows, err := r.db.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	apps := []*models.AuthorizedApp{}
+	for rows.Next() {
+		app := &models.AuthorizedApp{}
+		var scopes pq.StringArray
+		err := rows.Scan(
+			&app.ClientID,
+			&app.Name,
+			&scopes,
+			&app.AuthorizedAt,
+			&app.LastUsedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		app.Scopes = []string(scopes)
+		apps = append(apps, app)
+	}
+
+	return apps, rows.Err()
+}
+
+// RevokeAppFamilies revokes every grant the user has given an app.
+func (r *tokenRepository) RevokeAppFamilies(ctx context.Context, userID int, clientID string, reason string) ([]string, error) {
+	query := `
+		UPDATE token_families SET revoked_at = CURRENT_TIMESTAMP, revoked_reason = $3
+		WHERE user_id = $1 AND client_id = $2 AND revoked_at IS NULL
+		RETURNING id
+	`
+
+	return r.revokeFamilies(ctx, query, userID, clientID, reason)
+}
+
+// RevokeClientFamilies revokes every grant to an app, from any user.
+func (r *tokenRepository) RevokeClientFamilies(ctx context.Context, clientID string, reason string) ([]string, error) {
+	query := `
+		UPDATE token_families SET revoked_at = CURRENT_TIMESTAMP, revoked_reason = $2
+		WHERE client_id = $1 AND revoked_at IS NULL
+		RETURNING id
+	`
+
+	return r.revokeFamilies(ctx, query, clientID, reason)
+}
+
+// revokeFamilies runs an UPDATE ... RETURNING id and collects the ids of the
+// families it revoked.
+func (r *tokenRepository) revokeFamilies(ctx context.Context, query string, args ...interface{}) ([]string, error) {
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := []string{}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, rows.Err()
+}
+
+func (r *tokenRepository) CreateRefreshToken(ctx context.Context, token *models.RefreshToken) error {
+	query := `
+		INSERT INTO refresh_tokens (id, family_id, user_id, parent_id, expires_at)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING created_at
+	`
+
+	return r.db.QueryRowContext(ctx, query,
+		token.ID,
+		token.FamilyID,
+		token.UserID,
+		token.ParentID,
+		token.ExpiresAt,
+	).Scan(&token.CreatedAt)
+}
+
+func (r *tokenRepository) GetRefreshToken(ctx context.Context, id string) (*models.RefreshToken, error) {
+	query := `
+		SELECT t.id, t.family_id, t.user_id, t.parent_id, t.expires_at, t.rotated_at, t.created_at,
+			f.revoked_at, COALESCE(f.client_id, ''), f.scopes
+		FROM refresh_tokens t
+		JOIN token_families f ON f.id = t.family_id
+		WHERE t.id = $1
+	`
+
+	token := &models.RefreshToken{}
+	var scopes pq.StringArray
+	err := r.db.QueryRowContext(ctx, query, id).Scan(
+		&token.ID,
+		&token.FamilyID,
+		&token.UserID,
+		&token.ParentID,
+		&token.ExpiresAt,
+		&token.RotatedAt,
+		&token.CreatedAt,
+		&token.FamilyRevokedAt,
+		&token.FamilyClientID,
+		&scopes,
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	token.FamilyScopes = []string(scopes)
+	return token, nil
+}
+
+// RotateRefreshToken marks a refresh token as used and stores the token that
+// replaces it, in one transaction. It reports false, storing nothing, if the
+// token had already been rotated, which means it is being replayed.
+func (r *tokenRepository) RotateRefreshToken(ctx context.Context, id string, next *models.RefreshToken) (bool, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, `
+		UPDATE refresh_tokens SET rotated_at = CURRENT_TIMESTAMP
+		WHERE id = $1 AND rotated_at IS NULL
+	`, id)
+	if err != nil {
+		return false, err
+	}
+
+	rotated, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	if rotated == 0 {
+		return false, nil
+	}
+
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO refresh_tokens (id, family_id, user_id, parent_id, expires_at)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING created_at
+	`, next.ID, next.FamilyID, next.UserID, next.ParentID, next.ExpiresAt).Scan(&next.CreatedAt)
+	if err != nil {
+		return false, err
+	}
+
+	return true, tx.Commit()
+}
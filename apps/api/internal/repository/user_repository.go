@@ -2,14 +2,34 @@ package repository
 
 import (
 	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
 
 	"github.com/enkyuan/ato/api/internal/models"
+	"github.com/lib/pq"
 )
 
+// uniqueViolation is the Postgres error code for a duplicate unique key
+const uniqueViolation = "23505"
+
 type UserRepository interface {
 	Create(email, passwordHash, name string) (*models.User, error)
+	CreateExternal(email, name string) (*models.User, error)
 	GetByEmail(email string) (*models.User, error)
 	GetByID(id int) (*models.User, error)
+	GetTokenEpoch(id int) (int64, error)
+	IncrementTokenEpoch(id int) (int64, error)
+	UpdatePassword(id int, passwordHash string) error
+	UpgradePasswordHash(id int, oldHash, newHash string) error
+	MarkEmailVerified(id int, email string) (bool, error)
+	UpdateProfile(id int, name string, preferences models.UserPreferences) (*models.User, error)
+	UpdateEmail(id int, email string) error
+	ScheduleDeletion(id int, at time.Time) error
+	CancelDeletion(id int) (bool, error)
+	ListDueForDeletion(limit int) ([]*models.User, error)
+	DeleteIfDue(id int) error
+	SetDisabled(id int, disabled bool) (*models.User, error)
 }
 
 type userRepository struct {
@@ -20,11 +40,18 @@ func NewUserRepository(db *sql.DB) UserRepository {
 	return &userRepository{db: db}
 }
 
+// IsUniqueViolation reports whether err is Postgres refusing a row that
+// would duplicate a unique key, such as an email that is already in use.
+func IsUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == uniqueViolation
+}
+
 func (r *userRepository) Create(email, passwordHash, name string) (*models.User, error) {
 	query := `
 		INSERT INTO users (email, password_hash, name)
 		VALUES ($1, $2, $3)
-		RETURNING id, email, name, created_at, updated_at
+		RETURNING id, email, name, role, created_at, updated_at
 	`
 
 	user := &models.User{}
@@ -32,6 +59,7 @@ func (r *userRepository) Create(email, passwordHash, name string) (*models.User,
 		&user.ID,
 		&user.Email,
 		&user.Name,
+		&user.Role,
 		&user.CreatedAt,
 		&user.UpdatedAt,
 	)
@@ -43,19 +71,22 @@ func (r *userRepository) Create(email, passwordHash, name string) (*models.User,
 	return user, nil
 }
 
-func (r *userRepository) GetByEmail(email string) (*models.User, error) {
+// CreateExternal creates a user who signs in through an identity provider
+// and so has no password. The provider has already verified the email.
+func (r *userRepository) CreateExternal(email, name string) (*models.User, error) {
 	query := `
-		SELECT id, email, password_hash, name, created_at, updated_at
-		FROM users
-		WHERE email = $1
+		INSERT INTO users (email, name, email_verified_at)
+		VALUES ($1, $2, CURRENT_TIMESTAMP)
+		RETURNING id, email, name, email_verified_at, role, created_at, updated_at
 	`
 
 	user := &models.User{}
-	err := r.db.QueryRow(query, email).Scan(
+	err := r.db.QueryRow(query, email, name).Scan(
 		&user.ID,
 		&user.Email,
-		&user.PasswordHash,
 		&user.Name,
+		&user.EmailVerifiedAt,
+		&user.Role,
 		&user.CreatedAt,
 		&user.UpdatedAt,
 	)
@@ -67,26 +98,269 @@ func (r *userRepository) GetByEmail(email string) (*models.User, error) {
 	return user, nil
 }
 
-func (r *userRepository) GetByID(id int) (*models.User, error) {
-	query := `
-		SELECT id, email, password_hash, name, created_at, updated_at
-		FROM users
-		WHERE id = $1
-	`
+const userColumns = `
+	id, email, COALESCE(password_hash, ''), name, email_verified_at, preferences, deletion_scheduled_at, role, disabled_at, token_epoch, created_at, updated_at
+`
 
+func scanUser(row interface{ Scan(...interface{}) error }) (*models.User, error) {
 	user := &models.User{}
-	err := r.db.QueryRow(query, id).Scan(
+	var preferences []byte
+	err := row.Scan(
 		&user.ID,
 		&user.Email,
 		&user.PasswordHash,
 		&user.Name,
+		&user.EmailVerifiedAt,
+		&preferences,
+		&user.DeletionScheduledAt,
+		&user.Role,
+		&user.DisabledAt,
+		&user.TokenEpoch,
 		&user.CreatedAt,
 		&user.UpdatedAt,
 	)
-
 	if err != nil {
 		return nil, err
 	}
 
+	if err := json.Unmarshal(preferences, &user.Preferences); err != nil {
+		return nil, err
+	}
+
 	return user, nil
 }
+
+// GetByEmail finds a user by email, ignoring case. Emails are stored
+// lowercased, and a unique index on lower(email) keeps addresses that differ
+// only in case from being separate accounts.
+func (r *userRepository) GetByEmail(email string) (*models.User, error) {
+	query := `
+		SELECT ` + userColumns + `
+		FROM users
+		WHERE lower(email) = lower($1)
+	`
+
+	return scanUser(r.db.QueryRow(query, email))
+}
+
+func (r *userRepository) GetByID(id int) (*models.User, error) {
+	query := `
+		SELECT ` + userColumns + `
+		FROM users
+		WHERE id = $1
+	`
+
+	return scanUser(r.db.QueryRow(query, id))
+}
+
+func (r *userRepository) GetTokenEpoch(id int) (int64, error) {
+	query := `
+		SELECT token_epoch FROM users WHERE id = $1
+	`
+
+	var epoch int64
+	err := r.db.QueryRow(query, id).Scan(&epoch)
+	return epoch, err
+}
+
+// IncrementTokenEpoch invalidates every token issued to the user so far and
+// returns the new epoch.
+func (r *userRepository) IncrementTokenEpoch(id int) (int64, error) {
+	query := `
+		UPDATE users SET token_epoch = token_epoch + 1
+		WHERE id = $1
+		RETURNING token_epoch
+	`
+
+	var epoch int64
+	err := r.db.QueryRow(query, id).Scan(&epoch)
+	return epoch, err
+}
+
+func (r *userRepository) UpdatePassword(id int, passwordHash string) error {
+	query := `
+		UPDATE users SET password_hash = $2 WHERE id = $1
+	`
+
+	_, err := r.db.Exec(query, id, passwordHash)
+	return err
+}
+
+// UpgradePasswordHash replaces a hash with a stronger one of the same
+// password. It does nothing if the password changed since oldHash was read.
+func (r *userRepository) UpgradePasswordHash(id int, oldHash, newHash string) error {
+	query := `
+		UPDATE users SET password_hash = $3 WHERE id = $1 AND password_hash = $2
+	`
+
+	_, err := r.db.Exec(query, id, oldHash, newHash)
+	return err
+}
+
+// MarkEmailVerified records that the user controls email. It returns false
+// if the account's email has changed since the link was sent.
+func (r *userRepository) MarkEmailVerified(id int, email string) (bool, error) {
+	query := `
+		UPDATE users SET email_verified_at = COALESCE(email_verified_at, CURRENT_TIMESTAMP)
+		WHERE id = $1 AND email = $2
+	`
+
+	result, err := r.db.Exec(query, id, email)
+	if err != nil {
+		return false, err
+	}
+
+	verified, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return verified > 0, nil
+}
+
+func (r *userRepository) UpdateProfile(id int, name string, preferences models.UserPreferences) (*models.User, error) {
+	encoded, err := json.Marshal(preferences)
+	if err != nil {
+		return nil, err
+	}
+
+	query := `
+		UPDATE users SET name = $2, preferences = $3
+		WHERE id = $1
+		RETURNING ` + userColumns
+
+	return scanUser(r.db.QueryRow(query, id, name, encoded))
+}
+
+// UpdateEmail moves the account to a new address the user has just proven
+// they control, so it counts as verified. It returns sql.ErrNoRows if the
+// user does not exist.
+func (r *userRepository) UpdateEmail(id int, email string) error {
+	query := `
+		UPDATE users SET email = $2, email_verified_at = CURRENT_TIMESTAMP
+		WHERE id = $1
+	`
+
+	result, err := r.db.Exec(query, id, email)
+	if err != nil {
+		return err
+	}
+
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+func (r *userRepository) ScheduleDeletion(id int, at time.Time) error {
+	query := `
+		UPDATE users SET deletion_scheduled_at = $2
+		WHERE id = $1
+	`
+
+	result, err := r.db.Exec(query, id, at)
+	if err != nil {
+		return err
+	}
+
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+// CancelDeletion reports whether the account had a deletion scheduled.
+func (r *userRepository) CancelDeletion(id int) (bool, error) {
+	query := `
+		UPDATE users SET deletion_scheduled_at = NULL
+		WHERE id = $1 AND deletion_scheduled_at IS NOT NULL
+	`
+
+	result, err := r.db.Exec(query, id)
+	if err != nil {
+		return false, err
+	}
+
+	cancelled, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return cancelled > 0, nil
+}
+
+// ListDueForDeletion returns accounts whose deletion grace period has passed,
+// oldest first.
+func (r *userRepository) ListDueForDeletion(limit int) ([]*models.User, error) {
+	query := `
+		SELECT ` + userColumns + `
+		FROM users
+		WHERE deletion_scheduled_at <= CURRENT_TIMESTAMP
+		ORDER BY deletion_scheduled_at ASC
+		LIMIT $1
+	`
+
+	rows, err := r.db.Query(query, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []*models.User{}
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+
+	return users, rows.Err()
+}
+
+// DeleteIfDue erases an account and, through cascades, everything it owns.
+// It returns sql.ErrNoRows if the account is gone or its deletion was
+// cancelled in the meantime.
+func (r *userRepository) DeleteIfDue(id int) error {
+	query := `
+		DELETE FROM users
+		WHERE id = $1 AND deletion_scheduled_at <= CURRENT_TIMESTAMP
+	`
+
+	result, err := r.db.Exec(query, id)
+	if err != nil {
+		return err
+	}
+
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+// SetDisabled disables or re-enables an account. Disabling an account that
+// already is keeps the original time.
+func (r *userRepository) SetDisabled(id int, disabled bool) (*models.User, error) {
+	query := `
+		UPDATE users
+		SET disabled_at = CASE WHEN $2 THEN COALESCE(disabled_at, CURRENT_TIMESTAMP) ELSE NULL END
+		WHERE id = $1
+		RETURNING ` + userColumns
+
+	return scanUser(r.db.QueryRow(query, id, disabled))
+}
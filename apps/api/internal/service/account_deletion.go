@@ -0,0 +1,184 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/enkyuan/ato/api/internal/dto"
+	"github.com/enkyuan/ato/api/internal/models"
+	"github.com/enkyuan/ato/api/internal/repository"
+	"github.com/enkyuan/ato/api/pkg/mailer"
+)
+
+const (
+	// accountDeletionGracePeriod is how long a user has to change their mind
+	// before their account is erased
+	accountDeletionGracePeriod = 30 * 24 * time.Hour
+	// accountCleanupInterval is how often due deletions and expired data
+	// exports are cleaned up
+	accountCleanupInterval = time.Hour
+	// accountDeletionBatchSize bounds how many accounts one cleanup pass
+	// erases, so a backlog is worked off over several passes
+	accountDeletionBatchSize = 100
+)
+
+var ErrDeletionNotScheduled = errors.New("account deletion is not scheduled")
+
+type AccountLifecycleService interface {
+	ScheduleAccountDeletion(ctx context.Context, userID int, sessionID string, req dto.DeleteAccountRequest) (*models.User, error)
+	CancelAccountDeletion(ctx context.Context, userID int, client dto.ClientInfo) error
+	RunAccountCleanup(ctx context.Context)
+	RequestDataExport(ctx context.Context, userID int, client dto.ClientInfo) (*models.DataExport, error)
+	ListDataExports(ctx context.Context, userID int) ([]*models.DataExport, error)
+	GetDataExport(ctx context.Context, userID int, exportID int) (*models.DataExport, error)
+}
+
+// accountLifecycleService deletes accounts and exports their data. Ending an
+// account's sessions goes through the auth service, which owns them.
+type accountLifecycleService struct {
+	userRepo          repository.UserRepository
+	dataExportRepo    repository.DataExportRepository
+	securityEventRepo repository.SecurityEventRepository
+	accounts          AccountSecurity
+	mailer            mailer.Mailer
+}
+
+func NewAccountLifecycleService(userRepo repository.UserRepository, dataExportRepo repository.DataExportRepository, securityEventRepo repository.SecurityEventRepository, accounts AccountSecurity, mailer mailer.Mailer) AccountLifecycleService {
+	return &accountLifecycleService{
+		userRepo:          userRepo,
+		dataExportRepo:    dataExportRepo,
+		securityEventRepo: securityEventRepo,
+		accounts:          accounts,
+		mailer:            mailer,
+	}
+}
+
+// ScheduleAccountDeletion marks the account for deletion once the grace
+// period is over. Every other session and app is logged out; the account can
+// still be signed into until then to cancel.
+func (s *accountLifecycleService) ScheduleAccountDeletion(ctx context.Context, userID int, sessionID string, req dto.DeleteAccountRequest) (*models.User, error) {
+	user, err := checkCurrentPassword(s.userRepo, userID, req.Password)
+	if err != nil {
+		return nil, err
+	}
+
+	// Asking again does not push the date back
+	if user.DeletionScheduledAt != nil {
+		return user, nil
+	}
+
+	deleteAt := time.Now().Add(accountDeletionGracePeriod)
+	if err := s.userRepo.ScheduleDeletion(user.ID, deleteAt); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrUserNotFound
+		}
+		return nil, fmt.Errorf("failed to schedule deletion: %w", err)
+	}
+	user.DeletionScheduledAt = &deleteAt
+
+	if err := s.accounts.EndOtherSessions(ctx, user.ID, sessionID, models.TokenFamilyRevokedDeletion); err != nil {
+		return nil, err
+	}
+
+	saveSecurityEvent(ctx, s.securityEventRepo, &models.SecurityEvent{
+		UserID:    user.ID,
+		Type:      models.SecurityEventDeletionScheduled,
+		IPAddress: req.Client.IPAddress,
+		UserAgent: req.Client.UserAgent,
+		Metadata: map[string]string{
+			"delete_at": deleteAt.UTC().Format(time.RFC3339),
+		},
+	})
+
+	sendMailAsync(s.mailer, mailer.Message{
+		To:      user.Email,
+		Subject: "Your account will be deleted",
+		Body: fmt.Sprintf("Hi %s,\n\nYour account and all of its data will be permanently deleted on %s. To keep your account, sign in before then and cancel the deletion.\n",
+			user.Name, deleteAt.UTC().Format("January 2, 2006")),
+	})
+
+	return user, nil
+}
+
+func (s *accountLifecycleService) CancelAccountDeletion(ctx context.Context, userID int, client dto.ClientInfo) error {
+	cancelled, err := s.userRepo.CancelDeletion(userID)
+	if err != nil {
+		return fmt.Errorf("failed to cancel deletion: %w", err)
+	}
+	if !cancelled {
+		return ErrDeletionNotScheduled
+	}
+
+	saveSecurityEvent(ctx, s.securityEventRepo, &models.SecurityEvent{
+		UserID:    userID,
+		Type:      models.SecurityEventDeletionCancelled,
+		IPAddress: client.IPAddress,
+		UserAgent: client.UserAgent,
+	})
+
+	return nil
+}
+
+// RunAccountCleanup erases accounts whose deletion grace period has passed
+// and removes expired data exports, then again every hour until ctx is done.
+// Every instance may run it; deleting a row twice is harmless.
+func (s *accountLifecycleService) RunAccountCleanup(ctx context.Context) {
+	ticker := time.NewTicker(accountCleanupInterval)
+	defer ticker.Stop()
+
+	for {
+		s.cleanupAccounts(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *accountLifecycleService) cleanupAccounts(ctx context.Context) {
+	users, err := s.userRepo.ListDueForDeletion(accountDeletionBatchSize)
+	if err != nil {
+		log.Printf("Failed to list accounts due for deletion: %v", err)
+	}
+
+	for _, user := range users {
+		if err := s.deleteAccount(ctx, user); err != nil {
+			log.Printf("Failed to delete account %d: %v", user.ID, err)
+		}
+	}
+
+	if _, err := s.dataExportRepo.DeleteExpired(ctx); err != nil {
+		log.Printf("Failed to delete expired data exports: %v", err)
+	}
+}
+
+// deleteAccount erases an account for good. Its tokens are revoked first so
+// they stop working right away rather than when caches expire.
+func (s *accountLifecycleService) deleteAccount(ctx context.Context, user *models.User) error {
+	if err := s.accounts.EndAllSessions(ctx, user.ID); err != nil && !errors.Is(err, ErrUserNotFound) {
+		return err
+	}
+
+	if err := s.userRepo.DeleteIfDue(user.ID); err != nil {
+		// Cancelled or already deleted by another instance
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		return err
+	}
+	s.accounts.ForgetUser(user.ID)
+
+	sendMailAsync(s.mailer, mailer.Message{
+		To:      user.Email,
+		Subject: "Your account has been deleted",
+		Body:    fmt.Sprintf("Hi %s,\n\nAs you asked, your account and all of its data have been permanently deleted.\n", user.Name),
+	})
+
+	return nil
+}
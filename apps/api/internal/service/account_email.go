@@ -0,0 +1,309 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/enkyuan/ato/api/internal/dto"
+	"github.com/enkyuan/ato/api/internal/models"
+	"github.com/enkyuan/ato/api/internal/repository"
+	"github.com/enkyuan/ato/api/pkg/auth"
+	"github.com/enkyuan/ato/api/pkg/mailer"
+)
+
+var (
+	ErrInvalidAccountToken  = errors.New("link is invalid or has expired")
+	ErrEmailAlreadyVerified = errors.New("email is already verified")
+)
+
+const (
+	passwordResetTTL     = time.Hour
+	emailVerificationTTL = 48 * time.Hour
+	mailSendTimeout      = 30 * time.Second
+	emailVerifiedTTL     = 30 * time.Second
+	// At most passwordResetMaxPerWindow reset links are sent to one address
+	// per window
+	passwordResetMaxPerWindow = 5
+	passwordResetWindow       = time.Hour
+)
+
+// ForgotPassword emails a reset link if the address belongs to an account.
+// It reports success either way so the endpoint cannot be used to find out
+// who has an account. Like magic links, the rate limit is counted before the
+// lookup.
+func (s *authService) ForgotPassword(ctx context.Context, email string) error {
+	email = normalizeEmail(email)
+
+	window := s.limiter.Allow(ctx, passwordResetRateKey(email), passwordResetMaxPerWindow, passwordResetWindow)
+	if !window.Allowed {
+		return &RateLimitError{RetryAfter: window.ResetAfter(passwordResetWindow, time.Now())}
+	}
+
+	user, err := s.userRepo.GetByEmail(email)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		return fmt.Errorf("failed to get user: %w", err)
+	}
+
+	link, err := s.PasswordResetLink(ctx, user)
+	if err != nil {
+		return err
+	}
+
+	s.sendMail(mailer.Message{
+		To:      user.Email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf("Hi %s,\n\nSomeone asked to reset the password for your account. If it was you, open this link within an hour:\n\n%s\n\nIf it wasn't, you can ignore this email; your password has not changed.\n",
+			user.Name, link),
+	})
+
+	return nil
+}
+
+// PasswordResetLink creates a reset link for the user. Only the newest link
+// works.
+func (s *authService) PasswordResetLink(ctx context.Context, user *models.User) (string, error) {
+	if err := s.accountTokenRepo.InvalidateForUser(ctx, user.ID, models.AccountTokenPasswordReset); err != nil {
+		return "", fmt.Errorf("failed to invalidate reset links: %w", err)
+	}
+
+	token, err := createAccountToken(ctx, s.accountTokenRepo, user.ID, user.Email, models.AccountTokenPasswordReset, passwordResetTTL)
+	if err != nil {
+		return "", err
+	}
+
+	return frontendLink("/reset-password", token), nil
+}
+
+// ResetPassword sets a new password from a reset link. Every session is
+// logged out, since whoever had the old password may be signed in.
+func (s *authService) ResetPassword(ctx context.Context, req dto.ResetPasswordRequest) error {
+	// The new password is checked before the link is used up, so a refused
+	// password can be retried with the same link
+	pending, err := s.accountTokenRepo.GetValid(ctx, models.AccountTokenPasswordReset, auth.HashToken(req.Token))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return ErrInvalidAccountToken
+		}
+		return fmt.Errorf("failed to get account token: %w", err)
+	}
+
+	user, err := s.GetCurrentUser(ctx, pending.UserID)
+	if err != nil {
+		return err
+	}
+	if user.Email != pending.Email {
+		return ErrInvalidAccountToken
+	}
+
+	if err := s.passwordPolicy.Check(req.Password, user.Email, user.Name); err != nil {
+		return err
+	}
+
+	token, err := consumeAccountToken(ctx, s.accountTokenRepo, models.AccountTokenPasswordReset, req.Token)
+	if err != nil {
+		return err
+	}
+	if token.UserID != user.ID {
+		return ErrInvalidAccountToken
+	}
+
+	hashedPassword, err := auth.HashPassword(req.Password)
+	if err != nil {
+		return fmt.Errorf("failed to hash password: %w", err)
+	}
+
+	if err := s.userRepo.UpdatePassword(user.ID, hashedPassword); err != nil {
+		return fmt.Errorf("failed to update password: %w", err)
+	}
+
+	if err := s.accountTokenRepo.InvalidateForUser(ctx, user.ID, models.AccountTokenPasswordReset); err != nil {
+		// Log error but don't fail the request
+		log.Printf("Failed to invalidate reset links: %v", err)
+	}
+
+	// Following the link proved control of the mailbox as well
+	if _, err := s.userRepo.MarkEmailVerified(user.ID, token.Email); err != nil {
+		log.Printf("Failed to mark email verified: %v", err)
+	}
+	s.local.Delete(emailVerifiedKey(user.ID))
+
+	s.recordSecurityEvent(ctx, &models.SecurityEvent{
+		UserID:    user.ID,
+		Type:      models.SecurityEventPasswordReset,
+		IPAddress: req.Client.IPAddress,
+		UserAgent: req.Client.UserAgent,
+	})
+
+	return s.EndAllSessions(ctx, user.ID)
+}
+
+// SendEmailVerification emails a fresh verification link.
+func (s *authService) SendEmailVerification(ctx context.Context, userID int) error {
+	user, err := s.GetCurrentUser(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	if user.EmailVerifiedAt != nil {
+		return ErrEmailAlreadyVerified
+	}
+
+	return s.sendEmailVerification(ctx, user)
+}
+
+func (s *authService) VerifyEmail(ctx context.Context, req dto.VerifyEmailRequest) error {
+	token, err := consumeAccountToken(ctx, s.accountTokenRepo, models.AccountTokenEmailVerification, req.Token)
+	if err != nil {
+		return err
+	}
+
+	verified, err := s.userRepo.MarkEmailVerified(token.UserID, token.Email)
+	if err != nil {
+		return fmt.Errorf("failed to verify email: %w", err)
+	}
+	if !verified {
+		return ErrInvalidAccountToken
+	}
+	s.local.Delete(emailVerifiedKey(token.UserID))
+
+	s.recordSecurityEvent(ctx, &models.SecurityEvent{
+		UserID:    token.UserID,
+		Type:      models.SecurityEventEmailVerified,
+		IPAddress: req.Client.IPAddress,
+		UserAgent: req.Client.UserAgent,
+	})
+
+	return nil
+}
+
+// EmailVerified reports whether the user has verified their email. The
+// answer is cached in-process briefly since it is checked per request.
+func (s *authService) EmailVerified(ctx context.Context, userID int) (bool, error) {
+	key := emailVerifiedKey(userID)
+	if verified, ok := s.local.Get(key); ok {
+		return verified.(bool), nil
+	}
+
+	user, err := s.GetCurrentUser(ctx, userID)
+	if err != nil {
+		return false, err
+	}
+
+	verified := user.EmailVerifiedAt != nil
+	s.local.Set(key, verified, emailVerifiedTTL)
+
+	return verified, nil
+}
+
+// ForgetUser drops what this instance has cached about the user, such as
+// whether their email is verified, after their account changes elsewhere.
+func (s *authService) ForgetUser(userID int) {
+	s.local.Delete(emailVerifiedKey(userID))
+}
+
+func (s *authService) sendEmailVerification(ctx context.Context, user *models.User) error {
+	token, err := createAccountToken(ctx, s.accountTokenRepo, user.ID, user.Email, models.AccountTokenEmailVerification, emailVerificationTTL)
+	if err != nil {
+		return err
+	}
+
+	s.sendMail(mailer.Message{
+		To:      user.Email,
+		Subject: "Verify your email",
+		Body: fmt.Sprintf("Hi %s,\n\nPlease confirm this is your email address by opening this link:\n\n%s\n\nIf you didn't create an account, you can ignore this email.\n",
+			user.Name, frontendLink("/verify-email", token)),
+	})
+
+	return nil
+}
+
+// createAccountToken stores a new single-use token for a link sent to email,
+// normally the user's current one, and returns the raw token to put in the
+// link.
+func createAccountToken(ctx context.Context, repo repository.AccountTokenRepository, userID int, email string, purpose string, ttl time.Duration) (string, error) {
+	token, err := auth.GenerateOpaqueToken("")
+	if err != nil {
+		return "", err
+	}
+
+	err = repo.Create(ctx, &models.AccountToken{
+		UserID:    userID,
+		Purpose:   purpose,
+		TokenHash: auth.HashToken(token),
+		Email:     email,
+		ExpiresAt: time.Now().Add(ttl),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to create account token: %w", err)
+	}
+
+	return token, nil
+}
+
+func consumeAccountToken(ctx context.Context, repo repository.AccountTokenRepository, purpose string, token string) (*models.AccountToken, error) {
+	accountToken, err := repo.Consume(ctx, purpose, auth.HashToken(token))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrInvalidAccountToken
+		}
+		return nil, fmt.Errorf("failed to use account token: %w", err)
+	}
+
+	return accountToken, nil
+}
+
+// sendMail delivers in the background so a slow mail server does not hold up
+// the request. Failures are only logged; the user can ask again.
+func (s *authService) sendMail(msg mailer.Message) {
+	sendMailAsync(s.mailer, msg)
+}
+
+func sendMailAsync(m mailer.Mailer, msg mailer.Message) {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), mailSendTimeout)
+		defer cancel()
+
+		if err := m.Send(ctx, msg); err != nil {
+			log.Printf("Failed to send %q mail: %v", msg.Subject, err)
+		}
+	}()
+}
+
+// frontendLink builds a link into the web app carrying a token.
+func frontendLink(path string, token string) string {
+	return frontendURL(path) + "?token=" + url.QueryEscape(token)
+}
+
+// frontendURL builds a link to a page of the web app.
+func frontendURL(path string) string {
+	base := os.Getenv("FRONTEND_URL")
+	if base == "" {
+		base = "http://localhost:3000"
+	}
+	return base + path
+}
+
+func emailVerifiedKey(userID int) string {
+	return fmt.Sprintf("email_verified:user:%d", userID)
+}
+
+// normalizeEmail is the form emails are stored and looked up in. Addresses
+// are treated as case-insensitive, which is what every mail provider users
+// sign up with does in practice.
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+func passwordResetRateKey(email string) string {
+	return fmt.Sprintf("ratelimit:password_reset:%s", auth.HashToken(email))
+}
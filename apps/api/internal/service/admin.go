@@ -0,0 +1,223 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/enkyuan/ato/api/cache"
+	"github.com/enkyuan/ato/api/internal/dto"
+	"github.com/enkyuan/ato/api/internal/models"
+	"github.com/enkyuan/ato/api/internal/repository"
+	"github.com/enkyuan/ato/api/pkg/mailer"
+)
+
+var ErrCannotDisableSelf = errors.New("admins cannot disable their own account")
+
+const (
+	DefaultAdminUsersLimit = 50
+	MaxAdminUsersLimit     = 200
+)
+
+type AdminService interface {
+	IsAdmin(ctx context.Context, userID int) (bool, error)
+	AccountDisabled(ctx context.Context, userID int) (bool, error)
+	ListUsers(ctx context.Context, req dto.AdminListUsersRequest) (*dto.AdminUsersResponse, error)
+	GetUser(ctx context.Context, userID int) (*dto.AdminUserResponse, error)
+	SetAccountDisabled(ctx context.Context, adminID int, userID int, disabled bool, client dto.ClientInfo) (*models.User, error)
+	LogoutUser(ctx context.Context, adminID int, userID int, client dto.ClientInfo) error
+	SendPasswordReset(ctx context.Context, adminID int, userID int, client dto.ClientInfo) error
+}
+
+// adminService manages users on behalf of admins. Logging a user out and
+// minting reset links go through the auth service, which owns both.
+type adminService struct {
+	userRepo          repository.UserRepository
+	adminRepo         repository.AdminRepository
+	securityEventRepo repository.SecurityEventRepository
+	accounts          AccountSecurity
+	mailer            mailer.Mailer
+	local             *cache.Local
+}
+
+func NewAdminService(userRepo repository.UserRepository, adminRepo repository.AdminRepository, securityEventRepo repository.SecurityEventRepository, accounts AccountSecurity, mailer mailer.Mailer) AdminService {
+	return &adminService{
+		userRepo:          userRepo,
+		adminRepo:         adminRepo,
+		securityEventRepo: securityEventRepo,
+		accounts:          accounts,
+		mailer:            mailer,
+		local:             newLocalState(),
+	}
+}
+
+// IsAdmin reports whether the user may use the admin API. The role is read
+// fresh each time so a demotion takes effect at once.
+func (s *adminService) IsAdmin(ctx context.Context, userID int) (bool, error) {
+	user, err := getUser(s.userRepo, userID)
+	if err != nil {
+		return false, err
+	}
+
+	return user.Role == models.RoleAdmin, nil
+}
+
+// AccountDisabled reports whether an admin has disabled the account. The
+// answer is cached in-process briefly since it is checked per request.
+func (s *adminService) AccountDisabled(ctx context.Context, userID int) (bool, error) {
+	key := accountDisabledKey(userID)
+	if disabled, ok := s.local.Get(key); ok {
+		return disabled.(bool), nil
+	}
+
+	user, err := getUser(s.userRepo, userID)
+	if err != nil {
+		return false, err
+	}
+
+	disabled := user.DisabledAt != nil
+	s.local.Set(key, disabled, localStateTTL)
+
+	return disabled, nil
+}
+
+func (s *adminService) ListUsers(ctx context.Context, req dto.AdminListUsersRequest) (*dto.AdminUsersResponse, error) {
+	limit := req.Limit
+	if limit <= 0 {
+		limit = DefaultAdminUsersLimit
+	}
+	if limit > MaxAdminUsersLimit {
+		limit = MaxAdminUsersLimit
+	}
+
+	// One extra row tells whether there is another page
+	users, err := s.adminRepo.ListUsers(ctx, repository.UserFilter{
+		Query:    req.Query,
+		Role:     req.Role,
+		Disabled: req.Disabled,
+		Before:   req.Before,
+		Limit:    limit + 1,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list users: %w", err)
+	}
+
+	resp := &dto.AdminUsersResponse{Users: users}
+	if len(users) > limit {
+		resp.Users = users[:limit]
+		resp.NextBefore = resp.Users[limit-1].ID
+	}
+
+	return resp, nil
+}
+
+func (s *adminService) GetUser(ctx context.Context, userID int) (*dto.AdminUserResponse, error) {
+	user, err := getUser(s.userRepo, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	usage, err := s.adminRepo.GetUsage(ctx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get usage: %w", err)
+	}
+
+	return &dto.AdminUserResponse{User: user, Usage: usage}, nil
+}
+
+// SetAccountDisabled disables or re-enables a user's account. Disabling
+// logs the user out everywhere, and the account cannot sign in or use any
+// token until it is enabled again.
+func (s *adminService) SetAccountDisabled(ctx context.Context, adminID int, userID int, disabled bool, client dto.ClientInfo) (*models.User, error) {
+	if disabled && adminID == userID {
+		return nil, ErrCannotDisableSelf
+	}
+
+	before, err := getUser(s.userRepo, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := s.userRepo.SetDisabled(userID, disabled)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrUserNotFound
+		}
+		return nil, fmt.Errorf("failed to update account: %w", err)
+	}
+	s.local.Set(accountDisabledKey(userID), disabled, localStateTTL)
+
+	// Nothing changed, so there is nothing to record
+	if (before.DisabledAt != nil) == disabled {
+		return user, nil
+	}
+
+	eventType := models.SecurityEventAccountEnabled
+	if disabled {
+		eventType = models.SecurityEventAccountDisabled
+		if err := s.accounts.EndAllSessions(ctx, userID); err != nil {
+			return nil, err
+		}
+	}
+
+	s.recordAdminEvent(ctx, adminID, userID, eventType, client)
+
+	return user, nil
+}
+
+// LogoutUser revokes every session, app grant and API token the user has.
+func (s *adminService) LogoutUser(ctx context.Context, adminID int, userID int, client dto.ClientInfo) error {
+	if _, err := getUser(s.userRepo, userID); err != nil {
+		return err
+	}
+
+	if err := s.accounts.EndAllSessions(ctx, userID); err != nil {
+		return err
+	}
+
+	s.recordAdminEvent(ctx, adminID, userID, models.SecurityEventLogoutAll, client)
+
+	return nil
+}
+
+// SendPasswordReset emails the user a password reset link, as if they had
+// asked for one. Their current password keeps working until it is used.
+func (s *adminService) SendPasswordReset(ctx context.Context, adminID int, userID int, client dto.ClientInfo) error {
+	user, err := getUser(s.userRepo, userID)
+	if err != nil {
+		return err
+	}
+
+	link, err := s.accounts.PasswordResetLink(ctx, user)
+	if err != nil {
+		return err
+	}
+
+	sendMailAsync(s.mailer, mailer.Message{
+		To:      user.Email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf("Hi %s,\n\nAn administrator has asked you to set a new password for your account. Open this link within an hour to choose one:\n\n%s\n",
+			user.Name, link),
+	})
+
+	s.recordAdminEvent(ctx, adminID, userID, models.SecurityEventResetRequested, client)
+
+	return nil
+}
+
+// recordAdminEvent logs an admin's action in the user's security log.
+func (s *adminService) recordAdminEvent(ctx context.Context, adminID int, userID int, eventType string, client dto.ClientInfo) {
+	saveSecurityEvent(ctx, s.securityEventRepo, &models.SecurityEvent{
+		UserID:    userID,
+		Type:      eventType,
+		IPAddress: client.IPAddress,
+		UserAgent: client.UserAgent,
+		Metadata:  map[string]string{"admin_id": strconv.Itoa(adminID)},
+	})
+}
+
+func accountDisabledKey(userID int) string {
+	return fmt.Sprintf("account_disabled:user:%d", userID)
+}
@@ -0,0 +1,236 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/enkyuan/ato/api/internal/dto"
+	"github.com/enkyuan/ato/api/internal/models"
+	"github.com/enkyuan/ato/api/internal/repository"
+)
+
+// fakeUserRepository keeps users in memory. Methods a test does not need
+// panic through the nil embedded interface.
+type fakeUserRepository struct {
+	repository.UserRepository
+	users map[int]*models.User
+}
+
+func newFakeUserRepository(users ...*models.User) *fakeUserRepository {
+	r := &fakeUserRepository{users: make(map[int]*models.User)}
+	for _, user := range users {
+		r.users[user.ID] = user
+	}
+	return r
+}
+
+func (r *fakeUserRepository) GetByID(id int) (*models.User, error) {
+	user, ok := r.users[id]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	found := *user
+	return &found, nil
+}
+
+func (r *fakeUserRepository) SetDisabled(id int, disabled bool) (*models.User, error) {
+	user, ok := r.users[id]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	if !disabled {
+		user.DisabledAt = nil
+	} else if user.DisabledAt == nil {
+		now := time.Now()
+		user.DisabledAt = &now
+	}
+	updated := *user
+	return &updated, nil
+}
+
+type fakeSecurityEventRepository struct {
+	repository.SecurityEventRepository
+	events []*models.SecurityEvent
+}
+
+func (r *fakeSecurityEventRepository) Create(ctx context.Context, event *models.SecurityEvent) error {
+	r.events = append(r.events, event)
+	return nil
+}
+
+// fakeAccountSecurity records whose sessions were ended.
+type fakeAccountSecurity struct {
+	ended []int
+	err   error
+}
+
+func (a *fakeAccountSecurity) EndAllSessions(ctx context.Context, userID int) error {
+	if a.err != nil {
+		return a.err
+	}
+	a.ended = append(a.ended, userID)
+	return nil
+}
+
+func (a *fakeAccountSecurity) EndOtherSessions(ctx context.Context, userID int, sessionID string, reason string) error {
+	return a.EndAllSessions(ctx, userID)
+}
+
+func (a *fakeAccountSecurity) PasswordResetLink(ctx context.Context, user *models.User) (string, error) {
+	return "http://localhost:3000/reset-password?token=test", nil
+}
+
+func (a *fakeAccountSecurity) ForgetUser(userID int) {}
+
+const (
+	testAdminID = 1
+	testUserID  = 2
+)
+
+func newTestAdminService(users *fakeUserRepository, events *fakeSecurityEventRepository, accounts *fakeAccountSecurity) AdminService {
+	return NewAdminService(users, nil, events, accounts, nil)
+}
+
+func TestSetAccountDisabled(t *testing.T) {
+	ctx := context.Background()
+	client := dto.ClientInfo{IPAddress: "192.0.2.1"}
+	disabledAt := time.Now().Add(-time.Hour)
+
+	tests := []struct {
+		name         string
+		userID       int
+		disabledAt   *time.Time
+		disable      bool
+		wantErr      error
+		wantEnded    bool
+		wantEvent    string
+		wantDisabled bool
+	}{
+		{"disable", testUserID, nil, true, nil, true, models.SecurityEventAccountDisabled, true},
+		{"enable", testUserID, &disabledAt, false, nil, false, models.SecurityEventAccountEnabled, false},
+		{"disable again", testUserID, &disabledAt, true, nil, false, "", true},
+		{"enable when enabled", testUserID, nil, false, nil, false, "", false},
+		{"disable self", testAdminID, nil, true, ErrCannotDisableSelf, false, "", false},
+		{"unknown user", 99, nil, true, ErrUserNotFound, false, "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			users := newFakeUserRepository(
+				&models.User{ID: testAdminID, Role: models.RoleAdmin},
+				&models.User{ID: testUserID, Role: models.RoleUser, DisabledAt: tt.disabledAt},
+			)
+			events := &fakeSecurityEventRepository{}
+			accounts := &fakeAccountSecurity{}
+			s := newTestAdminService(users, events, accounts)
+
+			user, err := s.SetAccountDisabled(ctx, testAdminID, tt.userID, tt.disable, client)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("SetAccountDisabled() error = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && (user.DisabledAt != nil) != tt.wantDisabled {
+				t.Errorf("DisabledAt = %v, want disabled %v", user.DisabledAt, tt.wantDisabled)
+			}
+
+			if ended := len(accounts.ended) > 0; ended != tt.wantEnded {
+				t.Errorf("sessions ended = %v, want %v", ended, tt.wantEnded)
+			}
+
+			if tt.wantEvent == "" {
+				if len(events.events) != 0 {
+					t.Errorf("recorded %d events, want none", len(events.events))
+				}
+			} else {
+				if len(events.events) != 1 {
+					t.Fatalf("recorded %d events, want 1", len(events.events))
+				}
+				event := events.events[0]
+				if event.Type != tt.wantEvent || event.UserID != tt.userID || event.Metadata["admin_id"] != "1" {
+					t.Errorf("event = %s for user %d by admin %s, want %s for user %d by admin 1",
+						event.Type, event.UserID, event.Metadata["admin_id"], tt.wantEvent, tt.userID)
+				}
+			}
+
+			if err != nil {
+				return
+			}
+			disabled, err := s.AccountDisabled(ctx, tt.userID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if disabled != tt.wantDisabled {
+				t.Errorf("AccountDisabled() = %v, want %v", disabled, tt.wantDisabled)
+			}
+		})
+	}
+}
+
+func TestAccountDisabledSeesChangeAtOnce(t *testing.T) {
+	ctx := context.Background()
+	users := newFakeUserRepository(&models.User{ID: testUserID})
+	s := newTestAdminService(users, &fakeSecurityEventRepository{}, &fakeAccountSecurity{})
+
+	// Cache the account as enabled, as a request would
+	if disabled, err := s.AccountDisabled(ctx, testUserID); err != nil || disabled {
+		t.Fatalf("AccountDisabled() = %v, %v, want false", disabled, err)
+	}
+
+	if _, err := s.SetAccountDisabled(ctx, testAdminID, testUserID, true, dto.ClientInfo{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if disabled, err := s.AccountDisabled(ctx, testUserID); err != nil || !disabled {
+		t.Errorf("AccountDisabled() after disabling = %v, %v, want true", disabled, err)
+	}
+}
+
+func TestLogoutUser(t *testing.T) {
+	ctx := context.Background()
+	client := dto.ClientInfo{IPAddress: "192.0.2.1"}
+	errRevoke := errors.New("revoke failed")
+
+	tests := []struct {
+		name      string
+		userID    int
+		revokeErr error
+		wantErr   error
+		wantEnded bool
+	}{
+		{"logs the user out", testUserID, nil, nil, true},
+		{"unknown user", 99, nil, ErrUserNotFound, false},
+		{"revoking fails", testUserID, errRevoke, errRevoke, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			users := newFakeUserRepository(&models.User{ID: testUserID})
+			events := &fakeSecurityEventRepository{}
+			accounts := &fakeAccountSecurity{err: tt.revokeErr}
+			s := newTestAdminService(users, events, accounts)
+
+			err := s.LogoutUser(ctx, testAdminID, tt.userID, client)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("LogoutUser() error = %v, want %v", err, tt.wantErr)
+			}
+
+			if ended := len(accounts.ended) == 1 && accounts.ended[0] == tt.userID; ended != tt.wantEnded {
+				t.Errorf("sessions ended for %v, want ended %v", accounts.ended, tt.wantEnded)
+			}
+
+			// Only a logout that happened is recorded
+			wantEvents := 0
+			if tt.wantEnded {
+				wantEvents = 1
+			}
+			if len(events.events) != wantEvents {
+				t.Fatalf("recorded %d events, want %d", len(events.events), wantEvents)
+			}
+			if wantEvents == 1 && events.events[0].Type != models.SecurityEventLogoutAll {
+				t.Errorf("event = %s, want %s", events.events[0].Type, models.SecurityEventLogoutAll)
+			}
+		})
+	}
+}
@@ -0,0 +1,189 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/enkyuan/ato/api/cache"
+	"github.com/enkyuan/ato/api/internal/dto"
+	"github.com/enkyuan/ato/api/internal/models"
+	"github.com/enkyuan/ato/api/internal/repository"
+	"github.com/enkyuan/ato/api/pkg/auth"
+)
+
+// APITokenPrefix starts every personal access token, so they are easy to
+// recognise in code and for secret scanners.
+const APITokenPrefix = "ato_pat_"
+
+var (
+	ErrAPITokenNotFound      = errors.New("API token not found")
+	ErrAPITokenInvalidScopes = errors.New("unknown or missing scopes")
+	ErrAPITokenInvalidExpiry = errors.New("expiry must be in the future")
+)
+
+const (
+	// apiTokenHintLength keeps the prefix and four characters of the token
+	apiTokenHintLength = len(APITokenPrefix) + 4
+	// apiTokenTouchInterval limits how often last_used_at is written
+	apiTokenTouchInterval = 5 * time.Minute
+)
+
+type APITokenService interface {
+	CreateAPIToken(ctx context.Context, userID int, req dto.CreateAPITokenRequest) (*dto.CreateAPITokenResponse, error)
+	ListAPITokens(ctx context.Context, userID int) ([]*models.APIToken, error)
+	DeleteAPIToken(ctx context.Context, userID int, tokenID int) error
+	DeleteAllAPITokens(ctx context.Context, userID int) error
+	ValidateAPIToken(ctx context.Context, token string, client dto.ClientInfo) (*models.APIToken, error)
+}
+
+// apiTokenService manages personal access tokens. The auth service deletes
+// them all through it when a user's sessions are ended.
+type apiTokenService struct {
+	apiTokenRepo repository.APITokenRepository
+	cache        *cache.Cache
+	local        *cache.Local
+}
+
+func NewAPITokenService(apiTokenRepo repository.APITokenRepository, cache *cache.Cache) APITokenService {
+	return &apiTokenService{
+		apiTokenRepo: apiTokenRepo,
+		cache:        cache,
+		local:        newLocalState(),
+	}
+}
+
+// CreateAPIToken creates a personal access token. The raw token is only
+// returned here.
+func (s *apiTokenService) CreateAPIToken(ctx context.Context, userID int, req dto.CreateAPITokenRequest) (*dto.CreateAPITokenResponse, error) {
+	scopes, ok := auth.NormalizeScopes(req.Scopes)
+	if !ok || len(scopes) == 0 {
+		return nil, ErrAPITokenInvalidScopes
+	}
+
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		return nil, ErrAPITokenInvalidExpiry
+	}
+
+	token, err := auth.GenerateOpaqueToken(APITokenPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	apiToken := &models.APIToken{
+		UserID:    userID,
+		Name:      req.Name,
+		TokenHash: auth.HashToken(token),
+		TokenHint: token[:apiTokenHintLength],
+		Scopes:    scopes,
+		ExpiresAt: req.ExpiresAt,
+	}
+
+	if err := s.apiTokenRepo.Create(ctx, apiToken); err != nil {
+		return nil, fmt.Errorf("failed to create API token: %w", err)
+	}
+
+	return &dto.CreateAPITokenResponse{
+		APIToken: apiToken,
+		Token:    token,
+	}, nil
+}
+
+func (s *apiTokenService) ListAPITokens(ctx context.Context, userID int) ([]*models.APIToken, error) {
+	tokens, err := s.apiTokenRepo.ListByUser(ctx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list API tokens: %w", err)
+	}
+
+	return tokens, nil
+}
+
+func (s *apiTokenService) DeleteAPIToken(ctx context.Context, userID int, tokenID int) error {
+	tokenHash, err := s.apiTokenRepo.Delete(ctx, tokenID, userID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return ErrAPITokenNotFound
+		}
+		return fmt.Errorf("failed to delete API token: %w", err)
+	}
+
+	s.local.Delete(apiTokenKey(tokenHash))
+
+	return nil
+}
+
+// DeleteAllAPITokens revokes every personal access token the user has, so a
+// token minted from a stolen session does not outlive it.
+func (s *apiTokenService) DeleteAllAPITokens(ctx context.Context, userID int) error {
+	hashes, err := s.apiTokenRepo.DeleteAllForUser(ctx, userID)
+	if err != nil {
+		return fmt.Errorf("failed to delete API tokens: %w", err)
+	}
+
+	for _, hash := range hashes {
+		s.local.Delete(apiTokenKey(hash))
+	}
+
+	return nil
+}
+
+// ValidateAPIToken checks a personal access token. Lookups are cached
+// in-process briefly, so another instance may accept a deleted token for up to
+// that long.
+func (s *apiTokenService) ValidateAPIToken(ctx context.Context, token string, client dto.ClientInfo) (*models.APIToken, error) {
+	hash := auth.HashToken(token)
+	key := apiTokenKey(hash)
+
+	var apiToken *models.APIToken
+	if cached, ok := s.local.Get(key); ok {
+		apiToken = cached.(*models.APIToken)
+	} else {
+		found, err := s.apiTokenRepo.GetByHash(ctx, hash)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return nil, auth.ErrInvalidToken
+			}
+			return nil, fmt.Errorf("failed to get API token: %w", err)
+		}
+		apiToken = found
+		s.local.Set(key, apiToken, localStateTTL)
+	}
+
+	if apiToken.Expired(time.Now()) {
+		return nil, auth.ErrInvalidToken
+	}
+
+	s.touchAPIToken(ctx, apiToken.ID, client.IPAddress)
+
+	return apiToken, nil
+}
+
+// touchAPIToken records the token's last use like touchSession does for
+// sessions, checking this instance's own touches before Redis.
+func (s *apiTokenService) touchAPIToken(ctx context.Context, tokenID int, ip string) {
+	key := apiTokenTouchedKey(tokenID)
+	if _, ok := s.local.Get(key); ok {
+		return
+	}
+	s.local.Set(key, true, apiTokenTouchInterval)
+
+	due, err := s.cache.SetNX(ctx, key, "1", apiTokenTouchInterval)
+	if err != nil || !due {
+		return
+	}
+
+	if err := s.apiTokenRepo.RecordUse(ctx, tokenID, ip); err != nil {
+		log.Printf("Failed to update API token last use: %v", err)
+	}
+}
+
+func apiTokenKey(tokenHash string) string {
+	return fmt.Sprintf("api_token:%s", tokenHash)
+}
+
+func apiTokenTouchedKey(tokenID int) string {
+	return fmt.Sprintf("api_token:touched:%d", tokenID)
+}
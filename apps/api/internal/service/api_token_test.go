@@ -0,0 +1,232 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/enkyuan/ato/api/cache"
+	"github.com/enkyuan/ato/api/internal/dto"
+	"github.com/enkyuan/ato/api/internal/models"
+	"github.com/enkyuan/ato/api/pkg/auth"
+)
+
+// newTestCache returns a cache backed by an in-memory Redis that lives as
+// long as the test.
+func newTestCache(t *testing.T) *cache.Cache {
+	t.Helper()
+
+	server := miniredis.RunT(t)
+	c, err := cache.New("redis://" + server.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+
+	return c
+}
+
+// fakeAPITokenRepository keeps tokens in memory by hash.
+type fakeAPITokenRepository struct {
+	tokens map[string]*models.APIToken
+	nextID int
+	uses   map[int]int
+}
+
+func newFakeAPITokenRepository() *fakeAPITokenRepository {
+	return &fakeAPITokenRepository{
+		tokens: make(map[string]*models.APIToken),
+		uses:   make(map[int]int),
+	}
+}
+
+func (r *fakeAPITokenRepository) Create(ctx context.Context, token *models.APIToken) error {
+	r.nextID++
+	token.ID = r.nextID
+	token.CreatedAt = time.Now()
+	stored := *token
+	r.tokens[token.TokenHash] = &stored
+	return nil
+}
+
+func (r *fakeAPITokenRepository) GetByHash(ctx context.Context, tokenHash string) (*models.APIToken, error) {
+	token, ok := r.tokens[tokenHash]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	found := *token
+	return &found, nil
+}
+
+func (r *fakeAPITokenRepository) ListByUser(ctx context.Context, userID int) ([]*models.APIToken, error) {
+	var tokens []*models.APIToken
+	for _, token := range r.tokens {
+		if token.UserID == userID {
+			tokens = append(tokens, token)
+		}
+	}
+	return tokens, nil
+}
+
+func (r *fakeAPITokenRepository) RecordUse(ctx context.Context, id int, ip string) error {
+	r.uses[id]++
+	return nil
+}
+
+func (r *fakeAPITokenRepository) Delete(ctx context.Context, id int, userID int) (string, error) {
+	for hash, token := range r.tokens {
+		if token.ID == id && token.UserID == userID {
+			delete(r.tokens, hash)
+			return hash, nil
+		}
+	}
+	return "", sql.ErrNoRows
+}
+
+func (r *fakeAPITokenRepository) DeleteAllForUser(ctx context.Context, userID int) ([]string, error) {
+	var hashes []string
+	for hash, token := range r.tokens {
+		if token.UserID == userID {
+			delete(r.tokens, hash)
+			hashes = append(hashes, hash)
+		}
+	}
+	return hashes, nil
+}
+
+func TestCreateAPIToken(t *testing.T) {
+	ctx := context.Background()
+	past := time.Now().Add(-time.Minute)
+	future := time.Now().Add(time.Hour)
+
+	tests := []struct {
+		name    string
+		req     dto.CreateAPITokenRequest
+		wantErr error
+	}{
+		{"valid", dto.CreateAPITokenRequest{Name: "ci", Scopes: []string{auth.ScopeGroupsRead}}, nil},
+		{"with expiry", dto.CreateAPITokenRequest{Name: "ci", Scopes: []string{auth.ScopeGroupsRead}, ExpiresAt: &future}, nil},
+		{"no scopes", dto.CreateAPITokenRequest{Name: "ci"}, ErrAPITokenInvalidScopes},
+		{"unknown scope", dto.CreateAPITokenRequest{Name: "ci", Scopes: []string{"everything"}}, ErrAPITokenInvalidScopes},
+		{"expiry in the past", dto.CreateAPITokenRequest{Name: "ci", Scopes: []string{auth.ScopeGroupsRead}, ExpiresAt: &past}, ErrAPITokenInvalidExpiry},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := newFakeAPITokenRepository()
+			s := NewAPITokenService(repo, newTestCache(t))
+
+			resp, err := s.CreateAPIToken(ctx, 1, tt.req)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("CreateAPIToken() error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+
+			if !strings.HasPrefix(resp.Token, APITokenPrefix) {
+				t.Errorf("token %q does not start with %q", resp.Token, APITokenPrefix)
+			}
+			if !strings.HasPrefix(resp.Token, resp.TokenHint) {
+				t.Errorf("hint %q is not a prefix of the token", resp.TokenHint)
+			}
+			if _, ok := repo.tokens[auth.HashToken(resp.Token)]; !ok {
+				t.Error("token is not stored by its hash")
+			}
+		})
+	}
+}
+
+func TestValidateAPIToken(t *testing.T) {
+	ctx := context.Background()
+	client := dto.ClientInfo{IPAddress: "192.0.2.1"}
+	past := time.Now().Add(-time.Minute)
+
+	repo := newFakeAPITokenRepository()
+	s := NewAPITokenService(repo, newTestCache(t))
+
+	created, err := s.CreateAPIToken(ctx, 1, dto.CreateAPITokenRequest{Name: "ci", Scopes: []string{auth.ScopeGroupsRead}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := s.ValidateAPIToken(ctx, created.Token, client)
+	if err != nil {
+		t.Fatalf("ValidateAPIToken() error = %v", err)
+	}
+	if got.UserID != 1 || len(got.Scopes) != 1 || got.Scopes[0] != auth.ScopeGroupsRead {
+		t.Errorf("ValidateAPIToken() = user %d with scopes %v, want user 1 with [%s]", got.UserID, got.Scopes, auth.ScopeGroupsRead)
+	}
+
+	// Last use is written once per touch interval, not per request
+	if _, err := s.ValidateAPIToken(ctx, created.Token, client); err != nil {
+		t.Fatalf("second ValidateAPIToken() error = %v", err)
+	}
+	if uses := repo.uses[created.ID]; uses != 1 {
+		t.Errorf("RecordUse called %d times, want 1", uses)
+	}
+
+	if _, err := s.ValidateAPIToken(ctx, APITokenPrefix+"unknown", client); !errors.Is(err, auth.ErrInvalidToken) {
+		t.Errorf("ValidateAPIToken(unknown) error = %v, want %v", err, auth.ErrInvalidToken)
+	}
+
+	// Deleting drops this instance's cached copy at once
+	if err := s.DeleteAPIToken(ctx, 1, created.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.ValidateAPIToken(ctx, created.Token, client); !errors.Is(err, auth.ErrInvalidToken) {
+		t.Errorf("ValidateAPIToken(deleted) error = %v, want %v", err, auth.ErrInvalidToken)
+	}
+	if err := s.DeleteAPIToken(ctx, 1, created.ID); !errors.Is(err, ErrAPITokenNotFound) {
+		t.Errorf("DeleteAPIToken(deleted) error = %v, want %v", err, ErrAPITokenNotFound)
+	}
+
+	// Expired tokens are refused even while cached
+	expired, err := s.CreateAPIToken(ctx, 1, dto.CreateAPITokenRequest{Name: "old", Scopes: []string{auth.ScopeGroupsRead}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.ValidateAPIToken(ctx, expired.Token, client); err != nil {
+		t.Fatalf("ValidateAPIToken() error = %v", err)
+	}
+	cached, _ := s.(*apiTokenService).local.Get(apiTokenKey(auth.HashToken(expired.Token)))
+	cached.(*models.APIToken).ExpiresAt = &past
+	if _, err := s.ValidateAPIToken(ctx, expired.Token, client); !errors.Is(err, auth.ErrInvalidToken) {
+		t.Errorf("ValidateAPIToken(expired) error = %v, want %v", err, auth.ErrInvalidToken)
+	}
+}
+
+func TestDeleteAllAPITokens(t *testing.T) {
+	ctx := context.Background()
+	client := dto.ClientInfo{IPAddress: "192.0.2.1"}
+
+	repo := newFakeAPITokenRepository()
+	s := NewAPITokenService(repo, newTestCache(t))
+
+	var tokens []string
+	for _, userID := range []int{1, 1, 2} {
+		created, err := s.CreateAPIToken(ctx, userID, dto.CreateAPITokenRequest{Name: "ci", Scopes: []string{auth.ScopeGroupsRead}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Cache each one, as a request using it would
+		if _, err := s.ValidateAPIToken(ctx, created.Token, client); err != nil {
+			t.Fatal(err)
+		}
+		tokens = append(tokens, created.Token)
+	}
+
+	if err := s.DeleteAllAPITokens(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, want := range []error{auth.ErrInvalidToken, auth.ErrInvalidToken, nil} {
+		if _, err := s.ValidateAPIToken(ctx, tokens[i], client); !errors.Is(err, want) {
+			t.Errorf("ValidateAPIToken(token %d) error = %v, want %v", i, err, want)
+		}
+	}
+}
@@ -5,7 +5,8 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
-	"strings"
+	"log"
+	"strconv"
 	"time"
 
 	"github.com/enkyuan/ato/api/cache"
@@ -13,6 +14,9 @@ import (
 	"github.com/enkyuan/ato/api/internal/models"
 	"github.com/enkyuan/ato/api/internal/repository"
 	"github.com/enkyuan/ato/api/pkg/auth"
+	"github.com/enkyuan/ato/api/pkg/mailer"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
 )
 
 var (
@@ -20,30 +24,136 @@ var (
 	ErrEmailExists        = errors.New("email already exists")
 	ErrUserNotFound       = errors.New("user not found")
 	ErrTokenRevoked       = errors.New("token has been revoked")
+	ErrTokenReuse         = errors.New("refresh token reuse detected")
+	ErrSessionNotFound    = errors.New("session not found")
+	ErrAccountDisabled    = errors.New("account is disabled")
 )
 
+const (
+	// sessionStateTTL bounds how long a revoked session's access tokens can
+	// keep working on another instance that cached the session as active
+	sessionStateTTL = time.Minute
+	// sessionTouchInterval limits how often last_used_at is written
+	sessionTouchInterval = 5 * time.Minute
+
+	// localStateTTL bounds how stale this instance's in-process view of
+	// revocations can be
+	localStateTTL        = 5 * time.Second
+	localStateMaxEntries = 10000
+	tokenEpochTTL        = time.Hour
+
+	sessionActive  = "active"
+	sessionRevoked = "revoked"
+)
+
+// TokenIssuer issues, checks and revokes the tokens in users' token families.
+// The OAuth server builds the grants users give apps on it.
+type TokenIssuer interface {
+	ValidateToken(ctx context.Context, token string) (*auth.Claims, error)
+	StartAppGrant(ctx context.Context, user *models.User, clientID string, scopes []string, client dto.ClientInfo) (*auth.TokenPair, error)
+	RotateAppRefreshToken(ctx context.Context, refreshToken string, clientID string, client dto.ClientInfo) (*auth.TokenPair, []string, error)
+	TokenEpoch(ctx context.Context, userID int) (int64, error)
+	RevokeFamily(ctx context.Context, familyID string, reason string) error
+	RevokeAccessToken(ctx context.Context, claims *auth.Claims) error
+	MarkSessionsRevoked(ctx context.Context, familyIDs []string)
+}
+
+// AccountSecurity is what the services that manage accounts, such as the
+// admin and profile services, act on a user's sessions through.
+type AccountSecurity interface {
+	EndAllSessions(ctx context.Context, userID int) error
+	EndOtherSessions(ctx context.Context, userID int, sessionID string, reason string) error
+	PasswordResetLink(ctx context.Context, user *models.User) (string, error)
+	ForgetUser(userID int)
+}
+
 type AuthService interface {
+	TokenIssuer
+	AccountSecurity
 	Register(ctx context.Context, req dto.RegisterRequest) (*dto.AuthResponse, error)
 	Login(ctx context.Context, req dto.LoginRequest) (*dto.AuthResponse, error)
 	Refresh(ctx context.Context, req dto.RefreshRequest) (*dto.AuthResponse, error)
-	Logout(ctx context.Context, token string) error
+	Logout(ctx context.Context, token string, client dto.ClientInfo) error
 	GetCurrentUser(ctx context.Context, userID int) (*models.User, error)
-	ValidateToken(ctx context.Context, token string) (*auth.Claims, error)
+	ListSessions(ctx context.Context, userID int, currentSessionID string) ([]*models.TokenFamily, error)
+	RevokeSession(ctx context.Context, userID int, sessionID string, client dto.ClientInfo) error
+	RevokeAllSessions(ctx context.Context, userID int, client dto.ClientInfo) error
+	InvalidateAllTokens(ctx context.Context, userID int) error
+	EnrollTOTP(ctx context.Context, userID int) (*dto.TOTPEnrollmentResponse, error)
+	ConfirmTOTP(ctx context.Context, userID int, req dto.TOTPConfirmRequest) ([]string, error)
+	DisableTOTP(ctx context.Context, userID int, req dto.DisableTOTPRequest) error
+	VerifyMFA(ctx context.Context, req dto.MFAVerifyRequest) (*dto.AuthResponse, error)
+	BeginPasskeyRegistration(ctx context.Context, userID int, name string) (*protocol.CredentialCreation, error)
+	FinishPasskeyRegistration(ctx context.Context, userID int, body []byte, client dto.ClientInfo) (*models.Passkey, error)
+	BeginPasskeyLogin(ctx context.Context) (*protocol.CredentialAssertion, error)
+	FinishPasskeyLogin(ctx context.Context, body []byte, client dto.ClientInfo) (*dto.AuthResponse, error)
+	ListPasskeys(ctx context.Context, userID int) ([]*models.Passkey, error)
+	RenamePasskey(ctx context.Context, userID int, passkeyID int, name string) (*models.Passkey, error)
+	DeletePasskey(ctx context.Context, userID int, passkeyID int, client dto.ClientInfo) error
+	ForgotPassword(ctx context.Context, email string) error
+	ResetPassword(ctx context.Context, req dto.ResetPasswordRequest) error
+	SendEmailVerification(ctx context.Context, userID int) error
+	VerifyEmail(ctx context.Context, req dto.VerifyEmailRequest) error
+	EmailVerified(ctx context.Context, userID int) (bool, error)
+	SendMagicLink(ctx context.Context, email string) error
+	VerifyMagicLink(ctx context.Context, req dto.MagicLinkVerifyRequest) (*dto.AuthResponse, error)
+	OIDCProviders() []string
+	OIDCAuthorizeURL(ctx context.Context, provider string) (string, string, error)
+	OIDCCallback(ctx context.Context, provider string, code string, state string, client dto.ClientInfo) (string, error)
+	OIDCExchange(ctx context.Context, req dto.OIDCExchangeRequest) (*dto.AuthResponse, error)
 }
 
 type authService struct {
-	userRepo repository.UserRepository
-	cache    *cache.Cache
+	userRepo         repository.UserRepository
+	tokenRepo        repository.TokenRepository
+	mfaRepo          repository.MFARepository
+	passkeyRepo      repository.PasskeyRepository
+	accountTokenRepo repository.AccountTokenRepository
+	identityRepo     repository.IdentityRepository
+	apiTokens        APITokenService
+	securityEvents   SecurityEventService
+	mailer           mailer.Mailer
+	cache            *cache.Cache
+	limiter          *cache.Limiter
+	local            *cache.Local
+	webauthn         *webauthn.WebAuthn
+	oidcProviders    map[string]*oidcProvider
+	passwordPolicy   *auth.PasswordPolicy
 }
 
-func NewAuthService(userRepo repository.UserRepository, cache *cache.Cache) AuthService {
+func NewAuthService(userRepo repository.UserRepository, tokenRepo repository.TokenRepository, mfaRepo repository.MFARepository, passkeyRepo repository.PasskeyRepository, accountTokenRepo repository.AccountTokenRepository, identityRepo repository.IdentityRepository, apiTokens APITokenService, securityEvents SecurityEventService, cache *cache.Cache, limiter *cache.Limiter, mailer mailer.Mailer) AuthService {
 	return &authService{
-		userRepo: userRepo,
-		cache:    cache,
+		userRepo:         userRepo,
+		tokenRepo:        tokenRepo,
+		mfaRepo:          mfaRepo,
+		passkeyRepo:      passkeyRepo,
+		accountTokenRepo: accountTokenRepo,
+		identityRepo:     identityRepo,
+		apiTokens:        apiTokens,
+		securityEvents:   securityEvents,
+		mailer:           mailer,
+		cache:            cache,
+		limiter:          limiter,
+		local:            newLocalState(),
+		webauthn:         newWebAuthn(),
+		oidcProviders:    loadOIDCProviders(),
+		passwordPolicy:   auth.LoadPasswordPolicy(),
 	}
 }
 
+// newLocalState is split out because NewAuthService's cache parameter
+// shadows the package
+func newLocalState() *cache.Local {
+	return cache.NewLocal(localStateMaxEntries)
+}
+
 func (s *authService) Register(ctx context.Context, req dto.RegisterRequest) (*dto.AuthResponse, error) {
+	req.Email = normalizeEmail(req.Email)
+
+	if err := s.passwordPolicy.Check(req.Password, req.Email, req.Name); err != nil {
+		return nil, err
+	}
+
 	// Hash password
 	hashedPassword, err := auth.HashPassword(req.Password)
 	if err != nil {
@@ -53,30 +163,30 @@ func (s *authService) Register(ctx context.Context, req dto.RegisterRequest) (*d
 	// Create user
 	user, err := s.userRepo.Create(req.Email, hashedPassword, req.Name)
 	if err != nil {
-		if strings.Contains(err.Error(), "duplicate key") {
+		if repository.IsUniqueViolation(err) {
 			return nil, ErrEmailExists
 		}
 		return nil, fmt.Errorf("failed to create user: %w", err)
 	}
 
-	// Generate tokens
-	tokenPair, err := auth.GenerateTokenPair(user.ID, user.Email)
-	if err != nil {
-		return nil, fmt.Errorf("failed to generate tokens: %w", err)
+	if err := s.sendEmailVerification(ctx, user); err != nil {
+		// Log error but don't fail the request; the user can ask for another
+		log.Printf("Failed to send verification email: %v", err)
 	}
 
-	return &dto.AuthResponse{
-		AccessToken:  tokenPair.AccessToken,
-		RefreshToken: tokenPair.RefreshToken,
-		User:         user,
-	}, nil
+	return s.startFamily(ctx, user, loginMethodRegister, req.Client)
 }
 
 func (s *authService) Login(ctx context.Context, req dto.LoginRequest) (*dto.AuthResponse, error) {
+	if err := s.checkLoginThrottle(ctx, req.Email); err != nil {
+		return nil, err
+	}
+
 	// Get user by email
-	user, err := s.userRepo.GetByEmail(req.Email)
+	user, err := s.userRepo.GetByEmail(normalizeEmail(req.Email))
 	if err != nil {
 		if err == sql.ErrNoRows {
+			s.recordLoginFailure(ctx, req.Email, nil, req.Client)
 			return nil, ErrInvalidCredentials
 		}
 		return nil, fmt.Errorf("failed to get user: %w", err)
@@ -84,90 +194,336 @@ func (s *authService) Login(ctx context.Context, req dto.LoginRequest) (*dto.Aut
 
 	// Verify password
 	if !auth.CheckPassword(req.Password, user.PasswordHash) {
+		s.recordLoginFailure(ctx, req.Email, user, req.Client)
 		return nil, ErrInvalidCredentials
 	}
 
-	// Generate tokens
-	tokenPair, err := auth.GenerateTokenPair(user.ID, user.Email)
+	s.resetLoginFailures(ctx, req.Email)
+
+	// Checked before the 2FA step so a disabled account is not asked for a
+	// code it cannot use
+	if user.DisabledAt != nil {
+		return nil, ErrAccountDisabled
+	}
+	s.upgradePasswordHash(user, req.Password)
+
+	mfaEnabled, err := s.mfaEnabled(ctx, user.ID)
 	if err != nil {
-		return nil, fmt.Errorf("failed to generate tokens: %w", err)
+		return nil, err
+	}
+	if mfaEnabled {
+		return s.startMFAChallenge(ctx, user.ID)
 	}
 
-	return &dto.AuthResponse{
-		AccessToken:  tokenPair.AccessToken,
-		RefreshToken: tokenPair.RefreshToken,
-		User:         user,
-	}, nil
+	return s.startFamily(ctx, user, loginMethodPassword, req.Client)
+}
+
+// upgradePasswordHash rehashes a password that just verified if its stored
+// hash uses an older algorithm or weaker parameters than are configured now.
+func (s *authService) upgradePasswordHash(user *models.User, password string) {
+	if !auth.PasswordNeedsRehash(user.PasswordHash) {
+		return
+	}
+
+	hashedPassword, err := auth.HashPassword(password)
+	if err != nil {
+		log.Printf("Failed to rehash password for user %d: %v", user.ID, err)
+		return
+	}
+
+	if err := s.userRepo.UpgradePasswordHash(user.ID, user.PasswordHash, hashedPassword); err != nil {
+		// Log error but don't fail the login; the old hash still works
+		log.Printf("Failed to upgrade password hash for user %d: %v", user.ID, err)
+		return
+	}
+	user.PasswordHash = hashedPassword
 }
 
+// Refresh rotates a refresh token: the presented token is spent and a new
+// pair in the same family is issued. Presenting a token that was already
+// spent means it leaked, so the whole family is revoked.
 func (s *authService) Refresh(ctx context.Context, req dto.RefreshRequest) (*dto.AuthResponse, error) {
+	tokenPair, _, user, err := s.rotateRefreshToken(ctx, req.RefreshToken, "", req.Client)
+	if err != nil {
+		return nil, err
+	}
+
+	return authResponse(tokenPair, user), nil
+}
+
+// rotateRefreshToken spends a refresh token that was issued to clientID,
+// which is empty for the user's own logins, and issues the next pair in its
+// family. The token is only marked spent in the same transaction that stores
+// its replacement, so a failure on the way leaves it good for a retry rather
+// than looking like reuse.
+func (s *authService) rotateRefreshToken(ctx context.Context, refreshToken string, clientID string, client dto.ClientInfo) (*auth.TokenPair, *models.RefreshToken, *models.User, error) {
 	// Validate refresh token
-	claims, err := auth.ValidateToken(req.RefreshToken)
+	claims, err := auth.ValidateRefreshToken(refreshToken)
 	if err != nil {
-		return nil, fmt.Errorf("invalid refresh token: %w", err)
+		return nil, nil, nil, fmt.Errorf("invalid refresh token: %w", err)
 	}
 
-	// Check if token is blacklisted
-	blacklistKey := fmt.Sprintf("blacklist:%s", req.RefreshToken)
-	_, err = s.cache.Get(ctx, blacklistKey)
-	if err == nil {
-		return nil, ErrTokenRevoked
+	if claims.ID == "" {
+		return nil, nil, nil, fmt.Errorf("invalid refresh token: %w", auth.ErrInvalidToken)
+	}
+
+	token, err := s.tokenRepo.GetRefreshToken(ctx, claims.ID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil, nil, fmt.Errorf("invalid refresh token: %w", auth.ErrInvalidToken)
+		}
+		return nil, nil, nil, fmt.Errorf("failed to get refresh token: %w", err)
+	}
+
+	// An app's refresh tokens only work at the OAuth token endpoint, and only
+	// for that app
+	if token.UserID != claims.UserID || token.FamilyClientID != clientID {
+		return nil, nil, nil, fmt.Errorf("invalid refresh token: %w", auth.ErrInvalidToken)
+	}
+
+	if token.FamilyRevokedAt != nil {
+		return nil, nil, nil, ErrTokenRevoked
+	}
+
+	if token.RotatedAt != nil {
+		return nil, nil, nil, s.refreshTokenReused(ctx, token, client)
 	}
 
 	// Get user to ensure they still exist
 	user, err := s.userRepo.GetByID(claims.UserID)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return nil, ErrUserNotFound
+			return nil, nil, nil, ErrUserNotFound
 		}
-		return nil, fmt.Errorf("failed to get user: %w", err)
+		return nil, nil, nil, fmt.Errorf("failed to get user: %w", err)
+	}
+
+	if claims.Epoch < user.TokenEpoch {
+		return nil, nil, nil, ErrTokenRevoked
+	}
+	if user.DisabledAt != nil {
+		return nil, nil, nil, ErrAccountDisabled
+	}
+
+	grant := tokenGrant{familyID: token.FamilyID, clientID: clientID, scopes: token.FamilyScopes}
+	if clientID == "" {
+		// The user's own logins may do anything
+		grant.scopes = auth.AllScopes()
 	}
 
-	// Generate new token pair
-	tokenPair, err := auth.GenerateTokenPair(user.ID, user.Email)
+	tokenPair, err := generateTokenPair(user, grant)
 	if err != nil {
-		return nil, fmt.Errorf("failed to generate tokens: %w", err)
+		return nil, nil, nil, err
+	}
+
+	rotated, err := s.tokenRepo.RotateRefreshToken(ctx, token.ID, refreshTokenRecord(tokenPair, user, grant, &token.ID))
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to rotate refresh token: %w", err)
+	}
+
+	// Another request spent the token since it was read
+	if !rotated {
+		return nil, nil, nil, s.refreshTokenReused(ctx, token, client)
+	}
+
+	if err := s.tokenRepo.TouchFamily(ctx, token.FamilyID); err != nil {
+		// Log error but don't fail the request
+		log.Printf("Failed to update session last use: %v", err)
+	}
+
+	metadata := map[string]string{"session_id": token.FamilyID}
+	if clientID != "" {
+		metadata["client_id"] = clientID
+	}
+	s.recordSecurityEvent(ctx, &models.SecurityEvent{
+		UserID:    user.ID,
+		Type:      models.SecurityEventTokenRefreshed,
+		IPAddress: client.IPAddress,
+		UserAgent: client.UserAgent,
+		Metadata:  metadata,
+	})
+
+	return tokenPair, token, user, nil
+}
+
+// refreshTokenReused revokes the family of a refresh token that was presented
+// after it had been spent, since that means it leaked.
+func (s *authService) refreshTokenReused(ctx context.Context, token *models.RefreshToken, client dto.ClientInfo) error {
+	if err := s.RevokeFamily(ctx, token.FamilyID, models.TokenFamilyRevokedReuse); err != nil {
+		return err
+	}
+
+	s.recordSecurityEvent(ctx, &models.SecurityEvent{
+		UserID:    token.UserID,
+		Type:      models.SecurityEventRefreshTokenReuse,
+		IPAddress: client.IPAddress,
+		UserAgent: client.UserAgent,
+		Metadata: map[string]string{
+			"family_id": token.FamilyID,
+			"token_id":  token.ID,
+		},
+	})
+
+	return ErrTokenReuse
+}
+
+func (s *authService) Logout(ctx context.Context, token string, client dto.ClientInfo) error {
+	// Validate token to get expiry
+	claims, err := auth.ValidateAccessToken(token)
+	if err != nil {
+		return fmt.Errorf("invalid token: %w", err)
+	}
+
+	if err := s.RevokeAccessToken(ctx, claims); err != nil {
+		return err
 	}
 
-	// Blacklist old refresh token
-	expiresAt := time.Unix(claims.ExpiresAt.Unix(), 0)
-	ttl := time.Until(expiresAt)
-	if ttl > 0 {
-		if err := s.cache.Set(ctx, blacklistKey, "1", ttl); err != nil {
-			// Log error but don't fail the request
-			fmt.Printf("Failed to blacklist old refresh token: %v\n", err)
+	// Revoke the refresh tokens issued alongside it
+	if claims.FamilyID != "" {
+		if err := s.RevokeFamily(ctx, claims.FamilyID, models.TokenFamilyRevokedLogout); err != nil {
+			return err
 		}
 	}
 
+	s.recordSecurityEvent(ctx, &models.SecurityEvent{
+		UserID:    claims.UserID,
+		Type:      models.SecurityEventLogout,
+		IPAddress: client.IPAddress,
+		UserAgent: client.UserAgent,
+		Metadata:  map[string]string{"session_id": claims.FamilyID},
+	})
+
+	return nil
+}
+
+// startFamily begins a new token family, i.e. a session, for a fresh login.
+// method is how the user signed in, for the security event log.
+func (s *authService) startFamily(ctx context.Context, user *models.User, method string, client dto.ClientInfo) (*dto.AuthResponse, error) {
+	if user.DisabledAt != nil {
+		return nil, ErrAccountDisabled
+	}
+
+	family := &models.TokenFamily{
+		UserID:    user.ID,
+		UserAgent: client.UserAgent,
+		IPAddress: client.IPAddress,
+	}
+	if err := s.tokenRepo.CreateFamily(ctx, family); err != nil {
+		return nil, fmt.Errorf("failed to create token family: %w", err)
+	}
+
+	s.securityEvents.RecordLogin(ctx, user, family.ID, method, client)
+
+	// The user's own logins may do anything
+	tokenPair, err := s.issueTokenPair(ctx, user, tokenGrant{familyID: family.ID, scopes: auth.AllScopes()}, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return authResponse(tokenPair, user), nil
+}
+
+func authResponse(tokenPair *auth.TokenPair, user *models.User) *dto.AuthResponse {
 	return &dto.AuthResponse{
 		AccessToken:  tokenPair.AccessToken,
 		RefreshToken: tokenPair.RefreshToken,
 		User:         user,
-	}, nil
+	}
 }
 
-func (s *authService) Logout(ctx context.Context, token string) error {
-	// Validate token to get expiry
-	claims, err := auth.ValidateToken(token)
+// tokenGrant is what the tokens in a family are issued for: the app they
+// belong to, if any, and what they may do.
+type tokenGrant struct {
+	familyID string
+	clientID string
+	scopes   []string
+}
+
+// issueTokenPair generates a token pair for the grant and records the refresh
+// token so it can be rotated exactly once.
+func (s *authService) issueTokenPair(ctx context.Context, user *models.User, grant tokenGrant, parentID *string) (*auth.TokenPair, error) {
+	tokenPair, err := generateTokenPair(user, grant)
 	if err != nil {
-		return fmt.Errorf("invalid token: %w", err)
+		return nil, err
 	}
 
-	// Blacklist the token
-	expiresAt := time.Unix(claims.ExpiresAt.Unix(), 0)
-	ttl := time.Until(expiresAt)
-	if ttl > 0 {
-		blacklistKey := fmt.Sprintf("blacklist:%s", token)
-		if err := s.cache.Set(ctx, blacklistKey, "1", ttl); err != nil {
-			return fmt.Errorf("failed to blacklist token: %w", err)
-		}
+	if err := s.tokenRepo.CreateRefreshToken(ctx, refreshTokenRecord(tokenPair, user, grant, parentID)); err != nil {
+		return nil, fmt.Errorf("failed to store refresh token: %w", err)
 	}
 
-	return nil
+	return tokenPair, nil
+}
+
+func generateTokenPair(user *models.User, grant tokenGrant) (*auth.TokenPair, error) {
+	tokenPair, err := auth.GenerateTokenPair(auth.TokenSubject{
+		UserID:   user.ID,
+		Email:    user.Email,
+		FamilyID: grant.familyID,
+		Epoch:    user.TokenEpoch,
+		Scopes:   grant.scopes,
+		ClientID: grant.clientID,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate tokens: %w", err)
+	}
+
+	return tokenPair, nil
+}
+
+// refreshTokenRecord is the row stored for a pair's refresh token. parentID
+// is the token it replaced, if any.
+func refreshTokenRecord(tokenPair *auth.TokenPair, user *models.User, grant tokenGrant, parentID *string) *models.RefreshToken {
+	return &models.RefreshToken{
+		ID:        tokenPair.RefreshTokenID,
+		FamilyID:  grant.familyID,
+		UserID:    user.ID,
+		ParentID:  parentID,
+		ExpiresAt: tokenPair.RefreshExpiresAt,
+	}
+}
+
+// StartAppGrant begins a token family for access the user granted an app,
+// and issues its first token pair.
+func (s *authService) StartAppGrant(ctx context.Context, user *models.User, clientID string, scopes []string, client dto.ClientInfo) (*auth.TokenPair, error) {
+	family := &models.TokenFamily{
+		UserID:    user.ID,
+		ClientID:  clientID,
+		Scopes:    scopes,
+		UserAgent: client.UserAgent,
+		IPAddress: client.IPAddress,
+	}
+	if err := s.tokenRepo.CreateFamily(ctx, family); err != nil {
+		return nil, fmt.Errorf("failed to create token family: %w", err)
+	}
+
+	return s.issueTokenPair(ctx, user, tokenGrant{
+		familyID: family.ID,
+		clientID: clientID,
+		scopes:   scopes,
+	}, nil)
+}
+
+// RotateAppRefreshToken spends a refresh token issued to the app and returns
+// the next pair, with the scopes the grant holds.
+func (s *authService) RotateAppRefreshToken(ctx context.Context, refreshToken string, clientID string, client dto.ClientInfo) (*auth.TokenPair, []string, error) {
+	tokenPair, token, _, err := s.rotateRefreshToken(ctx, refreshToken, clientID, client)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return tokenPair, token.FamilyScopes, nil
+}
+
+func (s *authService) recordSecurityEvent(ctx context.Context, event *models.SecurityEvent) {
+	s.securityEvents.Record(ctx, event)
 }
 
 func (s *authService) GetCurrentUser(ctx context.Context, userID int) (*models.User, error) {
-	user, err := s.userRepo.GetByID(userID)
+	return getUser(s.userRepo, userID)
+}
+
+func getUser(userRepo repository.UserRepository, userID int) (*models.User, error) {
+	user, err := userRepo.GetByID(userID)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, ErrUserNotFound
@@ -179,18 +535,297 @@ func (s *authService) GetCurrentUser(ctx context.Context, userID int) (*models.U
 }
 
 func (s *authService) ValidateToken(ctx context.Context, token string) (*auth.Claims, error) {
-	// Check if token is blacklisted
-	blacklistKey := fmt.Sprintf("blacklist:%s", token)
-	_, err := s.cache.Get(ctx, blacklistKey)
-	if err == nil {
+	// Validate token
+	claims, err := auth.ValidateAccessToken(token)
+	if err != nil {
+		return nil, err
+	}
+
+	if claims.ID != "" && s.tokenRevoked(ctx, claims.ID) {
 		return nil, ErrTokenRevoked
 	}
 
-	// Validate token
-	claims, err := auth.ValidateToken(token)
+	epoch, err := s.TokenEpoch(ctx, claims.UserID)
 	if err != nil {
 		return nil, err
 	}
+	if claims.Epoch < epoch {
+		return nil, ErrTokenRevoked
+	}
+
+	// Access tokens die with the session they were issued for
+	if claims.FamilyID != "" {
+		active, err := s.sessionActive(ctx, claims.FamilyID)
+		if err != nil {
+			return nil, err
+		}
+		if !active {
+			return nil, ErrTokenRevoked
+		}
+
+		s.touchSession(ctx, claims.FamilyID)
+	}
 
 	return claims, nil
 }
+
+func (s *authService) ListSessions(ctx context.Context, userID int, currentSessionID string) ([]*models.TokenFamily, error) {
+	sessions, err := s.tokenRepo.ListActiveFamilies(ctx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list sessions: %w", err)
+	}
+
+	for _, session := range sessions {
+		session.Current = session.ID == currentSessionID
+	}
+
+	return sessions, nil
+}
+
+func (s *authService) RevokeSession(ctx context.Context, userID int, sessionID string, client dto.ClientInfo) error {
+	if !isUUID(sessionID) {
+		return ErrSessionNotFound
+	}
+
+	if err := s.tokenRepo.RevokeUserFamily(ctx, sessionID, userID, models.TokenFamilyRevokedByUser); err != nil {
+		if err == sql.ErrNoRows {
+			return ErrSessionNotFound
+		}
+		return fmt.Errorf("failed to revoke session: %w", err)
+	}
+
+	s.markSession(ctx, sessionID, sessionRevoked)
+
+	s.recordSecurityEvent(ctx, &models.SecurityEvent{
+		UserID:    userID,
+		Type:      models.SecurityEventSessionRevoked,
+		IPAddress: client.IPAddress,
+		UserAgent: client.UserAgent,
+		Metadata:  map[string]string{"session_id": sessionID},
+	})
+
+	return nil
+}
+
+func (s *authService) RevokeAllSessions(ctx context.Context, userID int, client dto.ClientInfo) error {
+	if err := s.EndAllSessions(ctx, userID); err != nil {
+		return err
+	}
+
+	s.recordSecurityEvent(ctx, &models.SecurityEvent{
+		UserID:    userID,
+		Type:      models.SecurityEventLogoutAll,
+		IPAddress: client.IPAddress,
+		UserAgent: client.UserAgent,
+	})
+
+	return nil
+}
+
+// EndAllSessions logs the user out everywhere, including apps and personal
+// access tokens. Callers record why.
+func (s *authService) EndAllSessions(ctx context.Context, userID int) error {
+	ids, err := s.tokenRepo.RevokeAllFamilies(ctx, userID, models.TokenFamilyRevokedLogoutAll)
+	if err != nil {
+		return fmt.Errorf("failed to revoke sessions: %w", err)
+	}
+
+	for _, id := range ids {
+		s.markSession(ctx, id, sessionRevoked)
+	}
+
+	if err := s.apiTokens.DeleteAllAPITokens(ctx, userID); err != nil {
+		return err
+	}
+
+	return s.InvalidateAllTokens(ctx, userID)
+}
+
+// EndOtherSessions logs the user out of every session and app but the one
+// making a change. Callers delete API tokens themselves if they should go
+// too.
+func (s *authService) EndOtherSessions(ctx context.Context, userID int, sessionID string, reason string) error {
+	ids, err := s.tokenRepo.RevokeOtherFamilies(ctx, userID, sessionID, reason)
+	if err != nil {
+		return fmt.Errorf("failed to revoke sessions: %w", err)
+	}
+
+	for _, id := range ids {
+		s.markSession(ctx, id, sessionRevoked)
+	}
+
+	return nil
+}
+
+// InvalidateAllTokens bumps the user's token epoch, which rejects every access
+// and refresh token issued to them before now.
+func (s *authService) InvalidateAllTokens(ctx context.Context, userID int) error {
+	epoch, err := s.userRepo.IncrementTokenEpoch(userID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return ErrUserNotFound
+		}
+		return fmt.Errorf("failed to invalidate tokens: %w", err)
+	}
+
+	key := tokenEpochKey(userID)
+	if err := s.cache.Set(ctx, key, strconv.FormatInt(epoch, 10), tokenEpochTTL); err != nil {
+		// Log error but don't fail the request
+		log.Printf("Failed to cache token epoch: %v", err)
+	}
+	s.local.Set(key, epoch, localStateTTL)
+
+	return nil
+}
+
+func (s *authService) RevokeFamily(ctx context.Context, familyID string, reason string) error {
+	if err := s.tokenRepo.RevokeFamily(ctx, familyID, reason); err != nil {
+		return fmt.Errorf("failed to revoke token family: %w", err)
+	}
+
+	s.markSession(ctx, familyID, sessionRevoked)
+	return nil
+}
+
+// RevokeAccessToken revokes a single access token by jti, until it would have
+// expired anyway.
+func (s *authService) RevokeAccessToken(ctx context.Context, claims *auth.Claims) error {
+	ttl := time.Until(claims.ExpiresAt.Time)
+	if claims.ID == "" || ttl <= 0 {
+		return nil
+	}
+
+	if err := s.cache.Set(ctx, revokedTokenKey(claims.ID), "1", ttl); err != nil {
+		return fmt.Errorf("failed to revoke token: %w", err)
+	}
+	s.local.Set(revokedTokenKey(claims.ID), true, localStateTTL)
+
+	return nil
+}
+
+// tokenRevoked reports whether a token was revoked by jti. A Redis failure is
+// treated as not revoked; the session and epoch checks still apply.
+func (s *authService) tokenRevoked(ctx context.Context, tokenID string) bool {
+	key := revokedTokenKey(tokenID)
+	if revoked, ok := s.local.Get(key); ok {
+		return revoked.(bool)
+	}
+
+	_, err := s.cache.Get(ctx, key)
+	revoked := err == nil
+	s.local.Set(key, revoked, localStateTTL)
+
+	return revoked
+}
+
+// TokenEpoch returns the user's current token epoch, looking in the
+// in-process cache, then Redis, then the database.
+func (s *authService) TokenEpoch(ctx context.Context, userID int) (int64, error) {
+	key := tokenEpochKey(userID)
+	if epoch, ok := s.local.Get(key); ok {
+		return epoch.(int64), nil
+	}
+
+	if value, err := s.cache.Get(ctx, key); err == nil {
+		if epoch, err := strconv.ParseInt(value, 10, 64); err == nil {
+			s.local.Set(key, epoch, localStateTTL)
+			return epoch, nil
+		}
+	}
+
+	epoch, err := s.userRepo.GetTokenEpoch(userID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return 0, ErrTokenRevoked
+		}
+		return 0, fmt.Errorf("failed to get token epoch: %w", err)
+	}
+
+	if err := s.cache.Set(ctx, key, strconv.FormatInt(epoch, 10), tokenEpochTTL); err != nil {
+		log.Printf("Failed to cache token epoch: %v", err)
+	}
+	s.local.Set(key, epoch, localStateTTL)
+
+	return epoch, nil
+}
+
+// sessionActive checks whether a session is still live. The answer is cached
+// briefly so authenticating a request does not always hit the database.
+func (s *authService) sessionActive(ctx context.Context, familyID string) (bool, error) {
+	key := sessionStateKey(familyID)
+	if state, ok := s.local.Get(key); ok {
+		return state == sessionActive, nil
+	}
+
+	if state, err := s.cache.Get(ctx, key); err == nil {
+		s.local.Set(key, state, localStateTTL)
+		return state == sessionActive, nil
+	}
+
+	family, err := s.tokenRepo.GetFamily(ctx, familyID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to get session: %w", err)
+	}
+
+	state := sessionActive
+	if family.RevokedAt != nil {
+		state = sessionRevoked
+	}
+	s.markSession(ctx, familyID, state)
+
+	return state == sessionActive, nil
+}
+
+// MarkSessionsRevoked drops the cached state of families that were revoked in
+// the database, so their access tokens stop working right away.
+func (s *authService) MarkSessionsRevoked(ctx context.Context, familyIDs []string) {
+	for _, id := range familyIDs {
+		s.markSession(ctx, id, sessionRevoked)
+	}
+}
+
+func (s *authService) markSession(ctx context.Context, familyID string, state string) {
+	s.local.Set(sessionStateKey(familyID), state, localStateTTL)
+	if err := s.cache.Set(ctx, sessionStateKey(familyID), state, sessionStateTTL); err != nil {
+		log.Printf("Failed to cache session state: %v", err)
+	}
+}
+
+// touchSession records that the session was used, at most once per
+// sessionTouchInterval across all instances. This instance remembers its own
+// touches so most requests skip the Redis round-trip too.
+func (s *authService) touchSession(ctx context.Context, familyID string) {
+	key := sessionTouchedKey(familyID)
+	if _, ok := s.local.Get(key); ok {
+		return
+	}
+	s.local.Set(key, true, sessionTouchInterval)
+
+	due, err := s.cache.SetNX(ctx, key, "1", sessionTouchInterval)
+	if err != nil || !due {
+		return
+	}
+
+	if err := s.tokenRepo.TouchFamily(ctx, familyID); err != nil {
+		log.Printf("Failed to update session last use: %v", err)
+	}
+}
+
+func sessionStateKey(familyID string) string {
+	return fmt.Sprintf("session:state:%s", familyID)
+}
+
+func sessionTouchedKey(familyID string) string {
+	return fmt.Sprintf("session:touched:%s", familyID)
+}
+
+func revokedTokenKey(tokenID string) string {
+	return fmt.Sprintf("revoked:jti:%s", tokenID)
+}
+
+func tokenEpochKey(userID int) string {
+	return fmt.Sprintf("token_epoch:user:%d", userID)
+}
@@ -0,0 +1,160 @@
+package service
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/enkyuan/ato/api/internal/dto"
+	"github.com/enkyuan/ato/api/internal/models"
+	"github.com/enkyuan/ato/api/pkg/mailer"
+)
+
+const (
+	// dataExportTTL is how long a finished export can be downloaded
+	dataExportTTL = 7 * 24 * time.Hour
+	// dataExportBuildTimeout bounds building one export. A pending export
+	// older than this was lost, for example to a restart, and no longer
+	// blocks asking for a new one.
+	dataExportBuildTimeout = 5 * time.Minute
+)
+
+var (
+	ErrDataExportInProgress = errors.New("a data export is already being prepared")
+	ErrDataExportNotFound   = errors.New("data export not found")
+)
+
+// RequestDataExport starts building an archive of everything stored about
+// the user. It is built in the background, and the user is emailed when it
+// is ready to download.
+func (s *accountLifecycleService) RequestDataExport(ctx context.Context, userID int, client dto.ClientInfo) (*models.DataExport, error) {
+	user, err := getUser(s.userRepo, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	latest, err := s.dataExportRepo.GetLatest(ctx, userID)
+	switch {
+	case err == sql.ErrNoRows:
+	case err != nil:
+		return nil, fmt.Errorf("failed to get data export: %w", err)
+	case latest.Status == models.DataExportPending && time.Since(latest.CreatedAt) < dataExportBuildTimeout:
+		return nil, ErrDataExportInProgress
+	}
+
+	export, err := s.dataExportRepo.Create(ctx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create data export: %w", err)
+	}
+
+	saveSecurityEvent(ctx, s.securityEventRepo, &models.SecurityEvent{
+		UserID:    userID,
+		Type:      models.SecurityEventDataExportRequested,
+		IPAddress: client.IPAddress,
+		UserAgent: client.UserAgent,
+	})
+
+	go s.buildDataExport(export.ID, user)
+
+	return export, nil
+}
+
+func (s *accountLifecycleService) ListDataExports(ctx context.Context, userID int) ([]*models.DataExport, error) {
+	exports, err := s.dataExportRepo.ListByUser(ctx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list data exports: %w", err)
+	}
+
+	return exports, nil
+}
+
+// GetDataExport returns a finished export with its archive.
+func (s *accountLifecycleService) GetDataExport(ctx context.Context, userID int, exportID int) (*models.DataExport, error) {
+	export, err := s.dataExportRepo.GetArchive(ctx, exportID, userID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrDataExportNotFound
+		}
+		return nil, fmt.Errorf("failed to get data export: %w", err)
+	}
+
+	return export, nil
+}
+
+// buildDataExport runs in the background, so it does not share the request's
+// context.
+func (s *accountLifecycleService) buildDataExport(exportID int, user *models.User) {
+	ctx, cancel := context.WithTimeout(context.Background(), dataExportBuildTimeout)
+	defer cancel()
+
+	archive, err := s.dataExportArchive(ctx, user.ID)
+	if err == nil {
+		err = s.dataExportRepo.Complete(ctx, exportID, archive, time.Now().Add(dataExportTTL))
+	}
+	if err != nil {
+		log.Printf("Failed to build data export %d: %v", exportID, err)
+		// ctx may be what timed out
+		if err := s.dataExportRepo.Fail(context.Background(), exportID); err != nil {
+			log.Printf("Failed to mark data export %d failed: %v", exportID, err)
+		}
+
+		sendMailAsync(s.mailer, mailer.Message{
+			To:      user.Email,
+			Subject: "Your data export failed",
+			Body:    fmt.Sprintf("Hi %s,\n\nWe couldn't prepare the copy of your data you asked for. Please try again later.\n", user.Name),
+		})
+		return
+	}
+
+	sendMailAsync(s.mailer, mailer.Message{
+		To:      user.Email,
+		Subject: "Your data export is ready",
+		Body: fmt.Sprintf("Hi %s,\n\nThe copy of your data you asked for is ready. Download it from your account settings within 7 days:\n\n%s\n",
+			user.Name, frontendURL("/settings/account")),
+	})
+}
+
+// dataExportArchive builds a zip file with one JSON file per kind of data,
+// such as account.json and todos.json.
+func (s *accountLifecycleService) dataExportArchive(ctx context.Context, userID int) ([]byte, error) {
+	data, err := s.dataExportRepo.CollectUserData(ctx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to collect user data: %w", err)
+	}
+
+	names := make([]string, 0, len(data))
+	for name := range data {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	archive := zip.NewWriter(&buf)
+	for _, name := range names {
+		var pretty bytes.Buffer
+		if err := json.Indent(&pretty, data[name], "", "  "); err != nil {
+			return nil, fmt.Errorf("failed to format %s: %w", name, err)
+		}
+		pretty.WriteByte('\n')
+
+		file, err := archive.Create(name + ".json")
+		if err != nil {
+			return nil, err
+		}
+		if _, err := file.Write(pretty.Bytes()); err != nil {
+			return nil, err
+		}
+	}
+	if err := archive.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
@@ -2,7 +2,9 @@ package service
 
 import (
 	"context"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"time"
 
@@ -11,12 +13,20 @@ import (
 	"github.com/enkyuan/ato/api/internal/repository"
 )
 
+var (
+	ErrGroupNotFound   = errors.New("group not found")
+	ErrVersionMismatch = errors.New("version mismatch")
+)
+
 type GroupService interface {
 	CreateGroup(ctx context.Context, userID int, name string) (*models.Group, error)
 	GetUserGroups(ctx context.Context, userID int) ([]*models.Group, error)
-	UpdateGroupName(ctx context.Context, groupID int, userID int, name string) error
-	UpdateGroupPosition(ctx context.Context, groupID int, position int) error
-	DeleteGroup(ctx context.Context, groupID int, userID int) error
+	GetGroup(ctx context.Context, groupID int, userID int) (*models.Group, error)
+	// The ifMatch argument of the write methods lists the versions the
+	// client expects the group to be at; nil makes the write unconditional.
+	UpdateGroupName(ctx context.Context, groupID int, userID int, name string, ifMatch []int64) (*models.Group, error)
+	UpdateGroupPosition(ctx context.Context, groupID int, userID int, position int, ifMatch []int64) (*models.Group, error)
+	DeleteGroup(ctx context.Context, groupID int, userID int, ifMatch []int64) error
 }
 
 type groupService struct {
@@ -66,31 +76,45 @@ func (s *groupService) GetUserGroups(ctx context.Context, userID int) ([]*models
 	return groups, nil
 }
 
-func (s *groupService) UpdateGroupName(ctx context.Context, groupID int, userID int, name string) error {
-	if err := s.groupRepo.UpdateName(ctx, groupID, userID, name); err != nil {
-		return err
+func (s *groupService) GetGroup(ctx context.Context, groupID int, userID int) (*models.Group, error) {
+	group, err := s.groupRepo.GetByID(ctx, groupID, userID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrGroupNotFound
+		}
+		return nil, err
+	}
+
+	return group, nil
+}
+
+func (s *groupService) UpdateGroupName(ctx context.Context, groupID int, userID int, name string, ifMatch []int64) (*models.Group, error) {
+	group, err := s.groupRepo.UpdateName(ctx, groupID, userID, name, ifMatch)
+	if err != nil {
+		return nil, s.writeError(ctx, err, groupID, userID)
 	}
 
 	// Invalidate cache
 	s.cache.DeletePattern(ctx, fmt.Sprintf("groups:user:%d", userID))
 
-	return nil
+	return group, nil
 }
 
-func (s *groupService) UpdateGroupPosition(ctx context.Context, groupID int, position int) error {
-	if err := s.groupRepo.UpdatePosition(ctx, groupID, position); err != nil {
-		return err
+func (s *groupService) UpdateGroupPosition(ctx context.Context, groupID int, userID int, position int, ifMatch []int64) (*models.Group, error) {
+	group, err := s.groupRepo.UpdatePosition(ctx, groupID, userID, position, ifMatch)
+	if err != nil {
+		return nil, s.writeError(ctx, err, groupID, userID)
 	}
 
-	// Invalidate cache - we don't have direct access to userID here, so invalidate all
-	s.cache.DeletePattern(ctx, "groups:user:*")
+	// Invalidate cache
+	s.cache.DeletePattern(ctx, fmt.Sprintf("groups:user:%d", userID))
 
-	return nil
+	return group, nil
 }
 
-func (s *groupService) DeleteGroup(ctx context.Context, groupID int, userID int) error {
-	if err := s.groupRepo.Delete(ctx, groupID, userID); err != nil {
-		return err
+func (s *groupService) DeleteGroup(ctx context.Context, groupID int, userID int, ifMatch []int64) error {
+	if err := s.groupRepo.Delete(ctx, groupID, userID, ifMatch); err != nil {
+		return s.writeError(ctx, err, groupID, userID)
 	}
 
 	// Invalidate cache
@@ -98,3 +122,20 @@ func (s *groupService) DeleteGroup(ctx context.Context, groupID int, userID int)
 
 	return nil
 }
+
+// writeError tells apart the two reasons a conditional write can match no
+// rows: the group is gone, or it exists at a different version.
+func (s *groupService) writeError(ctx context.Context, err error, groupID int, userID int) error {
+	if err != sql.ErrNoRows {
+		return err
+	}
+
+	if _, err := s.groupRepo.GetByID(ctx, groupID, userID); err != nil {
+		if err == sql.ErrNoRows {
+			return ErrGroupNotFound
+		}
+		return err
+	}
+
+	return ErrVersionMismatch
+}
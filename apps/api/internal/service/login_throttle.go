@@ -0,0 +1,105 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/enkyuan/ato/api/internal/dto"
+	"github.com/enkyuan/ato/api/internal/models"
+	"github.com/enkyuan/ato/api/pkg/auth"
+)
+
+var (
+	ErrTooManyRequests = errors.New("too many requests")
+)
+
+const (
+	loginFailureWindow = 15 * time.Minute
+	// After loginDelayAfter failures each attempt has to wait twice as long
+	// as the last, up to loginMaxDelay
+	loginDelayAfter = 3
+	loginMaxDelay   = time.Minute
+	// After loginLockoutAfter failures the account is locked until the oldest
+	// of them leaves the window
+	loginLockoutAfter = 10
+)
+
+// RateLimitError is returned when the caller has to wait before trying
+// again. It matches ErrTooManyRequests with errors.Is.
+type RateLimitError struct {
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("%s, retry after %s", ErrTooManyRequests, e.RetryAfter)
+}
+
+func (e *RateLimitError) Unwrap() error {
+	return ErrTooManyRequests
+}
+
+// checkLoginThrottle turns away password attempts for an account that has
+// failed too often recently, before any password hashing is done. Unknown emails
+// are throttled the same way so the response does not reveal which exist.
+func (s *authService) checkLoginThrottle(ctx context.Context, email string) error {
+	now := time.Now()
+	window := s.limiter.Peek(ctx, loginFailureKey(email), loginFailureWindow)
+
+	if window.Count >= loginLockoutAfter {
+		return &RateLimitError{RetryAfter: window.ResetAfter(loginFailureWindow, now)}
+	}
+
+	if window.Count >= loginDelayAfter {
+		if wait := window.Newest.Add(loginDelay(window.Count)).Sub(now); wait > 0 {
+			return &RateLimitError{RetryAfter: wait}
+		}
+	}
+
+	return nil
+}
+
+// recordLoginFailure counts a wrong password. user is nil when no account
+// has the email.
+func (s *authService) recordLoginFailure(ctx context.Context, email string, user *models.User, client dto.ClientInfo) {
+	window := s.limiter.Record(ctx, loginFailureKey(email), loginFailureWindow)
+
+	if user != nil {
+		s.recordSecurityEvent(ctx, &models.SecurityEvent{
+			UserID:    user.ID,
+			Type:      models.SecurityEventLoginFailed,
+			IPAddress: client.IPAddress,
+			UserAgent: client.UserAgent,
+			Metadata:  map[string]string{"reason": "invalid_password"},
+		})
+	}
+
+	if user != nil && window.Count == loginLockoutAfter {
+		s.recordSecurityEvent(ctx, &models.SecurityEvent{
+			UserID:    user.ID,
+			Type:      models.SecurityEventAccountLocked,
+			IPAddress: client.IPAddress,
+			UserAgent: client.UserAgent,
+			Metadata:  map[string]string{"failed_attempts": strconv.FormatInt(window.Count, 10)},
+		})
+	}
+}
+
+func (s *authService) resetLoginFailures(ctx context.Context, email string) {
+	s.limiter.Reset(ctx, loginFailureKey(email))
+}
+
+func loginDelay(failures int64) time.Duration {
+	delay := time.Second << (failures - loginDelayAfter)
+	if delay > loginMaxDelay || delay <= 0 {
+		return loginMaxDelay
+	}
+	return delay
+}
+
+func loginFailureKey(email string) string {
+	return fmt.Sprintf("ratelimit:login_failures:%s", auth.HashToken(strings.ToLower(strings.TrimSpace(email))))
+}
@@ -0,0 +1,94 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/enkyuan/ato/api/internal/dto"
+	"github.com/enkyuan/ato/api/internal/models"
+	"github.com/enkyuan/ato/api/pkg/auth"
+	"github.com/enkyuan/ato/api/pkg/mailer"
+)
+
+const (
+	magicLinkTTL = 15 * time.Minute
+	// At most magicLinkMaxPerWindow links are sent to one address per window
+	magicLinkMaxPerWindow = 5
+	magicLinkWindow       = time.Hour
+)
+
+// SendMagicLink emails a one-time sign-in link. Unknown addresses get the
+// same answer as known ones, and the rate limit is counted before the lookup
+// so it does not give the difference away either.
+func (s *authService) SendMagicLink(ctx context.Context, email string) error {
+	email = normalizeEmail(email)
+
+	window := s.limiter.Allow(ctx, magicLinkRateKey(email), magicLinkMaxPerWindow, magicLinkWindow)
+	if !window.Allowed {
+		return &RateLimitError{RetryAfter: window.ResetAfter(magicLinkWindow, time.Now())}
+	}
+
+	user, err := s.userRepo.GetByEmail(email)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		return fmt.Errorf("failed to get user: %w", err)
+	}
+
+	token, err := createAccountToken(ctx, s.accountTokenRepo, user.ID, user.Email, models.AccountTokenMagicLink, magicLinkTTL)
+	if err != nil {
+		return err
+	}
+
+	s.sendMail(mailer.Message{
+		To:      user.Email,
+		Subject: "Your sign-in link",
+		Body: fmt.Sprintf("Hi %s,\n\nOpen this link within 15 minutes to sign in. It works once:\n\n%s\n\nIf you didn't ask to sign in, you can ignore this email.\n",
+			user.Name, frontendLink("/magic-link", token)),
+	})
+
+	return nil
+}
+
+// VerifyMagicLink signs the user in from a magic link. The link only proves
+// control of the mailbox, so users with 2FA on still get the MFA challenge.
+func (s *authService) VerifyMagicLink(ctx context.Context, req dto.MagicLinkVerifyRequest) (*dto.AuthResponse, error) {
+	token, err := consumeAccountToken(ctx, s.accountTokenRepo, models.AccountTokenMagicLink, req.Token)
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := s.GetCurrentUser(ctx, token.UserID)
+	if err != nil {
+		return nil, err
+	}
+	if user.Email != token.Email {
+		return nil, ErrInvalidAccountToken
+	}
+
+	if user.EmailVerifiedAt == nil {
+		if _, err := s.userRepo.MarkEmailVerified(user.ID, token.Email); err != nil {
+			// Log error but don't fail the request
+			log.Printf("Failed to mark email verified: %v", err)
+		}
+		s.local.Delete(emailVerifiedKey(user.ID))
+	}
+
+	mfaEnabled, err := s.mfaEnabled(ctx, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	if mfaEnabled {
+		return s.startMFAChallenge(ctx, user.ID)
+	}
+
+	return s.startFamily(ctx, user, loginMethodMagicLink, req.Client)
+}
+
+func magicLinkRateKey(email string) string {
+	return fmt.Sprintf("ratelimit:magic_link:%s", auth.HashToken(email))
+}
@@ -0,0 +1,293 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/enkyuan/ato/api/internal/dto"
+	"github.com/enkyuan/ato/api/internal/models"
+	"github.com/enkyuan/ato/api/pkg/auth"
+)
+
+var (
+	ErrMFAAlreadyEnabled   = errors.New("two-factor authentication is already enabled")
+	ErrMFANotEnabled       = errors.New("two-factor authentication is not enabled")
+	ErrMFANotEnrolled      = errors.New("two-factor enrolment has not been started")
+	ErrInvalidMFACode      = errors.New("invalid two-factor code")
+	ErrMFAChallengeInvalid = errors.New("MFA challenge is invalid or has expired")
+	ErrPasswordRequired    = errors.New("current password is required")
+)
+
+const (
+	mfaChallengeTTL         = 5 * time.Minute
+	mfaChallengeMaxAttempts = 5
+	recoveryCodeCount       = 10
+	defaultTOTPIssuer       = "Ato"
+)
+
+// EnrollTOTP starts 2FA enrolment with a fresh secret. 2FA stays off until
+// ConfirmTOTP sees a valid code for it.
+func (s *authService) EnrollTOTP(ctx context.Context, userID int) (*dto.TOTPEnrollmentResponse, error) {
+	user, err := s.GetCurrentUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	secret, err := auth.GenerateTOTPSecret()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.mfaRepo.SaveTOTPEnrollment(ctx, userID, secret); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrMFAAlreadyEnabled
+		}
+		return nil, fmt.Errorf("failed to save TOTP enrolment: %w", err)
+	}
+
+	return &dto.TOTPEnrollmentResponse{
+		Secret: secret,
+		URI:    auth.TOTPURI(totpIssuer(), user.Email, secret),
+	}, nil
+}
+
+// ConfirmTOTP turns 2FA on once the user proves their authenticator works,
+// and returns the recovery codes. They are only ever shown here.
+func (s *authService) ConfirmTOTP(ctx context.Context, userID int, req dto.TOTPConfirmRequest) ([]string, error) {
+	credential, err := s.mfaRepo.GetTOTP(ctx, userID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrMFANotEnrolled
+		}
+		return nil, fmt.Errorf("failed to get TOTP credential: %w", err)
+	}
+
+	if credential.ConfirmedAt != nil {
+		return nil, ErrMFAAlreadyEnabled
+	}
+
+	step, ok := auth.ValidateTOTP(credential.Secret, req.Code, time.Now())
+	if !ok {
+		return nil, ErrInvalidMFACode
+	}
+
+	codes := make([]string, 0, recoveryCodeCount)
+	hashes := make([]string, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		code, err := auth.GenerateRecoveryCode()
+		if err != nil {
+			return nil, err
+		}
+		codes = append(codes, code)
+		hashes = append(hashes, auth.HashToken(code))
+	}
+
+	if err := s.mfaRepo.ConfirmTOTP(ctx, userID, step, hashes); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrMFAAlreadyEnabled
+		}
+		return nil, fmt.Errorf("failed to enable TOTP: %w", err)
+	}
+
+	s.recordSecurityEvent(ctx, &models.SecurityEvent{
+		UserID:    userID,
+		Type:      models.SecurityEventMFAEnabled,
+		IPAddress: req.Client.IPAddress,
+		UserAgent: req.Client.UserAgent,
+	})
+
+	return codes, nil
+}
+
+// DisableTOTP turns 2FA off. The user confirms their password again so a
+// stolen access token alone cannot strip the second factor. Accounts without
+// a password, which sign in through a provider or a passkey, confirm with a
+// TOTP or recovery code instead.
+func (s *authService) DisableTOTP(ctx context.Context, userID int, req dto.DisableTOTPRequest) error {
+	user, err := s.GetCurrentUser(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	enabled, err := s.mfaEnabled(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if !enabled {
+		return ErrMFANotEnabled
+	}
+
+	switch {
+	case user.PasswordHash != "" && req.Password == "":
+		return ErrPasswordRequired
+	case req.Password != "":
+		if _, err := checkCurrentPassword(s.userRepo, userID, req.Password); err != nil {
+			return err
+		}
+	default:
+		if err := s.checkSecondFactor(ctx, userID, req.Code, req.RecoveryCode, req.Client); err != nil {
+			return err
+		}
+	}
+
+	if err := s.mfaRepo.DeleteTOTP(ctx, userID); err != nil {
+		return fmt.Errorf("failed to disable TOTP: %w", err)
+	}
+
+	s.recordSecurityEvent(ctx, &models.SecurityEvent{
+		UserID:    userID,
+		Type:      models.SecurityEventMFADisabled,
+		IPAddress: req.Client.IPAddress,
+		UserAgent: req.Client.UserAgent,
+	})
+
+	return nil
+}
+
+// VerifyMFA completes a login that stopped at the MFA challenge. A challenge
+// allows a handful of wrong codes before it has to be started over with the
+// password.
+func (s *authService) VerifyMFA(ctx context.Context, req dto.MFAVerifyRequest) (*dto.AuthResponse, error) {
+	key := mfaChallengeKey(req.MFAToken)
+	value, err := s.cache.Get(ctx, key)
+	if err != nil {
+		return nil, ErrMFAChallengeInvalid
+	}
+
+	userID, err := strconv.Atoi(value)
+	if err != nil {
+		return nil, ErrMFAChallengeInvalid
+	}
+
+	attempts, err := s.cache.Incr(ctx, key+":attempts", mfaChallengeTTL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count MFA attempts: %w", err)
+	}
+	if attempts > mfaChallengeMaxAttempts {
+		s.cache.Delete(ctx, key)
+		return nil, ErrMFAChallengeInvalid
+	}
+
+	if err := s.checkSecondFactor(ctx, userID, req.Code, req.RecoveryCode, req.Client); err != nil {
+		if errors.Is(err, ErrInvalidMFACode) {
+			s.recordSecurityEvent(ctx, &models.SecurityEvent{
+				UserID:    userID,
+				Type:      models.SecurityEventLoginFailed,
+				IPAddress: req.Client.IPAddress,
+				UserAgent: req.Client.UserAgent,
+				Metadata:  map[string]string{"reason": "invalid_mfa_code"},
+			})
+		}
+		return nil, err
+	}
+
+	// Only one request gets to redeem the challenge
+	claimed, err := s.cache.DeleteIfEquals(ctx, key, value)
+	if err != nil {
+		return nil, fmt.Errorf("failed to redeem MFA challenge: %w", err)
+	}
+	if !claimed {
+		return nil, ErrMFAChallengeInvalid
+	}
+
+	user, err := s.GetCurrentUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.startFamily(ctx, user, loginMethodMFA, req.Client)
+}
+
+// checkSecondFactor spends a recovery code if one is given, and otherwise
+// checks a TOTP code.
+func (s *authService) checkSecondFactor(ctx context.Context, userID int, code string, recoveryCode string, client dto.ClientInfo) error {
+	if recoveryCode != "" {
+		hash := auth.HashToken(auth.NormalizeRecoveryCode(recoveryCode))
+		used, err := s.mfaRepo.UseRecoveryCode(ctx, userID, hash)
+		if err != nil {
+			return fmt.Errorf("failed to use recovery code: %w", err)
+		}
+		if !used {
+			return ErrInvalidMFACode
+		}
+
+		s.recordSecurityEvent(ctx, &models.SecurityEvent{
+			UserID:    userID,
+			Type:      models.SecurityEventRecoveryCodeUsed,
+			IPAddress: client.IPAddress,
+			UserAgent: client.UserAgent,
+		})
+		return nil
+	}
+
+	credential, err := s.mfaRepo.GetTOTP(ctx, userID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return ErrInvalidMFACode
+		}
+		return fmt.Errorf("failed to get TOTP credential: %w", err)
+	}
+
+	step, ok := auth.ValidateTOTP(credential.Secret, code, time.Now())
+	if !ok {
+		return ErrInvalidMFACode
+	}
+
+	// A code seen once, even by an attacker watching over a shoulder, is spent
+	used, err := s.mfaRepo.UseTOTPStep(ctx, userID, step)
+	if err != nil {
+		return fmt.Errorf("failed to record TOTP use: %w", err)
+	}
+	if !used {
+		return ErrInvalidMFACode
+	}
+
+	return nil
+}
+
+// startMFAChallenge is the first half of a login for users with 2FA on: the
+// password checked out, and the returned token stands in for it while the
+// client asks for a code.
+func (s *authService) startMFAChallenge(ctx context.Context, userID int) (*dto.AuthResponse, error) {
+	token, err := auth.GenerateOpaqueToken("mfa_")
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.cache.Set(ctx, mfaChallengeKey(token), strconv.Itoa(userID), mfaChallengeTTL); err != nil {
+		return nil, fmt.Errorf("failed to store MFA challenge: %w", err)
+	}
+
+	return &dto.AuthResponse{
+		MFARequired: true,
+		MFAToken:    token,
+	}, nil
+}
+
+func (s *authService) mfaEnabled(ctx context.Context, userID int) (bool, error) {
+	credential, err := s.mfaRepo.GetTOTP(ctx, userID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to get TOTP credential: %w", err)
+	}
+
+	return credential.ConfirmedAt != nil, nil
+}
+
+func mfaChallengeKey(token string) string {
+	return fmt.Sprintf("mfa:challenge:%s", auth.HashToken(token))
+}
+
+func totpIssuer() string {
+	if issuer := os.Getenv("TOTP_ISSUER"); issuer != "" {
+		return issuer
+	}
+	return defaultTOTPIssuer
+}
@@ -0,0 +1,503 @@
+package service
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/enkyuan/ato/api/cache"
+	"github.com/enkyuan/ato/api/internal/dto"
+	"github.com/enkyuan/ato/api/internal/models"
+	"github.com/enkyuan/ato/api/internal/repository"
+	"github.com/enkyuan/ato/api/pkg/auth"
+)
+
+const (
+	OAuthGrantAuthorizationCode = "authorization_code"
+	OAuthGrantRefreshToken      = "refresh_token"
+
+	// oauthCodeTTL only has to cover the redirect back to the app and its
+	// call to the token endpoint
+	oauthCodeTTL = time.Minute
+	// oauthChallengeLength is the length of an unpadded base64url SHA-256
+	oauthChallengeLength = 43
+)
+
+type OAuthService interface {
+	CreateClient(ctx context.Context, ownerID int, req dto.CreateOAuthClientRequest) (*dto.CreateOAuthClientResponse, error)
+	ListClients(ctx context.Context, ownerID int) ([]*models.OAuthClient, error)
+	DeleteClient(ctx context.Context, ownerID int, clientID string) error
+	Consent(ctx context.Context, req dto.OAuthAuthorizeRequest) (*dto.OAuthConsentResponse, error)
+	Decide(ctx context.Context, userID int, req dto.OAuthConsentRequest) (*dto.OAuthRedirectResponse, error)
+	Token(ctx context.Context, req dto.OAuthTokenRequest) (*dto.OAuthTokenResponse, error)
+	Revoke(ctx context.Context, credentials dto.OAuthClientCredentials, token string) error
+	Introspect(ctx context.Context, credentials dto.OAuthClientCredentials, token string) (*dto.OAuthIntrospectionResponse, error)
+	ListAuthorizedApps(ctx context.Context, userID int) ([]*models.AuthorizedApp, error)
+	RevokeAuthorizedApp(ctx context.Context, userID int, clientID string, client dto.ClientInfo) error
+}
+
+// oauthService is the OAuth 2.0 authorization server. The tokens it hands
+// apps live in token families like the user's own sessions, so it issues and
+// revokes them through the auth service.
+type oauthService struct {
+	oauthClientRepo   repository.OAuthClientRepository
+	tokenRepo         repository.TokenRepository
+	userRepo          repository.UserRepository
+	securityEventRepo repository.SecurityEventRepository
+	cache             *cache.Cache
+	tokens            TokenIssuer
+}
+
+func NewOAuthService(oauthClientRepo repository.OAuthClientRepository, tokenRepo repository.TokenRepository, userRepo repository.UserRepository, securityEventRepo repository.SecurityEventRepository, cache *cache.Cache, tokens TokenIssuer) OAuthService {
+	return &oauthService{
+		oauthClientRepo:   oauthClientRepo,
+		tokenRepo:         tokenRepo,
+		userRepo:          userRepo,
+		securityEventRepo: securityEventRepo,
+		cache:             cache,
+		tokens:            tokens,
+	}
+}
+
+// OAuthRedirectError is an authorization error that can be reported to the
+// app at RedirectTo, because its redirect URI has been checked.
+type OAuthRedirectError struct {
+	Err        error
+	RedirectTo string
+}
+
+func (e *OAuthRedirectError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *OAuthRedirectError) Unwrap() error {
+	return e.Err
+}
+
+// oauthCode is what an authorization code stands for until the app redeems
+// it.
+type oauthCode struct {
+	ClientID      string   `json:"client_id"`
+	UserID        int      `json:"user_id"`
+	RedirectURI   string   `json:"redirect_uri"`
+	Scopes        []string `json:"scopes"`
+	CodeChallenge string   `json:"code_challenge"`
+}
+
+// Consent checks an authorization request and describes it for the consent
+// screen.
+func (s *oauthService) Consent(ctx context.Context, req dto.OAuthAuthorizeRequest) (*dto.OAuthConsentResponse, error) {
+	client, redirectURI, scopes, err := s.checkAuthorization(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	consent := &dto.OAuthConsentResponse{
+		ClientID:    client.ID,
+		ClientName:  client.Name,
+		RedirectURI: redirectURI,
+		Scopes:      make([]dto.OAuthScope, 0, len(scopes)),
+	}
+	for _, scope := range scopes {
+		consent.Scopes = append(consent.Scopes, dto.OAuthScope{
+			Scope:       scope,
+			Description: auth.ScopeDescription(scope),
+		})
+	}
+
+	return consent, nil
+}
+
+// Decide records the user's answer on the consent screen and returns where to
+// send them back to the app: with an authorization code if they approved, or
+// access_denied if not.
+func (s *oauthService) Decide(ctx context.Context, userID int, req dto.OAuthConsentRequest) (*dto.OAuthRedirectResponse, error) {
+	client, redirectURI, scopes, err := s.checkAuthorization(ctx, req.OAuthAuthorizeRequest)
+	if err != nil {
+		return nil, err
+	}
+
+	if !req.Approve {
+		return &dto.OAuthRedirectResponse{
+			RedirectTo: oauthRedirect(redirectURI, url.Values{
+				"error":             {"access_denied"},
+				"error_description": {"The user denied access"},
+			}, req.State),
+		}, nil
+	}
+
+	code, err := auth.GenerateOpaqueToken("")
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := json.Marshal(oauthCode{
+		ClientID: client.ID,
+		UserID:   userID,
+		// The token request must repeat redirect_uri exactly as given here,
+		// including leaving it out
+		RedirectURI:   req.RedirectURI,
+		Scopes:        scopes,
+		CodeChallenge: req.CodeChallenge,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := s.cache.Set(ctx, oauthCodeKey(code), data, oauthCodeTTL); err != nil {
+		return nil, fmt.Errorf("failed to store authorization code: %w", err)
+	}
+
+	s.recordSecurityEvent(ctx, &models.SecurityEvent{
+		UserID:    userID,
+		Type:      models.SecurityEventAppAuthorized,
+		IPAddress: req.Client.IPAddress,
+		UserAgent: req.Client.UserAgent,
+		Metadata: map[string]string{
+			"client_id": client.ID,
+			"name":      client.Name,
+			"scope":     strings.Join(scopes, " "),
+		},
+	})
+
+	return &dto.OAuthRedirectResponse{
+		RedirectTo: oauthRedirect(redirectURI, url.Values{"code": {code}}, req.State),
+	}, nil
+}
+
+// checkAuthorization validates an authorization request, returning the
+// client, the redirect URI to answer at and the requested scopes. Errors
+// about the client or redirect URI must be shown to the user; any others
+// are an *OAuthRedirectError for the app.
+func (s *oauthService) checkAuthorization(ctx context.Context, req dto.OAuthAuthorizeRequest) (*models.OAuthClient, string, []string, error) {
+	client, err := s.oauthClientRepo.GetByID(ctx, req.ClientID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, "", nil, ErrOAuthClientNotFound
+		}
+		return nil, "", nil, fmt.Errorf("failed to get OAuth client: %w", err)
+	}
+
+	// redirect_uri may only be left out when there is no doubt which one
+	// is meant
+	redirectURI := req.RedirectURI
+	if redirectURI == "" && len(client.RedirectURIs) == 1 {
+		redirectURI = client.RedirectURIs[0]
+	}
+	if !client.AllowsRedirect(redirectURI) {
+		return nil, "", nil, ErrOAuthInvalidRedirect
+	}
+
+	redirectError := func(err error) error {
+		return &OAuthRedirectError{
+			Err: err,
+			RedirectTo: oauthRedirect(redirectURI, url.Values{
+				"error":             {OAuthErrorCode(err)},
+				"error_description": {err.Error()},
+			}, req.State),
+		}
+	}
+
+	if req.ResponseType != "code" {
+		return nil, "", nil, redirectError(ErrOAuthUnsupportedResponse)
+	}
+
+	// PKCE is required of every client, confidential or not, and only with
+	// S256: plain would put the verifier in the browser's history
+	if req.CodeChallengeMethod != "S256" || len(req.CodeChallenge) != oauthChallengeLength {
+		return nil, "", nil, redirectError(fmt.Errorf("%w: a code_challenge with method S256 is required", ErrOAuthInvalidRequest))
+	}
+
+	scopes, ok := auth.NormalizeScopes(strings.Fields(req.Scope))
+	if !ok || len(scopes) == 0 {
+		return nil, "", nil, redirectError(ErrOAuthInvalidScope)
+	}
+
+	return client, redirectURI, scopes, nil
+}
+
+// Token is the token endpoint. Apps trade an authorization code for their
+// first token pair, then rotate refresh tokens like the web app does.
+func (s *oauthService) Token(ctx context.Context, req dto.OAuthTokenRequest) (*dto.OAuthTokenResponse, error) {
+	client, err := s.authenticateOAuthClient(ctx, req.Credentials)
+	if err != nil {
+		return nil, err
+	}
+
+	switch req.GrantType {
+	case OAuthGrantAuthorizationCode:
+		return s.redeemOAuthCode(ctx, client, req)
+	case OAuthGrantRefreshToken:
+		return s.refreshOAuthToken(ctx, client, req)
+	default:
+		return nil, ErrOAuthUnsupportedGrantType
+	}
+}
+
+func (s *oauthService) redeemOAuthCode(ctx context.Context, client *models.OAuthClient, req dto.OAuthTokenRequest) (*dto.OAuthTokenResponse, error) {
+	if req.Code == "" || req.CodeVerifier == "" {
+		return nil, fmt.Errorf("%w: code and code_verifier are required", ErrOAuthInvalidRequest)
+	}
+
+	key := oauthCodeKey(req.Code)
+	value, err := s.cache.Get(ctx, key)
+	if err != nil {
+		return nil, ErrOAuthInvalidGrant
+	}
+
+	// A code is good for one token request
+	claimed, err := s.cache.DeleteIfEquals(ctx, key, value)
+	if err != nil {
+		return nil, fmt.Errorf("failed to redeem authorization code: %w", err)
+	}
+	if !claimed {
+		return nil, ErrOAuthInvalidGrant
+	}
+
+	var code oauthCode
+	if err := json.Unmarshal([]byte(value), &code); err != nil {
+		return nil, ErrOAuthInvalidGrant
+	}
+
+	if code.ClientID != client.ID || code.RedirectURI != req.RedirectURI || !verifyCodeChallenge(req.CodeVerifier, code.CodeChallenge) {
+		return nil, ErrOAuthInvalidGrant
+	}
+
+	user, err := s.userRepo.GetByID(code.UserID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrOAuthInvalidGrant
+		}
+		return nil, fmt.Errorf("failed to get user: %w", err)
+	}
+	if user.DisabledAt != nil {
+		return nil, ErrOAuthInvalidGrant
+	}
+
+	tokenPair, err := s.tokens.StartAppGrant(ctx, user, client.ID, code.Scopes, req.Client)
+	if err != nil {
+		return nil, err
+	}
+
+	return oauthTokenResponse(tokenPair, code.Scopes), nil
+}
+
+// refreshOAuthToken rotates an app's refresh token. A scope parameter is
+// ignored, which RFC 6749 allows: the response always says what was granted.
+func (s *oauthService) refreshOAuthToken(ctx context.Context, client *models.OAuthClient, req dto.OAuthTokenRequest) (*dto.OAuthTokenResponse, error) {
+	if req.RefreshToken == "" {
+		return nil, fmt.Errorf("%w: refresh_token is required", ErrOAuthInvalidRequest)
+	}
+
+	tokenPair, scopes, err := s.tokens.RotateAppRefreshToken(ctx, req.RefreshToken, client.ID, req.Client)
+	if err != nil {
+		if errors.Is(err, auth.ErrInvalidToken) || errors.Is(err, auth.ErrExpiredToken) ||
+			errors.Is(err, ErrTokenRevoked) || errors.Is(err, ErrTokenReuse) || errors.Is(err, ErrUserNotFound) ||
+			errors.Is(err, ErrAccountDisabled) {
+			return nil, ErrOAuthInvalidGrant
+		}
+		return nil, err
+	}
+
+	return oauthTokenResponse(tokenPair, scopes), nil
+}
+
+// Revoke is the revocation endpoint (RFC 7009). Revoking a refresh token ends
+// the whole grant; revoking an access token ends just that token. Tokens that
+// are invalid or belong to another app are ignored.
+func (s *oauthService) Revoke(ctx context.Context, credentials dto.OAuthClientCredentials, token string) error {
+	client, err := s.authenticateOAuthClient(ctx, credentials)
+	if err != nil {
+		return err
+	}
+
+	if claims, err := auth.ValidateRefreshToken(token); err == nil {
+		stored, err := s.tokenRepo.GetRefreshToken(ctx, claims.ID)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return nil
+			}
+			return fmt.Errorf("failed to get refresh token: %w", err)
+		}
+		if stored.FamilyClientID != client.ID {
+			return nil
+		}
+		return s.tokens.RevokeFamily(ctx, stored.FamilyID, models.TokenFamilyRevokedByClient)
+	}
+
+	if claims, err := auth.ValidateAccessToken(token); err == nil && claims.ClientID == client.ID {
+		return s.tokens.RevokeAccessToken(ctx, claims)
+	}
+
+	return nil
+}
+
+// Introspect is the introspection endpoint (RFC 7662). Apps may only
+// introspect their own tokens; anything else is reported inactive.
+func (s *oauthService) Introspect(ctx context.Context, credentials dto.OAuthClientCredentials, token string) (*dto.OAuthIntrospectionResponse, error) {
+	client, err := s.authenticateOAuthClient(ctx, credentials)
+	if err != nil {
+		return nil, err
+	}
+
+	inactive := &dto.OAuthIntrospectionResponse{Active: false}
+
+	if claims, err := s.tokens.ValidateToken(ctx, token); err == nil {
+		if claims.ClientID != client.ID {
+			return inactive, nil
+		}
+		return introspectionResponse(claims, claims.Scope, "Bearer"), nil
+	}
+
+	claims, err := auth.ValidateRefreshToken(token)
+	if err != nil {
+		return inactive, nil
+	}
+
+	stored, err := s.tokenRepo.GetRefreshToken(ctx, claims.ID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return inactive, nil
+		}
+		return nil, fmt.Errorf("failed to get refresh token: %w", err)
+	}
+	if stored.FamilyClientID != client.ID || stored.RotatedAt != nil || stored.FamilyRevokedAt != nil {
+		return inactive, nil
+	}
+
+	epoch, err := s.tokens.TokenEpoch(ctx, claims.UserID)
+	if err != nil {
+		return nil, err
+	}
+	if claims.Epoch < epoch {
+		return inactive, nil
+	}
+
+	return introspectionResponse(claims, strings.Join(stored.FamilyScopes, " "), ""), nil
+}
+
+// ListAuthorizedApps lists the apps the user has granted access to.
+func (s *oauthService) ListAuthorizedApps(ctx context.Context, userID int) ([]*models.AuthorizedApp, error) {
+	apps, err := s.tokenRepo.ListAuthorizedApps(ctx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list authorized apps: %w", err)
+	}
+
+	return apps, nil
+}
+
+// RevokeAuthorizedApp takes back every grant the user has given an app.
+func (s *oauthService) RevokeAuthorizedApp(ctx context.Context, userID int, clientID string, client dto.ClientInfo) error {
+	ids, err := s.tokenRepo.RevokeAppFamilies(ctx, userID, clientID, models.TokenFamilyRevokedAppRemoved)
+	if err != nil {
+		return fmt.Errorf("failed to revoke app: %w", err)
+	}
+	if len(ids) == 0 {
+		return ErrOAuthAppNotFound
+	}
+
+	s.tokens.MarkSessionsRevoked(ctx, ids)
+
+	s.recordSecurityEvent(ctx, &models.SecurityEvent{
+		UserID:    userID,
+		Type:      models.SecurityEventAppRevoked,
+		IPAddress: client.IPAddress,
+		UserAgent: client.UserAgent,
+		Metadata:  map[string]string{"client_id": clientID},
+	})
+
+	return nil
+}
+
+func (s *oauthService) recordSecurityEvent(ctx context.Context, event *models.SecurityEvent) {
+	saveSecurityEvent(ctx, s.securityEventRepo, event)
+}
+
+func oauthTokenResponse(tokenPair *auth.TokenPair, scopes []string) *dto.OAuthTokenResponse {
+	return &dto.OAuthTokenResponse{
+		AccessToken:  tokenPair.AccessToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    int64(time.Until(tokenPair.AccessExpiresAt).Round(time.Second).Seconds()),
+		RefreshToken: tokenPair.RefreshToken,
+		Scope:        strings.Join(scopes, " "),
+	}
+}
+
+func introspectionResponse(claims *auth.Claims, scope string, tokenType string) *dto.OAuthIntrospectionResponse {
+	response := &dto.OAuthIntrospectionResponse{
+		Active:    true,
+		Scope:     scope,
+		ClientID:  claims.ClientID,
+		Username:  claims.Email,
+		TokenType: tokenType,
+		Sub:       strconv.Itoa(claims.UserID),
+	}
+	if claims.ExpiresAt != nil {
+		response.Exp = claims.ExpiresAt.Unix()
+	}
+	if claims.IssuedAt != nil {
+		response.Iat = claims.IssuedAt.Unix()
+	}
+	return response
+}
+
+// verifyCodeChallenge checks a PKCE verifier against its S256 challenge
+// (RFC 7636 section 4.6).
+func verifyCodeChallenge(verifier string, challenge string) bool {
+	if len(verifier) < 43 || len(verifier) > 128 {
+		return false
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:]) == challenge
+}
+
+// oauthRedirect adds params, and state if the app sent one, to the app's
+// redirect URI.
+func oauthRedirect(redirectURI string, params url.Values, state string) string {
+	u, err := url.Parse(redirectURI)
+	if err != nil {
+		return redirectURI
+	}
+
+	query := u.Query()
+	for key, values := range params {
+		query[key] = values
+	}
+	if state != "" {
+		query.Set("state", state)
+	}
+	u.RawQuery = query.Encode()
+
+	return u.String()
+}
+
+// OAuthErrorCode is the RFC 6749 error code for an OAuth error.
+func OAuthErrorCode(err error) string {
+	switch {
+	case errors.Is(err, ErrOAuthInvalidClient):
+		return "invalid_client"
+	case errors.Is(err, ErrOAuthInvalidGrant):
+		return "invalid_grant"
+	case errors.Is(err, ErrOAuthInvalidScope):
+		return "invalid_scope"
+	case errors.Is(err, ErrOAuthUnsupportedGrantType):
+		return "unsupported_grant_type"
+	case errors.Is(err, ErrOAuthUnsupportedResponse):
+		return "unsupported_response_type"
+	case errors.Is(err, ErrOAuthInvalidRequest):
+		return "invalid_request"
+	default:
+		return "server_error"
+	}
+}
+
+func oauthCodeKey(code string) string {
+	return fmt.Sprintf("oauth:code:%s", auth.HashToken(code))
+}
@@ -0,0 +1,177 @@
+package service
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/enkyuan/ato/api/internal/dto"
+	"github.com/enkyuan/ato/api/internal/models"
+	"github.com/enkyuan/ato/api/pkg/auth"
+)
+
+// Client IDs and secrets are prefixed like API tokens, so they are easy to
+// tell apart and secret scanners can find leaked secrets.
+const (
+	OAuthClientIDPrefix     = "ato_client_"
+	OAuthClientSecretPrefix = "ato_secret_"
+)
+
+// maxOAuthRedirectURIs bounds how many redirect URIs a client may register
+const maxOAuthRedirectURIs = 10
+
+var (
+	ErrOAuthClientNotFound       = errors.New("OAuth client not found")
+	ErrOAuthInvalidRedirectURIs  = errors.New("redirect URIs must be https, http on loopback, or a private-use scheme")
+	ErrOAuthInvalidClient        = errors.New("client authentication failed")
+	ErrOAuthInvalidRedirect      = errors.New("redirect URI is not registered for this client")
+	ErrOAuthInvalidRequest       = errors.New("request is missing a parameter or malformed")
+	ErrOAuthInvalidScope         = errors.New("unknown or missing scopes")
+	ErrOAuthInvalidGrant         = errors.New("authorization grant is invalid, expired or revoked")
+	ErrOAuthUnsupportedGrantType = errors.New("grant type is not supported")
+	ErrOAuthUnsupportedResponse  = errors.New("response type is not supported")
+	ErrOAuthAppNotFound          = errors.New("app is not authorized")
+)
+
+// CreateClient registers a third-party app owned by the user. The client
+// secret of a confidential client is only returned here.
+func (s *oauthService) CreateClient(ctx context.Context, ownerID int, req dto.CreateOAuthClientRequest) (*dto.CreateOAuthClientResponse, error) {
+	if len(req.RedirectURIs) == 0 || len(req.RedirectURIs) > maxOAuthRedirectURIs {
+		return nil, ErrOAuthInvalidRedirectURIs
+	}
+	for _, uri := range req.RedirectURIs {
+		if !validRedirectURI(uri) {
+			return nil, ErrOAuthInvalidRedirectURIs
+		}
+	}
+
+	clientID, err := auth.GenerateOpaqueToken(OAuthClientIDPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	client := &models.OAuthClient{
+		ID:           clientID,
+		OwnerID:      ownerID,
+		Name:         req.Name,
+		RedirectURIs: req.RedirectURIs,
+		Public:       req.Public,
+	}
+
+	var secret string
+	if !req.Public {
+		secret, err = auth.GenerateOpaqueToken(OAuthClientSecretPrefix)
+		if err != nil {
+			return nil, err
+		}
+		client.SecretHash = auth.HashToken(secret)
+	}
+
+	if err := s.oauthClientRepo.Create(ctx, client); err != nil {
+		return nil, fmt.Errorf("failed to create OAuth client: %w", err)
+	}
+
+	return &dto.CreateOAuthClientResponse{
+		OAuthClient:  client,
+		ClientSecret: secret,
+	}, nil
+}
+
+func (s *oauthService) ListClients(ctx context.Context, ownerID int) ([]*models.OAuthClient, error) {
+	clients, err := s.oauthClientRepo.ListByOwner(ctx, ownerID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list OAuth clients: %w", err)
+	}
+
+	return clients, nil
+}
+
+// DeleteClient removes one of the user's apps. Every grant to it is revoked
+// first, so tokens already issued to it stop working everywhere right away.
+func (s *oauthService) DeleteClient(ctx context.Context, ownerID int, clientID string) error {
+	client, err := s.oauthClientRepo.GetByID(ctx, clientID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return ErrOAuthClientNotFound
+		}
+		return fmt.Errorf("failed to get OAuth client: %w", err)
+	}
+	if client.OwnerID != ownerID {
+		return ErrOAuthClientNotFound
+	}
+
+	ids, err := s.tokenRepo.RevokeClientFamilies(ctx, clientID, models.TokenFamilyRevokedClientDeleted)
+	if err != nil {
+		return fmt.Errorf("failed to revoke OAuth grants: %w", err)
+	}
+	s.tokens.MarkSessionsRevoked(ctx, ids)
+
+	if err := s.oauthClientRepo.Delete(ctx, clientID, ownerID); err != nil {
+		if err == sql.ErrNoRows {
+			return ErrOAuthClientNotFound
+		}
+		return fmt.Errorf("failed to delete OAuth client: %w", err)
+	}
+
+	return nil
+}
+
+// authenticateOAuthClient checks the credentials an app calls the token,
+// revocation and introspection endpoints with. Public clients present only
+// their client ID.
+func (s *oauthService) authenticateOAuthClient(ctx context.Context, credentials dto.OAuthClientCredentials) (*models.OAuthClient, error) {
+	if credentials.ClientID == "" {
+		return nil, ErrOAuthInvalidClient
+	}
+
+	client, err := s.oauthClientRepo.GetByID(ctx, credentials.ClientID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrOAuthInvalidClient
+		}
+		return nil, fmt.Errorf("failed to get OAuth client: %w", err)
+	}
+
+	if client.Public {
+		if credentials.ClientSecret != "" {
+			return nil, ErrOAuthInvalidClient
+		}
+		return client, nil
+	}
+
+	secretHash := auth.HashToken(credentials.ClientSecret)
+	if subtle.ConstantTimeCompare([]byte(secretHash), []byte(client.SecretHash)) != 1 {
+		return nil, ErrOAuthInvalidClient
+	}
+
+	return client, nil
+}
+
+// validRedirectURI accepts https URIs, http on the loopback interface for
+// apps running on the user's machine, and private-use schemes such as
+// com.example.app:/callback for native apps (RFC 8252). Requiring a dot in
+// other schemes also keeps out javascript: and data: URIs.
+func validRedirectURI(raw string) bool {
+	if strings.Contains(raw, "#") {
+		return false
+	}
+
+	u, err := url.Parse(raw)
+	if err != nil || !u.IsAbs() {
+		return false
+	}
+
+	switch u.Scheme {
+	case "https":
+		return u.Host != ""
+	case "http":
+		host := u.Hostname()
+		return host == "localhost" || host == "127.0.0.1" || host == "::1"
+	default:
+		return strings.Contains(u.Scheme, ".")
+	}
+}
@@ -0,0 +1,269 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/enkyuan/ato/api/internal/dto"
+	"github.com/enkyuan/ato/api/internal/models"
+	"github.com/enkyuan/ato/api/internal/repository"
+	"github.com/enkyuan/ato/api/pkg/auth"
+	"golang.org/x/oauth2"
+)
+
+var (
+	ErrOIDCProviderNotFound  = errors.New("sign-in provider not found")
+	ErrOIDCStateInvalid      = errors.New("sign-in attempt is invalid or has expired")
+	ErrOIDCEmailRequired     = errors.New("provider did not share an email address")
+	ErrOIDCEmailNotVerified  = errors.New("provider has not verified this email address")
+	ErrOIDCAccountUnverified = errors.New("an account with this email exists but has not verified it")
+	ErrOIDCLoginFailed       = errors.New("sign-in with provider failed")
+)
+
+const (
+	oidcStateTTL = 10 * time.Minute
+	// oidcLoginCodeTTL only has to cover the redirect back to the web app
+	oidcLoginCodeTTL = time.Minute
+)
+
+// oidcState is what OIDCAuthorizeURL leaves in Redis for OIDCCallback.
+type oidcState struct {
+	Provider string `json:"provider"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"`
+}
+
+// OIDCProviders lists the names of the configured providers.
+func (s *authService) OIDCProviders() []string {
+	names := make([]string, 0, len(s.oidcProviders))
+	for name := range s.oidcProviders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// OIDCAuthorizeURL starts a sign-in with the provider. It returns the URL to
+// send the browser to and the state, which the caller must bind to the
+// browser so the callback can only be completed where the sign-in started.
+func (s *authService) OIDCAuthorizeURL(ctx context.Context, providerName string) (string, string, error) {
+	provider, ok := s.oidcProviders[providerName]
+	if !ok {
+		return "", "", ErrOIDCProviderNotFound
+	}
+
+	config, err := provider.oauth2Config(ctx)
+	if err != nil {
+		return "", "", err
+	}
+
+	state, err := auth.GenerateOpaqueToken("")
+	if err != nil {
+		return "", "", err
+	}
+	nonce, err := auth.GenerateOpaqueToken("")
+	if err != nil {
+		return "", "", err
+	}
+	verifier := oauth2.GenerateVerifier()
+
+	data, err := json.Marshal(oidcState{Provider: providerName, Nonce: nonce, Verifier: verifier})
+	if err != nil {
+		return "", "", err
+	}
+	if err := s.cache.Set(ctx, oidcStateKey(state), data, oidcStateTTL); err != nil {
+		return "", "", fmt.Errorf("failed to store OIDC state: %w", err)
+	}
+
+	opts := []oauth2.AuthCodeOption{oauth2.S256ChallengeOption(verifier)}
+	if provider.kind == oidcProviderKindOIDC {
+		opts = append(opts, oauth2.SetAuthURLParam("nonce", nonce))
+	}
+
+	return config.AuthCodeURL(state, opts...), state, nil
+}
+
+// OIDCCallback finishes the provider's side of a sign-in and returns a
+// short-lived code that the web app trades for tokens with OIDCExchange, so
+// tokens never appear in a redirect URL.
+func (s *authService) OIDCCallback(ctx context.Context, providerName string, code string, state string, client dto.ClientInfo) (string, error) {
+	key := oidcStateKey(state)
+	value, err := s.cache.Get(ctx, key)
+	if err != nil {
+		return "", ErrOIDCStateInvalid
+	}
+
+	// A state is good for one callback
+	claimed, err := s.cache.DeleteIfEquals(ctx, key, value)
+	if err != nil {
+		return "", fmt.Errorf("failed to redeem OIDC state: %w", err)
+	}
+	if !claimed {
+		return "", ErrOIDCStateInvalid
+	}
+
+	var stored oidcState
+	if err := json.Unmarshal([]byte(value), &stored); err != nil || stored.Provider != providerName {
+		return "", ErrOIDCStateInvalid
+	}
+
+	provider, ok := s.oidcProviders[providerName]
+	if !ok {
+		return "", ErrOIDCProviderNotFound
+	}
+
+	config, err := provider.oauth2Config(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	token, err := config.Exchange(ctx, code, oauth2.VerifierOption(stored.Verifier))
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrOIDCLoginFailed, err)
+	}
+
+	identity, err := provider.identity(ctx, token, stored.Nonce)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrOIDCLoginFailed, err)
+	}
+
+	user, err := s.resolveExternalUser(ctx, providerName, identity, client)
+	if err != nil {
+		return "", err
+	}
+
+	loginCode, err := auth.GenerateOpaqueToken("")
+	if err != nil {
+		return "", err
+	}
+	if err := s.cache.Set(ctx, oidcLoginKey(loginCode), strconv.Itoa(user.ID), oidcLoginCodeTTL); err != nil {
+		return "", fmt.Errorf("failed to store OIDC login: %w", err)
+	}
+
+	return loginCode, nil
+}
+
+// OIDCExchange trades the code from OIDCCallback for tokens. The provider
+// stands in for the password, so users with 2FA on still get the MFA
+// challenge.
+func (s *authService) OIDCExchange(ctx context.Context, req dto.OIDCExchangeRequest) (*dto.AuthResponse, error) {
+	key := oidcLoginKey(req.Code)
+	value, err := s.cache.Get(ctx, key)
+	if err != nil {
+		return nil, ErrOIDCStateInvalid
+	}
+
+	claimed, err := s.cache.DeleteIfEquals(ctx, key, value)
+	if err != nil {
+		return nil, fmt.Errorf("failed to redeem OIDC login: %w", err)
+	}
+	if !claimed {
+		return nil, ErrOIDCStateInvalid
+	}
+
+	userID, err := strconv.Atoi(value)
+	if err != nil {
+		return nil, ErrOIDCStateInvalid
+	}
+
+	user, err := s.GetCurrentUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	mfaEnabled, err := s.mfaEnabled(ctx, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	if mfaEnabled {
+		return s.startMFAChallenge(ctx, user.ID)
+	}
+
+	return s.startFamily(ctx, user, loginMethodOIDC, req.Client)
+}
+
+// resolveExternalUser finds the user a provider account belongs to, linking
+// or creating one on first sign-in. Linking goes by email, and only when
+// both sides have verified it: otherwise whoever registered an address
+// first, or controls a provider that does not check addresses, could take
+// over the other account.
+func (s *authService) resolveExternalUser(ctx context.Context, providerName string, identity *externalIdentity, client dto.ClientInfo) (*models.User, error) {
+	existing, err := s.identityRepo.GetByProviderSubject(ctx, providerName, identity.Subject)
+	if err == nil {
+		if err := s.identityRepo.RecordLogin(ctx, existing.ID, identity.Email); err != nil {
+			return nil, fmt.Errorf("failed to record OIDC login: %w", err)
+		}
+		return s.GetCurrentUser(ctx, existing.UserID)
+	}
+	if err != sql.ErrNoRows {
+		return nil, fmt.Errorf("failed to get identity: %w", err)
+	}
+
+	if identity.Email == "" {
+		return nil, ErrOIDCEmailRequired
+	}
+	if !identity.EmailVerified {
+		return nil, ErrOIDCEmailNotVerified
+	}
+
+	user, err := s.userRepo.GetByEmail(identity.Email)
+	switch {
+	case err == nil:
+		if user.EmailVerifiedAt == nil {
+			return nil, ErrOIDCAccountUnverified
+		}
+	case err == sql.ErrNoRows:
+		user, err = s.userRepo.CreateExternal(identity.Email, externalUserName(identity))
+		if err != nil {
+			if repository.IsUniqueViolation(err) {
+				return nil, ErrEmailExists
+			}
+			return nil, fmt.Errorf("failed to create user: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("failed to get user: %w", err)
+	}
+
+	err = s.identityRepo.Create(ctx, &models.UserIdentity{
+		UserID:   user.ID,
+		Provider: providerName,
+		Subject:  identity.Subject,
+		Email:    identity.Email,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to link identity: %w", err)
+	}
+
+	s.recordSecurityEvent(ctx, &models.SecurityEvent{
+		UserID:    user.ID,
+		Type:      models.SecurityEventIdentityLinked,
+		IPAddress: client.IPAddress,
+		UserAgent: client.UserAgent,
+		Metadata:  map[string]string{"provider": providerName},
+	})
+
+	return user, nil
+}
+
+func externalUserName(identity *externalIdentity) string {
+	if identity.Name != "" {
+		return identity.Name
+	}
+	name, _, _ := strings.Cut(identity.Email, "@")
+	return name
+}
+
+func oidcStateKey(state string) string {
+	return fmt.Sprintf("oidc:state:%s", auth.HashToken(state))
+}
+
+func oidcLoginKey(code string) string {
+	return fmt.Sprintf("oidc:login:%s", auth.HashToken(code))
+}
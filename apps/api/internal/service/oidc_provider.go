@@ -0,0 +1,264 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/github"
+)
+
+const (
+	oidcProviderKindOIDC   = "oidc"
+	oidcProviderKindGitHub = "github"
+	githubAPIURL           = "https://api.github.com"
+)
+
+// externalIdentity is what a provider tells us about the user who signed in.
+type externalIdentity struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Name          string
+}
+
+// oidcProvider is one "Sign in with..." option. OpenID Connect providers are
+// discovered from their issuer URL the first time they are used, so an
+// unreachable provider does not stop the API from starting. GitHub does not
+// speak OpenID Connect and is handled through its REST API instead.
+type oidcProvider struct {
+	name         string
+	kind         string
+	issuer       string
+	clientID     string
+	clientSecret string
+	scopes       []string
+	redirectURL  string
+
+	mu       sync.Mutex
+	provider *oidc.Provider
+}
+
+// loadOIDCProviders reads OIDC_PROVIDERS, a comma-separated list of names,
+// and OIDC_<NAME>_ISSUER, _CLIENT_ID, _CLIENT_SECRET, _SCOPES and _TYPE for
+// each. A provider named "github" defaults to the GitHub type.
+func loadOIDCProviders() map[string]*oidcProvider {
+	redirectBase := strings.TrimRight(os.Getenv("OIDC_REDIRECT_BASE_URL"), "/")
+	if redirectBase == "" {
+		redirectBase = "http://localhost:8080"
+	}
+
+	providers := make(map[string]*oidcProvider)
+	for _, name := range strings.Split(os.Getenv("OIDC_PROVIDERS"), ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+
+		prefix := "OIDC_" + strings.ToUpper(name) + "_"
+		p := &oidcProvider{
+			name:         name,
+			kind:         os.Getenv(prefix + "TYPE"),
+			issuer:       os.Getenv(prefix + "ISSUER"),
+			clientID:     os.Getenv(prefix + "CLIENT_ID"),
+			clientSecret: os.Getenv(prefix + "CLIENT_SECRET"),
+			redirectURL:  redirectBase + "/api/v1/auth/oidc/" + name + "/callback",
+		}
+		if p.kind == "" {
+			p.kind = oidcProviderKindOIDC
+			if name == oidcProviderKindGitHub {
+				p.kind = oidcProviderKindGitHub
+			}
+		}
+
+		if scopes := os.Getenv(prefix + "SCOPES"); scopes != "" {
+			p.scopes = strings.Fields(strings.ReplaceAll(scopes, ",", " "))
+		} else if p.kind == oidcProviderKindGitHub {
+			p.scopes = []string{"read:user", "user:email"}
+		} else {
+			p.scopes = []string{oidc.ScopeOpenID, "email", "profile"}
+		}
+
+		if p.clientID == "" || (p.kind == oidcProviderKindOIDC && p.issuer == "") {
+			log.Printf("Skipping OIDC provider %s: issuer and client ID are required", name)
+			continue
+		}
+		if p.kind != oidcProviderKindOIDC && p.kind != oidcProviderKindGitHub {
+			log.Printf("Skipping OIDC provider %s: unknown type %q", name, p.kind)
+			continue
+		}
+
+		providers[name] = p
+	}
+
+	return providers
+}
+
+func (p *oidcProvider) oauth2Config(ctx context.Context) (*oauth2.Config, error) {
+	config := &oauth2.Config{
+		ClientID:     p.clientID,
+		ClientSecret: p.clientSecret,
+		RedirectURL:  p.redirectURL,
+		Scopes:       p.scopes,
+	}
+
+	if p.kind == oidcProviderKindGitHub {
+		config.Endpoint = github.Endpoint
+		return config, nil
+	}
+
+	provider, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	config.Endpoint = provider.Endpoint()
+
+	return config, nil
+}
+
+// discover fetches the provider's metadata once and keeps it. Failures are
+// not cached, so a provider that was down is retried on the next login.
+func (p *oidcProvider) discover(ctx context.Context) (*oidc.Provider, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.provider != nil {
+		return p.provider, nil
+	}
+
+	provider, err := oidc.NewProvider(ctx, p.issuer)
+	if err != nil {
+		return nil, fmt.Errorf("failed to discover OIDC provider %s: %w", p.name, err)
+	}
+	p.provider = provider
+
+	return provider, nil
+}
+
+// identity reads the signed-in user from the token response. For OpenID
+// Connect this is the verified ID token, which must carry our nonce.
+func (p *oidcProvider) identity(ctx context.Context, token *oauth2.Token, nonce string) (*externalIdentity, error) {
+	if p.kind == oidcProviderKindGitHub {
+		return githubIdentity(ctx, token)
+	}
+
+	provider, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return nil, errors.New("token response has no id_token")
+	}
+
+	idToken, err := provider.Verifier(&oidc.Config{ClientID: p.clientID}).Verify(ctx, rawIDToken)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ID token: %w", err)
+	}
+
+	if idToken.Nonce != nonce {
+		return nil, errors.New("ID token nonce does not match")
+	}
+
+	var claims struct {
+		Email         string          `json:"email"`
+		EmailVerified json.RawMessage `json:"email_verified"`
+		Name          string          `json:"name"`
+	}
+	if err := idToken.Claims(&claims); err != nil {
+		return nil, fmt.Errorf("invalid ID token claims: %w", err)
+	}
+
+	return &externalIdentity{
+		Subject:       idToken.Subject,
+		Email:         normalizeEmail(claims.Email),
+		EmailVerified: parseEmailVerified(claims.EmailVerified),
+		Name:          claims.Name,
+	}, nil
+}
+
+// parseEmailVerified accepts true and "true"; some providers send the
+// claim as a string.
+func parseEmailVerified(raw json.RawMessage) bool {
+	var verified bool
+	if err := json.Unmarshal(raw, &verified); err == nil {
+		return verified
+	}
+
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		verified, _ = strconv.ParseBool(s)
+	}
+	return verified
+}
+
+func githubIdentity(ctx context.Context, token *oauth2.Token) (*externalIdentity, error) {
+	client := oauth2.NewClient(ctx, oauth2.StaticTokenSource(token))
+
+	var user struct {
+		ID    int64  `json:"id"`
+		Login string `json:"login"`
+		Name  string `json:"name"`
+	}
+	if err := githubGet(client, "/user", &user); err != nil {
+		return nil, err
+	}
+
+	// The profile email may be unset or unverified, so ask for the primary
+	// verified address explicitly
+	var emails []struct {
+		Email    string `json:"email"`
+		Primary  bool   `json:"primary"`
+		Verified bool   `json:"verified"`
+	}
+	if err := githubGet(client, "/user/emails", &emails); err != nil {
+		return nil, err
+	}
+
+	identity := &externalIdentity{
+		Subject: strconv.FormatInt(user.ID, 10),
+		Name:    user.Name,
+	}
+	if identity.Name == "" {
+		identity.Name = user.Login
+	}
+	for _, email := range emails {
+		if email.Primary {
+			identity.Email = normalizeEmail(email.Email)
+			identity.EmailVerified = email.Verified
+			break
+		}
+	}
+
+	return identity, nil
+}
+
+func githubGet(client *http.Client, path string, v interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, githubAPIURL+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to call GitHub: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GitHub returned %s for %s", resp.Status, path)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
@@ -0,0 +1,415 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/enkyuan/ato/api/internal/dto"
+	"github.com/enkyuan/ato/api/internal/models"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+var (
+	ErrPasskeysDisabled   = errors.New("passkeys are not configured")
+	ErrPasskeyNotFound    = errors.New("passkey not found")
+	ErrPasskeyCeremony    = errors.New("passkey ceremony is invalid or has expired")
+	ErrPasskeyInvalid     = errors.New("passkey verification failed")
+	ErrPasskeyCloneWarned = errors.New("passkey signature counter went backwards")
+)
+
+const (
+	passkeyCeremonyTTL = 5 * time.Minute
+	defaultRPName      = "Ato"
+)
+
+// passkeyRegistration is what BeginPasskeyRegistration leaves in Redis for
+// FinishPasskeyRegistration.
+type passkeyRegistration struct {
+	Name    string               `json:"name"`
+	Session webauthn.SessionData `json:"session"`
+}
+
+// webauthnUser adapts a user and their passkeys to the webauthn library.
+type webauthnUser struct {
+	user     *models.User
+	handle   []byte
+	passkeys []*models.Passkey
+}
+
+func (u *webauthnUser) WebAuthnID() []byte          { return u.handle }
+func (u *webauthnUser) WebAuthnName() string        { return u.user.Email }
+func (u *webauthnUser) WebAuthnDisplayName() string { return u.user.Name }
+
+func (u *webauthnUser) WebAuthnCredentials() []webauthn.Credential {
+	credentials := make([]webauthn.Credential, 0, len(u.passkeys))
+	for _, passkey := range u.passkeys {
+		credentials = append(credentials, passkeyCredential(passkey))
+	}
+	return credentials
+}
+
+// newWebAuthn configures the relying party from the environment. The RP ID
+// must be the site's domain, or passkeys registered under it will not work.
+func newWebAuthn() *webauthn.WebAuthn {
+	rpID := os.Getenv("WEBAUTHN_RP_ID")
+	if rpID == "" {
+		rpID = "localhost"
+	}
+
+	rpName := os.Getenv("WEBAUTHN_RP_NAME")
+	if rpName == "" {
+		rpName = defaultRPName
+	}
+
+	var origins []string
+	for _, origin := range strings.Split(os.Getenv("WEBAUTHN_RP_ORIGINS"), ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			origins = append(origins, origin)
+		}
+	}
+	if len(origins) == 0 {
+		origins = []string{"http://localhost:3000"}
+		if frontendURL := os.Getenv("FRONTEND_URL"); frontendURL != "" {
+			if u, err := url.Parse(frontendURL); err == nil {
+				origins = append(origins, u.Scheme+"://"+u.Host)
+			}
+		}
+	}
+
+	w, err := webauthn.New(&webauthn.Config{
+		RPID:          rpID,
+		RPDisplayName: rpName,
+		RPOrigins:     origins,
+		AuthenticatorSelection: protocol.AuthenticatorSelection{
+			ResidentKey:      protocol.ResidentKeyRequirementRequired,
+			UserVerification: protocol.VerificationRequired,
+		},
+	})
+	if err != nil {
+		// Log error but keep serving; only passkeys are unavailable
+		log.Printf("Failed to configure passkeys: %v", err)
+		return nil
+	}
+
+	return w
+}
+
+// BeginPasskeyRegistration returns the options for navigator.credentials.create.
+func (s *authService) BeginPasskeyRegistration(ctx context.Context, userID int, name string) (*protocol.CredentialCreation, error) {
+	if s.webauthn == nil {
+		return nil, ErrPasskeysDisabled
+	}
+
+	user, err := s.webauthnUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Stop the authenticator from registering a second passkey for the same
+	// account
+	exclusions := make([]protocol.CredentialDescriptor, 0, len(user.passkeys))
+	for _, credential := range user.WebAuthnCredentials() {
+		exclusions = append(exclusions, credential.Descriptor())
+	}
+
+	creation, session, err := s.webauthn.BeginRegistration(user, webauthn.WithExclusions(exclusions))
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin passkey registration: %w", err)
+	}
+
+	data, err := json.Marshal(passkeyRegistration{Name: name, Session: *session})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.cache.Set(ctx, passkeyRegistrationKey(userID), string(data), passkeyCeremonyTTL); err != nil {
+		return nil, fmt.Errorf("failed to store passkey registration: %w", err)
+	}
+
+	return creation, nil
+}
+
+// FinishPasskeyRegistration verifies the authenticator's response and stores
+// the new passkey.
+func (s *authService) FinishPasskeyRegistration(ctx context.Context, userID int, body []byte, client dto.ClientInfo) (*models.Passkey, error) {
+	if s.webauthn == nil {
+		return nil, ErrPasskeysDisabled
+	}
+
+	key := passkeyRegistrationKey(userID)
+	data, err := s.cache.Get(ctx, key)
+	if err != nil {
+		return nil, ErrPasskeyCeremony
+	}
+	s.cache.Delete(ctx, key)
+
+	var registration passkeyRegistration
+	if err := json.Unmarshal([]byte(data), &registration); err != nil {
+		return nil, ErrPasskeyCeremony
+	}
+
+	parsed, err := protocol.ParseCredentialCreationResponseBytes(body)
+	if err != nil {
+		return nil, ErrPasskeyInvalid
+	}
+
+	user, err := s.webauthnUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	credential, err := s.webauthn.CreateCredential(user, registration.Session, parsed)
+	if err != nil {
+		return nil, ErrPasskeyInvalid
+	}
+
+	transports := make([]string, 0, len(credential.Transport))
+	for _, transport := range credential.Transport {
+		transports = append(transports, string(transport))
+	}
+
+	passkey := &models.Passkey{
+		UserID:          userID,
+		Name:            registration.Name,
+		CredentialID:    credential.ID,
+		PublicKey:       credential.PublicKey,
+		AttestationType: credential.AttestationType,
+		Transports:      transports,
+		AAGUID:          credential.Authenticator.AAGUID,
+		SignCount:       credential.Authenticator.SignCount,
+		UserPresent:     credential.Flags.UserPresent,
+		UserVerified:    credential.Flags.UserVerified,
+		BackupEligible:  credential.Flags.BackupEligible,
+		BackupState:     credential.Flags.BackupState,
+	}
+
+	if err := s.passkeyRepo.Create(ctx, passkey); err != nil {
+		return nil, fmt.Errorf("failed to store passkey: %w", err)
+	}
+
+	s.recordSecurityEvent(ctx, &models.SecurityEvent{
+		UserID:    userID,
+		Type:      models.SecurityEventPasskeyAdded,
+		IPAddress: client.IPAddress,
+		UserAgent: client.UserAgent,
+		Metadata:  map[string]string{"passkey_id": strconv.Itoa(passkey.ID)},
+	})
+
+	return passkey, nil
+}
+
+// BeginPasskeyLogin returns the options for navigator.credentials.get. The
+// login is discoverable: the authenticator picks the account, so the client
+// does not send an email first.
+func (s *authService) BeginPasskeyLogin(ctx context.Context) (*protocol.CredentialAssertion, error) {
+	if s.webauthn == nil {
+		return nil, ErrPasskeysDisabled
+	}
+
+	assertion, session, err := s.webauthn.BeginDiscoverableLogin(
+		webauthn.WithUserVerification(protocol.VerificationRequired),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin passkey login: %w", err)
+	}
+
+	data, err := json.Marshal(session)
+	if err != nil {
+		return nil, err
+	}
+
+	// The signed client data echoes the challenge, which is how the finish
+	// step finds this session again
+	if err := s.cache.Set(ctx, passkeyLoginKey(session.Challenge), string(data), passkeyCeremonyTTL); err != nil {
+		return nil, fmt.Errorf("failed to store passkey login: %w", err)
+	}
+
+	return assertion, nil
+}
+
+// FinishPasskeyLogin verifies an assertion and starts a session for the
+// passkey's owner. A passkey with user verification is already two factors,
+// so 2FA is not asked for on top.
+func (s *authService) FinishPasskeyLogin(ctx context.Context, body []byte, client dto.ClientInfo) (*dto.AuthResponse, error) {
+	if s.webauthn == nil {
+		return nil, ErrPasskeysDisabled
+	}
+
+	parsed, err := protocol.ParseCredentialRequestResponseBytes(body)
+	if err != nil {
+		return nil, ErrPasskeyInvalid
+	}
+
+	key := passkeyLoginKey(parsed.Response.CollectedClientData.Challenge)
+	data, err := s.cache.Get(ctx, key)
+	if err != nil {
+		return nil, ErrPasskeyCeremony
+	}
+
+	// Each challenge can be answered once
+	claimed, err := s.cache.DeleteIfEquals(ctx, key, data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to redeem passkey login: %w", err)
+	}
+	if !claimed {
+		return nil, ErrPasskeyCeremony
+	}
+
+	var session webauthn.SessionData
+	if err := json.Unmarshal([]byte(data), &session); err != nil {
+		return nil, ErrPasskeyCeremony
+	}
+
+	var owner *webauthnUser
+	credential, err := s.webauthn.ValidateDiscoverableLogin(func(rawID, userHandle []byte) (webauthn.User, error) {
+		userID, err := s.passkeyRepo.GetUserIDByHandle(ctx, userHandle)
+		if err != nil {
+			return nil, err
+		}
+		owner, err = s.webauthnUser(ctx, userID)
+		return owner, err
+	}, session, parsed)
+	if err != nil {
+		return nil, ErrPasskeyInvalid
+	}
+
+	var passkey *models.Passkey
+	for _, candidate := range owner.passkeys {
+		if bytes.Equal(candidate.CredentialID, credential.ID) {
+			passkey = candidate
+			break
+		}
+	}
+	if passkey == nil {
+		return nil, ErrPasskeyInvalid
+	}
+
+	// A counter that did not move forward means the key may have been copied
+	if credential.Authenticator.CloneWarning {
+		s.recordSecurityEvent(ctx, &models.SecurityEvent{
+			UserID:    owner.user.ID,
+			Type:      models.SecurityEventPasskeyCloned,
+			IPAddress: client.IPAddress,
+			UserAgent: client.UserAgent,
+			Metadata:  map[string]string{"passkey_id": strconv.Itoa(passkey.ID)},
+		})
+		return nil, ErrPasskeyCloneWarned
+	}
+
+	if err := s.passkeyRepo.RecordUse(ctx, passkey.ID, credential.Authenticator.SignCount, credential.Flags.BackupState); err != nil {
+		return nil, fmt.Errorf("failed to update passkey: %w", err)
+	}
+
+	return s.startFamily(ctx, owner.user, loginMethodPasskey, client)
+}
+
+func (s *authService) ListPasskeys(ctx context.Context, userID int) ([]*models.Passkey, error) {
+	passkeys, err := s.passkeyRepo.ListByUser(ctx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list passkeys: %w", err)
+	}
+
+	return passkeys, nil
+}
+
+func (s *authService) RenamePasskey(ctx context.Context, userID int, passkeyID int, name string) (*models.Passkey, error) {
+	passkey, err := s.passkeyRepo.Rename(ctx, passkeyID, userID, name)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrPasskeyNotFound
+		}
+		return nil, fmt.Errorf("failed to rename passkey: %w", err)
+	}
+
+	return passkey, nil
+}
+
+func (s *authService) DeletePasskey(ctx context.Context, userID int, passkeyID int, client dto.ClientInfo) error {
+	if err := s.passkeyRepo.Delete(ctx, passkeyID, userID); err != nil {
+		if err == sql.ErrNoRows {
+			return ErrPasskeyNotFound
+		}
+		return fmt.Errorf("failed to delete passkey: %w", err)
+	}
+
+	s.recordSecurityEvent(ctx, &models.SecurityEvent{
+		UserID:    userID,
+		Type:      models.SecurityEventPasskeyRemoved,
+		IPAddress: client.IPAddress,
+		UserAgent: client.UserAgent,
+		Metadata:  map[string]string{"passkey_id": strconv.Itoa(passkeyID)},
+	})
+
+	return nil
+}
+
+// webauthnUser loads a user with their passkeys, giving them a random user
+// handle the first time. The handle is what authenticators store, so it
+// must not reveal the account.
+func (s *authService) webauthnUser(ctx context.Context, userID int) (*webauthnUser, error) {
+	user, err := s.GetCurrentUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	candidate := make([]byte, 32)
+	if _, err := rand.Read(candidate); err != nil {
+		return nil, fmt.Errorf("failed to generate user handle: %w", err)
+	}
+
+	handle, err := s.passkeyRepo.EnsureUserHandle(ctx, userID, candidate)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user handle: %w", err)
+	}
+
+	passkeys, err := s.passkeyRepo.ListByUser(ctx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list passkeys: %w", err)
+	}
+
+	return &webauthnUser{user: user, handle: handle, passkeys: passkeys}, nil
+}
+
+func passkeyCredential(passkey *models.Passkey) webauthn.Credential {
+	transports := make([]protocol.AuthenticatorTransport, 0, len(passkey.Transports))
+	for _, transport := range passkey.Transports {
+		transports = append(transports, protocol.AuthenticatorTransport(transport))
+	}
+
+	return webauthn.Credential{
+		ID:              passkey.CredentialID,
+		PublicKey:       passkey.PublicKey,
+		AttestationType: passkey.AttestationType,
+		Transport:       transports,
+		Flags: webauthn.CredentialFlags{
+			UserPresent:    passkey.UserPresent,
+			UserVerified:   passkey.UserVerified,
+			BackupEligible: passkey.BackupEligible,
+			BackupState:    passkey.BackupState,
+		},
+		Authenticator: webauthn.Authenticator{
+			AAGUID:    passkey.AAGUID,
+			SignCount: passkey.SignCount,
+		},
+	}
+}
+
+func passkeyRegistrationKey(userID int) string {
+	return fmt.Sprintf("webauthn:registration:user:%d", userID)
+}
+
+func passkeyLoginKey(challenge string) string {
+	return fmt.Sprintf("webauthn:login:%s", challenge)
+}
@@ -0,0 +1,430 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/enkyuan/ato/api/internal/dto"
+	"github.com/enkyuan/ato/api/internal/models"
+	"github.com/enkyuan/ato/api/internal/repository"
+	"github.com/enkyuan/ato/api/pkg/auth"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/protocol/webauthncbor"
+	"github.com/go-webauthn/webauthn/protocol/webauthncose"
+)
+
+// The relying party NewAuthService configures without WEBAUTHN_* set
+const (
+	testRPID   = "localhost"
+	testOrigin = "http://localhost:3000"
+)
+
+// fakePasskeyRepository keeps user handles and passkeys in memory.
+type fakePasskeyRepository struct {
+	repository.PasskeyRepository
+	handles  map[int][]byte
+	passkeys []*models.Passkey
+}
+
+func newFakePasskeyRepository() *fakePasskeyRepository {
+	return &fakePasskeyRepository{handles: make(map[int][]byte)}
+}
+
+func (r *fakePasskeyRepository) EnsureUserHandle(ctx context.Context, userID int, candidate []byte) ([]byte, error) {
+	if handle, ok := r.handles[userID]; ok {
+		return handle, nil
+	}
+	r.handles[userID] = candidate
+	return candidate, nil
+}
+
+func (r *fakePasskeyRepository) GetUserIDByHandle(ctx context.Context, handle []byte) (int, error) {
+	for userID, candidate := range r.handles {
+		if bytes.Equal(candidate, handle) {
+			return userID, nil
+		}
+	}
+	return 0, sql.ErrNoRows
+}
+
+func (r *fakePasskeyRepository) Create(ctx context.Context, passkey *models.Passkey) error {
+	passkey.ID = len(r.passkeys) + 1
+	stored := *passkey
+	r.passkeys = append(r.passkeys, &stored)
+	return nil
+}
+
+func (r *fakePasskeyRepository) ListByUser(ctx context.Context, userID int) ([]*models.Passkey, error) {
+	var passkeys []*models.Passkey
+	for _, passkey := range r.passkeys {
+		if passkey.UserID == userID {
+			found := *passkey
+			passkeys = append(passkeys, &found)
+		}
+	}
+	return passkeys, nil
+}
+
+func (r *fakePasskeyRepository) RecordUse(ctx context.Context, id int, signCount uint32, backupState bool) error {
+	for _, passkey := range r.passkeys {
+		if passkey.ID == id {
+			passkey.SignCount = signCount
+			passkey.BackupState = backupState
+			return nil
+		}
+	}
+	return sql.ErrNoRows
+}
+
+// fakeTokenRepository accepts the rows a login writes.
+type fakeTokenRepository struct {
+	repository.TokenRepository
+	families      []*models.TokenFamily
+	refreshTokens []*models.RefreshToken
+}
+
+func (r *fakeTokenRepository) CreateFamily(ctx context.Context, family *models.TokenFamily) error {
+	family.ID = fmt.Sprintf("family-%d", len(r.families)+1)
+	r.families = append(r.families, family)
+	return nil
+}
+
+func (r *fakeTokenRepository) CreateRefreshToken(ctx context.Context, token *models.RefreshToken) error {
+	r.refreshTokens = append(r.refreshTokens, token)
+	return nil
+}
+
+// testAuthenticator is a software passkey: an ES256 key with a signature
+// counter, answering ceremonies as a browser would pass them on.
+type testAuthenticator struct {
+	key          *ecdsa.PrivateKey
+	credentialID []byte
+	signCount    uint32
+}
+
+func newTestAuthenticator(t *testing.T) *testAuthenticator {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	credentialID := make([]byte, 16)
+	if _, err := rand.Read(credentialID); err != nil {
+		t.Fatal(err)
+	}
+	return &testAuthenticator{key: key, credentialID: credentialID}
+}
+
+// authenticatorData is the rpIdHash, the user present and verified flags
+// plus any extra, and the counter.
+func (a *testAuthenticator) authenticatorData(flags protocol.AuthenticatorFlags) []byte {
+	rpIDHash := sha256.Sum256([]byte(testRPID))
+	data := append(rpIDHash[:], byte(protocol.FlagUserPresent|protocol.FlagUserVerified|flags))
+	return binary.BigEndian.AppendUint32(data, a.signCount)
+}
+
+func clientDataJSON(t *testing.T, ceremony protocol.CeremonyType, challenge protocol.URLEncodedBase64) []byte {
+	t.Helper()
+
+	data, err := json.Marshal(map[string]string{
+		"type":      string(ceremony),
+		"challenge": challenge.String(),
+		"origin":    testOrigin,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// register answers navigator.credentials.create with a "none" attestation.
+func (a *testAuthenticator) register(t *testing.T, creation *protocol.CredentialCreation) []byte {
+	t.Helper()
+
+	publicKey, err := webauthncbor.Marshal(webauthncose.EC2PublicKeyData{
+		PublicKeyData: webauthncose.PublicKeyData{
+			KeyType:   int64(webauthncose.EllipticKey),
+			Algorithm: int64(webauthncose.AlgES256),
+		},
+		Curve:  int64(webauthncose.P256),
+		XCoord: a.key.X.FillBytes(make([]byte, 32)),
+		YCoord: a.key.Y.FillBytes(make([]byte, 32)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	authData := a.authenticatorData(protocol.FlagAttestedCredentialData)
+	authData = append(authData, make([]byte, 16)...) // AAGUID
+	authData = binary.BigEndian.AppendUint16(authData, uint16(len(a.credentialID)))
+	authData = append(authData, a.credentialID...)
+	authData = append(authData, publicKey...)
+
+	attestation, err := webauthncbor.Marshal(map[string]any{
+		"fmt":      "none",
+		"attStmt":  map[string]any{},
+		"authData": authData,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return a.response(t, map[string]string{
+		"clientDataJSON":    encode(clientDataJSON(t, protocol.CreateCeremony, creation.Response.Challenge)),
+		"attestationObject": encode(attestation),
+	})
+}
+
+// login answers navigator.credentials.get for the given user handle.
+func (a *testAuthenticator) login(t *testing.T, assertion *protocol.CredentialAssertion, userHandle []byte) []byte {
+	t.Helper()
+
+	authData := a.authenticatorData(0)
+	clientData := clientDataJSON(t, protocol.AssertCeremony, assertion.Response.Challenge)
+	clientDataHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(authData, clientDataHash[:]...))
+
+	signature, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return a.response(t, map[string]string{
+		"clientDataJSON":    encode(clientData),
+		"authenticatorData": encode(authData),
+		"signature":         encode(signature),
+		"userHandle":        encode(userHandle),
+	})
+}
+
+func (a *testAuthenticator) response(t *testing.T, response map[string]string) []byte {
+	t.Helper()
+
+	body, err := json.Marshal(map[string]any{
+		"id":       encode(a.credentialID),
+		"rawId":    encode(a.credentialID),
+		"type":     "public-key",
+		"response": response,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+func encode(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// useTestKeySet signs tokens with a throwaway key for the rest of the test
+// binary; nothing else in this package checks which key signed them.
+func useTestKeySet(t *testing.T) {
+	t.Helper()
+
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ks, err := auth.NewKeySet([]*auth.SigningKey{{ID: "test", Algorithm: auth.AlgorithmEdDSA, Public: public, Private: private}}, auth.TokenConfig{
+		Issuer:        "test",
+		Audience:      []string{"test"},
+		AccessExpiry:  time.Minute,
+		RefreshExpiry: time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth.SetKeySet(ks)
+}
+
+type passkeyTest struct {
+	s        AuthService
+	passkeys *fakePasskeyRepository
+	tokens   *fakeTokenRepository
+	events   *fakeSecurityEventRepository
+	key      *testAuthenticator
+}
+
+func newPasskeyTest(t *testing.T) *passkeyTest {
+	t.Helper()
+
+	useTestKeySet(t)
+
+	users := newFakeUserRepository(&models.User{ID: testUserID, Email: "user@example.com", Name: "User"})
+	pt := &passkeyTest{
+		passkeys: newFakePasskeyRepository(),
+		tokens:   &fakeTokenRepository{},
+		events:   &fakeSecurityEventRepository{},
+		key:      newTestAuthenticator(t),
+	}
+	pt.s = NewAuthService(users, pt.tokens, nil, pt.passkeys, nil, nil, nil, NewSecurityEventService(pt.events, nil), newTestCache(t), nil, nil)
+
+	return pt
+}
+
+// register adds the authenticator's passkey to the test user.
+func (pt *passkeyTest) register(t *testing.T, client dto.ClientInfo) *models.Passkey {
+	t.Helper()
+
+	ctx := context.Background()
+	creation, err := pt.s.BeginPasskeyRegistration(ctx, testUserID, "Laptop")
+	if err != nil {
+		t.Fatalf("BeginPasskeyRegistration() error = %v", err)
+	}
+
+	pt.key.signCount = 1
+	passkey, err := pt.s.FinishPasskeyRegistration(ctx, testUserID, pt.key.register(t, creation), client)
+	if err != nil {
+		t.Fatalf("FinishPasskeyRegistration() error = %v", err)
+	}
+	return passkey
+}
+
+// login answers a fresh login ceremony with the authenticator's next count.
+func (pt *passkeyTest) login(t *testing.T, signCount uint32) []byte {
+	t.Helper()
+
+	assertion, err := pt.s.BeginPasskeyLogin(context.Background())
+	if err != nil {
+		t.Fatalf("BeginPasskeyLogin() error = %v", err)
+	}
+
+	pt.key.signCount = signCount
+	return pt.key.login(t, assertion, pt.passkeys.handles[testUserID])
+}
+
+func TestPasskeyRegistrationAndLogin(t *testing.T) {
+	ctx := context.Background()
+	client := dto.ClientInfo{IPAddress: "192.0.2.1"}
+	pt := newPasskeyTest(t)
+
+	passkey := pt.register(t, client)
+	if passkey.Name != "Laptop" || !bytes.Equal(passkey.CredentialID, pt.key.credentialID) || passkey.SignCount != 1 {
+		t.Errorf("registered passkey %q with count %d, want Laptop with count 1", passkey.Name, passkey.SignCount)
+	}
+	if len(pt.passkeys.passkeys) != 1 {
+		t.Fatalf("stored %d passkeys, want 1", len(pt.passkeys.passkeys))
+	}
+	if len(pt.events.events) != 1 || pt.events.events[0].Type != models.SecurityEventPasskeyAdded {
+		t.Errorf("events = %v, want one %s", pt.events.events, models.SecurityEventPasskeyAdded)
+	}
+
+	// The registration can only be finished once
+	if _, err := pt.s.FinishPasskeyRegistration(ctx, testUserID, pt.key.register(t, &protocol.CredentialCreation{}), client); !errors.Is(err, ErrPasskeyCeremony) {
+		t.Errorf("FinishPasskeyRegistration() again error = %v, want %v", err, ErrPasskeyCeremony)
+	}
+
+	body := pt.login(t, 2)
+	resp, err := pt.s.FinishPasskeyLogin(ctx, body, client)
+	if err != nil {
+		t.Fatalf("FinishPasskeyLogin() error = %v", err)
+	}
+	if resp.User.ID != testUserID || resp.AccessToken == "" || resp.RefreshToken == "" {
+		t.Errorf("FinishPasskeyLogin() = user %d with tokens %v, want user %d", resp.User.ID, resp.AccessToken != "", testUserID)
+	}
+	if len(pt.tokens.families) != 1 || len(pt.tokens.refreshTokens) != 1 {
+		t.Errorf("started %d sessions with %d refresh tokens, want 1 and 1", len(pt.tokens.families), len(pt.tokens.refreshTokens))
+	}
+	if count := pt.passkeys.passkeys[0].SignCount; count != 2 {
+		t.Errorf("stored sign count = %d, want 2", count)
+	}
+
+	// Each challenge can be answered once
+	if _, err := pt.s.FinishPasskeyLogin(ctx, body, client); !errors.Is(err, ErrPasskeyCeremony) {
+		t.Errorf("FinishPasskeyLogin() replayed error = %v, want %v", err, ErrPasskeyCeremony)
+	}
+}
+
+func TestFinishPasskeyLoginRejects(t *testing.T) {
+	ctx := context.Background()
+	client := dto.ClientInfo{IPAddress: "192.0.2.1"}
+
+	tests := []struct {
+		name      string
+		body      func(t *testing.T, pt *passkeyTest) []byte
+		wantErr   error
+		wantEvent string
+	}{
+		{
+			name: "no ceremony",
+			body: func(t *testing.T, pt *passkeyTest) []byte {
+				return pt.key.login(t, &protocol.CredentialAssertion{
+					Response: protocol.PublicKeyCredentialRequestOptions{Challenge: []byte("never issued")},
+				}, pt.passkeys.handles[testUserID])
+			},
+			wantErr: ErrPasskeyCeremony,
+		},
+		{
+			name: "wrong key",
+			body: func(t *testing.T, pt *passkeyTest) []byte {
+				// Same credential ID, different private key
+				pt.key.key = newTestAuthenticator(t).key
+				return pt.login(t, 2)
+			},
+			wantErr: ErrPasskeyInvalid,
+		},
+		{
+			name: "unknown user handle",
+			body: func(t *testing.T, pt *passkeyTest) []byte {
+				assertion, err := pt.s.BeginPasskeyLogin(ctx)
+				if err != nil {
+					t.Fatal(err)
+				}
+				pt.key.signCount = 2
+				return pt.key.login(t, assertion, []byte("someone else"))
+			},
+			wantErr: ErrPasskeyInvalid,
+		},
+		{
+			name: "counter did not move",
+			body: func(t *testing.T, pt *passkeyTest) []byte {
+				return pt.login(t, 1)
+			},
+			wantErr:   ErrPasskeyCloneWarned,
+			wantEvent: models.SecurityEventPasskeyCloned,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pt := newPasskeyTest(t)
+			pt.register(t, client)
+			pt.events.events = nil
+
+			if _, err := pt.s.FinishPasskeyLogin(ctx, tt.body(t, pt), client); !errors.Is(err, tt.wantErr) {
+				t.Fatalf("FinishPasskeyLogin() error = %v, want %v", err, tt.wantErr)
+			}
+
+			if len(pt.tokens.families) != 0 {
+				t.Errorf("started %d sessions, want none", len(pt.tokens.families))
+			}
+			if count := pt.passkeys.passkeys[0].SignCount; count != 1 {
+				t.Errorf("stored sign count = %d, want 1", count)
+			}
+
+			if tt.wantEvent == "" {
+				if len(pt.events.events) != 0 {
+					t.Errorf("recorded %d events, want none", len(pt.events.events))
+				}
+				return
+			}
+			if len(pt.events.events) != 1 || pt.events.events[0].Type != tt.wantEvent {
+				t.Errorf("events = %v, want one %s", pt.events.events, tt.wantEvent)
+			}
+		})
+	}
+}
@@ -0,0 +1,338 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/enkyuan/ato/api/cache"
+	"github.com/enkyuan/ato/api/internal/dto"
+	"github.com/redis/go-redis/v9"
+)
+
+var (
+	ErrEditLocked = errors.New("todo is being edited by another user")
+)
+
+const (
+	// PresenceTTL is how long a connection stays visible without a heartbeat.
+	PresenceTTL = 30 * time.Second
+	// EditLockTTL is how long an "is editing" lock survives without a refresh.
+	EditLockTTL = 30 * time.Second
+
+	realtimeChannelPrefix = "realtime:group:"
+)
+
+type PresenceService interface {
+	Join(ctx context.Context, groupID int, member dto.PresenceMember, connID string) (bool, error)
+	Heartbeat(ctx context.Context, groupID int, member dto.PresenceMember, connID string) error
+	Leave(ctx context.Context, groupID int, userID int, connID string) (bool, error)
+	Members(ctx context.Context, groupID int) ([]dto.PresenceMember, error)
+	StartEditing(ctx context.Context, groupID int, todoID int, userID int, connID string) error
+	StopEditing(ctx context.Context, groupID int, todoID int, userID int, connID string) (bool, error)
+	Editing(ctx context.Context, groupID int) ([]dto.EditLock, error)
+	Publish(ctx context.Context, event dto.RealtimeEvent) error
+	Subscribe(ctx context.Context) *redis.PubSub
+}
+
+type presenceService struct {
+	cache *cache.Cache
+}
+
+func NewPresenceService(cache *cache.Cache) PresenceService {
+	return &presenceService{
+		cache: cache,
+	}
+}
+
+// RealtimeChannelGroupID extracts the group ID from a pub/sub channel name.
+func RealtimeChannelGroupID(channel string) (int, bool) {
+	id, err := strconv.Atoi(strings.TrimPrefix(channel, realtimeChannelPrefix))
+	if err != nil {
+		return 0, false
+	}
+	return id, true
+}
+
+// Presence is kept per group in a sorted set of "userID:connID" members
+// scored by when they expire, with the members' names in a hash by user ID.
+// Edit locks are one key per todo, so they can be taken atomically, and are
+// indexed per group in a sorted set the same way. Reading a group's state
+// never has to scan the keyspace.
+func presenceKey(groupID int) string {
+	return fmt.Sprintf("presence:group:%d", groupID)
+}
+
+func presenceNamesKey(groupID int) string {
+	return fmt.Sprintf("presence:group:%d:names", groupID)
+}
+
+func presenceMember(userID int, connID string) string {
+	return fmt.Sprintf("%d:%s", userID, connID)
+}
+
+func editLockKey(groupID int, todoID int) string {
+	return fmt.Sprintf("editlock:group:%d:todo:%d", groupID, todoID)
+}
+
+func editLocksKey(groupID int) string {
+	return fmt.Sprintf("editlocks:group:%d", groupID)
+}
+
+func editLockValue(userID int, connID string) string {
+	return fmt.Sprintf("%d:%s", userID, connID)
+}
+
+// scoreNow is the sorted set score of an entry expiring now.
+func scoreNow() string {
+	return strconv.FormatInt(time.Now().UnixMilli(), 10)
+}
+
+func expiryScore(ttl time.Duration) float64 {
+	return float64(time.Now().Add(ttl).UnixMilli())
+}
+
+// liveMembers drops expired entries from a sorted set indexed by expiry and
+// returns the rest.
+func (s *presenceService) liveMembers(ctx context.Context, key string) ([]string, error) {
+	now := scoreNow()
+	if err := s.cache.ZRemRangeByScore(ctx, key, "-inf", now); err != nil {
+		return nil, err
+	}
+	return s.cache.ZRangeByScore(ctx, key, "("+now, "+inf")
+}
+
+// connectedElsewhere reports whether the user has a live connection to the
+// group other than connID.
+func connectedElsewhere(members []string, userID int, connID string) bool {
+	prefix := strconv.Itoa(userID) + ":"
+	for _, member := range members {
+		if strings.HasPrefix(member, prefix) && member != presenceMember(userID, connID) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *presenceService) Join(ctx context.Context, groupID int, member dto.PresenceMember, connID string) (bool, error) {
+	existing, err := s.liveMembers(ctx, presenceKey(groupID))
+	if err != nil {
+		return false, err
+	}
+
+	if err := s.Heartbeat(ctx, groupID, member, connID); err != nil {
+		return false, err
+	}
+
+	// A user with several tabs open should only be announced once
+	return !connectedElsewhere(existing, member.UserID, connID), nil
+}
+
+func (s *presenceService) Heartbeat(ctx context.Context, groupID int, member dto.PresenceMember, connID string) error {
+	data, err := json.Marshal(member)
+	if err != nil {
+		return err
+	}
+
+	return s.cache.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZAdd(ctx, presenceKey(groupID), redis.Z{Score: expiryScore(PresenceTTL), Member: presenceMember(member.UserID, connID)})
+		pipe.HSet(ctx, presenceNamesKey(groupID), strconv.Itoa(member.UserID), string(data))
+		// The whole group's entry goes once nobody sends heartbeats
+		pipe.Expire(ctx, presenceKey(groupID), PresenceTTL)
+		pipe.Expire(ctx, presenceNamesKey(groupID), PresenceTTL)
+		return nil
+	})
+}
+
+func (s *presenceService) Leave(ctx context.Context, groupID int, userID int, connID string) (bool, error) {
+	if err := s.cache.ZRem(ctx, presenceKey(groupID), presenceMember(userID, connID)); err != nil {
+		return false, err
+	}
+
+	remaining, err := s.liveMembers(ctx, presenceKey(groupID))
+	if err != nil {
+		return false, err
+	}
+	if connectedElsewhere(remaining, userID, connID) {
+		return false, nil
+	}
+
+	if err := s.cache.HDel(ctx, presenceNamesKey(groupID), strconv.Itoa(userID)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *presenceService) Members(ctx context.Context, groupID int) ([]dto.PresenceMember, error) {
+	live, err := s.liveMembers(ctx, presenceKey(groupID))
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	var userIDs []string
+	for _, member := range live {
+		userID, _, _ := strings.Cut(member, ":")
+		if !seen[userID] {
+			seen[userID] = true
+			userIDs = append(userIDs, userID)
+		}
+	}
+
+	members := []dto.PresenceMember{}
+	if len(userIDs) == 0 {
+		return members, nil
+	}
+
+	names, err := s.cache.HMGet(ctx, presenceNamesKey(groupID), userIDs...)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, value := range names {
+		data, ok := value.(string)
+		if !ok {
+			// Left between the two reads
+			continue
+		}
+
+		var member dto.PresenceMember
+		if err := json.Unmarshal([]byte(data), &member); err != nil {
+			continue
+		}
+		members = append(members, member)
+	}
+
+	sort.Slice(members, func(i, j int) bool {
+		return members[i].UserID < members[j].UserID
+	})
+
+	return members, nil
+}
+
+func (s *presenceService) StartEditing(ctx context.Context, groupID int, todoID int, userID int, connID string) error {
+	if err := s.lockTodo(ctx, groupID, todoID, userID, connID); err != nil {
+		return err
+	}
+
+	return s.cache.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZAdd(ctx, editLocksKey(groupID), redis.Z{Score: expiryScore(EditLockTTL), Member: strconv.Itoa(todoID)})
+		pipe.Expire(ctx, editLocksKey(groupID), EditLockTTL)
+		return nil
+	})
+}
+
+// lockTodo takes or refreshes the todo's edit lock for the connection.
+func (s *presenceService) lockTodo(ctx context.Context, groupID int, todoID int, userID int, connID string) error {
+	key := editLockKey(groupID, todoID)
+	value := editLockValue(userID, connID)
+
+	acquired, err := s.cache.SetNX(ctx, key, value, EditLockTTL)
+	if err != nil {
+		return err
+	}
+	if acquired {
+		return nil
+	}
+
+	// Already held: refresh it if it is ours, otherwise report the conflict
+	holder, err := s.cache.Get(ctx, key)
+	if err == redis.Nil {
+		// Released between the two calls, so try once more
+		acquired, err = s.cache.SetNX(ctx, key, value, EditLockTTL)
+		if err != nil {
+			return err
+		}
+		if !acquired {
+			return ErrEditLocked
+		}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if holder != value {
+		return ErrEditLocked
+	}
+
+	return s.cache.Expire(ctx, key, EditLockTTL)
+}
+
+func (s *presenceService) StopEditing(ctx context.Context, groupID int, todoID int, userID int, connID string) (bool, error) {
+	released, err := s.cache.DeleteIfEquals(ctx, editLockKey(groupID, todoID), editLockValue(userID, connID))
+	if err != nil || !released {
+		return released, err
+	}
+
+	if err := s.cache.ZRem(ctx, editLocksKey(groupID), strconv.Itoa(todoID)); err != nil {
+		return true, err
+	}
+	return true, nil
+}
+
+func (s *presenceService) Editing(ctx context.Context, groupID int) ([]dto.EditLock, error) {
+	todos, err := s.liveMembers(ctx, editLocksKey(groupID))
+	if err != nil {
+		return nil, err
+	}
+
+	locks := []dto.EditLock{}
+	if len(todos) == 0 {
+		return locks, nil
+	}
+
+	todoIDs := make([]int, 0, len(todos))
+	keys := make([]string, 0, len(todos))
+	for _, member := range todos {
+		todoID, err := strconv.Atoi(member)
+		if err != nil {
+			continue
+		}
+		todoIDs = append(todoIDs, todoID)
+		keys = append(keys, editLockKey(groupID, todoID))
+	}
+
+	holders, err := s.cache.MGet(ctx, keys...)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, value := range holders {
+		holder, ok := value.(string)
+		if !ok {
+			// Released or expired since it was indexed
+			continue
+		}
+
+		userID, err := strconv.Atoi(strings.SplitN(holder, ":", 2)[0])
+		if err != nil {
+			continue
+		}
+
+		locks = append(locks, dto.EditLock{TodoID: todoIDs[i], UserID: userID})
+	}
+
+	sort.Slice(locks, func(i, j int) bool {
+		return locks[i].TodoID < locks[j].TodoID
+	})
+
+	return locks, nil
+}
+
+func (s *presenceService) Publish(ctx context.Context, event dto.RealtimeEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	return s.cache.Publish(ctx, fmt.Sprintf("%s%d", realtimeChannelPrefix, event.GroupID), string(data))
+}
+
+func (s *presenceService) Subscribe(ctx context.Context) *redis.PubSub {
+	return s.cache.PSubscribe(ctx, realtimeChannelPrefix+"*")
+}
@@ -0,0 +1,283 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+
+	// Time zones are validated against the embedded database, so it does
+	// not matter whether the host has one
+	_ "time/tzdata"
+
+	"github.com/enkyuan/ato/api/internal/dto"
+	"github.com/enkyuan/ato/api/internal/models"
+	"github.com/enkyuan/ato/api/internal/repository"
+	"github.com/enkyuan/ato/api/pkg/auth"
+	"github.com/enkyuan/ato/api/pkg/mailer"
+)
+
+var (
+	ErrInvalidPreferences = errors.New("invalid preferences")
+	ErrPasswordNotSet     = errors.New("account has no password")
+	ErrEmailUnchanged     = errors.New("email is already the account's email")
+)
+
+const emailChangeTTL = time.Hour
+
+// localePattern loosely matches BCP 47 language tags such as en or pt-BR
+var localePattern = regexp.MustCompile(`^[a-zA-Z]{2,3}(-[a-zA-Z0-9]{2,8}){0,3}$`)
+
+type ProfileService interface {
+	UpdateProfile(ctx context.Context, userID int, req dto.UpdateProfileRequest) (*models.User, error)
+	RequestEmailChange(ctx context.Context, userID int, req dto.ChangeEmailRequest) error
+	ConfirmEmailChange(ctx context.Context, req dto.ConfirmEmailChangeRequest) error
+	ChangePassword(ctx context.Context, userID int, sessionID string, req dto.ChangePasswordRequest) error
+}
+
+// profileService lets users change their own account details. Signing out
+// other sessions goes through the auth service, which owns them.
+type profileService struct {
+	userRepo          repository.UserRepository
+	accountTokenRepo  repository.AccountTokenRepository
+	securityEventRepo repository.SecurityEventRepository
+	accounts          AccountSecurity
+	apiTokens         APITokenService
+	mailer            mailer.Mailer
+	passwordPolicy    *auth.PasswordPolicy
+}
+
+func NewProfileService(userRepo repository.UserRepository, accountTokenRepo repository.AccountTokenRepository, securityEventRepo repository.SecurityEventRepository, accounts AccountSecurity, apiTokens APITokenService, mailer mailer.Mailer) ProfileService {
+	return &profileService{
+		userRepo:          userRepo,
+		accountTokenRepo:  accountTokenRepo,
+		securityEventRepo: securityEventRepo,
+		accounts:          accounts,
+		apiTokens:         apiTokens,
+		mailer:            mailer,
+		passwordPolicy:    auth.LoadPasswordPolicy(),
+	}
+}
+
+// UpdateProfile changes the user's name and preferences. Fields the request
+// leaves out keep their current values.
+func (s *profileService) UpdateProfile(ctx context.Context, userID int, req dto.UpdateProfileRequest) (*models.User, error) {
+	user, err := getUser(s.userRepo, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	name := user.Name
+	if req.Name != nil {
+		name = strings.TrimSpace(*req.Name)
+	}
+
+	preferences := user.Preferences
+	if update := req.Preferences; update != nil {
+		if update.Theme != nil {
+			preferences.Theme = *update.Theme
+		}
+		if update.Locale != nil {
+			preferences.Locale = *update.Locale
+		}
+		if update.Timezone != nil {
+			preferences.Timezone = *update.Timezone
+		}
+		if err := validatePreferences(preferences); err != nil {
+			return nil, err
+		}
+	}
+
+	updated, err := s.userRepo.UpdateProfile(userID, name, preferences)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrUserNotFound
+		}
+		return nil, fmt.Errorf("failed to update profile: %w", err)
+	}
+
+	return updated, nil
+}
+
+// RequestEmailChange sends a confirmation link to the new address. The
+// account keeps its current email until the link is followed.
+func (s *profileService) RequestEmailChange(ctx context.Context, userID int, req dto.ChangeEmailRequest) error {
+	user, err := checkCurrentPassword(s.userRepo, userID, req.Password)
+	if err != nil {
+		return err
+	}
+
+	email := normalizeEmail(req.Email)
+	if email == user.Email {
+		return ErrEmailUnchanged
+	}
+
+	if _, err := s.userRepo.GetByEmail(email); err == nil {
+		return ErrEmailExists
+	} else if err != sql.ErrNoRows {
+		return fmt.Errorf("failed to get user: %w", err)
+	}
+
+	// Only the newest link works
+	if err := s.accountTokenRepo.InvalidateForUser(ctx, user.ID, models.AccountTokenEmailChange); err != nil {
+		return fmt.Errorf("failed to invalidate email change links: %w", err)
+	}
+
+	token, err := createAccountToken(ctx, s.accountTokenRepo, user.ID, email, models.AccountTokenEmailChange, emailChangeTTL)
+	if err != nil {
+		return err
+	}
+
+	sendMailAsync(s.mailer, mailer.Message{
+		To:      email,
+		Subject: "Confirm your new email",
+		Body: fmt.Sprintf("Hi %s,\n\nOpen this link within an hour to start using this address for your account:\n\n%s\n\nIf you didn't ask for this, you can ignore this email.\n",
+			user.Name, frontendLink("/confirm-email", token)),
+	})
+
+	return nil
+}
+
+// ConfirmEmailChange moves the account to the address a change link was sent
+// to, and tells the old address about it.
+func (s *profileService) ConfirmEmailChange(ctx context.Context, req dto.ConfirmEmailChangeRequest) error {
+	token, err := consumeAccountToken(ctx, s.accountTokenRepo, models.AccountTokenEmailChange, req.Token)
+	if err != nil {
+		return err
+	}
+
+	user, err := getUser(s.userRepo, token.UserID)
+	if err != nil {
+		return err
+	}
+
+	// Links already sent to the old address stop working on their own,
+	// since they no longer match the account's email
+	if err := s.userRepo.UpdateEmail(user.ID, token.Email); err != nil {
+		if repository.IsUniqueViolation(err) {
+			return ErrEmailExists
+		}
+		if err == sql.ErrNoRows {
+			return ErrUserNotFound
+		}
+		return fmt.Errorf("failed to update email: %w", err)
+	}
+	s.accounts.ForgetUser(user.ID)
+
+	saveSecurityEvent(ctx, s.securityEventRepo, &models.SecurityEvent{
+		UserID:    user.ID,
+		Type:      models.SecurityEventEmailChanged,
+		IPAddress: req.Client.IPAddress,
+		UserAgent: req.Client.UserAgent,
+		Metadata: map[string]string{
+			"old_email": user.Email,
+			"new_email": token.Email,
+		},
+	})
+
+	sendMailAsync(s.mailer, mailer.Message{
+		To:      user.Email,
+		Subject: "Your email was changed",
+		Body: fmt.Sprintf("Hi %s,\n\nThe email for your account was changed from %s to %s. If you didn't do this, contact us right away.\n",
+			user.Name, user.Email, token.Email),
+	})
+
+	return nil
+}
+
+// ChangePassword sets a new password for a user who knows the current one.
+// Every other session and app is logged out and API tokens are revoked; the
+// session making the change stays signed in.
+func (s *profileService) ChangePassword(ctx context.Context, userID int, sessionID string, req dto.ChangePasswordRequest) error {
+	user, err := checkCurrentPassword(s.userRepo, userID, req.CurrentPassword)
+	if err != nil {
+		return err
+	}
+
+	if err := s.passwordPolicy.Check(req.NewPassword, user.Email, user.Name); err != nil {
+		return err
+	}
+
+	hashedPassword, err := auth.HashPassword(req.NewPassword)
+	if err != nil {
+		return fmt.Errorf("failed to hash password: %w", err)
+	}
+
+	if err := s.userRepo.UpdatePassword(user.ID, hashedPassword); err != nil {
+		return fmt.Errorf("failed to update password: %w", err)
+	}
+
+	if err := s.accounts.EndOtherSessions(ctx, user.ID, sessionID, models.TokenFamilyRevokedPassword); err != nil {
+		return err
+	}
+
+	if err := s.apiTokens.DeleteAllAPITokens(ctx, user.ID); err != nil {
+		return err
+	}
+
+	// Reset links sent for the old password are no longer needed
+	if err := s.accountTokenRepo.InvalidateForUser(ctx, user.ID, models.AccountTokenPasswordReset); err != nil {
+		// Log error but don't fail the request
+		log.Printf("Failed to invalidate reset links: %v", err)
+	}
+
+	saveSecurityEvent(ctx, s.securityEventRepo, &models.SecurityEvent{
+		UserID:    user.ID,
+		Type:      models.SecurityEventPasswordChanged,
+		IPAddress: req.Client.IPAddress,
+		UserAgent: req.Client.UserAgent,
+	})
+
+	sendMailAsync(s.mailer, mailer.Message{
+		To:      user.Email,
+		Subject: "Your password was changed",
+		Body: fmt.Sprintf("Hi %s,\n\nThe password for your account was just changed, and your other sessions were signed out. If you didn't do this, reset your password right away:\n\n%s\n",
+			user.Name, frontendURL("/forgot-password")),
+	})
+
+	return nil
+}
+
+// checkCurrentPassword re-authenticates a signed-in user before a sensitive
+// change. Accounts created through a sign-in provider have no password and
+// must set one through the reset flow first.
+func checkCurrentPassword(userRepo repository.UserRepository, userID int, password string) (*models.User, error) {
+	user, err := getUser(userRepo, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	if user.PasswordHash == "" {
+		return nil, ErrPasswordNotSet
+	}
+	if !auth.CheckPassword(password, user.PasswordHash) {
+		return nil, ErrInvalidCredentials
+	}
+
+	return user, nil
+}
+
+func validatePreferences(preferences models.UserPreferences) error {
+	switch preferences.Theme {
+	case "", models.ThemeSystem, models.ThemeLight, models.ThemeDark:
+	default:
+		return fmt.Errorf("%w: theme must be system, light or dark", ErrInvalidPreferences)
+	}
+
+	if preferences.Locale != "" && !localePattern.MatchString(preferences.Locale) {
+		return fmt.Errorf("%w: locale must be a language tag such as en-US", ErrInvalidPreferences)
+	}
+
+	// LoadLocation also accepts "Local", which would mean the server's zone
+	if tz := preferences.Timezone; tz != "" {
+		if _, err := time.LoadLocation(tz); err != nil || tz == "Local" {
+			return fmt.Errorf("%w: time zone must be an IANA name such as Europe/Paris", ErrInvalidPreferences)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,169 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/enkyuan/ato/api/internal/dto"
+	"github.com/enkyuan/ato/api/internal/models"
+	"github.com/enkyuan/ato/api/internal/repository"
+	"github.com/enkyuan/ato/api/pkg/auth"
+	"github.com/enkyuan/ato/api/pkg/mailer"
+)
+
+// How a session was started, recorded with each login
+const (
+	loginMethodRegister  = "register"
+	loginMethodPassword  = "password"
+	loginMethodMFA       = "mfa"
+	loginMethodPasskey   = "passkey"
+	loginMethodMagicLink = "magic_link"
+	loginMethodOIDC      = "oidc"
+)
+
+const (
+	DefaultSecurityEventsLimit = 50
+	MaxSecurityEventsLimit     = 200
+)
+
+// versionNumbers matches the version parts of a user agent, which change
+// with every browser update while the device stays the same
+var versionNumbers = regexp.MustCompile(`[0-9][0-9._]*`)
+
+type SecurityEventService interface {
+	ListSecurityEvents(ctx context.Context, userID int, req dto.ListSecurityEventsRequest) (*dto.SecurityEventsResponse, error)
+	Record(ctx context.Context, event *models.SecurityEvent)
+	RecordLogin(ctx context.Context, user *models.User, sessionID string, method string, client dto.ClientInfo)
+}
+
+// securityEventService keeps users' security logs and alerts them to logins
+// from new devices. Services that only write events save them with
+// saveSecurityEvent.
+type securityEventService struct {
+	securityEventRepo repository.SecurityEventRepository
+	mailer            mailer.Mailer
+}
+
+func NewSecurityEventService(securityEventRepo repository.SecurityEventRepository, mailer mailer.Mailer) SecurityEventService {
+	return &securityEventService{
+		securityEventRepo: securityEventRepo,
+		mailer:            mailer,
+	}
+}
+
+// ListSecurityEvents returns a page of the user's own security events,
+// newest first.
+func (s *securityEventService) ListSecurityEvents(ctx context.Context, userID int, req dto.ListSecurityEventsRequest) (*dto.SecurityEventsResponse, error) {
+	limit := req.Limit
+	if limit <= 0 {
+		limit = DefaultSecurityEventsLimit
+	}
+	if limit > MaxSecurityEventsLimit {
+		limit = MaxSecurityEventsLimit
+	}
+
+	// One extra row tells whether there is another page
+	events, err := s.securityEventRepo.ListByUser(ctx, userID, repository.SecurityEventFilter{
+		Types:  req.Types,
+		Before: req.Before,
+		Limit:  limit + 1,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list security events: %w", err)
+	}
+
+	resp := &dto.SecurityEventsResponse{Events: events}
+	if len(events) > limit {
+		resp.Events = events[:limit]
+		resp.NextBefore = resp.Events[limit-1].ID
+	}
+
+	return resp, nil
+}
+
+// saveSecurityEvent records an event without failing the request it came
+// from.
+func saveSecurityEvent(ctx context.Context, repo repository.SecurityEventRepository, event *models.SecurityEvent) {
+	if err := repo.Create(ctx, event); err != nil {
+		// Log error but don't fail the request
+		log.Printf("Failed to record security event %s: %v", event.Type, err)
+	}
+}
+
+// Record logs an event without failing the request it came from.
+func (s *securityEventService) Record(ctx context.Context, event *models.SecurityEvent) {
+	saveSecurityEvent(ctx, s.securityEventRepo, event)
+}
+
+// RecordLogin logs a successful login and emails the user if it came from a
+// device they have not logged in from before. The first login, at
+// registration, never alerts.
+func (s *securityEventService) RecordLogin(ctx context.Context, user *models.User, sessionID string, method string, client dto.ClientInfo) {
+	metadata := map[string]string{
+		"method":     method,
+		"session_id": sessionID,
+	}
+
+	device := deviceKey(client.UserAgent)
+	newDevice := false
+	if device != "" {
+		metadata["device"] = device
+
+		seen, anyLogins, err := s.securityEventRepo.DeviceSeen(ctx, user.ID, device)
+		if err != nil {
+			// Log error but don't fail the login
+			log.Printf("Failed to check login device: %v", err)
+		} else {
+			newDevice = !seen && anyLogins
+		}
+	}
+	if newDevice {
+		metadata["new_device"] = "true"
+	}
+
+	event := &models.SecurityEvent{
+		UserID:    user.ID,
+		Type:      models.SecurityEventLoginSucceeded,
+		IPAddress: client.IPAddress,
+		UserAgent: client.UserAgent,
+		Metadata:  metadata,
+	}
+	s.Record(ctx, event)
+
+	if newDevice {
+		s.sendNewDeviceAlert(user, event)
+	}
+}
+
+func (s *securityEventService) sendNewDeviceAlert(user *models.User, event *models.SecurityEvent) {
+	at := event.CreatedAt
+	if at.IsZero() {
+		at = time.Now()
+	}
+
+	ip := event.IPAddress
+	if ip == "" {
+		ip = "unknown"
+	}
+
+	sendMailAsync(s.mailer, mailer.Message{
+		To:      user.Email,
+		Subject: "New sign-in to your account",
+		Body: fmt.Sprintf("Hi %s,\n\nYour account was just signed in to from a device it hasn't been used on before.\n\nTime: %s\nIP address: %s\nDevice: %s\n\nIf this was you, there's nothing to do. If not, change your password and sign out your other sessions right away:\n\n%s\n",
+			user.Name, at.UTC().Format(time.RFC1123), ip, event.UserAgent, frontendURL("/settings/security")),
+	})
+}
+
+// deviceKey identifies the kind of device and browser a user agent
+// describes, ignoring versions so updates do not look like a new device.
+func deviceKey(userAgent string) string {
+	normalized := strings.ToLower(strings.TrimSpace(versionNumbers.ReplaceAllString(userAgent, "")))
+	if normalized == "" {
+		return ""
+	}
+	return auth.HashToken(normalized)[:16]
+}
@@ -0,0 +1,165 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/enkyuan/ato/api/internal/dto"
+	"github.com/enkyuan/ato/api/internal/models"
+	"github.com/enkyuan/ato/api/internal/repository"
+	"github.com/enkyuan/ato/api/pkg/auth"
+)
+
+const shareTokenPrefix = "shr_"
+
+var (
+	ErrShareNotFound         = errors.New("share link not found")
+	ErrSharePasswordRequired = errors.New("share link password required")
+	ErrSharePasswordInvalid  = errors.New("invalid share link password")
+)
+
+type ShareService interface {
+	CreateShare(ctx context.Context, groupID int, userID int, req dto.CreateShareRequest) (*dto.CreateShareResponse, error)
+	ListShares(ctx context.Context, groupID int, userID int) ([]*models.GroupShare, error)
+	RevokeShare(ctx context.Context, shareID int, groupID int, userID int) error
+	GetSharedGroup(ctx context.Context, token string, password string) (*dto.SharedGroupResponse, error)
+}
+
+type shareService struct {
+	shareRepo repository.ShareRepository
+	groupRepo repository.GroupRepository
+}
+
+func NewShareService(shareRepo repository.ShareRepository, groupRepo repository.GroupRepository) ShareService {
+	return &shareService{
+		shareRepo: shareRepo,
+		groupRepo: groupRepo,
+	}
+}
+
+func (s *shareService) CreateShare(ctx context.Context, groupID int, userID int, req dto.CreateShareRequest) (*dto.CreateShareResponse, error) {
+	// Only the owner can share a group
+	if _, err := s.groupRepo.GetByID(ctx, groupID, userID); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrGroupNotFound
+		}
+		return nil, fmt.Errorf("failed to get group: %w", err)
+	}
+
+	token, err := auth.GenerateOpaqueToken(shareTokenPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	share := &models.GroupShare{
+		GroupID:   groupID,
+		UserID:    userID,
+		TokenHash: auth.HashToken(token),
+		ExpiresAt: req.ExpiresAt,
+	}
+
+	if req.Password != "" {
+		share.PasswordHash, err = auth.HashPassword(req.Password)
+		if err != nil {
+			return nil, fmt.Errorf("failed to hash password: %w", err)
+		}
+		share.HasPassword = true
+	}
+
+	if err := s.shareRepo.Create(ctx, share); err != nil {
+		return nil, fmt.Errorf("failed to create share: %w", err)
+	}
+
+	return &dto.CreateShareResponse{
+		GroupShare: share,
+		Token:      token,
+	}, nil
+}
+
+func (s *shareService) ListShares(ctx context.Context, groupID int, userID int) ([]*models.GroupShare, error) {
+	if _, err := s.groupRepo.GetByID(ctx, groupID, userID); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrGroupNotFound
+		}
+		return nil, fmt.Errorf("failed to get group: %w", err)
+	}
+
+	return s.shareRepo.ListByGroupID(ctx, groupID, userID)
+}
+
+func (s *shareService) RevokeShare(ctx context.Context, shareID int, groupID int, userID int) error {
+	if err := s.shareRepo.Revoke(ctx, shareID, groupID, userID); err != nil {
+		if err == sql.ErrNoRows {
+			return ErrShareNotFound
+		}
+		return fmt.Errorf("failed to revoke share: %w", err)
+	}
+
+	return nil
+}
+
+func (s *shareService) GetSharedGroup(ctx context.Context, token string, password string) (*dto.SharedGroupResponse, error) {
+	share, err := s.shareRepo.GetByTokenHash(ctx, auth.HashToken(token))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrShareNotFound
+		}
+		return nil, fmt.Errorf("failed to get share: %w", err)
+	}
+
+	// Revoked and expired links look the same as links that never existed
+	if share.RevokedAt != nil || (share.ExpiresAt != nil && time.Now().After(*share.ExpiresAt)) {
+		return nil, ErrShareNotFound
+	}
+
+	if share.HasPassword {
+		if password == "" {
+			return nil, ErrSharePasswordRequired
+		}
+		if !auth.CheckPassword(password, share.PasswordHash) {
+			return nil, ErrSharePasswordInvalid
+		}
+	}
+
+	group, err := s.groupRepo.GetByID(ctx, share.GroupID, share.UserID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrShareNotFound
+		}
+		return nil, fmt.Errorf("failed to get group: %w", err)
+	}
+
+	todos, err := s.shareRepo.GetTodosByGroupID(ctx, group.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get todos: %w", err)
+	}
+
+	if err := s.shareRepo.RecordAccess(ctx, share.ID); err != nil {
+		// Log error but don't fail the request
+		log.Printf("Failed to record share access: %v", err)
+	}
+
+	resp := &dto.SharedGroupResponse{
+		Group: dto.SharedGroup{
+			Name:      group.Name,
+			CreatedAt: group.CreatedAt,
+			UpdatedAt: group.UpdatedAt,
+		},
+		Todos: make([]dto.SharedTodo, 0, len(todos)),
+	}
+	for _, todo := range todos {
+		resp.Todos = append(resp.Todos, dto.SharedTodo{
+			Title:       todo.Title,
+			Description: todo.Description,
+			Completed:   todo.Completed,
+			CreatedAt:   todo.CreatedAt,
+			UpdatedAt:   todo.UpdatedAt,
+		})
+	}
+
+	return resp, nil
+}
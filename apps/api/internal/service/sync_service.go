@@ -0,0 +1,393 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/enkyuan/ato/api/cache"
+	"github.com/enkyuan/ato/api/internal/dto"
+	"github.com/enkyuan/ato/api/internal/models"
+	"github.com/enkyuan/ato/api/internal/repository"
+)
+
+const (
+	DefaultSyncLimit = 500
+	MaxSyncLimit     = 1000
+	MaxSyncMutations = 500
+)
+
+var (
+	errUnknownField = errors.New("unknown field")
+)
+
+type SyncService interface {
+	Sync(ctx context.Context, userID int, req dto.SyncRequest) (*dto.SyncResponse, error)
+}
+
+type syncService struct {
+	syncRepo repository.SyncRepository
+	cache    *cache.Cache
+}
+
+func NewSyncService(syncRepo repository.SyncRepository, cache *cache.Cache) SyncService {
+	return &syncService{
+		syncRepo: syncRepo,
+		cache:    cache,
+	}
+}
+
+// Sync applies the client's mutations in order and then returns every change
+// after the client's cursor, including the merged result of its own writes.
+//
+// Conflicts are resolved per field, last writer wins. Each field remembers the
+// clock of its last write as "<unix ms>:<device id>", and a write only lands
+// if its clock sorts after the stored one. The device ID breaks ties, so every
+// server and client reaches the same answer. Deletes always win: once a row
+// is tombstoned, later upserts for its client ID are ignored.
+func (s *syncService) Sync(ctx context.Context, userID int, req dto.SyncRequest) (*dto.SyncResponse, error) {
+	results := make([]*models.SyncResult, 0, len(req.Mutations))
+	applied := false
+
+	for _, mutation := range req.Mutations {
+		result, err := s.apply(ctx, userID, req.DeviceID, mutation)
+		if err != nil {
+			return nil, fmt.Errorf("failed to apply mutation %s: %w", mutation.ID, err)
+		}
+		if result.Status == models.SyncStatusApplied {
+			applied = true
+		}
+		results = append(results, result)
+	}
+
+	if applied {
+		// Invalidate user's groups cache
+		s.cache.DeletePattern(ctx, fmt.Sprintf("groups:user:%d", userID))
+	}
+
+	limit := req.Limit
+	if limit <= 0 {
+		limit = DefaultSyncLimit
+	}
+	if limit > MaxSyncLimit {
+		limit = MaxSyncLimit
+	}
+
+	changes, err := s.syncRepo.Changes(ctx, userID, req.Cursor, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load changes: %w", err)
+	}
+
+	return &dto.SyncResponse{
+		Cursor:     changes.Cursor,
+		HasMore:    changes.HasMore,
+		Results:    results,
+		Groups:     changes.Groups,
+		Todos:      changes.Todos,
+		Tombstones: changes.Tombstones,
+	}, nil
+}
+
+func (s *syncService) apply(ctx context.Context, userID int, deviceID string, mutation dto.SyncMutation) (*models.SyncResult, error) {
+	if err := validateMutation(mutation); err != nil {
+		return rejected(mutation, err), nil
+	}
+
+	clock := fieldClock(mutation.Timestamp, deviceID)
+
+	return s.syncRepo.Apply(ctx, userID, mutation.ID, func(tx repository.SyncTx) (*models.SyncResult, error) {
+		if mutation.Op == dto.SyncOpDelete {
+			if err := tx.Delete(ctx, userID, mutation.Entity, mutation.ClientID); err != nil {
+				return nil, err
+			}
+			return &models.SyncResult{MutationID: mutation.ID, Status: models.SyncStatusApplied}, nil
+		}
+
+		if mutation.Entity == models.SyncEntityGroup {
+			return upsertGroup(ctx, tx, userID, clock, mutation)
+		}
+		return upsertTodo(ctx, tx, userID, clock, mutation)
+	})
+}
+
+func upsertGroup(ctx context.Context, tx repository.SyncTx, userID int, clock string, mutation dto.SyncMutation) (*models.SyncResult, error) {
+	group, err := tx.GetGroup(ctx, userID, mutation.ClientID)
+	if err != nil {
+		return nil, err
+	}
+
+	if group == nil {
+		deleted, err := tx.IsDeleted(ctx, userID, models.SyncEntityGroup, mutation.ClientID)
+		if err != nil {
+			return nil, err
+		}
+		if deleted {
+			return ignored(mutation, "group has been deleted"), nil
+		}
+
+		position, err := tx.NextGroupPosition(ctx, userID)
+		if err != nil {
+			return nil, err
+		}
+
+		group = &models.Group{
+			UserID:      userID,
+			ClientID:    mutation.ClientID,
+			Position:    position,
+			FieldClocks: map[string]string{},
+		}
+		for field, value := range mutation.Fields {
+			setGroupField(group, field, value)
+		}
+		// Fields the client left out still get a clock, so an older write
+		// arriving later from another device cannot overwrite them
+		for _, field := range groupSyncFields {
+			group.FieldClocks[field] = clock
+		}
+
+		if err := tx.InsertGroup(ctx, group); err != nil {
+			return nil, err
+		}
+		return &models.SyncResult{MutationID: mutation.ID, Status: models.SyncStatusApplied}, nil
+	}
+
+	winners := mergeClocks(group.FieldClocks, mutation.Fields, clock)
+	if len(winners) == 0 {
+		return ignored(mutation, "superseded by a newer change"), nil
+	}
+
+	for field, value := range winners {
+		setGroupField(group, field, value)
+	}
+
+	if err := tx.UpdateGroup(ctx, group); err != nil {
+		return nil, err
+	}
+	return &models.SyncResult{MutationID: mutation.ID, Status: models.SyncStatusApplied}, nil
+}
+
+func upsertTodo(ctx context.Context, tx repository.SyncTx, userID int, clock string, mutation dto.SyncMutation) (*models.SyncResult, error) {
+	todo, err := tx.GetTodo(ctx, userID, mutation.ClientID)
+	if err != nil {
+		return nil, err
+	}
+
+	fields := mutation.Fields
+	insert := todo == nil
+
+	if insert {
+		deleted, err := tx.IsDeleted(ctx, userID, models.SyncEntityTodo, mutation.ClientID)
+		if err != nil {
+			return nil, err
+		}
+		if deleted {
+			return ignored(mutation, "todo has been deleted"), nil
+		}
+
+		todo = &models.Todo{
+			UserID:      userID,
+			ClientID:    mutation.ClientID,
+			FieldClocks: map[string]string{},
+		}
+		for _, field := range todoSyncFields {
+			todo.FieldClocks[field] = clock
+		}
+	} else {
+		fields = mergeClocks(todo.FieldClocks, mutation.Fields, clock)
+		if len(fields) == 0 {
+			return ignored(mutation, "superseded by a newer change"), nil
+		}
+	}
+
+	for field, value := range fields {
+		setTodoField(todo, field, value)
+	}
+
+	if insert && todo.Title == "" {
+		return rejected(mutation, errors.New("title is required")), nil
+	}
+
+	// Groups are referenced by client ID, which only the transaction can
+	// resolve to a row
+	if _, ok := fields["group_id"]; ok {
+		todo.GroupID = nil
+		if todo.GroupClientID != nil {
+			group, err := tx.GetGroup(ctx, userID, *todo.GroupClientID)
+			if err != nil {
+				return nil, err
+			}
+			if group == nil {
+				return rejected(mutation, errors.New("unknown group")), nil
+			}
+			todo.GroupID = &group.ID
+		}
+	}
+
+	if insert {
+		err = tx.InsertTodo(ctx, todo)
+	} else {
+		err = tx.UpdateTodo(ctx, todo)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &models.SyncResult{MutationID: mutation.ID, Status: models.SyncStatusApplied}, nil
+}
+
+var (
+	groupSyncFields = []string{"name", "position"}
+	todoSyncFields  = []string{"group_id", "title", "description", "completed"}
+)
+
+// fieldClock formats a write time so that plain string comparison orders
+// writes by time and then by device. Timestamps from the future are clamped
+// so a client with a fast clock cannot win every conflict.
+func fieldClock(timestamp int64, deviceID string) string {
+	if now := time.Now().UnixMilli(); timestamp > now {
+		timestamp = now
+	}
+	return fmt.Sprintf("%013d:%s", timestamp, deviceID)
+}
+
+// mergeClocks returns the fields whose incoming clock beats the stored one and
+// advances the stored clocks for them.
+func mergeClocks(clocks map[string]string, fields map[string]json.RawMessage, clock string) map[string]json.RawMessage {
+	winners := make(map[string]json.RawMessage)
+	for field, value := range fields {
+		if clock > clocks[field] {
+			winners[field] = value
+			clocks[field] = clock
+		}
+	}
+	return winners
+}
+
+func validateMutation(mutation dto.SyncMutation) error {
+	if mutation.ID == "" || len(mutation.ID) > 64 {
+		return errors.New("id must be between 1 and 64 characters")
+	}
+	if mutation.Entity != models.SyncEntityGroup && mutation.Entity != models.SyncEntityTodo {
+		return fmt.Errorf("unknown entity %q", mutation.Entity)
+	}
+	if mutation.Op != dto.SyncOpUpsert && mutation.Op != dto.SyncOpDelete {
+		return fmt.Errorf("unknown op %q", mutation.Op)
+	}
+	if !isUUID(mutation.ClientID) {
+		return errors.New("client_id must be a UUID")
+	}
+	if mutation.Op == dto.SyncOpDelete {
+		return nil
+	}
+	if mutation.Timestamp <= 0 {
+		return errors.New("timestamp is required")
+	}
+
+	// Decode into scratch rows so bad values are rejected before any writes
+	for field, value := range mutation.Fields {
+		var err error
+		if mutation.Entity == models.SyncEntityGroup {
+			err = setGroupField(&models.Group{}, field, value)
+		} else {
+			err = setTodoField(&models.Todo{}, field, value)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func setGroupField(group *models.Group, field string, value json.RawMessage) error {
+	switch field {
+	case "name":
+		var name string
+		if err := json.Unmarshal(value, &name); err != nil {
+			return errors.New("name must be a string")
+		}
+		if len(name) > 100 {
+			return errors.New("name must be at most 100 characters")
+		}
+		group.Name = name
+	case "position":
+		var position int
+		if err := json.Unmarshal(value, &position); err != nil {
+			return errors.New("position must be an integer")
+		}
+		group.Position = position
+	default:
+		return fmt.Errorf("%w %q", errUnknownField, field)
+	}
+	return nil
+}
+
+func setTodoField(todo *models.Todo, field string, value json.RawMessage) error {
+	switch field {
+	case "group_id":
+		var groupClientID *string
+		if err := json.Unmarshal(value, &groupClientID); err != nil {
+			return errors.New("group_id must be a UUID or null")
+		}
+		if groupClientID != nil && !isUUID(*groupClientID) {
+			return errors.New("group_id must be a UUID or null")
+		}
+		todo.GroupClientID = groupClientID
+	case "title":
+		var title string
+		if err := json.Unmarshal(value, &title); err != nil {
+			return errors.New("title must be a string")
+		}
+		if title == "" || len(title) > 255 {
+			return errors.New("title must be between 1 and 255 characters")
+		}
+		todo.Title = title
+	case "description":
+		var description string
+		if err := json.Unmarshal(value, &description); err != nil {
+			return errors.New("description must be a string")
+		}
+		if len(description) > 1000 {
+			return errors.New("description must be at most 1000 characters")
+		}
+		todo.Description = description
+	case "completed":
+		var completed bool
+		if err := json.Unmarshal(value, &completed); err != nil {
+			return errors.New("completed must be a boolean")
+		}
+		todo.Completed = completed
+	default:
+		return fmt.Errorf("%w %q", errUnknownField, field)
+	}
+	return nil
+}
+
+func rejected(mutation dto.SyncMutation, err error) *models.SyncResult {
+	return &models.SyncResult{MutationID: mutation.ID, Status: models.SyncStatusRejected, Error: err.Error()}
+}
+
+func ignored(mutation dto.SyncMutation, reason string) *models.SyncResult {
+	return &models.SyncResult{MutationID: mutation.ID, Status: models.SyncStatusIgnored, Error: reason}
+}
+
+func isUUID(s string) bool {
+	if len(s) != 36 {
+		return false
+	}
+	for i, c := range s {
+		switch i {
+		case 8, 13, 18, 23:
+			if c != '-' {
+				return false
+			}
+		default:
+			if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F') {
+				return false
+			}
+		}
+	}
+	return true
+}
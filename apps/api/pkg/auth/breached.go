@@ -0,0 +1,63 @@
+package auth
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// breachPrefixLength is how many hex characters of a password's SHA-1 name
+// the range file it is listed in
+const breachPrefixLength = 5
+
+// BreachedPasswords checks passwords against a local copy of a breached
+// password list split into k-anonymity range files, as Have I Been Pwned's
+// downloader writes them: one file per SHA-1 prefix, such as 21BD1.txt,
+// holding "SUFFIX:COUNT" lines for every listed hash starting with it. Only
+// the one small file for a password's prefix is read per check.
+type BreachedPasswords struct {
+	dir string
+}
+
+func NewBreachedPasswords(dir string) *BreachedPasswords {
+	return &BreachedPasswords{dir: dir}
+}
+
+// Contains reports whether the password is on the list. A missing range file
+// means no listed password has that prefix.
+func (b *BreachedPasswords) Contains(password string) (bool, error) {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	prefix, suffix := hash[:breachPrefixLength], hash[breachPrefixLength:]
+
+	file, err := b.openRange(prefix)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return false, nil
+		}
+		return false, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		listed, _, _ := strings.Cut(strings.TrimSpace(scanner.Text()), ":")
+		if strings.EqualFold(listed, suffix) {
+			return true, nil
+		}
+	}
+
+	return false, scanner.Err()
+}
+
+func (b *BreachedPasswords) openRange(prefix string) (*os.File, error) {
+	file, err := os.Open(filepath.Join(b.dir, prefix+".txt"))
+	if errors.Is(err, os.ErrNotExist) {
+		return os.Open(filepath.Join(b.dir, prefix))
+	}
+	return file, err
+}
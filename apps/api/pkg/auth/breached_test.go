@@ -0,0 +1,50 @@
+package auth
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBreachedPasswordsContains(t *testing.T) {
+	// SHA-1("password") is 5BAA61E4C9B93F3F0682250B6CF8331B7EE68FD8,
+	// SHA-1("123456") is 7C4A8D09CA3762AF61E59520943DC26494F8941B and
+	// SHA-1("password1") is E38AD214943DAAD1D64C102FAEC29DE4AFE9DA3D
+	dir := t.TempDir()
+	writeRange(t, dir, "5BAA6.txt",
+		"003D68EB55068C33ACE09247EE4C639306B:3\r\n"+
+			"1e4c9b93f3f0682250b6cf8331b7ee68fd8:10434004\r\n")
+	writeRange(t, dir, "7C4A8", "D09CA3762AF61E59520943DC26494F8941B:37359195\n")
+	writeRange(t, dir, "E38AD.txt", "214943DAAD1D64C102FAEC29DE4AFE9DA3E:2\n")
+
+	tests := []struct {
+		name     string
+		password string
+		want     bool
+	}{
+		{"listed, lowercase suffix", "password", true},
+		{"listed in a file without extension", "123456", true},
+		{"same prefix, not listed", "password1", false},
+		{"no range file", "correct horse battery staple", false},
+	}
+
+	breached := NewBreachedPasswords(dir)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := breached.Contains(tt.password)
+			if err != nil {
+				t.Fatalf("Contains(%q) error = %v", tt.password, err)
+			}
+			if got != tt.want {
+				t.Errorf("Contains(%q) = %v, want %v", tt.password, got, tt.want)
+			}
+		})
+	}
+}
+
+func writeRange(t *testing.T, dir string, name string, contents string) {
+	t.Helper()
+	if err := os.WriteFile(filepath.Join(dir, name), []byte(contents), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
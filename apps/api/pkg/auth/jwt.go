@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
@@ -14,83 +15,173 @@ var (
 	ErrExpiredToken = errors.New("token has expired")
 )
 
+const (
+	TokenTypeAccess  = "access"
+	TokenTypeRefresh = "refresh"
+
+	defaultIssuer   = "ato-api"
+	defaultAudience = "ato"
+)
+
 type Claims struct {
 	UserID int    `json:"user_id"`
 	Email  string `json:"email"`
+	// FamilyID ties the token to the login it was issued for
+	FamilyID string `json:"fam,omitempty"`
+	// Epoch is the user's token epoch at issue time; bumping the epoch
+	// invalidates every token issued before it
+	Epoch int64 `json:"epc"`
+	// Type separates access tokens from refresh tokens, which share a shape
+	Type string `json:"typ"`
+	// Scope lists the access token's scopes, space-separated
+	Scope string `json:"scope,omitempty"`
+	// ClientID names the third-party app an access token was issued to; it is
+	// empty for the user's own logins
+	ClientID string `json:"client_id,omitempty"`
 	jwt.RegisteredClaims
 }
 
+// Scopes returns the scopes the token grants. A token without a scope claim
+// grants none.
+func (c *Claims) Scopes() []string {
+	return strings.Fields(c.Scope)
+}
+
+// TokenSubject is what a token pair is issued for.
+type TokenSubject struct {
+	UserID   int
+	Email    string
+	FamilyID string
+	Epoch    int64
+	Scopes   []string
+	ClientID string
+}
+
 type TokenPair struct {
 	AccessToken  string `json:"access_token"`
 	RefreshToken string `json:"refresh_token"`
+
+	// RefreshTokenID and RefreshExpiresAt describe the refresh token so it
+	// can be recorded server-side
+	RefreshTokenID   string    `json:"-"`
+	RefreshExpiresAt time.Time `json:"-"`
+	AccessExpiresAt  time.Time `json:"-"`
 }
 
-func GenerateTokenPair(userID int, email string) (*TokenPair, error) {
-	jwtSecret := []byte(os.Getenv("JWT_SECRET"))
-	if len(jwtSecret) < 32 {
-		return nil, errors.New("JWT_SECRET must be at least 32 characters")
+func GenerateTokenPair(subject TokenSubject) (*TokenPair, error) {
+	keys := currentKeys.Load()
+	if keys == nil {
+		return nil, ErrNoSigningKey
+	}
+
+	signer, err := keys.Signer(time.Now())
+	if err != nil {
+		return nil, err
 	}
 
-	// Parse expiry durations
-	accessExpiry, err := time.ParseDuration(os.Getenv("JWT_EXPIRY"))
+	config := keys.config
+
+	accessID, err := NewTokenID()
 	if err != nil {
-		accessExpiry = 24 * time.Hour // default 24 hours
+		return nil, err
 	}
 
-	refreshExpiry, err := time.ParseDuration(os.Getenv("REFRESH_TOKEN_EXPIRY"))
+	refreshID, err := NewTokenID()
 	if err != nil {
-		refreshExpiry = 168 * time.Hour // default 7 days
+		return nil, err
 	}
 
 	// Generate access token
 	accessClaims := &Claims{
-		UserID: userID,
-		Email:  email,
+		UserID:   subject.UserID,
+		Email:    subject.Email,
+		FamilyID: subject.FamilyID,
+		Epoch:    subject.Epoch,
+		Type:     TokenTypeAccess,
+		Scope:    strings.Join(subject.Scopes, " "),
+		ClientID: subject.ClientID,
 		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(accessExpiry)),
+			ID:        accessID,
+			Issuer:    config.Issuer,
+			Audience:  config.Audience,
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(config.AccessExpiry)),
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
 			NotBefore: jwt.NewNumericDate(time.Now()),
 		},
 	}
 
-	accessToken := jwt.NewWithClaims(jwt.SigningMethodHS256, accessClaims)
-	accessTokenString, err := accessToken.SignedString(jwtSecret)
+	accessTokenString, err := signToken(signer, accessClaims)
 	if err != nil {
 		return nil, fmt.Errorf("failed to sign access token: %w", err)
 	}
 
-	// Generate refresh token
+	// Generate refresh token. Only we redeem it, so its audience is
+	// ourselves and other services reject it.
 	refreshClaims := &Claims{
-		UserID: userID,
-		Email:  email,
+		UserID:   subject.UserID,
+		Email:    subject.Email,
+		FamilyID: subject.FamilyID,
+		Epoch:    subject.Epoch,
+		Type:     TokenTypeRefresh,
 		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(refreshExpiry)),
+			ID:        refreshID,
+			Issuer:    config.Issuer,
+			Audience:  jwt.ClaimStrings{config.Issuer},
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(config.RefreshExpiry)),
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
 			NotBefore: jwt.NewNumericDate(time.Now()),
 		},
 	}
 
-	refreshToken := jwt.NewWithClaims(jwt.SigningMethodHS256, refreshClaims)
-	refreshTokenString, err := refreshToken.SignedString(jwtSecret)
+	refreshTokenString, err := signToken(signer, refreshClaims)
 	if err != nil {
 		return nil, fmt.Errorf("failed to sign refresh token: %w", err)
 	}
 
 	return &TokenPair{
-		AccessToken:  accessTokenString,
-		RefreshToken: refreshTokenString,
+		AccessToken:      accessTokenString,
+		RefreshToken:     refreshTokenString,
+		RefreshTokenID:   refreshID,
+		RefreshExpiresAt: refreshClaims.ExpiresAt.Time,
+		AccessExpiresAt:  accessClaims.ExpiresAt.Time,
 	}, nil
 }
 
-func ValidateToken(tokenString string) (*Claims, error) {
-	jwtSecret := []byte(os.Getenv("JWT_SECRET"))
+// ValidateAccessToken validates a bearer token presented to the API.
+func ValidateAccessToken(tokenString string) (*Claims, error) {
+	keys := currentKeys.Load()
+	if keys == nil {
+		return nil, ErrInvalidToken
+	}
+	return keys.validateToken(tokenString, TokenTypeAccess, keys.config.Audience)
+}
 
+// ValidateRefreshToken validates a token presented for rotation.
+func ValidateRefreshToken(tokenString string) (*Claims, error) {
+	keys := currentKeys.Load()
+	if keys == nil {
+		return nil, ErrInvalidToken
+	}
+	return keys.validateToken(tokenString, TokenTypeRefresh, []string{keys.config.Issuer})
+}
+
+func (ks *KeySet) validateToken(tokenString string, tokenType string, audience []string) (*Claims, error) {
 	token, err := jwt.ParseWithClaims(tokenString, &Claims{}, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+		kid, _ := token.Header["kid"].(string)
+		key, err := ks.Verifier(kid, time.Now())
+		if err != nil {
+			return nil, err
+		}
+		// The key decides the algorithm, never the token header
+		if token.Method.Alg() != key.Algorithm {
 			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
 		}
-		return jwtSecret, nil
-	})
+		return key.Public, nil
+	},
+		jwt.WithValidMethods([]string{AlgorithmRS256, AlgorithmEdDSA}),
+		jwt.WithIssuer(ks.config.Issuer),
+		jwt.WithExpirationRequired(),
+	)
 
 	if err != nil {
 		if errors.Is(err, jwt.ErrTokenExpired) {
@@ -100,9 +191,78 @@ func ValidateToken(tokenString string) (*Claims, error) {
 	}
 
 	claims, ok := token.Claims.(*Claims)
-	if !ok || !token.Valid {
+	if !ok || !token.Valid || claims.Type != tokenType {
+		return nil, ErrInvalidToken
+	}
+
+	if !hasAudience(claims.Audience, audience) {
 		return nil, ErrInvalidToken
 	}
 
 	return claims, nil
 }
+
+func signToken(key *SigningKey, claims *Claims) (string, error) {
+	method := jwt.GetSigningMethod(key.Algorithm)
+	if method == nil {
+		return "", fmt.Errorf("unsupported signing algorithm %s", key.Algorithm)
+	}
+
+	token := jwt.NewWithClaims(method, claims)
+	token.Header["kid"] = key.ID
+	return token.SignedString(key.Private)
+}
+
+// TokenConfig is what tokens are issued and checked with.
+type TokenConfig struct {
+	// Issuer is the iss claim on tokens we sign
+	Issuer string
+	// Audience is the aud claim on access tokens, which are accepted if they
+	// name any of them
+	Audience      []string
+	AccessExpiry  time.Duration
+	RefreshExpiry time.Duration
+}
+
+// LoadTokenConfig reads the token settings from JWT_ISSUER, the
+// comma-separated JWT_AUDIENCE, JWT_EXPIRY and REFRESH_TOKEN_EXPIRY. It is
+// called once at startup, as part of LoadKeySet.
+func LoadTokenConfig() TokenConfig {
+	config := TokenConfig{
+		Issuer:        os.Getenv("JWT_ISSUER"),
+		AccessExpiry:  24 * time.Hour,  // default 24 hours
+		RefreshExpiry: 168 * time.Hour, // default 7 days
+	}
+	if config.Issuer == "" {
+		config.Issuer = defaultIssuer
+	}
+
+	for _, value := range strings.Split(os.Getenv("JWT_AUDIENCE"), ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			config.Audience = append(config.Audience, value)
+		}
+	}
+	if len(config.Audience) == 0 {
+		config.Audience = []string{defaultAudience}
+	}
+
+	if expiry, err := time.ParseDuration(os.Getenv("JWT_EXPIRY")); err == nil {
+		config.AccessExpiry = expiry
+	}
+	if expiry, err := time.ParseDuration(os.Getenv("REFRESH_TOKEN_EXPIRY")); err == nil {
+		config.RefreshExpiry = expiry
+	}
+
+	return config
+}
+
+func hasAudience(claimed jwt.ClaimStrings, accepted []string) bool {
+	for _, value := range claimed {
+		for _, want := range accepted {
+			if value == want {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,367 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	AlgorithmRS256 = "RS256"
+	AlgorithmEdDSA = "EdDSA"
+
+	// activatesAtHeader is an optional PEM header that schedules when a key
+	// starts signing. Keys published ahead of time show up in the JWKS early,
+	// so verifiers have them cached before the first token is signed.
+	activatesAtHeader = "Activates-At"
+	minRSAKeyBits     = 2048
+)
+
+var (
+	ErrNoSigningKey = errors.New("no signing key available")
+	ErrUnknownKey   = errors.New("unknown signing key")
+)
+
+// SigningKey is one entry in a key set. Keys that only have a public half can
+// verify tokens but are never chosen to sign.
+type SigningKey struct {
+	ID          string
+	Algorithm   string
+	Public      crypto.PublicKey
+	Private     crypto.Signer
+	ActivatesAt time.Time
+}
+
+// KeySet holds every key that may sign or verify tokens, and the settings
+// tokens are issued with. The newest active key signs; a key it replaced keeps
+// verifying for the retention period, which is long enough for every token it
+// signed to expire.
+type KeySet struct {
+	keys      []*SigningKey
+	config    TokenConfig
+	retention time.Duration
+}
+
+// JWK is a public key in JSON Web Key format.
+type JWK struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	N         string `json:"n,omitempty"`
+	E         string `json:"e,omitempty"`
+	Curve     string `json:"crv,omitempty"`
+	X         string `json:"x,omitempty"`
+}
+
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+var currentKeys atomic.Pointer[KeySet]
+
+// SetKeySet makes ks the key set used to sign and verify tokens.
+func SetKeySet(ks *KeySet) {
+	currentKeys.Store(ks)
+}
+
+// JWKS returns the public keys of the current key set.
+func JWKS() JWKSet {
+	ks := currentKeys.Load()
+	if ks == nil {
+		return JWKSet{Keys: []JWK{}}
+	}
+	return ks.JWKS(time.Now())
+}
+
+// LoadKeySet reads signing keys from JWT_KEYS_DIR, one PEM file per key named
+// <kid>.pem, or a single PEM key from JWT_PRIVATE_KEY, along with the token
+// settings from the environment. Without keys it fails, unless
+// APP_ENV=development, where an ephemeral Ed25519 key is generated. Tokens
+// signed with it do not survive a restart or work across replicas.
+func LoadKeySet() (*KeySet, error) {
+	config := LoadTokenConfig()
+
+	if dir := os.Getenv("JWT_KEYS_DIR"); dir != "" {
+		keys, err := loadKeysDir(dir)
+		if err != nil {
+			return nil, err
+		}
+		return NewKeySet(keys, config)
+	}
+
+	if data := os.Getenv("JWT_PRIVATE_KEY"); data != "" {
+		key, err := parseKey([]byte(data))
+		if err != nil {
+			return nil, fmt.Errorf("invalid JWT_PRIVATE_KEY: %w", err)
+		}
+		key.ID = os.Getenv("JWT_KEY_ID")
+		if key.ID == "" {
+			key.ID, err = thumbprint(key.Public)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return NewKeySet([]*SigningKey{key}, config)
+	}
+
+	if os.Getenv("APP_ENV") != "development" {
+		return nil, errors.New("no signing keys configured: set JWT_KEYS_DIR or JWT_PRIVATE_KEY")
+	}
+
+	log.Println("No JWT signing keys configured, generating an ephemeral key; tokens will not survive a restart")
+
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate signing key: %w", err)
+	}
+	id, err := thumbprint(public)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewKeySet([]*SigningKey{{
+		ID:        id,
+		Algorithm: AlgorithmEdDSA,
+		Public:    public,
+		Private:   private,
+	}}, config)
+}
+
+func NewKeySet(keys []*SigningKey, config TokenConfig) (*KeySet, error) {
+	if len(keys) == 0 {
+		return nil, ErrNoSigningKey
+	}
+
+	seen := make(map[string]bool)
+	canSign := false
+	for _, key := range keys {
+		if key.ID == "" {
+			return nil, errors.New("signing key has no ID")
+		}
+		if seen[key.ID] {
+			return nil, fmt.Errorf("duplicate signing key ID %q", key.ID)
+		}
+		seen[key.ID] = true
+		if key.Private != nil {
+			canSign = true
+		}
+	}
+	if !canSign {
+		return nil, ErrNoSigningKey
+	}
+
+	sorted := append([]*SigningKey(nil), keys...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].ActivatesAt.Before(sorted[j].ActivatesAt)
+	})
+
+	// Tokens must outlive the key that signed them by their full lifetime
+	retention := max(config.AccessExpiry, config.RefreshExpiry)
+
+	return &KeySet{keys: sorted, config: config, retention: retention}, nil
+}
+
+// Signer returns the key that signs new tokens: the private key that
+// activated most recently, or the earliest scheduled one if none is active yet.
+func (ks *KeySet) Signer(now time.Time) (*SigningKey, error) {
+	var signer *SigningKey
+	for _, key := range ks.keys {
+		if key.Private == nil {
+			continue
+		}
+		if signer == nil || !key.ActivatesAt.After(now) {
+			signer = key
+		}
+	}
+	if signer == nil {
+		return nil, ErrNoSigningKey
+	}
+	return signer, nil
+}
+
+// Verifier returns the key a token with the given kid must verify against.
+// Keys that were replaced longer ago than the retention period are refused.
+func (ks *KeySet) Verifier(kid string, now time.Time) (*SigningKey, error) {
+	for _, key := range ks.keys {
+		if key.ID == kid {
+			if ks.retired(key, now) {
+				return nil, ErrUnknownKey
+			}
+			return key, nil
+		}
+	}
+	return nil, ErrUnknownKey
+}
+
+// retired reports whether every token the key could have signed has expired,
+// counting from when the next key took over.
+func (ks *KeySet) retired(key *SigningKey, now time.Time) bool {
+	signer, err := ks.Signer(now)
+	if err != nil || key == signer || !key.ActivatesAt.Before(signer.ActivatesAt) {
+		return false
+	}
+
+	for _, next := range ks.keys {
+		if next.Private != nil && next.ActivatesAt.After(key.ActivatesAt) && !next.ActivatesAt.After(now) {
+			return now.After(next.ActivatesAt.Add(ks.retention))
+		}
+	}
+	return false
+}
+
+// JWKS returns the public half of every key that can still verify, including
+// keys scheduled to activate later.
+func (ks *KeySet) JWKS(now time.Time) JWKSet {
+	set := JWKSet{Keys: []JWK{}}
+	for _, key := range ks.keys {
+		if ks.retired(key, now) {
+			continue
+		}
+		jwk, err := publicJWK(key)
+		if err != nil {
+			continue
+		}
+		set.Keys = append(set.Keys, jwk)
+	}
+	return set
+}
+
+// loadKeysDir reads every key in dir. Keys take over from one another in the
+// order of their Activates-At headers, or if none has one, in filename order,
+// the last file signing. Some keys having the header and others not would
+// leave the order to chance, so that is refused.
+func loadKeysDir(dir string) ([]*SigningKey, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list signing keys: %w", err)
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no signing keys found in %s", dir)
+	}
+	sort.Strings(paths)
+
+	keys := make([]*SigningKey, 0, len(paths))
+	scheduled := 0
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read signing key: %w", err)
+		}
+
+		key, err := parseKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("invalid signing key %s: %w", filepath.Base(path), err)
+		}
+		key.ID = strings.TrimSuffix(filepath.Base(path), ".pem")
+
+		if !key.ActivatesAt.IsZero() {
+			scheduled++
+		}
+		keys = append(keys, key)
+	}
+
+	if scheduled != 0 && scheduled != len(keys) {
+		return nil, fmt.Errorf("%d of %d signing keys in %s have an %s header: set it on every key, or on none to order them by filename",
+			scheduled, len(keys), dir, activatesAtHeader)
+	}
+
+	return keys, nil
+}
+
+func parseKey(data []byte) (*SigningKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+
+	key := &SigningKey{}
+	if value, ok := block.Headers[activatesAtHeader]; ok {
+		activatesAt, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s header: %w", activatesAtHeader, err)
+		}
+		key.ActivatesAt = activatesAt
+	}
+
+	var parsed interface{}
+	var err error
+	switch block.Type {
+	case "PRIVATE KEY":
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PUBLIC KEY":
+		parsed, err = x509.ParsePKIXPublicKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	switch k := parsed.(type) {
+	case *rsa.PrivateKey:
+		key.Private, key.Public = k, &k.PublicKey
+	case ed25519.PrivateKey:
+		key.Private, key.Public = k, k.Public()
+	case *rsa.PublicKey, ed25519.PublicKey:
+		key.Public = k
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", parsed)
+	}
+
+	switch k := key.Public.(type) {
+	case *rsa.PublicKey:
+		if k.N.BitLen() < minRSAKeyBits {
+			return nil, fmt.Errorf("RSA keys must be at least %d bits", minRSAKeyBits)
+		}
+		key.Algorithm = AlgorithmRS256
+	case ed25519.PublicKey:
+		key.Algorithm = AlgorithmEdDSA
+	}
+
+	return key, nil
+}
+
+func publicJWK(key *SigningKey) (JWK, error) {
+	jwk := JWK{KeyID: key.ID, Use: "sig", Algorithm: key.Algorithm}
+	switch k := key.Public.(type) {
+	case *rsa.PublicKey:
+		jwk.KeyType = "RSA"
+		jwk.N = base64.RawURLEncoding.EncodeToString(k.N.Bytes())
+		jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(k.E)).Bytes())
+	case ed25519.PublicKey:
+		jwk.KeyType = "OKP"
+		jwk.Curve = "Ed25519"
+		jwk.X = base64.RawURLEncoding.EncodeToString(k)
+	default:
+		return JWK{}, fmt.Errorf("unsupported key type %T", key.Public)
+	}
+	return jwk, nil
+}
+
+// thumbprint derives a stable key ID from the public key.
+func thumbprint(public crypto.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(public)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode public key: %w", err)
+	}
+	sum := sha256.Sum256(der)
+	return base64.RawURLEncoding.EncodeToString(sum[:12]), nil
+}
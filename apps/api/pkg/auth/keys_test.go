@@ -0,0 +1,317 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var testTokenConfig = TokenConfig{
+	Issuer:        defaultIssuer,
+	Audience:      []string{defaultAudience},
+	AccessExpiry:  time.Hour,
+	RefreshExpiry: 2 * time.Hour,
+}
+
+func newTestKey(t *testing.T, id string, activatesAt time.Time) *SigningKey {
+	t.Helper()
+
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &SigningKey{ID: id, Algorithm: AlgorithmEdDSA, Public: public, Private: private, ActivatesAt: activatesAt}
+}
+
+func TestKeySetSigner(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	old := newTestKey(t, "old", now.Add(-48*time.Hour))
+	current := newTestKey(t, "current", now.Add(-time.Hour))
+	next := newTestKey(t, "next", now.Add(time.Hour))
+	later := newTestKey(t, "later", now.Add(2*time.Hour))
+	// A newer key without its private half can only verify
+	verifyOnly := newTestKey(t, "verify-only", now.Add(-time.Minute))
+	verifyOnly.Private = nil
+
+	tests := []struct {
+		name string
+		keys []*SigningKey
+		at   time.Time
+		want string
+	}{
+		{"newest active key", []*SigningKey{next, old, current, verifyOnly}, now, "current"},
+		{"scheduled key once active", []*SigningKey{old, current, next}, now.Add(time.Hour), "next"},
+		{"earliest scheduled key before any is active", []*SigningKey{later, next}, now, "next"},
+		{"keys without a schedule in the order given", []*SigningKey{newTestKey(t, "a", time.Time{}), newTestKey(t, "b", time.Time{})}, now, "b"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ks, err := NewKeySet(tt.keys, testTokenConfig)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			signer, err := ks.Signer(tt.at)
+			if err != nil {
+				t.Fatalf("Signer() error = %v", err)
+			}
+			if signer.ID != tt.want {
+				t.Errorf("Signer() = %q, want %q", signer.ID, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewKeySetErrors(t *testing.T) {
+	verifyOnly := newTestKey(t, "verify-only", time.Time{})
+	verifyOnly.Private = nil
+
+	tests := []struct {
+		name string
+		keys []*SigningKey
+	}{
+		{"no keys", nil},
+		{"no private key", []*SigningKey{verifyOnly}},
+		{"missing ID", []*SigningKey{newTestKey(t, "", time.Time{})}},
+		{"duplicate ID", []*SigningKey{newTestKey(t, "a", time.Time{}), newTestKey(t, "a", time.Time{})}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewKeySet(tt.keys, testTokenConfig); err == nil {
+				t.Error("NewKeySet() error = nil, want an error")
+			}
+		})
+	}
+}
+
+func TestKeySetRetirement(t *testing.T) {
+	rotatedAt := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	ks, err := NewKeySet([]*SigningKey{
+		newTestKey(t, "old", rotatedAt.Add(-30*24*time.Hour)),
+		newTestKey(t, "new", rotatedAt),
+	}, testTokenConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The old key verifies until the longest-lived token it signed expires
+	retention := testTokenConfig.RefreshExpiry
+
+	tests := []struct {
+		name    string
+		kid     string
+		at      time.Time
+		wantErr error
+	}{
+		{"old key before rotation", "old", rotatedAt.Add(-time.Hour), nil},
+		{"old key within retention", "old", rotatedAt.Add(retention - time.Minute), nil},
+		{"old key after retention", "old", rotatedAt.Add(retention + time.Minute), ErrUnknownKey},
+		{"new key long after rotation", "new", rotatedAt.Add(365 * 24 * time.Hour), nil},
+		{"unknown key", "missing", rotatedAt, ErrUnknownKey},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, err := ks.Verifier(tt.kid, tt.at)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Verifier(%q) error = %v, want %v", tt.kid, err, tt.wantErr)
+			}
+			if err == nil && key.ID != tt.kid {
+				t.Errorf("Verifier(%q) = %q", tt.kid, key.ID)
+			}
+		})
+	}
+}
+
+func TestKeySetJWKS(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, minRSAKeyBits)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ks, err := NewKeySet([]*SigningKey{
+		newTestKey(t, "retired", now.Add(-30*24*time.Hour)),
+		{ID: "rsa", Algorithm: AlgorithmRS256, Public: &rsaKey.PublicKey, Private: rsaKey, ActivatesAt: now.Add(-7 * 24 * time.Hour)},
+		newTestKey(t, "scheduled", now.Add(time.Hour)),
+	}, testTokenConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	set := ks.JWKS(now)
+	got := make(map[string]JWK)
+	for _, jwk := range set.Keys {
+		got[jwk.KeyID] = jwk
+	}
+
+	if len(got) != 2 {
+		t.Fatalf("JWKS() has keys %v, want rsa and scheduled", set.Keys)
+	}
+	if _, ok := got["retired"]; ok {
+		t.Error("JWKS() includes a retired key")
+	}
+
+	rsaJWK, ok := got["rsa"]
+	if !ok {
+		t.Fatal("JWKS() is missing the signing key")
+	}
+	if rsaJWK.KeyType != "RSA" || rsaJWK.Algorithm != AlgorithmRS256 || rsaJWK.Use != "sig" {
+		t.Errorf("RSA JWK = kty %q, alg %q, use %q", rsaJWK.KeyType, rsaJWK.Algorithm, rsaJWK.Use)
+	}
+	// 65537 is AQAB in base64url
+	if rsaJWK.N == "" || rsaJWK.E != "AQAB" || rsaJWK.X != "" {
+		t.Errorf("RSA JWK = n %q, e %q, x %q", rsaJWK.N, rsaJWK.E, rsaJWK.X)
+	}
+
+	// Published before it signs, so verifiers can cache it in time
+	edJWK, ok := got["scheduled"]
+	if !ok {
+		t.Fatal("JWKS() is missing the scheduled key")
+	}
+	if edJWK.KeyType != "OKP" || edJWK.Curve != "Ed25519" || edJWK.Algorithm != AlgorithmEdDSA || edJWK.X == "" || edJWK.N != "" {
+		t.Errorf("Ed25519 JWK = kty %q, crv %q, alg %q, x %q, n %q", edJWK.KeyType, edJWK.Curve, edJWK.Algorithm, edJWK.X, edJWK.N)
+	}
+}
+
+// writeTestKey writes an Ed25519 key to dir as <name>.pem, with an
+// Activates-At header unless activatesAt is empty.
+func writeTestKey(t *testing.T, dir string, name string, activatesAt string) {
+	t.Helper()
+
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	block := &pem.Block{Type: "PRIVATE KEY", Bytes: der}
+	if activatesAt != "" {
+		block.Headers = map[string]string{activatesAtHeader: activatesAt}
+	}
+	if err := os.WriteFile(filepath.Join(dir, name+".pem"), pem.EncodeToMemory(block), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadKeysDir(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	type file struct {
+		name        string
+		activatesAt string
+	}
+
+	tests := []struct {
+		name       string
+		files      []file
+		wantSigner string
+		wantErr    bool
+	}{
+		{"single key without header", []file{{"only", ""}}, "only", false},
+		{"headers decide", []file{{"b", "2025-06-01T00:00:00Z"}, {"a", "2025-12-01T00:00:00Z"}}, "a", false},
+		{"scheduled key waits", []file{{"a", "2025-06-01T00:00:00Z"}, {"b", "2026-06-01T00:00:00Z"}}, "a", false},
+		{"filename order without headers", []file{{"2025-12", ""}, {"2025-06", ""}}, "2025-12", false},
+		{"some keys without header", []file{{"a", "2025-06-01T00:00:00Z"}, {"b", ""}}, "", true},
+		{"invalid header", []file{{"a", "June 2025"}}, "", true},
+		{"no keys", nil, "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for _, f := range tt.files {
+				writeTestKey(t, dir, f.name, f.activatesAt)
+			}
+
+			keys, err := loadKeysDir(dir)
+			if tt.wantErr {
+				if err == nil {
+					t.Error("loadKeysDir() error = nil, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("loadKeysDir() error = %v", err)
+			}
+
+			ks, err := NewKeySet(keys, testTokenConfig)
+			if err != nil {
+				t.Fatal(err)
+			}
+			signer, err := ks.Signer(now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if signer.ID != tt.wantSigner {
+				t.Errorf("signer = %q, want %q", signer.ID, tt.wantSigner)
+			}
+		})
+	}
+}
+
+func TestTokensUseKeySetConfig(t *testing.T) {
+	ks, err := NewKeySet([]*SigningKey{newTestKey(t, "key", time.Time{})}, TokenConfig{
+		Issuer:        "issuer",
+		Audience:      []string{"app"},
+		AccessExpiry:  time.Minute,
+		RefreshExpiry: time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	previous := currentKeys.Load()
+	SetKeySet(ks)
+	t.Cleanup(func() { currentKeys.Store(previous) })
+
+	// Changing the environment after startup has no effect
+	t.Setenv("JWT_ISSUER", "other")
+	t.Setenv("JWT_AUDIENCE", "other")
+
+	pair, err := GenerateTokenPair(TokenSubject{UserID: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	access, err := ValidateAccessToken(pair.AccessToken)
+	if err != nil {
+		t.Fatalf("ValidateAccessToken() error = %v", err)
+	}
+	if access.Issuer != "issuer" || len(access.Audience) != 1 || access.Audience[0] != "app" {
+		t.Errorf("access token iss %q, aud %v, want issuer, [app]", access.Issuer, access.Audience)
+	}
+	if lifetime := access.ExpiresAt.Sub(access.IssuedAt.Time); lifetime != time.Minute {
+		t.Errorf("access token lifetime = %v, want %v", lifetime, time.Minute)
+	}
+
+	refresh, err := ValidateRefreshToken(pair.RefreshToken)
+	if err != nil {
+		t.Fatalf("ValidateRefreshToken() error = %v", err)
+	}
+	if len(refresh.Audience) != 1 || refresh.Audience[0] != "issuer" {
+		t.Errorf("refresh token aud %v, want [issuer]", refresh.Audience)
+	}
+
+	// Each kind is only accepted where it belongs
+	if _, err := ValidateAccessToken(pair.RefreshToken); err == nil {
+		t.Error("ValidateAccessToken(refresh token) error = nil, want an error")
+	}
+	if _, err := ValidateRefreshToken(pair.AccessToken); err == nil {
+		t.Error("ValidateRefreshToken(access token) error = nil, want an error")
+	}
+}
@@ -1,17 +1,270 @@
 package auth
 
 import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"golang.org/x/crypto/argon2"
 	"golang.org/x/crypto/bcrypt"
 )
 
-const bcryptCost = 12
+const (
+	// Argon2id defaults, from the OWASP password storage recommendations
+	defaultArgon2Memory      = 64 * 1024
+	defaultArgon2Time        = 3
+	defaultArgon2Parallelism = 2
+	argon2SaltLength         = 16
+	argon2KeyLength          = 32
 
-func HashPassword(password string) (string, error) {
-	bytes, err := bcrypt.GenerateFromPassword([]byte(password), bcryptCost)
+	bcryptCost = 12
+)
+
+// PasswordScheme is one way of hashing passwords. Hashes are self-describing
+// strings, in PHC format for Argon2id and modular crypt format for bcrypt, so
+// the scheme and parameters a stored hash was made with can be read back.
+type PasswordScheme interface {
+	Hash(password string) (string, error)
+	Verify(password, hash string) bool
+	// Recognizes reports whether hash was made by this scheme
+	Recognizes(hash string) bool
+	// Outdated reports whether hash was made with different parameters than
+	// the scheme's current ones
+	Outdated(hash string) bool
+}
+
+// Argon2id hashes passwords with Argon2id. Memory is in KiB.
+type Argon2id struct {
+	Memory      uint32
+	Time        uint32
+	Parallelism uint8
+}
+
+type argon2idHash struct {
+	version     int
+	memory      uint32
+	time        uint32
+	parallelism uint8
+	salt        []byte
+	key         []byte
+}
+
+func (a Argon2id) Hash(password string) (string, error) {
+	salt := make([]byte, argon2SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey([]byte(password), salt, a.Time, a.Memory, a.Parallelism, argon2KeyLength)
+
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, a.Memory, a.Time, a.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+func (a Argon2id) Verify(password, hash string) bool {
+	parsed, err := parseArgon2id(hash)
+	if err != nil || parsed.version != argon2.Version {
+		return false
+	}
+
+	key := argon2.IDKey([]byte(password), parsed.salt, parsed.time, parsed.memory, parsed.parallelism, uint32(len(parsed.key)))
+	return subtle.ConstantTimeCompare(key, parsed.key) == 1
+}
+
+func (a Argon2id) Recognizes(hash string) bool {
+	return strings.HasPrefix(hash, "$argon2id$")
+}
+
+func (a Argon2id) Outdated(hash string) bool {
+	parsed, err := parseArgon2id(hash)
+	if err != nil {
+		return true
+	}
+
+	return parsed.version != argon2.Version ||
+		parsed.memory != a.Memory ||
+		parsed.time != a.Time ||
+		parsed.parallelism != a.Parallelism ||
+		len(parsed.salt) < argon2SaltLength ||
+		len(parsed.key) != argon2KeyLength
+}
+
+// parseArgon2id reads a hash of the form
+// $argon2id$v=19$m=65536,t=3,p=2$<salt>$<key>.
+func parseArgon2id(hash string) (*argon2idHash, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[0] != "" || parts[1] != "argon2id" {
+		return nil, fmt.Errorf("not an argon2id hash")
+	}
+
+	var parsed argon2idHash
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &parsed.version); err != nil {
+		return nil, fmt.Errorf("invalid argon2id version: %w", err)
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &parsed.memory, &parsed.time, &parsed.parallelism); err != nil {
+		return nil, fmt.Errorf("invalid argon2id parameters: %w", err)
+	}
+	if parsed.memory == 0 || parsed.time == 0 || parsed.parallelism == 0 {
+		return nil, fmt.Errorf("invalid argon2id parameters")
+	}
+
+	var err error
+	if parsed.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return nil, fmt.Errorf("invalid argon2id salt: %w", err)
+	}
+	if parsed.key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil || len(parsed.key) == 0 {
+		return nil, fmt.Errorf("invalid argon2id key")
+	}
+
+	return &parsed, nil
+}
+
+// Bcrypt hashes passwords with bcrypt. It is kept so passwords stored before
+// the switch to Argon2id still verify.
+type Bcrypt struct {
+	Cost int
+}
+
+func (b Bcrypt) Hash(password string) (string, error) {
+	bytes, err := bcrypt.GenerateFromPassword([]byte(password), b.Cost)
 	return string(bytes), err
 }
 
+func (b Bcrypt) Verify(password, hash string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+func (b Bcrypt) Recognizes(hash string) bool {
+	return strings.HasPrefix(hash, "$2a$") || strings.HasPrefix(hash, "$2b$") || strings.HasPrefix(hash, "$2y$")
+}
+
+func (b Bcrypt) Outdated(hash string) bool {
+	cost, err := bcrypt.Cost([]byte(hash))
+	return err != nil || cost < b.Cost
+}
+
+// PasswordHasher makes new hashes with its preferred scheme and verifies
+// hashes made by it or any legacy scheme. A hash that is not from the
+// preferred scheme at its current parameters needs rehashing.
+type PasswordHasher struct {
+	preferred PasswordScheme
+	legacy    []PasswordScheme
+}
+
+func NewPasswordHasher(preferred PasswordScheme, legacy ...PasswordScheme) *PasswordHasher {
+	return &PasswordHasher{preferred: preferred, legacy: legacy}
+}
+
+// LoadPasswordHasher hashes with Argon2id, tuned by PASSWORD_ARGON2_MEMORY
+// (KiB), PASSWORD_ARGON2_TIME and PASSWORD_ARGON2_PARALLELISM, and still
+// verifies bcrypt hashes. Unset or invalid values fall back to the defaults.
+func LoadPasswordHasher() *PasswordHasher {
+	params := Argon2id{
+		Memory:      defaultArgon2Memory,
+		Time:        defaultArgon2Time,
+		Parallelism: defaultArgon2Parallelism,
+	}
+
+	if n, ok := envUint("PASSWORD_ARGON2_MEMORY", 32); ok {
+		params.Memory = uint32(n)
+	}
+	if n, ok := envUint("PASSWORD_ARGON2_TIME", 32); ok {
+		params.Time = uint32(n)
+	}
+	if n, ok := envUint("PASSWORD_ARGON2_PARALLELISM", 8); ok {
+		params.Parallelism = uint8(n)
+	}
+	// Argon2 needs at least 8 KiB per lane
+	if params.Memory < 8*uint32(params.Parallelism) {
+		log.Printf("PASSWORD_ARGON2_MEMORY must be at least 8 KiB per lane, using %d KiB", defaultArgon2Memory)
+		params.Memory = defaultArgon2Memory
+	}
+
+	return NewPasswordHasher(params, Bcrypt{Cost: bcryptCost})
+}
+
+func envUint(name string, bits int) (uint64, bool) {
+	value := os.Getenv(name)
+	if value == "" {
+		return 0, false
+	}
+
+	n, err := strconv.ParseUint(value, 10, bits)
+	if err != nil || n == 0 {
+		log.Printf("Invalid %s %q, using the default", name, value)
+		return 0, false
+	}
+	return n, true
+}
+
+func (h *PasswordHasher) Hash(password string) (string, error) {
+	return h.preferred.Hash(password)
+}
+
+func (h *PasswordHasher) Verify(password, hash string) bool {
+	scheme := h.scheme(hash)
+	return scheme != nil && scheme.Verify(password, hash)
+}
+
+// NeedsRehash reports whether hash should be replaced the next time the
+// password is known.
+func (h *PasswordHasher) NeedsRehash(hash string) bool {
+	return !h.preferred.Recognizes(hash) || h.preferred.Outdated(hash)
+}
+
+func (h *PasswordHasher) scheme(hash string) PasswordScheme {
+	if h.preferred.Recognizes(hash) {
+		return h.preferred
+	}
+	for _, scheme := range h.legacy {
+		if scheme.Recognizes(hash) {
+			return scheme
+		}
+	}
+	return nil
+}
+
+var (
+	defaultPasswordHasher = NewPasswordHasher(Argon2id{
+		Memory:      defaultArgon2Memory,
+		Time:        defaultArgon2Time,
+		Parallelism: defaultArgon2Parallelism,
+	}, Bcrypt{Cost: bcryptCost})
+
+	currentPasswordHasher atomic.Pointer[PasswordHasher]
+)
+
+// SetPasswordHasher makes h the hasher used by HashPassword and CheckPassword.
+func SetPasswordHasher(h *PasswordHasher) {
+	currentPasswordHasher.Store(h)
+}
+
+func passwordHasher() *PasswordHasher {
+	if h := currentPasswordHasher.Load(); h != nil {
+		return h
+	}
+	return defaultPasswordHasher
+}
+
+func HashPassword(password string) (string, error) {
+	return passwordHasher().Hash(password)
+}
+
 func CheckPassword(password, hash string) bool {
-	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
-	return err == nil
+	return passwordHasher().Verify(password, hash)
+}
+
+// PasswordNeedsRehash reports whether a hash that just verified should be
+// replaced with one from HashPassword.
+func PasswordNeedsRehash(hash string) bool {
+	return passwordHasher().NeedsRehash(hash)
 }
@@ -0,0 +1,147 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	defaultPasswordMinLength   = 8
+	defaultPasswordMinStrength = 2
+	// maxPasswordBytes leaves room for any passphrase while bounding how much
+	// is hashed per attempt
+	maxPasswordBytes = 256
+)
+
+var (
+	ErrPasswordTooShort     = errors.New("password is too short")
+	ErrPasswordTooLong      = errors.New("password is too long")
+	ErrPasswordTooWeak      = errors.New("password is too easy to guess")
+	ErrPasswordPersonalInfo = errors.New("password contains personal information")
+	ErrPasswordBreached     = errors.New("password has appeared in a data breach")
+)
+
+// PasswordPolicyError is why a password was refused, with a message that can
+// be shown to the user. It wraps one of the ErrPassword errors.
+type PasswordPolicyError struct {
+	Err     error
+	Message string
+}
+
+func (e *PasswordPolicyError) Error() string { return e.Message }
+func (e *PasswordPolicyError) Unwrap() error { return e.Err }
+
+// PasswordPolicy decides which new passwords are accepted.
+type PasswordPolicy struct {
+	MinLength int
+	// MinStrength is the lowest EstimatePasswordStrength score allowed, 0
+	// to accept any
+	MinStrength int
+	// BlockPersonalInfo refuses passwords containing the user's name or
+	// email
+	BlockPersonalInfo bool
+	// Breached, if set, refuses passwords found in a breach
+	Breached *BreachedPasswords
+}
+
+// LoadPasswordPolicy reads the policy from PASSWORD_MIN_LENGTH,
+// PASSWORD_MIN_STRENGTH (0-4), PASSWORD_BLOCK_PERSONAL_INFO and
+// PASSWORD_BREACH_DIR. Unset or invalid values fall back to the defaults.
+func LoadPasswordPolicy() *PasswordPolicy {
+	policy := &PasswordPolicy{
+		MinLength:         defaultPasswordMinLength,
+		MinStrength:       defaultPasswordMinStrength,
+		BlockPersonalInfo: os.Getenv("PASSWORD_BLOCK_PERSONAL_INFO") != "false",
+	}
+
+	if n, err := strconv.Atoi(os.Getenv("PASSWORD_MIN_LENGTH")); err == nil && n >= 1 && n <= maxPasswordBytes {
+		policy.MinLength = n
+	}
+	if n, err := strconv.Atoi(os.Getenv("PASSWORD_MIN_STRENGTH")); err == nil && n >= 0 && n <= 4 {
+		policy.MinStrength = n
+	}
+	if dir := os.Getenv("PASSWORD_BREACH_DIR"); dir != "" {
+		if _, err := os.Stat(dir); err != nil {
+			log.Printf("Breached password list unavailable, not checking for breached passwords: %v", err)
+		} else {
+			policy.Breached = NewBreachedPasswords(dir)
+		}
+	}
+
+	return policy
+}
+
+// Check returns a *PasswordPolicyError if the password is not allowed.
+// personalInfo is the user's name and email.
+func (p *PasswordPolicy) Check(password string, personalInfo ...string) error {
+	if utf8.RuneCountInString(password) < p.MinLength {
+		return &PasswordPolicyError{
+			Err:     ErrPasswordTooShort,
+			Message: fmt.Sprintf("Password must be at least %d characters", p.MinLength),
+		}
+	}
+	if len(password) > maxPasswordBytes {
+		return &PasswordPolicyError{
+			Err:     ErrPasswordTooLong,
+			Message: fmt.Sprintf("Password must be at most %d bytes", maxPasswordBytes),
+		}
+	}
+
+	if p.BlockPersonalInfo && containsPersonalInfo(password, personalInfo) {
+		return &PasswordPolicyError{
+			Err:     ErrPasswordPersonalInfo,
+			Message: "Password must not contain your name or email",
+		}
+	}
+
+	if p.MinStrength > 0 {
+		if strength := EstimatePasswordStrength(password, personalInfo...); strength.Score < p.MinStrength {
+			return &PasswordPolicyError{
+				Err:     ErrPasswordTooWeak,
+				Message: "Password is too easy to guess: " + strength.Warning,
+			}
+		}
+	}
+
+	if p.Breached != nil {
+		breached, err := p.Breached.Contains(password)
+		if err != nil {
+			// Log error but don't refuse the password; the other checks
+			// still apply
+			log.Printf("Failed to check breached passwords: %v", err)
+		}
+		if breached {
+			return &PasswordPolicyError{
+				Err:     ErrPasswordBreached,
+				Message: "This password has appeared in a data breach, choose a different one",
+			}
+		}
+	}
+
+	return nil
+}
+
+// containsPersonalInfo looks for the user's name, or the name part of their
+// email, anywhere in the password, also with l33t swaps undone.
+func containsPersonalInfo(password string, personalInfo []string) bool {
+	lower := strings.ToLower(password)
+	unleet := strings.Map(func(r rune) rune {
+		if sub, ok := l33tSubstitutions[r]; ok {
+			return sub
+		}
+		return r
+	}, lower)
+
+	for word := range userInputWords(personalInfo) {
+		if strings.Contains(lower, word) || strings.Contains(unleet, word) {
+			return true
+		}
+	}
+
+	return false
+}
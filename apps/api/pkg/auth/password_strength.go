@@ -0,0 +1,448 @@
+package auth
+
+import (
+	_ "embed"
+	"math"
+	"strings"
+	"unicode"
+)
+
+// Password strength is estimated the way zxcvbn does it: the password is
+// split into the pieces an attacker would guess separately (common
+// passwords, sequences, repeats, keyboard rows, years and random
+// characters), and the guesses needed for each piece are multiplied. The
+// split that needs the fewest guesses wins, since that is what a smart
+// attacker would try. The score buckets match zxcvbn's.
+
+//go:embed common_passwords.txt
+var commonPasswordList string
+
+// commonPasswords maps common passwords and words to their popularity rank,
+// 1 being the most common
+var commonPasswords = func() map[string]int {
+	ranks := make(map[string]int)
+	for i, word := range strings.Fields(commonPasswordList) {
+		if _, ok := ranks[word]; !ok {
+			ranks[word] = i + 1
+		}
+	}
+	return ranks
+}()
+
+// keyboardRows are runs of adjacent keys people type as passwords
+var keyboardRows = []string{
+	"1234567890",
+	"qwertyuiop",
+	"asdfghjkl",
+	"zxcvbnm",
+	"qazwsxedcrfvtgbyhnujmikolp",
+}
+
+// l33tSubstitutions undoes the usual character swaps, so p@ssw0rd is
+// matched as password
+var l33tSubstitutions = map[rune]rune{
+	'4': 'a', '@': 'a', '8': 'b', '(': 'c', '3': 'e', '6': 'g', '1': 'i',
+	'!': 'i', '|': 'l', '0': 'o', '$': 's', '5': 's', '7': 't', '+': 't', '2': 'z',
+}
+
+const (
+	// bruteforceCardinality is the guesses per character for characters
+	// no pattern explains
+	bruteforceCardinality = 10
+	// The minimum guesses for a one-character and a longer piece, which keep
+	// a short pattern in a longer password from looking almost free
+	minSubmatchGuessesSingle = 10
+	minSubmatchGuessesMulti  = 50
+	// minGuessesBeforeGrowingSequence penalizes passwords made of many
+	// pieces, since the attacker also has to guess how they were joined
+	minGuessesBeforeGrowingSequence = 10000
+	// minUserInputLength keeps short names and email parts, which show up
+	// in plenty of good passwords by chance, from counting
+	minUserInputLength = 3
+)
+
+// Password patterns, also used to pick the warning shown to the user
+const (
+	patternBruteforce = "bruteforce"
+	patternDictionary = "dictionary"
+	patternUserInput  = "user_input"
+	patternRepeat     = "repeat"
+	patternSequence   = "sequence"
+	patternKeyboard   = "keyboard"
+	patternYear       = "year"
+)
+
+var patternWarnings = map[string]string{
+	patternDictionary: "it is similar to a commonly used password",
+	patternUserInput:  "it is based on your name or email",
+	patternRepeat:     "repeats like aaa are easy to guess",
+	patternSequence:   "sequences like abc or 6543 are easy to guess",
+	patternKeyboard:   "straight rows of keys like qwerty are easy to guess",
+	patternYear:       "years are easy to guess",
+	patternBruteforce: "add more words or characters",
+}
+
+// PasswordStrength is an estimate of how hard a password is to guess.
+type PasswordStrength struct {
+	// Score is 0 (too guessable) to 4 (very unguessable), like zxcvbn
+	Score int
+	// Guesses is the estimated number of guesses to find the password
+	Guesses float64
+	// Warning says what makes the password weak, if anything in particular
+	Warning string
+}
+
+type passwordMatch struct {
+	pattern string
+	start   int
+	end     int
+	guesses float64
+}
+
+// EstimatePasswordStrength rates a password. userInputs, such as the user's
+// name and email, are treated like the most common passwords.
+func EstimatePasswordStrength(password string, userInputs ...string) PasswordStrength {
+	runes := []rune(password)
+	if len(runes) == 0 {
+		return PasswordStrength{Warning: patternWarnings[patternBruteforce]}
+	}
+
+	matches := findPasswordMatches(runes, userInputWords(userInputs))
+	guesses, sequence := mostGuessableSequence(runes, matches)
+
+	return PasswordStrength{
+		Score:   guessesToScore(guesses),
+		Guesses: guesses,
+		Warning: sequenceWarning(sequence),
+	}
+}
+
+func findPasswordMatches(runes []rune, userInputs map[string]bool) []passwordMatch {
+	n := len(runes)
+	lower := []rune(strings.ToLower(string(runes)))
+	unleet := make([]rune, n)
+	for i, r := range lower {
+		if sub, ok := l33tSubstitutions[r]; ok {
+			unleet[i] = sub
+		} else {
+			unleet[i] = r
+		}
+	}
+
+	var matches []passwordMatch
+	for i := 0; i < n; i++ {
+		for j := i + 3; j <= n; j++ {
+			length := j - i
+
+			if guesses, pattern, ok := dictionaryGuesses(runes[i:j], lower[i:j], unleet[i:j], userInputs); ok {
+				matches = append(matches, passwordMatch{pattern, i, j, guesses})
+			}
+
+			if isRepeat(lower[i:j]) {
+				matches = append(matches, passwordMatch{patternRepeat, i, j, float64(bruteforceCardinality * length)})
+			}
+
+			if guesses, ok := sequenceGuesses(lower[i:j]); ok {
+				matches = append(matches, passwordMatch{patternSequence, i, j, guesses})
+			}
+
+			if length >= 4 && isKeyboardRun(string(lower[i:j])) {
+				matches = append(matches, passwordMatch{patternKeyboard, i, j, float64(40 * length)})
+			}
+
+			if length == 4 && isYear(lower[i:j]) {
+				matches = append(matches, passwordMatch{patternYear, i, j, 100})
+			}
+		}
+	}
+
+	return matches
+}
+
+// dictionaryGuesses looks a piece up as typed, reversed and with l33t
+// swaps undone. Capitals and swaps each make it somewhat harder to guess.
+func dictionaryGuesses(original, lower, unleet []rune, userInputs map[string]bool) (float64, string, bool) {
+	var variants float64 = 1
+	if string(original) != string(lower) {
+		variants *= uppercaseVariations(original)
+	}
+
+	candidates := []struct {
+		word       string
+		multiplier float64
+	}{
+		{string(lower), 1},
+		{reverseString(string(lower)), 2},
+		{string(unleet), 2},
+	}
+
+	best := math.Inf(1)
+	pattern := ""
+	for _, candidate := range candidates {
+		if userInputs[candidate.word] {
+			if guesses := variants * candidate.multiplier; guesses < best {
+				best, pattern = guesses, patternUserInput
+			}
+		}
+		if rank, ok := commonPasswords[candidate.word]; ok {
+			if guesses := float64(rank) * variants * candidate.multiplier; guesses < best {
+				best, pattern = guesses, patternDictionary
+			}
+		}
+	}
+
+	return best, pattern, pattern != ""
+}
+
+// uppercaseVariations is how many ways there are to capitalize a word the
+// way this piece is. A capital first or last letter, or all capitals, only
+// doubles the guesses.
+func uppercaseVariations(word []rune) float64 {
+	upper, lower := 0, 0
+	for _, r := range word {
+		switch {
+		case unicode.IsUpper(r):
+			upper++
+		case unicode.IsLower(r):
+			lower++
+		}
+	}
+
+	if lower == 0 || (upper == 1 && (unicode.IsUpper(word[0]) || unicode.IsUpper(word[len(word)-1]))) {
+		return 2
+	}
+
+	var variations float64
+	for i := 1; i <= min(upper, lower); i++ {
+		variations += binomial(upper+lower, i)
+	}
+	return max(variations, 1)
+}
+
+func isRepeat(word []rune) bool {
+	for _, r := range word[1:] {
+		if r != word[0] {
+			return false
+		}
+	}
+	return true
+}
+
+// sequenceGuesses matches runs like abc, 2468 or zyx, where each character
+// is a fixed step from the last.
+func sequenceGuesses(word []rune) (float64, bool) {
+	delta := word[1] - word[0]
+	if delta == 0 || delta > 5 || delta < -5 {
+		return 0, false
+	}
+	for i := 2; i < len(word); i++ {
+		if word[i]-word[i-1] != delta {
+			return 0, false
+		}
+	}
+
+	var base float64
+	switch {
+	case strings.ContainsRune("aAzZ019", word[0]):
+		base = 4
+	case unicode.IsDigit(word[0]):
+		base = 10
+	default:
+		base = 26
+	}
+	if delta < 0 {
+		base *= 2
+	}
+
+	return base * float64(len(word)), true
+}
+
+func isKeyboardRun(word string) bool {
+	for _, row := range keyboardRows {
+		if strings.Contains(row, word) || strings.Contains(reverseString(row), word) {
+			return true
+		}
+	}
+	return false
+}
+
+func isYear(word []rune) bool {
+	s := string(word)
+	return (strings.HasPrefix(s, "19") || strings.HasPrefix(s, "20")) &&
+		unicode.IsDigit(word[2]) && unicode.IsDigit(word[3])
+}
+
+// mostGuessableSequence finds the split of the password into matches and
+// random characters that needs the fewest guesses, the way zxcvbn does:
+// guesses = k! * product(match guesses) + 10000^(k-1) for k pieces.
+func mostGuessableSequence(runes []rune, matches []passwordMatch) (float64, []passwordMatch) {
+	n := len(runes)
+
+	byEnd := make([][]passwordMatch, n+1)
+	for _, m := range matches {
+		minimum := float64(minSubmatchGuessesMulti)
+		if m.end-m.start == 1 {
+			minimum = minSubmatchGuessesSingle
+		}
+		if m.end-m.start < n {
+			m.guesses = max(m.guesses, minimum)
+		}
+		byEnd[m.end] = append(byEnd[m.end], m)
+	}
+
+	// best[j][k] is the smallest product of guesses covering the first j
+	// characters with k pieces, and last[j][k] the last piece of that split
+	best := make([][]float64, n+1)
+	last := make([][]*passwordMatch, n+1)
+	for j := range best {
+		best[j] = make([]float64, n+1)
+		last[j] = make([]*passwordMatch, n+1)
+		for k := range best[j] {
+			best[j][k] = math.Inf(1)
+		}
+	}
+	best[0][0] = 1
+
+	for j := 1; j <= n; j++ {
+		candidates := byEnd[j]
+		for i := 0; i < j; i++ {
+			candidates = append(candidates, passwordMatch{
+				pattern: patternBruteforce,
+				start:   i,
+				end:     j,
+				guesses: bruteforceGuesses(j-i, n),
+			})
+		}
+
+		for c := range candidates {
+			m := candidates[c]
+			for k := 0; k < j; k++ {
+				if math.IsInf(best[m.start][k], 1) {
+					continue
+				}
+				// Two random runs in a row are one random run
+				if m.pattern == patternBruteforce && last[m.start][k] != nil && last[m.start][k].pattern == patternBruteforce {
+					continue
+				}
+				if product := best[m.start][k] * m.guesses; product < best[j][k+1] {
+					best[j][k+1] = product
+					last[j][k+1] = &m
+				}
+			}
+		}
+	}
+
+	guesses := math.Inf(1)
+	pieces := 0
+	for k := 1; k <= n; k++ {
+		if math.IsInf(best[n][k], 1) {
+			continue
+		}
+		total := factorial(k)*best[n][k] + math.Pow(minGuessesBeforeGrowingSequence, float64(k-1))
+		if total < guesses {
+			guesses, pieces = total, k
+		}
+	}
+
+	sequence := make([]passwordMatch, pieces)
+	for j, k := n, pieces; k > 0; k-- {
+		m := last[j][k]
+		sequence[k-1] = *m
+		j = m.start
+	}
+
+	return guesses, sequence
+}
+
+func bruteforceGuesses(length int, passwordLength int) float64 {
+	guesses := math.Pow(bruteforceCardinality, float64(length))
+	if length < passwordLength {
+		minimum := float64(minSubmatchGuessesMulti)
+		if length == 1 {
+			minimum = minSubmatchGuessesSingle
+		}
+		guesses = max(guesses, minimum+1)
+	}
+	return guesses
+}
+
+func guessesToScore(guesses float64) int {
+	const delta = 5
+	switch {
+	case guesses < 1e3+delta:
+		return 0
+	case guesses < 1e6+delta:
+		return 1
+	case guesses < 1e8+delta:
+		return 2
+	case guesses < 1e10+delta:
+		return 3
+	default:
+		return 4
+	}
+}
+
+// sequenceWarning explains the weakest part of the password: the pattern
+// covering the most characters.
+func sequenceWarning(sequence []passwordMatch) string {
+	warning := patternWarnings[patternBruteforce]
+	longest := 0
+	for _, m := range sequence {
+		if m.pattern == patternBruteforce {
+			continue
+		}
+		if length := m.end - m.start; length > longest {
+			longest, warning = length, patternWarnings[m.pattern]
+		}
+	}
+	return warning
+}
+
+// userInputWords splits names and emails into the lowercase words someone
+// might build a password from: each word of a name or the name part of an
+// email, and all of them run together.
+func userInputWords(inputs []string) map[string]bool {
+	words := make(map[string]bool)
+	for _, input := range inputs {
+		input = strings.ToLower(input)
+		if local, _, ok := strings.Cut(input, "@"); ok {
+			input = local
+		}
+
+		parts := strings.FieldsFunc(input, func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+		})
+		parts = append(parts, strings.Join(parts, ""))
+
+		for _, part := range parts {
+			if len([]rune(part)) >= minUserInputLength {
+				words[part] = true
+			}
+		}
+	}
+	return words
+}
+
+func reverseString(s string) string {
+	runes := []rune(s)
+	for i, j := 0, len(runes)-1; i < j; i, j = i+1, j-1 {
+		runes[i], runes[j] = runes[j], runes[i]
+	}
+	return string(runes)
+}
+
+func factorial(n int) float64 {
+	result := 1.0
+	for i := 2; i <= n; i++ {
+		result *= float64(i)
+	}
+	return result
+}
+
+func binomial(n, k int) float64 {
+	result := 1.0
+	for i := 1; i <= k; i++ {
+		result = result * float64(n-k+i) / float64(i)
+	}
+	return result
+}
@@ -0,0 +1,69 @@
+package auth
+
+import "testing"
+
+func TestEstimatePasswordStrength(t *testing.T) {
+	tests := []struct {
+		name        string
+		password    string
+		userInputs  []string
+		wantScore   int
+		wantWarning string
+	}{
+		{"empty", "", nil, 0, patternWarnings[patternBruteforce]},
+		{"common password", "password", nil, 0, patternWarnings[patternDictionary]},
+		{"l33t common password", "p@ssw0rd", nil, 0, patternWarnings[patternDictionary]},
+		{"reversed common password", "drowssap", nil, 0, patternWarnings[patternDictionary]},
+		{"capitalized with digit", "Password1", nil, 0, patternWarnings[patternDictionary]},
+		{"repeat", "aaaaaaaaaaaa", nil, 0, patternWarnings[patternRepeat]},
+		{"sequence", "abcdefghij", nil, 0, patternWarnings[patternSequence]},
+		{"year", "1987", nil, 0, patternWarnings[patternYear]},
+		{"name and email", "johnsmith1", []string{"John Smith", "john@example.com"}, 1, patternWarnings[patternUserInput]},
+		{"random characters", "xK9#mQ2$vL7!pR4z", nil, 4, patternWarnings[patternBruteforce]},
+		{"passphrase", "correct horse battery staple", nil, 4, patternWarnings[patternDictionary]},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := EstimatePasswordStrength(tt.password, tt.userInputs...)
+			if got.Score != tt.wantScore {
+				t.Errorf("Score = %d (%g guesses), want %d", got.Score, got.Guesses, tt.wantScore)
+			}
+			if got.Warning != tt.wantWarning {
+				t.Errorf("Warning = %q, want %q", got.Warning, tt.wantWarning)
+			}
+		})
+	}
+}
+
+func TestEstimatePasswordStrengthUserInputs(t *testing.T) {
+	without := EstimatePasswordStrength("johnsmith1")
+	with := EstimatePasswordStrength("johnsmith1", "John Smith")
+	if with.Guesses >= without.Guesses {
+		t.Errorf("guesses with the user's name = %g, want fewer than %g without it", with.Guesses, without.Guesses)
+	}
+}
+
+func TestGuessesToScore(t *testing.T) {
+	tests := []struct {
+		guesses float64
+		want    int
+	}{
+		{0, 0},
+		{1e3, 0},
+		{1e3 + 5, 1},
+		{1e6, 1},
+		{1e6 + 5, 2},
+		{1e8, 2},
+		{1e8 + 5, 3},
+		{1e10, 3},
+		{1e10 + 5, 4},
+		{1e20, 4},
+	}
+
+	for _, tt := range tests {
+		if got := guessesToScore(tt.guesses); got != tt.want {
+			t.Errorf("guessesToScore(%g) = %d, want %d", tt.guesses, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package auth
+
+import "testing"
+
+// testArgon2id keeps hashing fast; the parameters are recorded in the hash,
+// so nothing else depends on them.
+var testArgon2id = Argon2id{Memory: 64, Time: 1, Parallelism: 1}
+
+func TestArgon2idRoundTrip(t *testing.T) {
+	hash, err := testArgon2id.Hash("correct horse battery staple")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !testArgon2id.Recognizes(hash) {
+		t.Errorf("Recognizes(%q) = false, want true", hash)
+	}
+	if !testArgon2id.Verify("correct horse battery staple", hash) {
+		t.Error("Verify with the right password = false, want true")
+	}
+	if testArgon2id.Verify("correct horse battery stapler", hash) {
+		t.Error("Verify with the wrong password = true, want false")
+	}
+
+	// Parameters travel with the hash, so other settings still verify it
+	other := Argon2id{Memory: 128, Time: 2, Parallelism: 2}
+	if !other.Verify("correct horse battery staple", hash) {
+		t.Error("Verify with different parameters = false, want true")
+	}
+
+	parsed, err := parseArgon2id(hash)
+	if err != nil {
+		t.Fatalf("parseArgon2id(%q) error = %v", hash, err)
+	}
+	if parsed.memory != testArgon2id.Memory || parsed.time != testArgon2id.Time || parsed.parallelism != testArgon2id.Parallelism {
+		t.Errorf("parseArgon2id() parameters = m=%d,t=%d,p=%d, want m=%d,t=%d,p=%d",
+			parsed.memory, parsed.time, parsed.parallelism,
+			testArgon2id.Memory, testArgon2id.Time, testArgon2id.Parallelism)
+	}
+	if len(parsed.salt) != argon2SaltLength || len(parsed.key) != argon2KeyLength {
+		t.Errorf("parseArgon2id() salt and key lengths = %d, %d, want %d, %d",
+			len(parsed.salt), len(parsed.key), argon2SaltLength, argon2KeyLength)
+	}
+}
+
+func TestParseArgon2idMalformed(t *testing.T) {
+	const salt = "c29tZXNhbHRzb21lc2FsdA"
+	const key = "a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2U"
+
+	tests := []struct {
+		name string
+		hash string
+	}{
+		{"empty", ""},
+		{"bcrypt", "$2a$12$R9h/cIPz0gi.URNNX3kh2OPST9/PgBkqquzi.Ss7KIUgO2t0jWMUW"},
+		{"argon2i", "$argon2i$v=19$m=64,t=1,p=1$" + salt + "$" + key},
+		{"no leading dollar", "argon2id$v=19$m=64,t=1,p=1$" + salt + "$" + key},
+		{"missing key", "$argon2id$v=19$m=64,t=1,p=1$" + salt},
+		{"extra field", "$argon2id$v=19$m=64,t=1,p=1$" + salt + "$" + key + "$x"},
+		{"bad version", "$argon2id$v=x$m=64,t=1,p=1$" + salt + "$" + key},
+		{"missing parameters", "$argon2id$v=19$m=64$" + salt + "$" + key},
+		{"zero memory", "$argon2id$v=19$m=0,t=1,p=1$" + salt + "$" + key},
+		{"zero time", "$argon2id$v=19$m=64,t=0,p=1$" + salt + "$" + key},
+		{"zero parallelism", "$argon2id$v=19$m=64,t=1,p=0$" + salt + "$" + key},
+		{"parallelism overflow", "$argon2id$v=19$m=64,t=1,p=256$" + salt + "$" + key},
+		{"bad salt", "$argon2id$v=19$m=64,t=1,p=1$not*base64$" + key},
+		{"bad key", "$argon2id$v=19$m=64,t=1,p=1$" + salt + "$not*base64"},
+		{"empty key", "$argon2id$v=19$m=64,t=1,p=1$" + salt + "$"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := parseArgon2id(tt.hash); err == nil {
+				t.Errorf("parseArgon2id(%q) error = nil, want an error", tt.hash)
+			}
+			if testArgon2id.Verify("password", tt.hash) {
+				t.Errorf("Verify(%q) = true, want false", tt.hash)
+			}
+			if !testArgon2id.Outdated(tt.hash) {
+				t.Errorf("Outdated(%q) = false, want true", tt.hash)
+			}
+		})
+	}
+}
+
+func TestArgon2idOutdated(t *testing.T) {
+	hash, err := testArgon2id.Hash("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		scheme Argon2id
+		hash   string
+		want   bool
+	}{
+		{"same parameters", testArgon2id, hash, false},
+		{"more memory", Argon2id{Memory: 128, Time: 1, Parallelism: 1}, hash, true},
+		{"more time", Argon2id{Memory: 64, Time: 2, Parallelism: 1}, hash, true},
+		{"more parallelism", Argon2id{Memory: 64, Time: 1, Parallelism: 2}, hash, true},
+		{"older version", testArgon2id, "$argon2id$v=16$m=64,t=1,p=1$c29tZXNhbHRzb21lc2FsdA$a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2U", true},
+		{"short salt", testArgon2id, "$argon2id$v=19$m=64,t=1,p=1$c2FsdA$a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2U", true},
+		{"short key", testArgon2id, "$argon2id$v=19$m=64,t=1,p=1$c29tZXNhbHRzb21lc2FsdA$a2V5", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.scheme.Outdated(tt.hash); got != tt.want {
+				t.Errorf("Outdated() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPasswordHasherNeedsRehash(t *testing.T) {
+	legacy := Bcrypt{Cost: 4}
+	hasher := NewPasswordHasher(testArgon2id, legacy)
+
+	current, err := hasher.Hash("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bcryptHash, err := legacy.Hash("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale, err := Argon2id{Memory: 128, Time: 1, Parallelism: 1}.Hash("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		hash       string
+		wantVerify bool
+		wantRehash bool
+	}{
+		{"current argon2id", current, true, false},
+		{"legacy bcrypt", bcryptHash, true, true},
+		{"argon2id with old parameters", stale, true, true},
+		{"unknown scheme", "$1$salt$hash", false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := hasher.Verify("password", tt.hash); got != tt.wantVerify {
+				t.Errorf("Verify() = %v, want %v", got, tt.wantVerify)
+			}
+			if got := hasher.NeedsRehash(tt.hash); got != tt.wantRehash {
+				t.Errorf("NeedsRehash() = %v, want %v", got, tt.wantRehash)
+			}
+		})
+	}
+}
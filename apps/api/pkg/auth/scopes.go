@@ -0,0 +1,73 @@
+package auth
+
+import "sort"
+
+// Scopes limit what a token may do. Tokens from an interactive login hold
+// every scope; API tokens hold the ones chosen when they were created. In
+// JWTs they travel space-separated in the scope claim.
+const (
+	ScopeGroupsRead  = "groups:read"
+	ScopeGroupsWrite = "groups:write"
+	ScopeTodosRead   = "todos:read"
+	ScopeTodosWrite  = "todos:write"
+	ScopeSharesRead  = "shares:read"
+	ScopeSharesWrite = "shares:write"
+	ScopeProfileRead = "profile:read"
+)
+
+var scopeDescriptions = map[string]string{
+	ScopeGroupsRead:  "Read your groups",
+	ScopeGroupsWrite: "Create, change and delete your groups",
+	ScopeTodosRead:   "Read your todos",
+	ScopeTodosWrite:  "Create, change and delete your todos",
+	ScopeSharesRead:  "See your share links",
+	ScopeSharesWrite: "Create and revoke share links",
+	ScopeProfileRead: "See your name, email and settings",
+}
+
+// AllScopes returns every scope, sorted.
+func AllScopes() []string {
+	scopes := make([]string, 0, len(scopeDescriptions))
+	for scope := range scopeDescriptions {
+		scopes = append(scopes, scope)
+	}
+	sort.Strings(scopes)
+	return scopes
+}
+
+func ValidScope(scope string) bool {
+	_, ok := scopeDescriptions[scope]
+	return ok
+}
+
+// ScopeDescription is a short, user-facing explanation of a scope.
+func ScopeDescription(scope string) string {
+	return scopeDescriptions[scope]
+}
+
+func HasScope(scopes []string, scope string) bool {
+	for _, s := range scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// NormalizeScopes sorts scopes and drops duplicates. It reports false if any
+// scope is unknown.
+func NormalizeScopes(scopes []string) ([]string, bool) {
+	seen := make(map[string]bool, len(scopes))
+	normalized := make([]string, 0, len(scopes))
+	for _, scope := range scopes {
+		if !ValidScope(scope) {
+			return nil, false
+		}
+		if !seen[scope] {
+			seen[scope] = true
+			normalized = append(normalized, scope)
+		}
+	}
+	sort.Strings(normalized)
+	return normalized, true
+}
@@ -0,0 +1,90 @@
+package auth
+
+import (
+	"testing"
+	"time"
+)
+
+// rfc6238Secret is the SHA-1 seed from RFC 6238 appendix B, the ASCII
+// string "12345678901234567890", base32 encoded.
+const rfc6238Secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestTOTPCodeRFC6238Vectors(t *testing.T) {
+	key := []byte("12345678901234567890")
+
+	// The RFC lists 8-digit codes; a 6-digit code is their last six digits
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+
+	for _, tt := range tests {
+		if got := totpCode(key, tt.unix/totpPeriod); got != tt.code {
+			t.Errorf("totpCode at %d = %q, want %q", tt.unix, got, tt.code)
+		}
+	}
+}
+
+func TestValidateTOTP(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	step := now.Unix() / totpPeriod
+	key, err := totpEncoding.DecodeString(rfc6238Secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		secret   string
+		code     string
+		wantStep int64
+		wantOK   bool
+	}{
+		{"current step", rfc6238Secret, totpCode(key, step), step, true},
+		{"previous step", rfc6238Secret, totpCode(key, step-1), step - 1, true},
+		{"next step", rfc6238Secret, totpCode(key, step+1), step + 1, true},
+		{"two steps behind", rfc6238Secret, totpCode(key, step-2), 0, false},
+		{"two steps ahead", rfc6238Secret, totpCode(key, step+2), 0, false},
+		{"lowercase secret", "gezdgnbvgy3tqojqgezdgnbvgy3tqojq", totpCode(key, step), step, true},
+		{"wrong code", rfc6238Secret, "000000", 0, false},
+		{"too short", rfc6238Secret, "50471", 0, false},
+		{"too long", rfc6238Secret, "0050471", 0, false},
+		{"empty code", rfc6238Secret, "", 0, false},
+		{"invalid secret", "not base32!", totpCode(key, step), 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotStep, gotOK := ValidateTOTP(tt.secret, tt.code, now)
+			if gotOK != tt.wantOK || gotStep != tt.wantStep {
+				t.Errorf("ValidateTOTP() = (%d, %v), want (%d, %v)", gotStep, gotOK, tt.wantStep, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestNormalizeRecoveryCode(t *testing.T) {
+	tests := []struct {
+		code string
+		want string
+	}{
+		{"k7m2p-xq9rt", "k7m2p-xq9rt"},
+		{"K7M2P-XQ9RT", "k7m2p-xq9rt"},
+		{"k7m2pxq9rt", "k7m2p-xq9rt"},
+		{" k7m2p xq9rt ", "k7m2p-xq9rt"},
+		{"k7m2p", "k7m2p"},
+	}
+
+	for _, tt := range tests {
+		if got := NormalizeRecoveryCode(tt.code); got != tt.want {
+			t.Errorf("NormalizeRecoveryCode(%q) = %q, want %q", tt.code, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package mailer
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+// LogMailer prints messages to the log, or writes each one to an .eml file
+// in dir when it is set. It never delivers anything, which is what local
+// development wants.
+type LogMailer struct {
+	from  string
+	dir   string
+	count atomic.Int64
+}
+
+func NewLogMailer(from string, dir string) *LogMailer {
+	return &LogMailer{from: from, dir: dir}
+}
+
+func (m *LogMailer) Send(ctx context.Context, msg Message) error {
+	data, err := formatMessage(m.from, msg)
+	if err != nil {
+		return err
+	}
+
+	if m.dir == "" {
+		log.Printf("Mail to %s: %s\n%s", msg.To, msg.Subject, msg.Body)
+		return nil
+	}
+
+	if err := os.MkdirAll(m.dir, 0o755); err != nil {
+		return fmt.Errorf("failed to create mail directory: %w", err)
+	}
+
+	name := fmt.Sprintf("%s-%d.eml", time.Now().Format("20060102T150405"), m.count.Add(1))
+	if err := os.WriteFile(filepath.Join(m.dir, name), data, 0o644); err != nil {
+		return fmt.Errorf("failed to write mail: %w", err)
+	}
+
+	return nil
+}
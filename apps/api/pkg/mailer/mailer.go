@@ -0,0 +1,62 @@
+package mailer
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+)
+
+// Message is a plain-text email.
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer delivers email. Implementations must be safe for concurrent use.
+type Mailer interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// FromEnv builds the mailer selected by MAIL_DRIVER: "smtp", or "log" for
+// local development. MAIL_DRIVER is required unless APP_ENV=development, where
+// it defaults to "log".
+func FromEnv() (Mailer, error) {
+	from := os.Getenv("MAIL_FROM")
+	if from == "" {
+		from = "Ato <no-reply@localhost>"
+	}
+
+	development := os.Getenv("APP_ENV") == "development"
+
+	driver := os.Getenv("MAIL_DRIVER")
+	if driver == "" {
+		if !development {
+			return nil, fmt.Errorf("MAIL_DRIVER is required")
+		}
+		driver = "log"
+	}
+
+	switch driver {
+	case "log":
+		// Mail carries sign-in and password reset links, so anyone who can
+		// read the logs can take over accounts
+		if !development {
+			log.Println("WARNING: MAIL_DRIVER=log never delivers mail and exposes account links to anyone who can read the logs or MAIL_DIR; use smtp in production")
+		}
+		return NewLogMailer(from, os.Getenv("MAIL_DIR")), nil
+	case "smtp":
+		host := os.Getenv("SMTP_HOST")
+		if host == "" {
+			return nil, fmt.Errorf("SMTP_HOST is required for the smtp mail driver")
+		}
+		port := os.Getenv("SMTP_PORT")
+		if port == "" {
+			port = "587"
+		}
+		return NewSMTPMailer(host, port, os.Getenv("SMTP_USERNAME"), os.Getenv("SMTP_PASSWORD"), from), nil
+	default:
+		return nil, fmt.Errorf("unknown MAIL_DRIVER %q", driver)
+	}
+}
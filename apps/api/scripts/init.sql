@@ -2,8 +2,24 @@
 CREATE TABLE IF NOT EXISTS users (
     id SERIAL PRIMARY KEY,
     email VARCHAR(255) UNIQUE NOT NULL,
-    password_hash VARCHAR(255) NOT NULL,
+    -- NULL for accounts created through an OpenID Connect provider
+    password_hash VARCHAR(255),
     name VARCHAR(100) NOT NULL,
+    email_verified_at TIMESTAMP WITH TIME ZONE,
+    -- Tokens issued with an older epoch are no longer accepted
+    token_epoch BIGINT NOT NULL DEFAULT 0,
+    -- Random WebAuthn user handle, set when the first passkey is registered
+    webauthn_handle BYTEA UNIQUE,
+    -- Display settings such as theme and time zone, see models.UserPreferences
+    preferences JSONB NOT NULL DEFAULT '{}',
+    -- Set while the account waits out its deletion grace period; it is
+    -- erased for good once this time passes
+    deletion_scheduled_at TIMESTAMP WITH TIME ZONE,
+    -- "admin" can use the /admin API, see models.RoleAdmin
+    role VARCHAR(20) NOT NULL DEFAULT 'user' CHECK (role IN ('user', 'admin')),
+    -- Set while an admin has the account disabled; it cannot sign in or use
+    -- any token until enabled again
+    disabled_at TIMESTAMP WITH TIME ZONE,
     created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
     updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
 );
@@ -11,32 +27,84 @@ CREATE TABLE IF NOT EXISTS users (
 -- Create index on email for faster lookups
 CREATE INDEX IF NOT EXISTS idx_users_email ON users(email);
 
+-- Emails are stored lowercased and compared ignoring case, so addresses that
+-- differ only in case are one account. Lowercase rows written before that
+-- rule; this fails, and needs the duplicates merged by hand, if two accounts
+-- already differ only in case.
+UPDATE users SET email = lower(email) WHERE email <> lower(email);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_users_email_lower ON users(lower(email));
+CREATE INDEX IF NOT EXISTS idx_users_deletion_scheduled_at ON users(deletion_scheduled_at) WHERE deletion_scheduled_at IS NOT NULL;
+
+-- Create groups table
+CREATE TABLE IF NOT EXISTS groups (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    client_id UUID NOT NULL DEFAULT gen_random_uuid(),
+    name VARCHAR(100) DEFAULT '',
+    position INTEGER NOT NULL DEFAULT 0,
+    version INTEGER NOT NULL DEFAULT 1,
+    field_clocks JSONB NOT NULL DEFAULT '{}',
+    sync_cursor BIGINT NOT NULL DEFAULT 0,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (user_id, client_id)
+);
+
+-- Create index on user_id for faster lookups
+CREATE INDEX IF NOT EXISTS idx_groups_user_id ON groups(user_id);
+CREATE INDEX IF NOT EXISTS idx_groups_user_sync_cursor ON groups(user_id, sync_cursor);
+
 -- Create todos table
 CREATE TABLE IF NOT EXISTS todos (
     id SERIAL PRIMARY KEY,
     user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    group_id INTEGER REFERENCES groups(id) ON DELETE CASCADE,
+    client_id UUID NOT NULL DEFAULT gen_random_uuid(),
     title VARCHAR(255) NOT NULL,
     description TEXT,
     completed BOOLEAN DEFAULT FALSE,
+    version INTEGER NOT NULL DEFAULT 1,
+    field_clocks JSONB NOT NULL DEFAULT '{}',
+    sync_cursor BIGINT NOT NULL DEFAULT 0,
     created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
-    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (user_id, client_id)
 );
 
 -- Create index on user_id for faster lookups
 CREATE INDEX IF NOT EXISTS idx_todos_user_id ON todos(user_id);
+CREATE INDEX IF NOT EXISTS idx_todos_group_id ON todos(group_id);
+CREATE INDEX IF NOT EXISTS idx_todos_user_sync_cursor ON todos(user_id, sync_cursor);
 
--- Create groups table
-CREATE TABLE IF NOT EXISTS groups (
+-- Per-user change counter for delta sync. Every write to a synced row takes
+-- the next value, so clients can ask for "everything after cursor N".
+CREATE TABLE IF NOT EXISTS sync_cursors (
+    user_id INTEGER PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+    cursor BIGINT NOT NULL DEFAULT 0
+);
+
+-- Deleted synced rows, so offline clients learn about deletions
+CREATE TABLE IF NOT EXISTS sync_tombstones (
     id SERIAL PRIMARY KEY,
     user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
-    name VARCHAR(100) DEFAULT '',
-    position INTEGER NOT NULL DEFAULT 0,
-    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
-    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+    entity VARCHAR(20) NOT NULL,
+    client_id UUID NOT NULL,
+    sync_cursor BIGINT NOT NULL,
+    deleted_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (user_id, entity, client_id)
 );
 
--- Create index on user_id for faster lookups
-CREATE INDEX IF NOT EXISTS idx_groups_user_id ON groups(user_id);
+CREATE INDEX IF NOT EXISTS idx_sync_tombstones_user_sync_cursor ON sync_tombstones(user_id, sync_cursor);
+
+-- Client mutations that have already been applied, for idempotent replay
+CREATE TABLE IF NOT EXISTS sync_mutations (
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    mutation_id VARCHAR(64) NOT NULL,
+    status VARCHAR(20) NOT NULL,
+    error TEXT,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (user_id, mutation_id)
+);
 
 -- Create function to update updated_at timestamp
 CREATE OR REPLACE FUNCTION update_updated_at_column()
@@ -56,3 +124,309 @@ CREATE TRIGGER update_todos_updated_at BEFORE UPDATE ON todos
 
 CREATE TRIGGER update_groups_updated_at BEFORE UPDATE ON groups
     FOR EACH ROW EXECUTE FUNCTION update_updated_at_column();
+
+-- Create function to bump the version used for optimistic concurrency
+CREATE OR REPLACE FUNCTION increment_version_column()
+RETURNS TRIGGER AS $$
+BEGIN
+    NEW.version = OLD.version + 1;
+    RETURN NEW;
+END;
+$$ language 'plpgsql';
+
+-- Create triggers to auto-increment version
+CREATE TRIGGER increment_todos_version BEFORE UPDATE ON todos
+    FOR EACH ROW EXECUTE FUNCTION increment_version_column();
+
+CREATE TRIGGER increment_groups_version BEFORE UPDATE ON groups
+    FOR EACH ROW EXECUTE FUNCTION increment_version_column();
+
+-- Take the next change cursor for a user. Returns NULL while the user row is
+-- being deleted, since there is nobody left to sync with.
+CREATE OR REPLACE FUNCTION next_sync_cursor(p_user_id INTEGER)
+RETURNS BIGINT AS $$
+DECLARE
+    next_cursor BIGINT;
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM users WHERE id = p_user_id) THEN
+        RETURN NULL;
+    END IF;
+
+    INSERT INTO sync_cursors (user_id, cursor)
+    VALUES (p_user_id, 1)
+    ON CONFLICT (user_id) DO UPDATE SET cursor = sync_cursors.cursor + 1
+    RETURNING cursor INTO next_cursor;
+
+    RETURN next_cursor;
+END;
+$$ language 'plpgsql';
+
+-- Field clock used for writes that do not come through /sync, in the same
+-- "<unix ms>:<device>" format clients use
+CREATE OR REPLACE FUNCTION server_field_clock()
+RETURNS TEXT AS $$
+BEGIN
+    RETURN lpad(floor(extract(epoch FROM clock_timestamp()) * 1000)::bigint::text, 13, '0') || ':server';
+END;
+$$ language 'plpgsql';
+
+-- Stamp synced rows with a change cursor. Writers other than /sync leave
+-- field_clocks untouched, so the fields they changed get a server clock.
+-- Trigger arguments are the names of the synced fields.
+CREATE OR REPLACE FUNCTION track_sync_changes()
+RETURNS TRIGGER AS $$
+DECLARE
+    field TEXT;
+    clock TEXT := server_field_clock();
+    old_row JSONB;
+    new_row JSONB := to_jsonb(NEW);
+BEGIN
+    IF TG_OP = 'INSERT' THEN
+        IF NEW.field_clocks = '{}'::jsonb THEN
+            FOREACH field IN ARRAY TG_ARGV LOOP
+                NEW.field_clocks = NEW.field_clocks || jsonb_build_object(field, clock);
+            END LOOP;
+        END IF;
+    ELSIF NEW.field_clocks IS NOT DISTINCT FROM OLD.field_clocks THEN
+        old_row := to_jsonb(OLD);
+        FOREACH field IN ARRAY TG_ARGV LOOP
+            IF new_row -> field IS DISTINCT FROM old_row -> field THEN
+                NEW.field_clocks = NEW.field_clocks || jsonb_build_object(field, clock);
+            END IF;
+        END LOOP;
+    END IF;
+
+    NEW.sync_cursor = COALESCE(next_sync_cursor(NEW.user_id), NEW.sync_cursor);
+    RETURN NEW;
+END;
+$$ language 'plpgsql';
+
+-- Leave a tombstone behind for deleted synced rows. The trigger argument is
+-- the entity name reported to clients.
+CREATE OR REPLACE FUNCTION record_sync_tombstone()
+RETURNS TRIGGER AS $$
+DECLARE
+    next_cursor BIGINT := next_sync_cursor(OLD.user_id);
+BEGIN
+    IF next_cursor IS NOT NULL THEN
+        INSERT INTO sync_tombstones (user_id, entity, client_id, sync_cursor)
+        VALUES (OLD.user_id, TG_ARGV[0], OLD.client_id, next_cursor)
+        ON CONFLICT (user_id, entity, client_id) DO UPDATE SET sync_cursor = EXCLUDED.sync_cursor;
+    END IF;
+    RETURN OLD;
+END;
+$$ language 'plpgsql';
+
+CREATE TRIGGER track_groups_sync_changes BEFORE INSERT OR UPDATE ON groups
+    FOR EACH ROW EXECUTE FUNCTION track_sync_changes('name', 'position');
+
+CREATE TRIGGER track_todos_sync_changes BEFORE INSERT OR UPDATE ON todos
+    FOR EACH ROW EXECUTE FUNCTION track_sync_changes('group_id', 'title', 'description', 'completed');
+
+CREATE TRIGGER record_groups_sync_tombstone AFTER DELETE ON groups
+    FOR EACH ROW EXECUTE FUNCTION record_sync_tombstone('group');
+
+CREATE TRIGGER record_todos_sync_tombstone AFTER DELETE ON todos
+    FOR EACH ROW EXECUTE FUNCTION record_sync_tombstone('todo');
+
+-- Create group shares table for public read-only links. Only a hash of the
+-- token is stored, so a database leak does not expose working links.
+CREATE TABLE IF NOT EXISTS group_shares (
+    id SERIAL PRIMARY KEY,
+    group_id INTEGER NOT NULL REFERENCES groups(id) ON DELETE CASCADE,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    token_hash VARCHAR(64) UNIQUE NOT NULL,
+    password_hash VARCHAR(255),
+    expires_at TIMESTAMP WITH TIME ZONE,
+    access_count INTEGER NOT NULL DEFAULT 0,
+    last_accessed_at TIMESTAMP WITH TIME ZONE,
+    revoked_at TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_group_shares_group_id ON group_shares(group_id);
+
+-- Create OAuth clients table for third-party apps registered by users. id is
+-- the public client_id. Public clients, such as mobile apps, have no secret
+-- and rely on PKCE alone; only the SHA-256 of a confidential client's secret
+-- is stored.
+CREATE TABLE IF NOT EXISTS oauth_clients (
+    id VARCHAR(64) PRIMARY KEY,
+    owner_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    name VARCHAR(100) NOT NULL,
+    secret_hash VARCHAR(64),
+    redirect_uris TEXT[] NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_oauth_clients_owner_id ON oauth_clients(owner_id);
+
+-- Create token families table. A family is one login (a session): every
+-- refresh token issued by rotating it belongs to the same family, and
+-- revoking the family invalidates all of them at once. A family with a
+-- client_id is instead a grant to a third-party app, limited to scopes.
+CREATE TABLE IF NOT EXISTS token_families (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    client_id VARCHAR(64) REFERENCES oauth_clients(id) ON DELETE CASCADE,
+    scopes TEXT[],
+    user_agent TEXT,
+    ip_address VARCHAR(45),
+    last_used_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    revoked_at TIMESTAMP WITH TIME ZONE,
+    revoked_reason VARCHAR(50),
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_token_families_user_id ON token_families(user_id);
+CREATE INDEX IF NOT EXISTS idx_token_families_client_id ON token_families(client_id);
+
+-- Create refresh tokens table, keyed by the token's jti claim
+CREATE TABLE IF NOT EXISTS refresh_tokens (
+    id UUID PRIMARY KEY,
+    family_id UUID NOT NULL REFERENCES token_families(id) ON DELETE CASCADE,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    parent_id UUID,
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    rotated_at TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_refresh_tokens_family_id ON refresh_tokens(family_id);
+
+-- Create security events table
+CREATE TABLE IF NOT EXISTS security_events (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    type VARCHAR(50) NOT NULL,
+    ip_address VARCHAR(45),
+    user_agent TEXT,
+    metadata JSONB NOT NULL DEFAULT '{}',
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_security_events_user_id ON security_events(user_id, created_at DESC);
+
+-- Looks up whether a user has logged in from a device before
+CREATE INDEX IF NOT EXISTS idx_security_events_login_device ON security_events(user_id, (metadata->>'device'))
+    WHERE type = 'login_succeeded';
+
+-- The security log is append-only: events cannot be edited, and are only
+-- deleted along with their account
+CREATE OR REPLACE FUNCTION protect_security_events()
+RETURNS TRIGGER AS $$
+BEGIN
+    IF TG_OP = 'DELETE' AND NOT EXISTS (SELECT 1 FROM users WHERE id = OLD.user_id) THEN
+        RETURN OLD;
+    END IF;
+    RAISE EXCEPTION 'security_events is append-only';
+END;
+$$ language 'plpgsql';
+
+CREATE TRIGGER protect_security_events BEFORE UPDATE OR DELETE ON security_events
+    FOR EACH ROW EXECUTE FUNCTION protect_security_events();
+
+-- Create TOTP credentials table. confirmed_at stays NULL until the user
+-- proves they can generate codes; only confirmed credentials enable 2FA.
+CREATE TABLE IF NOT EXISTS totp_credentials (
+    user_id INTEGER PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+    secret VARCHAR(64) NOT NULL,
+    -- Last time step a code was accepted for, so a code cannot be replayed
+    last_used_step BIGINT NOT NULL DEFAULT 0,
+    confirmed_at TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Create recovery codes table. Codes are single use and stored hashed.
+CREATE TABLE IF NOT EXISTS recovery_codes (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    code_hash VARCHAR(64) NOT NULL,
+    used_at TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (user_id, code_hash)
+);
+
+-- Create passkeys table for WebAuthn credentials
+CREATE TABLE IF NOT EXISTS passkeys (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    name VARCHAR(100) NOT NULL,
+    credential_id BYTEA UNIQUE NOT NULL,
+    public_key BYTEA NOT NULL,
+    attestation_type VARCHAR(32) NOT NULL DEFAULT '',
+    transports TEXT[] NOT NULL DEFAULT '{}',
+    aaguid BYTEA,
+    sign_count BIGINT NOT NULL DEFAULT 0,
+    user_present BOOLEAN NOT NULL DEFAULT FALSE,
+    user_verified BOOLEAN NOT NULL DEFAULT FALSE,
+    backup_eligible BOOLEAN NOT NULL DEFAULT FALSE,
+    backup_state BOOLEAN NOT NULL DEFAULT FALSE,
+    last_used_at TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_passkeys_user_id ON passkeys(user_id);
+
+-- Create account tokens table for single-use links sent by email, such as
+-- password resets and email verification. The email the link was sent to is
+-- kept so a link stops working if the account's email changes; for an email
+-- change it is the new address.
+CREATE TABLE IF NOT EXISTS account_tokens (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    purpose VARCHAR(32) NOT NULL,
+    token_hash VARCHAR(64) UNIQUE NOT NULL,
+    email VARCHAR(255) NOT NULL,
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    used_at TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_account_tokens_user_purpose ON account_tokens(user_id, purpose);
+
+-- Create user identities table linking accounts to OpenID Connect providers.
+-- subject is the provider's stable user ID (the sub claim).
+CREATE TABLE IF NOT EXISTS user_identities (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    provider VARCHAR(50) NOT NULL,
+    subject VARCHAR(255) NOT NULL,
+    email VARCHAR(255),
+    last_login_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (provider, subject)
+);
+
+CREATE INDEX IF NOT EXISTS idx_user_identities_user_id ON user_identities(user_id);
+
+-- Create API tokens table for personal access tokens. Only the SHA-256 of a
+-- token is stored; token_hint is its first few characters for display.
+CREATE TABLE IF NOT EXISTS api_tokens (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    name VARCHAR(100) NOT NULL,
+    token_hash VARCHAR(64) UNIQUE NOT NULL,
+    token_hint VARCHAR(20) NOT NULL,
+    scopes TEXT[] NOT NULL DEFAULT '{}',
+    expires_at TIMESTAMP WITH TIME ZONE,
+    last_used_at TIMESTAMP WITH TIME ZONE,
+    last_used_ip VARCHAR(45),
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_api_tokens_user_id ON api_tokens(user_id);
+
+-- Create data exports table for archives of a user's data they asked to
+-- download. The archive is built in the background and kept for a week.
+CREATE TABLE IF NOT EXISTS data_exports (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    status VARCHAR(20) NOT NULL DEFAULT 'pending',
+    archive BYTEA,
+    completed_at TIMESTAMP WITH TIME ZONE,
+    expires_at TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_data_exports_user_id ON data_exports(user_id, created_at DESC);